@@ -3,25 +3,65 @@ package reservoirsampler
 import (
 	"bytes"
 	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
 const (
 	// Badger DB key prefixes
-	keyPrefixState      = "state:"
-	keyPrefixReservoir  = "reservoir:"
-	keyPrefixWindow     = "window:"
-	keyPrefixCheckpoint = "checkpoint:"
+	keyPrefixManifest  = "manifest:"
+	keyPrefixReservoir = "reservoir:"
+	keyPrefixBuffer    = "buffer:"
+	
+	// Keys of the checkpoint format before manifests: the state of each
+	// window, and a marker naming the window of the latest checkpoint
+	keyPrefixLegacyState   = "state:"
+	legacyCurrentWindowKey = "checkpoint:current_window"
+
+	// windowStateSize is the encoded size of a window state record (4 int64s)
+	windowStateSize = 32
+
+	// manifestEntrySize is the encoded size of a manifest span entry (hash and CRC)
+	manifestEntrySize = 12
+
+	// manifestHeaderSize is the encoded size of a manifest without its entries:
+	// generation, window state and span count, plus the trailing checksum
+	manifestHeaderSize = 8 + windowStateSize + 4 + 4
 )
 
+// ErrNoCheckpoint is returned by LoadCheckpoint when no checkpoint has been written yet
+var ErrNoCheckpoint = errors.New("no checkpoint found")
+
+// castagnoliTable is the CRC-32C table used for checkpoint checksums
+var castagnoliTable = crc32.MakeTable(crc32.Castagnoli)
+
+// checkpointManifest describes one committed checkpoint generation
+type checkpointManifest struct {
+	generation  uint64
+	windowID    int64
+	startTime   time.Time
+	endTime     time.Time
+	windowCount int64
+	
+	// spans maps the hash of each span in the generation to the CRC of its stored value
+	spans map[uint64]uint32
+}
+
 // BadgerCheckpointManager implements checkpoint management using BadgerDB
 type BadgerCheckpointManager struct {
 	// Badger database
@@ -30,10 +70,28 @@ type BadgerCheckpointManager struct {
 	// Configuration
 	checkpointPath       string
 	compactionTargetSize int64
+	retainedWindows      int
 	
 	// State
 	lastCheckpoint time.Time
 	
+	// Generations: the newest number in use and the last good manifest, which
+	// the next checkpoint builds on
+	loaded     bool
+	generation uint64
+	current    *checkpointManifest
+	
+	// Spans dropped by the last commit, deleted once the next one commits
+	retiring       []uint64
+	retiringWindow int64
+	
+	// Whether the last good checkpoint was read from the keys of the format
+	// before manifests, which are deleted once the first manifest commits
+	legacy bool
+	
+	// Serializes checkpoints from the background loop and shutdown
+	mu sync.Mutex
+	
 	// Metrics
 	checkpointAgeGauge     *atomic.Int64
 	dbSizeGauge            *atomic.Int64
@@ -47,6 +105,7 @@ type BadgerCheckpointManager struct {
 func NewBadgerCheckpointManager(
 	checkpointPath string, 
 	compactionTargetSize int64,
+	retainedWindows int,
 	checkpointAgeGauge, dbSizeGauge, compactionCountCounter *atomic.Int64,
 	logger *zap.Logger,
 ) (*BadgerCheckpointManager, error) {
@@ -59,7 +118,7 @@ func NewBadgerCheckpointManager(
 	badgerOptions := badger.DefaultOptions(checkpointPath).
 		WithLogger(zapToBadgerLogger{logger.Named("badger")}).
 		WithSyncWrites(true).    // Ensure durability
-		WithCompression(badger.ZSTD)  // Better compression
+		WithCompression(options.ZSTD)  // Better compression
 	
 	db, err := badger.Open(badgerOptions)
 	if err != nil {
@@ -70,6 +129,7 @@ func NewBadgerCheckpointManager(
 		db:                     db,
 		checkpointPath:         checkpointPath,
 		compactionTargetSize:   compactionTargetSize,
+		retainedWindows:        retainedWindows,
 		lastCheckpoint:         time.Time{},
 		checkpointAgeGauge:     checkpointAgeGauge,
 		dbSizeGauge:            dbSizeGauge,
@@ -78,7 +138,11 @@ func NewBadgerCheckpointManager(
 	}, nil
 }
 
-// Checkpoint saves the current state to persistent storage
+// Checkpoint saves the current state to persistent storage.
+// It writes the spans that are not yet stored for the window and then commits
+// a manifest for the new generation listing every span of the checkpoint.
+// Spans dropped from the reservoir stay on disk until the generation after
+// this one commits, so the previous generation remains loadable.
 func (c *BadgerCheckpointManager) Checkpoint(
 	windowID int64, 
 	startTime time.Time, 
@@ -86,76 +150,168 @@ func (c *BadgerCheckpointManager) Checkpoint(
 	windowCount int64, 
 	spans map[uint64]SpanWithResource,
 ) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
 	startTimer := time.Now()
+	c.ensureLoadedLocked()
 	
-	// Create state buffer
-	stateBuffer := &bytes.Buffer{}
-	if err := binary.Write(stateBuffer, binary.BigEndian, windowID); err != nil {
-		return fmt.Errorf("failed to write window ID: %w", err)
+	// Work out what changed since the previous generation
+	members := c.membersLocked(windowID)
+	added := make([]uint64, 0)
+	for hash := range spans {
+		if _, persisted := members[hash]; !persisted {
+			added = append(added, hash)
+		}
 	}
-	if err := binary.Write(stateBuffer, binary.BigEndian, startTime.Unix()); err != nil {
-		return fmt.Errorf("failed to write start time: %w", err)
+	removed := 0
+	for hash := range members {
+		if _, kept := spans[hash]; !kept {
+			delete(members, hash)
+			removed++
+		}
 	}
-	if err := binary.Write(stateBuffer, binary.BigEndian, endTime.Unix()); err != nil {
-		return fmt.Errorf("failed to write end time: %w", err)
+	
+	written, err := c.writeSpansLocked(windowID, added, spans, members)
+	if err != nil {
+		return err
+	}
+	
+	manifest := &checkpointManifest{
+		windowID:    windowID,
+		startTime:   startTime,
+		endTime:     endTime,
+		windowCount: windowCount,
+		spans:       members,
 	}
-	if err := binary.Write(stateBuffer, binary.BigEndian, windowCount); err != nil {
-		return fmt.Errorf("failed to write window count: %w", err)
+	if err := c.commitLocked(manifest); err != nil {
+		return err
 	}
-	stateBytes := stateBuffer.Bytes()
 	
-	// Write state in transaction
-	err := c.db.Update(func(txn *badger.Txn) error {
-		// Write window state
-		stateKey := []byte(fmt.Sprintf("%s%d", keyPrefixState, windowID))
-		if err := txn.Set(stateKey, stateBytes); err != nil {
-			return fmt.Errorf("failed to write state: %w", err)
+	c.logger.Debug("Checkpoint completed",
+		zap.Uint64("generation", manifest.generation),
+		zap.Int("spans_saved", written),
+		zap.Int("spans_removed", removed),
+		zap.Int("total_spans", len(members)),
+		zap.Duration("duration", time.Since(startTimer)))
+	
+	return nil
+}
+
+// CheckpointDelta saves only the reservoir mutations since the previous checkpoint.
+// The added spans not yet stored are written and the new generation's manifest
+// is the previous one with the added spans in and the removed ones out. On error
+// nothing is committed, and the caller should follow up with a full Checkpoint.
+func (c *BadgerCheckpointManager) CheckpointDelta(
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	added map[uint64]SpanWithResource,
+	removed []uint64,
+) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	startTimer := time.Now()
+	c.ensureLoadedLocked()
+	
+	// Spans the previous generation already holds are not rewritten, as their
+	// stored values are what it falls back to if this manifest never commits
+	members := c.membersLocked(windowID)
+	addedHashes := make([]uint64, 0, len(added))
+	for hash := range added {
+		if _, persisted := members[hash]; !persisted {
+			addedHashes = append(addedHashes, hash)
 		}
-		
-		// Write current window marker
-		currentWindowKey := []byte(keyPrefixCheckpoint + "current_window")
-		if err := txn.Set(currentWindowKey, []byte(fmt.Sprintf("%d", windowID))); err != nil {
-			return fmt.Errorf("failed to write current window: %w", err)
+	}
+	for _, hash := range removed {
+		if _, readded := added[hash]; readded {
+			continue
 		}
-		
-		return nil
-	})
+		delete(members, hash)
+	}
 	
+	written, err := c.writeSpansLocked(windowID, addedHashes, added, members)
 	if err != nil {
-		return fmt.Errorf("failed to write state: %w", err)
+		return err
 	}
 	
-	// Process spans in batches
-	const batchSize = 100
-	spanKeys := make([]uint64, 0, len(spans))
+	manifest := &checkpointManifest{
+		windowID:    windowID,
+		startTime:   startTime,
+		endTime:     endTime,
+		windowCount: windowCount,
+		spans:       members,
+	}
+	if err := c.commitLocked(manifest); err != nil {
+		return err
+	}
 	
-	// Collect all keys
-	for hash := range spans {
-		spanKeys = append(spanKeys, hash)
+	c.logger.Debug("Delta checkpoint completed",
+		zap.Uint64("generation", manifest.generation),
+		zap.Int("spans_saved", written),
+		zap.Int("spans_removed", len(removed)),
+		zap.Duration("duration", time.Since(startTimer)))
+	
+	return nil
+}
+
+// ensureLoadedLocked reads the newest good generation if LoadCheckpoint has not (must be called with lock held).
+// Without it the first checkpoint would not know which spans are already on
+// disk or which generation number comes next.
+func (c *BadgerCheckpointManager) ensureLoadedLocked() {
+	if c.loaded {
+		return
 	}
 	
-	// Process in batches
+	if _, _, err := c.loadLatestLocked(); err != nil && !errors.Is(err, ErrNoCheckpoint) {
+		c.logger.Warn("No usable checkpoint generation, starting a new one", zap.Error(err))
+	}
+}
+
+// membersLocked returns a copy of the spans of the last good generation if it
+// belongs to the given window, or an empty set otherwise (must be called with lock held)
+func (c *BadgerCheckpointManager) membersLocked(windowID int64) map[uint64]uint32 {
+	if c.current == nil || c.current.windowID != windowID {
+		return make(map[uint64]uint32)
+	}
+	
+	members := make(map[uint64]uint32, len(c.current.spans))
+	for hash, sum := range c.current.spans {
+		members[hash] = sum
+	}
+	return members
+}
+
+// writeSpansLocked writes the given spans of a window in batches (must be called with lock held).
+// Each span written is added to members with the checksum of its stored
+// value. Spans that fail to serialize are left out of the checkpoint; a
+// failed batch aborts it, as its manifest could not be verified.
+func (c *BadgerCheckpointManager) writeSpansLocked(
+	windowID int64,
+	hashes []uint64,
+	spans map[uint64]SpanWithResource,
+	members map[uint64]uint32,
+) (int, error) {
+	// Process spans in batches
+	const batchSize = 100
 	spanCount := 0
-	totalSpans := len(spans)
 	
-	for i := 0; i < len(spanKeys); i += batchSize {
+	for i := 0; i < len(hashes); i += batchSize {
 		end := i + batchSize
-		if end > len(spanKeys) {
-			end = len(spanKeys)
+		if end > len(hashes) {
+			end = len(hashes)
 		}
 		
-		currentBatch := spanKeys[i:end]
+		currentBatch := hashes[i:end]
+		written := make(map[uint64]uint32, len(currentBatch))
 		
 		// Write spans in a transaction
-		err = c.db.Update(func(txn *badger.Txn) error {
+		err := c.db.Update(func(txn *badger.Txn) error {
 			for _, hash := range currentBatch {
-				spanWithRes, exists := spans[hash]
-				if !exists {
-					continue
-				}
-				
 				// Serialize span
-				spanBytes, err := serializeSpanWithResource(spanWithRes)
+				spanBytes, err := serializeSpanWithResource(spans[hash])
 				if err != nil {
 					c.logger.Error("Failed to serialize span",
 						zap.Uint64("hash", hash),
@@ -163,36 +319,129 @@ func (c *BadgerCheckpointManager) Checkpoint(
 					continue
 				}
 				
-				// Create key for this span
-				key := []byte(fmt.Sprintf("%s%d:%d", keyPrefixReservoir, windowID, hash))
-				
 				// Write span
-				if err := txn.Set(key, spanBytes); err != nil {
+				if err := txn.Set(reservoirSpanKey(windowID, hash), spanBytes); err != nil {
 					return fmt.Errorf("failed to write span: %w", err)
 				}
 				
-				spanCount++
+				written[hash] = crc32.Checksum(spanBytes, castagnoliTable)
 			}
 			
 			return nil
 		})
 		
 		if err != nil {
-			c.logger.Error("Failed to write span batch",
-				zap.Int("batch_start", i),
-				zap.Int("batch_end", end),
-				zap.Error(err))
-			// Continue with next batch despite error
+			return spanCount, fmt.Errorf("failed to write spans %d to %d: %w", i, end, err)
 		}
 		
+		for hash, sum := range written {
+			members[hash] = sum
+		}
+		spanCount += len(written)
+		
 		// Log progress for large reservoirs
-		if totalSpans > 1000 && (i+batchSize)%1000 == 0 {
+		if len(hashes) > 1000 && (i+batchSize)%1000 == 0 {
 			c.logger.Debug("Checkpointing progress",
 				zap.Int("spans_processed", i+batchSize),
-				zap.Int("total_spans", totalSpans))
+				zap.Int("total_spans", len(hashes)))
+		}
+	}
+	
+	return spanCount, nil
+}
+
+// commitLocked makes a manifest the newest generation (must be called with lock held).
+// The manifest is written last, in its own transaction, so a checkpoint that
+// fails or crashes before it never becomes visible. Once it is committed,
+// everything only the generation before the previous one needed is deleted:
+// spans retired by the previous commit, older manifests other than the last
+// of each retained window and, when a new window starts, windows that are no
+// longer retained.
+func (c *BadgerCheckpointManager) commitLocked(manifest *checkpointManifest) error {
+	manifest.generation = c.generation + 1
+	
+	manifestBytes, err := encodeManifest(manifest)
+	if err != nil {
+		return err
+	}
+	
+	err = c.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(manifestKey(manifest.generation), manifestBytes)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to commit manifest of generation %d: %w", manifest.generation, err)
+	}
+	
+	previous := c.current
+	c.generation = manifest.generation
+	c.current = manifest
+	
+	// The checkpoint no longer depends on the keys of the old format
+	if c.legacy {
+		if err := c.purgeLegacyKeys(); err != nil {
+			c.logger.Error("Failed to delete checkpoint keys of the old format", zap.Error(err))
+		} else {
+			c.legacy = false
 		}
 	}
 	
+	// Spans retired by the previous commit are referenced by neither loadable generation
+	var garbage [][]byte
+	for _, hash := range c.retiring {
+		if _, readded := manifest.spans[hash]; readded && c.retiringWindow == manifest.windowID {
+			continue
+		}
+		garbage = append(garbage, reservoirSpanKey(c.retiringWindow, hash))
+	}
+	
+	// Spans dropped now are still needed to fall back to the previous generation.
+	// Those of a closed window stay with it until the window is purged.
+	c.retiring = nil
+	if previous != nil && previous.windowID == manifest.windowID {
+		c.retiringWindow = manifest.windowID
+		for hash := range previous.spans {
+			if _, kept := manifest.spans[hash]; !kept {
+				c.retiring = append(c.retiring, hash)
+			}
+		}
+	}
+	
+	// Keep the manifests of this generation, the previous good one and the
+	// last generation of each retained window
+	keep := manifest.generation
+	if previous != nil {
+		keep = previous.generation
+	}
+	retainedFrom := manifest.windowID - int64(c.retainedWindows)
+	obsolete, err := c.obsoleteManifestKeys(keep, manifest.windowID, retainedFrom)
+	if err != nil {
+		c.logger.Error("Failed to list obsolete manifests", zap.Error(err))
+	}
+	garbage = append(garbage, obsolete...)
+	
+	if err := c.deleteKeys(garbage); err != nil {
+		c.logger.Error("Failed to delete retired spans", zap.Error(err))
+	}
+	
+	// Garbage-collect closed windows, sparing the one the previous generation
+	// belongs to
+	if previous == nil || previous.windowID != manifest.windowID {
+		cutoff := retainedFrom
+		if previous != nil && previous.windowID < cutoff {
+			cutoff = previous.windowID
+		}
+		if err := c.purgeWindowsBefore(cutoff); err != nil {
+			c.logger.Error("Failed to drop expired checkpoint windows", zap.Error(err))
+		}
+	}
+	
+	c.finishCheckpointLocked()
+	
+	return nil
+}
+
+// finishCheckpointLocked updates the checkpoint metrics (must be called with lock held)
+func (c *BadgerCheckpointManager) finishCheckpointLocked() {
 	// Update checkpoint time and metrics
 	c.lastCheckpoint = time.Now()
 	c.checkpointAgeGauge.Store(0)
@@ -201,177 +450,587 @@ func (c *BadgerCheckpointManager) Checkpoint(
 	if fi, err := os.Stat(c.checkpointPath); err == nil {
 		c.dbSizeGauge.Store(fi.Size())
 	}
+}
+
+// obsoleteManifestKeys returns the keys of the manifests older than the given
+// generation, except the last one of each closed window from retainedFrom on,
+// which are what LoadWindow reads the retained windows from
+func (c *BadgerCheckpointManager) obsoleteManifestKeys(generation uint64, currentWindow, retainedFrom int64) ([][]byte, error) {
+	windows, err := c.manifestWindows()
+	if err != nil {
+		return nil, err
+	}
 	
-	c.logger.Debug("Checkpoint completed",
-		zap.Int("spans_saved", spanCount),
-		zap.Int("total_spans", totalSpans),
-		zap.Duration("duration", time.Since(startTimer)))
+	// The newest manifest of each retained window
+	last := make(map[int64]uint64)
+	for gen, windowID := range windows {
+		if windowID >= retainedFrom && windowID < currentWindow && gen > last[windowID] {
+			last[windowID] = gen
+		}
+	}
 	
-	return nil
+	keys := make([][]byte, 0)
+	for gen, windowID := range windows {
+		if gen < generation && last[windowID] != gen {
+			keys = append(keys, manifestKey(gen))
+		}
+	}
+	return keys, nil
 }
 
-// LoadCheckpoint loads the most recent state from persistent storage
-func (c *BadgerCheckpointManager) LoadCheckpoint() (
-	windowID int64, 
-	startTime time.Time, 
-	endTime time.Time, 
-	windowCount int64, 
-	spans map[uint64]SpanWithResource, 
-	err error) {
+// manifestWindows maps the generation of every manifest to the window it
+// belongs to. Manifests too short to hold a window are mapped to window -1.
+func (c *BadgerCheckpointManager) manifestWindows() (map[uint64]int64, error) {
+	prefix := []byte(keyPrefixManifest)
+	windows := make(map[uint64]int64)
 	
-	// Initialize return values
-	windowID = 0
-	startTime = time.Now()
-	endTime = startTime.Add(1 * time.Minute) // Default 1 minute window
-	windowCount = 0
-	spans = make(map[uint64]SpanWithResource)
-	
-	// Find the current window ID
-	var currentWindowID int64
-	err = c.db.View(func(txn *badger.Txn) error {
-		item, err := txn.Get([]byte(keyPrefixCheckpoint + "current_window"))
-		if err != nil {
-			if err == badger.ErrKeyNotFound {
-				return fmt.Errorf("no checkpoint found")
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			item := it.Item()
+			gen, err := strconv.ParseUint(string(item.Key()[len(prefix):]), 10, 64)
+			if err != nil {
+				continue
 			}
-			return fmt.Errorf("failed to get current window: %w", err)
+			
+			windowID := int64(-1)
+			err = item.Value(func(manifestBytes []byte) error {
+				if len(manifestBytes) >= manifestHeaderSize {
+					windowID = int64(binary.BigEndian.Uint64(manifestBytes[8:16]))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			windows[gen] = windowID
 		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoint manifests: %w", err)
+	}
+	
+	return windows, nil
+}
+
+// listGenerations returns the generations that have a manifest, newest first
+func (c *BadgerCheckpointManager) listGenerations() ([]uint64, error) {
+	prefix := []byte(keyPrefixManifest)
+	generations := make([]uint64, 0)
+	
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
 		
-		return item.Value(func(val []byte) error {
-			_, err := fmt.Sscanf(string(val), "%d", &currentWindowID)
-			return err
-		})
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			gen, err := strconv.ParseUint(string(it.Item().Key()[len(prefix):]), 10, 64)
+			if err != nil {
+				continue
+			}
+			generations = append(generations, gen)
+		}
+		return nil
 	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list checkpoint generations: %w", err)
+	}
+	
+	// Keys are zero-padded, so the scan returned them oldest first
+	for i, j := 0, len(generations)-1; i < j; i, j = i+1, j-1 {
+		generations[i], generations[j] = generations[j], generations[i]
+	}
 	
+	return generations, nil
+}
+
+// purgeWindowsBefore deletes the spans of every window older than cutoff
+func (c *BadgerCheckpointManager) purgeWindowsBefore(cutoff int64) error {
+	var expired [][]byte
+	windows := make(map[int64]struct{})
+	prefix := []byte(keyPrefixReservoir)
+	
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			
+			// The window ID follows the prefix, up to the next separator
+			rest := string(key[len(prefix):])
+			if sep := strings.IndexByte(rest, ':'); sep >= 0 {
+				rest = rest[:sep]
+			}
+			windowID, err := strconv.ParseInt(rest, 10, 64)
+			if err != nil || windowID >= cutoff {
+				continue
+			}
+			
+			expired = append(expired, key)
+			windows[windowID] = struct{}{}
+		}
+		return nil
+	})
 	if err != nil {
-		return windowID, startTime, endTime, windowCount, spans, err
+		return fmt.Errorf("failed to scan checkpoint windows: %w", err)
+	}
+	
+	if len(expired) == 0 {
+		return nil
+	}
+	
+	if err := c.deleteKeys(expired); err != nil {
+		return err
+	}
+	
+	c.logger.Debug("Dropped expired checkpoint windows",
+		zap.Int("windows", len(windows)),
+		zap.Int("keys", len(expired)),
+		zap.Int64("cutoff", cutoff))
+	
+	return nil
+}
+
+// deleteKeys deletes the given keys, splitting them over as many transactions as needed
+func (c *BadgerCheckpointManager) deleteKeys(keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+	
+	wb := c.db.NewWriteBatch()
+	defer wb.Cancel()
+	
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete key: %w", err)
+		}
 	}
 	
-	// Read the window state
-	err = c.db.View(func(txn *badger.Txn) error {
-		stateKey := []byte(fmt.Sprintf("%s%d", keyPrefixState, currentWindowID))
-		item, err := txn.Get(stateKey)
+	if err := wb.Flush(); err != nil {
+		return fmt.Errorf("failed to flush deletes: %w", err)
+	}
+	
+	return nil
+}
+
+// LoadCheckpoint loads the most recent state from persistent storage.
+// It tries generations newest first and returns the first one whose manifest
+// and spans verify, so a checkpoint that was interrupted or damaged falls
+// back to the one before it. ErrNoCheckpoint is returned when the database
+// does not hold a checkpoint yet.
+func (c *BadgerCheckpointManager) LoadCheckpoint() (
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	spans map[uint64]SpanWithResource,
+	err error) {
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	startTimer := time.Now()
+
+	manifest, spans, err := c.loadLatestLocked()
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, 0, make(map[uint64]SpanWithResource), err
+	}
+
+	// The loaded state is as fresh as the checkpoint it came from
+	c.lastCheckpoint = time.Now()
+	c.checkpointAgeGauge.Store(0)
+
+	c.logger.Info("Loaded checkpoint",
+		zap.Uint64("generation", manifest.generation),
+		zap.Int64("window", manifest.windowID),
+		zap.Int("spans_loaded", len(spans)),
+		zap.Duration("duration", time.Since(startTimer)))
+
+	return manifest.windowID, manifest.startTime, manifest.endTime, manifest.windowCount, spans, nil
+}
+
+// LoadWindow loads the last checkpoint of a window kept on disk, which may be
+// a closed window retained by checkpoint_retained_windows rather than the
+// current one. ErrNoCheckpoint is returned when no manifest of the window is left.
+func (c *BadgerCheckpointManager) LoadWindow(windowID int64) (
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	spans map[uint64]SpanWithResource,
+	err error) {
+	
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	windows, err := c.manifestWindows()
+	if err != nil {
+		return time.Time{}, time.Time{}, 0, nil, err
+	}
+	
+	var generation uint64
+	for gen, id := range windows {
+		if id == windowID && gen > generation {
+			generation = gen
+		}
+	}
+	if generation == 0 {
+		return time.Time{}, time.Time{}, 0, nil, fmt.Errorf("window %d: %w", windowID, ErrNoCheckpoint)
+	}
+	
+	manifest, spans, err := c.readGeneration(generation)
+	if err != nil {
+		return time.Time{}, time.Time{}, 0, nil, fmt.Errorf("failed to load window %d: %w", windowID, err)
+	}
+	
+	return manifest.startTime, manifest.endTime, manifest.windowCount, spans, nil
+}
+
+// loadLatestLocked reads the newest generation that verifies (must be called with lock held).
+// It also records the newest generation number seen, verified or not, so
+// the next checkpoint is numbered after it.
+func (c *BadgerCheckpointManager) loadLatestLocked() (*checkpointManifest, map[uint64]SpanWithResource, error) {
+	generations, err := c.listGenerations()
+	if err != nil {
+		return nil, nil, err
+	}
+	
+	c.loaded = true
+	c.current = nil
+	c.retiring = nil
+	c.legacy = false
+	if len(generations) == 0 {
+		// The database may hold a checkpoint written before manifests
+		manifest, spans, err := c.readLegacy()
+		if err != nil {
+			return nil, nil, err
+		}
+		c.current = manifest
+		c.legacy = true
+		return manifest, spans, nil
+	}
+	c.generation = generations[0]
+	
+	var lastErr error
+	for _, gen := range generations {
+		manifest, spans, err := c.readGeneration(gen)
 		if err != nil {
-			return fmt.Errorf("failed to get window state: %w", err)
+			c.logger.Warn("Checkpoint generation failed verification, falling back to the previous one",
+				zap.Uint64("generation", gen),
+				zap.Error(err))
+			lastErr = err
+			continue
 		}
 		
-		return item.Value(func(stateBytes []byte) error {
-			if len(stateBytes) < 32 { // 4 int64s = 32 bytes
-				return fmt.Errorf("invalid state data: too short")
-			}
-			
-			buffer := bytes.NewReader(stateBytes)
-			
-			// Read state fields
-			if err := binary.Read(buffer, binary.BigEndian, &windowID); err != nil {
-				return fmt.Errorf("failed to read window ID: %w", err)
+		c.current = manifest
+		return manifest, spans, nil
+	}
+	
+	return nil, nil, fmt.Errorf("no checkpoint generation could be verified: %w", lastErr)
+}
+
+// readGeneration reads a generation's manifest and spans, checking every span
+// against the checksum recorded in the manifest
+func (c *BadgerCheckpointManager) readGeneration(generation uint64) (*checkpointManifest, map[uint64]SpanWithResource, error) {
+	var manifest *checkpointManifest
+	spans := make(map[uint64]SpanWithResource)
+	
+	// Read manifest and spans in one transaction so they are consistent
+	err := c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(manifestKey(generation))
+		if err != nil {
+			return fmt.Errorf("failed to get manifest: %w", err)
+		}
+		err = item.Value(func(manifestBytes []byte) error {
+			var decodeErr error
+			manifest, decodeErr = decodeManifest(manifestBytes)
+			return decodeErr
+		})
+		if err != nil {
+			return err
+		}
+		if manifest.generation != generation {
+			return fmt.Errorf("manifest holds generation %d", manifest.generation)
+		}
+		
+		for hash, sum := range manifest.spans {
+			item, err := txn.Get(reservoirSpanKey(manifest.windowID, hash))
+			if err != nil {
+				return fmt.Errorf("failed to get span %d: %w", hash, err)
 			}
 			
-			var startTimeUnix, endTimeUnix int64
-			if err := binary.Read(buffer, binary.BigEndian, &startTimeUnix); err != nil {
-				return fmt.Errorf("failed to read start time: %w", err)
-			}
-			if err := binary.Read(buffer, binary.BigEndian, &endTimeUnix); err != nil {
-				return fmt.Errorf("failed to read end time: %w", err)
+			err = item.Value(func(spanBytes []byte) error {
+				if crc32.Checksum(spanBytes, castagnoliTable) != sum {
+					return fmt.Errorf("checksum mismatch")
+				}
+				spanWithRes, err := deserializeSpanWithResource(spanBytes)
+				if err != nil {
+					return err
+				}
+				spans[hash] = spanWithRes
+				return nil
+			})
+			if err != nil {
+				return fmt.Errorf("failed to load span %d: %w", hash, err)
 			}
 			
-			// Convert Unix timestamps to time.Time
-			startTime = time.Unix(startTimeUnix, 0)
-			endTime = time.Unix(endTimeUnix, 0)
-			
-			if err := binary.Read(buffer, binary.BigEndian, &windowCount); err != nil {
-				return fmt.Errorf("failed to read window count: %w", err)
+			// Log progress for large reservoirs
+			if len(spans)%1000 == 0 {
+				c.logger.Debug("Loading checkpoint progress",
+					zap.Int("loaded_spans", len(spans)))
 			}
-			
-			return nil
-		})
+		}
+		
+		return nil
 	})
-	
 	if err != nil {
-		return windowID, startTime, endTime, windowCount, spans, err
-	}
-	
-	// Check if the window is still valid
-	now := time.Now()
-	if now.After(endTime) {
-		// Window has expired, return empty state
-		return 0, now, now.Add(1 * time.Minute), 0, spans, nil
+		return nil, nil, err
 	}
 	
-	// Read all spans for this window
-	// Use a prefix scan for efficient retrieval
-	prefix := []byte(fmt.Sprintf("%s%d:", keyPrefixReservoir, windowID))
+	return manifest, spans, nil
+}
+
+// readLegacy reads a checkpoint in the format before manifests: the window
+// named by the current window marker, its state and every span stored for it.
+// It returns the checkpoint as an uncommitted generation, with the checksums
+// of the stored spans, so the first manifest can build on it. ErrNoCheckpoint
+// is returned when there is no marker.
+func (c *BadgerCheckpointManager) readLegacy() (*checkpointManifest, map[uint64]SpanWithResource, error) {
+	manifest := &checkpointManifest{spans: make(map[uint64]uint32)}
+	spans := make(map[uint64]SpanWithResource)
 	
-	err = c.db.View(func(txn *badger.Txn) error {
+	// Read marker, state and spans in one transaction so they are consistent
+	err := c.db.View(func(txn *badger.Txn) error {
+		item, err := txn.Get([]byte(legacyCurrentWindowKey))
+		if errors.Is(err, badger.ErrKeyNotFound) {
+			return ErrNoCheckpoint
+		}
+		if err != nil {
+			return fmt.Errorf("failed to get current window: %w", err)
+		}
+		
+		marker, err := item.ValueCopy(nil)
+		if err != nil {
+			return fmt.Errorf("failed to read current window: %w", err)
+		}
+		currentWindowID, err := strconv.ParseInt(string(marker), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid current window marker %q: %w", marker, err)
+		}
+		
+		item, err = txn.Get([]byte(fmt.Sprintf("%s%d", keyPrefixLegacyState, currentWindowID)))
+		if err != nil {
+			return fmt.Errorf("failed to get state of window %d: %w", currentWindowID, err)
+		}
+		err = item.Value(func(stateBytes []byte) error {
+			var decodeErr error
+			manifest.windowID, manifest.startTime, manifest.endTime, manifest.windowCount, decodeErr = decodeWindowState(stateBytes)
+			return decodeErr
+		})
+		if err != nil {
+			return err
+		}
+		if manifest.windowID != currentWindowID {
+			return fmt.Errorf("window state mismatch: marker points at %d, state holds %d", currentWindowID, manifest.windowID)
+		}
+		
+		prefix := reservoirKeyPrefix(manifest.windowID)
 		opts := badger.DefaultIteratorOptions
-		opts.PrefetchSize = 100 // Tune for performance
+		opts.PrefetchSize = 100
+		opts.Prefix = prefix
 		
 		it := txn.NewIterator(opts)
 		defer it.Close()
 		
-		// Count for logging
-		loadedCount := 0
-		
-		// Iterate through all keys with the prefix
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
 			item := it.Item()
 			
-			// Extract the hash from the key
-			keyStr := string(item.Key())
-			var hash uint64
-			_, err := fmt.Sscanf(keyStr, "%s%d:%d", &keyPrefixReservoir, &windowID, &hash)
+			// The key suffix is the span hash
+			hash, err := strconv.ParseUint(string(item.Key()[len(prefix):]), 10, 64)
 			if err != nil {
-				c.logger.Warn("Failed to parse span key", zap.String("key", keyStr), zap.Error(err))
+				c.logger.Warn("Failed to parse span key",
+					zap.ByteString("key", item.Key()),
+					zap.Error(err))
 				continue
 			}
 			
-			// Read the span value
 			err = item.Value(func(spanBytes []byte) error {
-				// Deserialize the span
 				spanWithRes, err := deserializeSpanWithResource(spanBytes)
 				if err != nil {
-					return fmt.Errorf("failed to deserialize span: %w", err)
+					return err
 				}
-				
-				// Add to spans map
 				spans[hash] = spanWithRes
-				loadedCount++
-				
+				manifest.spans[hash] = crc32.Checksum(spanBytes, castagnoliTable)
 				return nil
 			})
-			
 			if err != nil {
 				c.logger.Warn("Failed to load span",
 					zap.Uint64("hash", hash),
 					zap.Error(err))
-				continue
-			}
-			
-			// Log progress for large reservoirs
-			if loadedCount > 0 && loadedCount%1000 == 0 {
-				c.logger.Debug("Loading checkpoint progress",
-					zap.Int("loaded_spans", loadedCount))
 			}
 		}
 		
-		c.logger.Info("Loaded spans from checkpoint",
-			zap.Int("spans_loaded", loadedCount))
-		
 		return nil
 	})
+	if err != nil {
+		return nil, nil, err
+	}
 	
-	// If there was an error loading spans, still return the window state
-	// but with an empty spans map
+	c.logger.Info("Read checkpoint in the format before manifests",
+		zap.Int64("window", manifest.windowID),
+		zap.Int("spans", len(spans)))
+	
+	return manifest, spans, nil
+}
+
+// purgeLegacyKeys deletes the window states and the current window marker of
+// the format before manifests
+func (c *BadgerCheckpointManager) purgeLegacyKeys() error {
+	keys, err := c.keysWithPrefix([]byte(keyPrefixLegacyState))
 	if err != nil {
-		c.logger.Error("Error loading spans from checkpoint", zap.Error(err))
-		return windowID, startTime, endTime, windowCount, make(map[uint64]SpanWithResource), err
+		return err
 	}
+	keys = append(keys, []byte(legacyCurrentWindowKey))
+	return c.deleteKeys(keys)
+}
+
+// CheckpointTraceBuffer saves the traces waiting in the trace buffer, one
+// key per trace, and deletes the saved traces that are no longer buffered
+func (c *BadgerCheckpointManager) CheckpointTraceBuffer(traces []BufferedTrace) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	
-	// Update metrics
-	c.lastCheckpoint = time.Now()
-	c.checkpointAgeGauge.Store(0)
+	saved, err := c.keysWithPrefix([]byte(keyPrefixBuffer))
+	if err != nil {
+		return err
+	}
+	
+	wb := c.db.NewWriteBatch()
+	defer wb.Cancel()
+	
+	buffered := make(map[string]struct{}, len(traces))
+	for _, trace := range traces {
+		value, err := encodeBufferedTrace(trace)
+		if err != nil {
+			return err
+		}
+		key := bufferTraceKey(trace.TraceID)
+		buffered[string(key)] = struct{}{}
+		if err := wb.Set(key, value); err != nil {
+			return fmt.Errorf("failed to save buffered trace: %w", err)
+		}
+	}
+	for _, key := range saved {
+		if _, stillBuffered := buffered[string(key)]; !stillBuffered {
+			if err := wb.Delete(key); err != nil {
+				return fmt.Errorf("failed to delete buffered trace: %w", err)
+			}
+		}
+	}
+	
+	if err := wb.Flush(); err != nil {
+		return fmt.Errorf("failed to save trace buffer: %w", err)
+	}
+	
+	return nil
+}
+
+// CheckpointTraceBufferDelta saves the buffered traces changed since the
+// previous trace buffer checkpoint and deletes the removed ones
+func (c *BadgerCheckpointManager) CheckpointTraceBufferDelta(changed []BufferedTrace, removed []pcommon.TraceID) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	wb := c.db.NewWriteBatch()
+	defer wb.Cancel()
+	
+	for _, trace := range changed {
+		value, err := encodeBufferedTrace(trace)
+		if err != nil {
+			return err
+		}
+		if err := wb.Set(bufferTraceKey(trace.TraceID), value); err != nil {
+			return fmt.Errorf("failed to save buffered trace: %w", err)
+		}
+	}
+	for _, traceID := range removed {
+		if err := wb.Delete(bufferTraceKey(traceID)); err != nil {
+			return fmt.Errorf("failed to delete buffered trace: %w", err)
+		}
+	}
+	
+	if err := wb.Flush(); err != nil {
+		return fmt.Errorf("failed to save trace buffer: %w", err)
+	}
+	
+	return nil
+}
+
+// LoadTraceBuffer loads the saved trace buffer. Traces that cannot be
+// decoded are left out.
+func (c *BadgerCheckpointManager) LoadTraceBuffer() ([]BufferedTrace, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	
+	var traces []BufferedTrace
+	err := c.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(keyPrefixBuffer)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			trace, err := decodeBufferedTrace(value)
+			if err != nil {
+				c.logger.Warn("Dropping unreadable buffered trace", zap.Error(err))
+				continue
+			}
+			traces = append(traces, trace)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load trace buffer: %w", err)
+	}
+	
+	return traces, nil
+}
+
+// keysWithPrefix lists the keys starting with prefix
+func (c *BadgerCheckpointManager) keysWithPrefix(prefix []byte) ([][]byte, error) {
+	var keys [][]byte
+	err := c.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to list keys: %w", err)
+	}
 	
-	return windowID, startTime, endTime, windowCount, spans, nil
+	return keys, nil
 }
 
 // Compact performs database compaction
@@ -429,6 +1088,125 @@ func (c *BadgerCheckpointManager) UpdateMetrics() {
 	}
 }
 
+// manifestKey returns the key holding the manifest of a generation.
+// The generation is zero-padded so keys sort in generation order.
+func manifestKey(generation uint64) []byte {
+	return []byte(fmt.Sprintf("%s%020d", keyPrefixManifest, generation))
+}
+
+// bufferTraceKey returns the key holding a buffered trace
+func bufferTraceKey(traceID pcommon.TraceID) []byte {
+	key := make([]byte, 0, len(keyPrefixBuffer)+len(traceID))
+	key = append(key, keyPrefixBuffer...)
+	return append(key, traceID[:]...)
+}
+
+// reservoirKeyPrefix returns the key prefix shared by all spans of a window
+func reservoirKeyPrefix(windowID int64) []byte {
+	return []byte(fmt.Sprintf("%s%d:", keyPrefixReservoir, windowID))
+}
+
+// reservoirSpanKey returns the key holding a single span of a window
+func reservoirSpanKey(windowID int64, hash uint64) []byte {
+	return []byte(fmt.Sprintf("%s%d:%d", keyPrefixReservoir, windowID, hash))
+}
+
+// encodeWindowState encodes a window state record
+func encodeWindowState(windowID int64, startTime, endTime time.Time, windowCount int64) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, windowStateSize))
+	if err := binary.Write(buf, binary.BigEndian, windowID); err != nil {
+		return nil, fmt.Errorf("failed to write window ID: %w", err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, startTime.Unix()); err != nil {
+		return nil, fmt.Errorf("failed to write start time: %w", err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, endTime.Unix()); err != nil {
+		return nil, fmt.Errorf("failed to write end time: %w", err)
+	}
+	if err := binary.Write(buf, binary.BigEndian, windowCount); err != nil {
+		return nil, fmt.Errorf("failed to write window count: %w", err)
+	}
+	return buf.Bytes(), nil
+}
+
+// decodeWindowState decodes a window state record written by encodeWindowState
+func decodeWindowState(data []byte) (windowID int64, startTime, endTime time.Time, windowCount int64, err error) {
+	if len(data) < windowStateSize {
+		return 0, time.Time{}, time.Time{}, 0, fmt.Errorf("invalid state data: expected %d bytes, got %d", windowStateSize, len(data))
+	}
+
+	windowID = int64(binary.BigEndian.Uint64(data[0:8]))
+	startTime = time.Unix(int64(binary.BigEndian.Uint64(data[8:16])), 0)
+	endTime = time.Unix(int64(binary.BigEndian.Uint64(data[16:24])), 0)
+	windowCount = int64(binary.BigEndian.Uint64(data[24:32]))
+
+	return windowID, startTime, endTime, windowCount, nil
+}
+
+// encodeManifest encodes a manifest: generation, window state, span count and
+// the span entries sorted by hash, followed by a CRC-32C of all of it
+func encodeManifest(manifest *checkpointManifest) ([]byte, error) {
+	hashes := make([]uint64, 0, len(manifest.spans))
+	for hash := range manifest.spans {
+		hashes = append(hashes, hash)
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	
+	stateBytes, err := encodeWindowState(manifest.windowID, manifest.startTime, manifest.endTime, manifest.windowCount)
+	if err != nil {
+		return nil, err
+	}
+	
+	data := make([]byte, 0, manifestHeaderSize+len(hashes)*manifestEntrySize)
+	data = binary.BigEndian.AppendUint64(data, manifest.generation)
+	data = append(data, stateBytes...)
+	data = binary.BigEndian.AppendUint32(data, uint32(len(hashes)))
+	for _, hash := range hashes {
+		data = binary.BigEndian.AppendUint64(data, hash)
+		data = binary.BigEndian.AppendUint32(data, manifest.spans[hash])
+	}
+	
+	return binary.BigEndian.AppendUint32(data, crc32.Checksum(data, castagnoliTable)), nil
+}
+
+// decodeManifest decodes and verifies a manifest written by encodeManifest
+func decodeManifest(data []byte) (*checkpointManifest, error) {
+	if len(data) < manifestHeaderSize {
+		return nil, fmt.Errorf("invalid manifest: expected at least %d bytes, got %d", manifestHeaderSize, len(data))
+	}
+	
+	body, sum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, castagnoliTable) != sum {
+		return nil, fmt.Errorf("invalid manifest: checksum mismatch")
+	}
+	
+	windowID, startTime, endTime, windowCount, err := decodeWindowState(body[8:])
+	if err != nil {
+		return nil, err
+	}
+	
+	count := int(binary.BigEndian.Uint32(body[8+windowStateSize:]))
+	entries := body[8+windowStateSize+4:]
+	if len(entries) != count*manifestEntrySize {
+		return nil, fmt.Errorf("invalid manifest: %d spans need %d bytes, got %d", count, count*manifestEntrySize, len(entries))
+	}
+	
+	manifest := &checkpointManifest{
+		generation:  binary.BigEndian.Uint64(body[0:8]),
+		windowID:    windowID,
+		startTime:   startTime,
+		endTime:     endTime,
+		windowCount: windowCount,
+		spans:       make(map[uint64]uint32, count),
+	}
+	for i := 0; i < count; i++ {
+		entry := entries[i*manifestEntrySize:]
+		manifest.spans[binary.BigEndian.Uint64(entry[0:8])] = binary.BigEndian.Uint32(entry[8:12])
+	}
+	
+	return manifest, nil
+}
+
 // zapToBadgerLogger adapts zap.Logger to badger.Logger
 type zapToBadgerLogger struct {
 	*zap.Logger
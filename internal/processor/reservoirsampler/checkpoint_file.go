@@ -0,0 +1,490 @@
+package reservoirsampler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// Snapshot file format (gzip compressed):
+//
+//	[Magic (4 bytes)] "RSNP"
+//	[Version (1 byte)]
+//	[Window state (32 bytes)] as encoded by encodeWindowState
+//	[Span count (4 bytes)]
+//	Per span:
+//	  [Hash (8 bytes)]
+//	  [Length (4 bytes)]
+//	  [Serialized span (Length bytes)]
+const (
+	snapshotFileMagic   = "RSNP"
+	snapshotFileVersion = 1
+)
+
+// FileCheckpointManager implements checkpoint management with a single snapshot file.
+// Every checkpoint rewrites the whole file to a temporary path and renames it
+// into place, so the file on disk is always a complete checkpoint. It has no
+// background goroutines and keeps one serialized copy of the reservoir in memory.
+// The trace buffer is saved the same way in a second file next to it.
+type FileCheckpointManager struct {
+	// Configuration
+	checkpointPath string
+
+	// The last checkpoint written, loaded from disk on first use
+	snapshot *spanSnapshot
+	loaded   bool
+
+	// The last trace buffer written, loaded from disk on first use
+	traceBuffer       bufferedTraceRecords
+	traceBufferLoaded bool
+
+	// State
+	lastCheckpoint time.Time
+	mu             sync.Mutex
+
+	// Metrics
+	checkpointAgeGauge *atomic.Int64
+	fileSizeGauge      *atomic.Int64
+
+	// Logging
+	logger *zap.Logger
+}
+
+// NewFileCheckpointManager creates a new FileCheckpointManager
+func NewFileCheckpointManager(
+	checkpointPath string,
+	checkpointAgeGauge, fileSizeGauge *atomic.Int64,
+	logger *zap.Logger,
+) (*FileCheckpointManager, error) {
+	// Create directory if it doesn't exist
+	if err := os.MkdirAll(filepath.Dir(checkpointPath), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create checkpoint directory: %w", err)
+	}
+
+	return &FileCheckpointManager{
+		checkpointPath:     checkpointPath,
+		checkpointAgeGauge: checkpointAgeGauge,
+		fileSizeGauge:      fileSizeGauge,
+		logger:             logger,
+	}, nil
+}
+
+// Checkpoint saves the current state to the snapshot file
+func (f *FileCheckpointManager) Checkpoint(
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	spans map[uint64]SpanWithResource,
+) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	startTimer := time.Now()
+	snapshot := f.baseSnapshotLocked()
+	snapshot.setState(windowID, startTime, endTime, windowCount)
+	snapshot.replace(spans, f.logger)
+
+	if err := f.writeLocked(snapshot); err != nil {
+		return err
+	}
+
+	f.logger.Debug("Checkpoint completed",
+		zap.Int("total_spans", len(snapshot.spans)),
+		zap.Duration("duration", time.Since(startTimer)))
+
+	return nil
+}
+
+// CheckpointDelta saves the spans added and removed since the previous checkpoint.
+// The file is still rewritten in full, but only the added spans are serialized.
+func (f *FileCheckpointManager) CheckpointDelta(
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	added map[uint64]SpanWithResource,
+	removed []uint64,
+) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	startTimer := time.Now()
+	snapshot := f.baseSnapshotLocked()
+	snapshot.setState(windowID, startTime, endTime, windowCount)
+	snapshot.applyDelta(added, removed, f.logger)
+
+	if err := f.writeLocked(snapshot); err != nil {
+		return err
+	}
+
+	f.logger.Debug("Delta checkpoint completed",
+		zap.Int("spans_saved", len(added)),
+		zap.Int("spans_removed", len(removed)),
+		zap.Duration("duration", time.Since(startTimer)))
+
+	return nil
+}
+
+// baseSnapshotLocked returns a copy of the last checkpoint to build the next one on (must be called with lock held).
+// Working on a copy leaves the last checkpoint intact if writing fails.
+func (f *FileCheckpointManager) baseSnapshotLocked() *spanSnapshot {
+	if !f.loaded {
+		if _, err := f.readLocked(); err != nil && !errors.Is(err, ErrNoCheckpoint) {
+			f.logger.Warn("Failed to read snapshot file, starting a new one", zap.Error(err))
+		}
+	}
+
+	return f.snapshot.clone()
+}
+
+// writeLocked atomically replaces the snapshot file (must be called with lock held)
+func (f *FileCheckpointManager) writeLocked(snapshot *spanSnapshot) error {
+	err := replaceFile(f.checkpointPath, "snapshot", func(w io.Writer) error {
+		return writeSnapshot(w, snapshot)
+	}, f.logger)
+	if err != nil {
+		return err
+	}
+
+	f.snapshot = snapshot
+	f.lastCheckpoint = time.Now()
+	f.checkpointAgeGauge.Store(0)
+
+	if fi, err := os.Stat(f.checkpointPath); err == nil {
+		f.fileSizeGauge.Store(fi.Size())
+	}
+
+	return nil
+}
+
+// replaceFile atomically replaces the file at path with what write writes,
+// by writing a temporary file and renaming it into place. kind names the
+// file in errors.
+func replaceFile(path, kind string, write func(io.Writer) error, logger *zap.Logger) error {
+	tmpPath := path + ".tmp"
+
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return fmt.Errorf("failed to create %s file: %w", kind, err)
+	}
+
+	if err := write(file); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	// Make the data durable before the rename makes it visible
+	if err := file.Sync(); err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to sync %s file: %w", kind, err)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to close %s file: %w", kind, err)
+	}
+
+	if err := os.Rename(tmpPath, path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to replace %s file: %w", kind, err)
+	}
+
+	// Persist the rename itself; not every platform can sync a directory
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		if err := dir.Sync(); err != nil {
+			logger.Debug("Failed to sync checkpoint directory", zap.Error(err))
+		}
+		dir.Close()
+	}
+
+	return nil
+}
+
+// LoadCheckpoint loads the state from the snapshot file.
+// It returns ErrNoCheckpoint if the file does not exist yet.
+func (f *FileCheckpointManager) LoadCheckpoint() (
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	spans map[uint64]SpanWithResource,
+	err error) {
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	startTimer := time.Now()
+
+	snapshot, err := f.readLocked()
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, 0, make(map[uint64]SpanWithResource), err
+	}
+
+	// The loaded state is as fresh as the checkpoint it came from
+	f.lastCheckpoint = time.Now()
+	f.checkpointAgeGauge.Store(0)
+
+	spans = snapshot.decodeSpans(f.logger)
+
+	f.logger.Info("Loaded checkpoint",
+		zap.Int64("window", snapshot.windowID),
+		zap.Int("spans_loaded", len(spans)),
+		zap.Duration("duration", time.Since(startTimer)))
+
+	return snapshot.windowID, snapshot.startTime, snapshot.endTime, snapshot.windowCount, spans, nil
+}
+
+// readLocked reads the snapshot file and makes it the base of the next checkpoint (must be called with lock held)
+func (f *FileCheckpointManager) readLocked() (*spanSnapshot, error) {
+	f.loaded = true
+	f.snapshot = nil
+
+	file, err := os.Open(f.checkpointPath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrNoCheckpoint
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot file: %w", err)
+	}
+	defer file.Close()
+
+	snapshot, err := readSnapshot(file)
+	if err != nil {
+		return nil, err
+	}
+
+	f.snapshot = snapshot
+	return snapshot, nil
+}
+
+// traceBufferPath returns the path of the file holding the trace buffer, next
+// to the snapshot file
+func (f *FileCheckpointManager) traceBufferPath() string {
+	return f.checkpointPath + ".buffer"
+}
+
+// CheckpointTraceBuffer atomically replaces the trace buffer file with the
+// traces waiting in the trace buffer
+func (f *FileCheckpointManager) CheckpointTraceBuffer(traces []BufferedTrace) error {
+	records, err := newBufferedTraceRecords(traces)
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.writeTraceBufferLocked(records)
+}
+
+// CheckpointTraceBufferDelta saves the buffered traces changed and removed
+// since the previous trace buffer checkpoint. The file is still rewritten in
+// full, but only the changed traces are encoded.
+func (f *FileCheckpointManager) CheckpointTraceBufferDelta(changed []BufferedTrace, removed []pcommon.TraceID) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.traceBufferLoaded {
+		if _, err := f.readTraceBufferLocked(); err != nil {
+			f.logger.Warn("Failed to read trace buffer file, starting a new one", zap.Error(err))
+		}
+	}
+
+	undo, err := f.traceBuffer.applyDelta(changed, removed)
+	if err != nil {
+		return err
+	}
+	if err := f.writeTraceBufferLocked(f.traceBuffer); err != nil {
+		// Keep the records matching what is stored
+		undo()
+		return err
+	}
+	return nil
+}
+
+// writeTraceBufferLocked atomically replaces the trace buffer file (must be called with lock held)
+func (f *FileCheckpointManager) writeTraceBufferLocked(records bufferedTraceRecords) error {
+	err := replaceFile(f.traceBufferPath(), "trace buffer", func(w io.Writer) error {
+		return writeTraceBuffer(w, records)
+	}, f.logger)
+	if err != nil {
+		return err
+	}
+
+	f.traceBuffer = records
+	f.traceBufferLoaded = true
+	return nil
+}
+
+// LoadTraceBuffer loads the traces from the trace buffer file
+func (f *FileCheckpointManager) LoadTraceBuffer() ([]BufferedTrace, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	records, err := f.readTraceBufferLocked()
+	if err != nil {
+		return nil, err
+	}
+	return records.decode(f.logger), nil
+}
+
+// readTraceBufferLocked reads the trace buffer file and makes it the base of
+// the next trace buffer delta (must be called with lock held)
+func (f *FileCheckpointManager) readTraceBufferLocked() (bufferedTraceRecords, error) {
+	f.traceBufferLoaded = true
+	f.traceBuffer = nil
+
+	file, err := os.Open(f.traceBufferPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace buffer file: %w", err)
+	}
+	defer file.Close()
+
+	records, err := readTraceBuffer(file, f.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	f.traceBuffer = records
+	return records, nil
+}
+
+// Compact is a no-op, as each checkpoint rewrites the file from scratch
+func (f *FileCheckpointManager) Compact() error {
+	return nil
+}
+
+// Close releases any resources used by the checkpoint manager
+func (f *FileCheckpointManager) Close() error {
+	return nil
+}
+
+// UpdateMetrics updates the checkpoint age metric
+func (f *FileCheckpointManager) UpdateMetrics() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !f.lastCheckpoint.IsZero() {
+		elapsed := time.Since(f.lastCheckpoint)
+		f.checkpointAgeGauge.Store(int64(elapsed.Seconds()))
+	}
+}
+
+// writeSnapshot writes a compressed snapshot
+func writeSnapshot(w io.Writer, snapshot *spanSnapshot) error {
+	stateBytes, err := encodeWindowState(snapshot.windowID, snapshot.startTime, snapshot.endTime, snapshot.windowCount)
+	if err != nil {
+		return err
+	}
+
+	gz := gzip.NewWriter(w)
+	buf := bufio.NewWriter(gz)
+
+	header := make([]byte, 0, len(snapshotFileMagic)+1+windowStateSize+4)
+	header = append(header, snapshotFileMagic...)
+	header = append(header, snapshotFileVersion)
+	header = append(header, stateBytes...)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(snapshot.spans)))
+	if _, err := buf.Write(header); err != nil {
+		return fmt.Errorf("failed to write snapshot header: %w", err)
+	}
+
+	entry := make([]byte, 12)
+	for hash, spanBytes := range snapshot.spans {
+		binary.BigEndian.PutUint64(entry[0:8], hash)
+		binary.BigEndian.PutUint32(entry[8:12], uint32(len(spanBytes)))
+		if _, err := buf.Write(entry); err != nil {
+			return fmt.Errorf("failed to write span: %w", err)
+		}
+		if _, err := buf.Write(spanBytes); err != nil {
+			return fmt.Errorf("failed to write span: %w", err)
+		}
+	}
+
+	if err := buf.Flush(); err != nil {
+		return fmt.Errorf("failed to write snapshot: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress snapshot: %w", err)
+	}
+
+	return nil
+}
+
+// readSnapshot reads a compressed snapshot written by writeSnapshot
+func readSnapshot(r io.Reader) (*spanSnapshot, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+	defer gz.Close()
+
+	// Reading to the end also verifies the gzip checksum
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress snapshot: %w", err)
+	}
+
+	headerSize := len(snapshotFileMagic) + 1 + windowStateSize + 4
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("invalid snapshot: expected at least %d bytes, got %d", headerSize, len(data))
+	}
+	if string(data[:len(snapshotFileMagic)]) != snapshotFileMagic {
+		return nil, fmt.Errorf("invalid snapshot: bad magic %q", data[:len(snapshotFileMagic)])
+	}
+	if version := data[len(snapshotFileMagic)]; version != snapshotFileVersion {
+		return nil, fmt.Errorf("unsupported snapshot version: %d", version)
+	}
+
+	stateStart := len(snapshotFileMagic) + 1
+	windowID, startTime, endTime, windowCount, err := decodeWindowState(data[stateStart : stateStart+windowStateSize])
+	if err != nil {
+		return nil, err
+	}
+
+	count := int(binary.BigEndian.Uint32(data[stateStart+windowStateSize:]))
+	snapshot := &spanSnapshot{
+		windowID:    windowID,
+		startTime:   startTime,
+		endTime:     endTime,
+		windowCount: windowCount,
+		spans:       make(map[uint64][]byte, count),
+	}
+
+	rest := data[headerSize:]
+	for i := 0; i < count; i++ {
+		if len(rest) < 12 {
+			return nil, fmt.Errorf("invalid snapshot: span %d of %d truncated", i, count)
+		}
+		hash := binary.BigEndian.Uint64(rest[0:8])
+		length := int(binary.BigEndian.Uint32(rest[8:12]))
+		rest = rest[12:]
+		if len(rest) < length {
+			return nil, fmt.Errorf("invalid snapshot: span %d of %d truncated", i, count)
+		}
+		snapshot.spans[hash] = rest[:length]
+		rest = rest[length:]
+	}
+
+	if len(rest) != 0 {
+		return nil, fmt.Errorf("invalid snapshot: %d trailing bytes", len(rest))
+	}
+
+	return snapshot, nil
+}
@@ -0,0 +1,259 @@
+package reservoirsampler
+
+import (
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// spanSnapshot is a serialized copy of a checkpointed window, used by the
+// backends that hold the whole checkpoint as a single unit
+type spanSnapshot struct {
+	windowID    int64
+	startTime   time.Time
+	endTime     time.Time
+	windowCount int64
+
+	// spans maps span hashes to their serialized form
+	spans map[uint64][]byte
+}
+
+// clone returns a copy of the snapshot that can be changed independently,
+// or an empty snapshot if s is nil. Serialized spans are shared, as they are
+// never modified.
+func (s *spanSnapshot) clone() *spanSnapshot {
+	snapshot := &spanSnapshot{}
+	if s != nil {
+		*snapshot = *s
+		snapshot.spans = make(map[uint64][]byte, len(s.spans))
+		for hash, spanBytes := range s.spans {
+			snapshot.spans[hash] = spanBytes
+		}
+	}
+	return snapshot
+}
+
+// setState updates the window state, dropping the spans of a previous window
+func (s *spanSnapshot) setState(windowID int64, startTime, endTime time.Time, windowCount int64) {
+	if s.spans == nil || s.windowID != windowID {
+		s.spans = make(map[uint64][]byte)
+	}
+
+	s.windowID = windowID
+	s.startTime = startTime
+	s.endTime = endTime
+	s.windowCount = windowCount
+}
+
+// replace makes the given spans the content of the snapshot.
+// Spans already in the snapshot keep their serialized form.
+func (s *spanSnapshot) replace(spans map[uint64]SpanWithResource, logger *zap.Logger) {
+	for hash := range s.spans {
+		if _, kept := spans[hash]; !kept {
+			delete(s.spans, hash)
+		}
+	}
+
+	for hash, spanWithRes := range spans {
+		if _, exists := s.spans[hash]; exists {
+			continue
+		}
+		s.add(hash, spanWithRes, logger)
+	}
+}
+
+// applyDelta adds and removes spans from the snapshot
+func (s *spanSnapshot) applyDelta(added map[uint64]SpanWithResource, removed []uint64, logger *zap.Logger) {
+	for _, hash := range removed {
+		delete(s.spans, hash)
+	}
+
+	for hash, spanWithRes := range added {
+		s.add(hash, spanWithRes, logger)
+	}
+}
+
+// add serializes a span into the snapshot
+func (s *spanSnapshot) add(hash uint64, spanWithRes SpanWithResource, logger *zap.Logger) {
+	spanBytes, err := serializeSpanWithResource(spanWithRes)
+	if err != nil {
+		logger.Error("Failed to serialize span",
+			zap.Uint64("hash", hash),
+			zap.Error(err))
+		return
+	}
+	s.spans[hash] = spanBytes
+}
+
+// decodeSpans deserializes every span in the snapshot
+func (s *spanSnapshot) decodeSpans(logger *zap.Logger) map[uint64]SpanWithResource {
+	spans := make(map[uint64]SpanWithResource, len(s.spans))
+	for hash, spanBytes := range s.spans {
+		spanWithRes, err := deserializeSpanWithResource(spanBytes)
+		if err != nil {
+			logger.Warn("Failed to load span",
+				zap.Uint64("hash", hash),
+				zap.Error(err))
+			continue
+		}
+		spans[hash] = spanWithRes
+	}
+	return spans
+}
+
+// MemoryCheckpointManager implements checkpoint management in memory.
+// Nothing survives the process, which makes it useful for tests and for
+// deployments that only want the checkpoint interfaces exercised.
+type MemoryCheckpointManager struct {
+	// The last checkpoint, nil until one is taken
+	snapshot *spanSnapshot
+
+	// The last checkpointed trace buffer, nil until one is taken
+	traceBuffer bufferedTraceRecords
+
+	// State
+	lastCheckpoint time.Time
+	mu             sync.Mutex
+
+	// Metrics
+	checkpointAgeGauge *atomic.Int64
+
+	// Logging
+	logger *zap.Logger
+}
+
+// NewMemoryCheckpointManager creates a new MemoryCheckpointManager
+func NewMemoryCheckpointManager(checkpointAgeGauge *atomic.Int64, logger *zap.Logger) *MemoryCheckpointManager {
+	return &MemoryCheckpointManager{
+		checkpointAgeGauge: checkpointAgeGauge,
+		logger:             logger,
+	}
+}
+
+// Checkpoint saves the current state
+func (m *MemoryCheckpointManager) Checkpoint(
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	spans map[uint64]SpanWithResource,
+) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.snapshot == nil {
+		m.snapshot = &spanSnapshot{}
+	}
+	m.snapshot.setState(windowID, startTime, endTime, windowCount)
+	m.snapshot.replace(spans, m.logger)
+
+	m.finishCheckpointLocked()
+	return nil
+}
+
+// CheckpointDelta saves the spans added and removed since the previous checkpoint
+func (m *MemoryCheckpointManager) CheckpointDelta(
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	added map[uint64]SpanWithResource,
+	removed []uint64,
+) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.snapshot == nil {
+		m.snapshot = &spanSnapshot{}
+	}
+	m.snapshot.setState(windowID, startTime, endTime, windowCount)
+	m.snapshot.applyDelta(added, removed, m.logger)
+
+	m.finishCheckpointLocked()
+	return nil
+}
+
+// finishCheckpointLocked updates the checkpoint metrics (must be called with lock held)
+func (m *MemoryCheckpointManager) finishCheckpointLocked() {
+	m.lastCheckpoint = time.Now()
+	m.checkpointAgeGauge.Store(0)
+}
+
+// LoadCheckpoint returns the last checkpoint, or ErrNoCheckpoint if none was taken
+func (m *MemoryCheckpointManager) LoadCheckpoint() (
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	spans map[uint64]SpanWithResource,
+	err error) {
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.snapshot == nil {
+		return 0, time.Time{}, time.Time{}, 0, make(map[uint64]SpanWithResource), ErrNoCheckpoint
+	}
+
+	s := m.snapshot
+	return s.windowID, s.startTime, s.endTime, s.windowCount, s.decodeSpans(m.logger), nil
+}
+
+// CheckpointTraceBuffer saves the traces waiting in the trace buffer
+func (m *MemoryCheckpointManager) CheckpointTraceBuffer(traces []BufferedTrace) error {
+	records, err := newBufferedTraceRecords(traces)
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.traceBuffer = records
+	return nil
+}
+
+// CheckpointTraceBufferDelta saves the buffered traces changed and removed
+// since the previous trace buffer checkpoint
+func (m *MemoryCheckpointManager) CheckpointTraceBufferDelta(changed []BufferedTrace, removed []pcommon.TraceID) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := m.traceBuffer.applyDelta(changed, removed)
+	return err
+}
+
+// LoadTraceBuffer returns the last checkpointed trace buffer
+func (m *MemoryCheckpointManager) LoadTraceBuffer() ([]BufferedTrace, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.traceBuffer == nil {
+		return nil, nil
+	}
+	return m.traceBuffer.decode(m.logger), nil
+}
+
+// Compact is a no-op, as there is no storage to compact
+func (m *MemoryCheckpointManager) Compact() error {
+	return nil
+}
+
+// Close releases any resources used by the checkpoint manager
+func (m *MemoryCheckpointManager) Close() error {
+	return nil
+}
+
+// UpdateMetrics updates the checkpoint age metric
+func (m *MemoryCheckpointManager) UpdateMetrics() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if !m.lastCheckpoint.IsZero() {
+		elapsed := time.Since(m.lastCheckpoint)
+		m.checkpointAgeGauge.Store(int64(elapsed.Seconds()))
+	}
+}
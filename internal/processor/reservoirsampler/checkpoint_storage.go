@@ -0,0 +1,347 @@
+package reservoirsampler
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/extension/xextension/storage"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+const (
+	// storageCheckpointKey is the storage client key holding the checkpoint
+	storageCheckpointKey = "reservoir_checkpoint"
+
+	// storageTraceBufferKey is the storage client key holding the trace buffer
+	storageTraceBufferKey = "reservoir_trace_buffer"
+)
+
+// StorageCheckpointManager implements checkpoint management through a collector storage extension.
+// The checkpoint is stored as one compressed snapshot, in the format of the
+// file backend, under a single key. Setting one key is atomic, so the stored
+// checkpoint is always complete; durability and compaction are left to the
+// extension.
+type StorageCheckpointManager struct {
+	// Storage client obtained from the extension
+	client storage.Client
+
+	// The last checkpoint written, loaded from storage on first use
+	snapshot *spanSnapshot
+	loaded   bool
+
+	// The last trace buffer stored, loaded from storage on first use
+	traceBuffer       bufferedTraceRecords
+	traceBufferLoaded bool
+
+	// State
+	lastCheckpoint time.Time
+	mu             sync.Mutex
+
+	// Metrics
+	checkpointAgeGauge *atomic.Int64
+	sizeGauge          *atomic.Int64
+
+	// Logging
+	logger *zap.Logger
+}
+
+// NewStorageCheckpointManager creates a new StorageCheckpointManager
+func NewStorageCheckpointManager(
+	client storage.Client,
+	checkpointAgeGauge, sizeGauge *atomic.Int64,
+	logger *zap.Logger,
+) *StorageCheckpointManager {
+	return &StorageCheckpointManager{
+		client:             client,
+		checkpointAgeGauge: checkpointAgeGauge,
+		sizeGauge:          sizeGauge,
+		logger:             logger,
+	}
+}
+
+// getStorageClient obtains a storage client for a component of the given
+// kind from the named storage extension
+func getStorageClient(
+	ctx context.Context,
+	host component.Host,
+	storageID component.ID,
+	kind component.Kind,
+	componentID component.ID,
+) (storage.Client, error) {
+	if host == nil {
+		return nil, fmt.Errorf("storage extension %s not found: no host", storageID)
+	}
+
+	ext, found := host.GetExtensions()[storageID]
+	if !found {
+		return nil, fmt.Errorf("storage extension %s not found", storageID)
+	}
+
+	storageExt, ok := ext.(storage.Extension)
+	if !ok {
+		return nil, fmt.Errorf("extension %s is not a storage extension", storageID)
+	}
+
+	return storageExt.GetClient(ctx, kind, componentID, "")
+}
+
+// Checkpoint saves the current state to storage
+func (s *StorageCheckpointManager) Checkpoint(
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	spans map[uint64]SpanWithResource,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	startTimer := time.Now()
+	snapshot := s.baseSnapshotLocked()
+	snapshot.setState(windowID, startTime, endTime, windowCount)
+	snapshot.replace(spans, s.logger)
+
+	if err := s.writeLocked(snapshot); err != nil {
+		return err
+	}
+
+	s.logger.Debug("Checkpoint completed",
+		zap.Int("total_spans", len(snapshot.spans)),
+		zap.Duration("duration", time.Since(startTimer)))
+
+	return nil
+}
+
+// CheckpointDelta saves the spans added and removed since the previous checkpoint.
+// The stored snapshot is still replaced in full, but only the added spans are serialized.
+func (s *StorageCheckpointManager) CheckpointDelta(
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	added map[uint64]SpanWithResource,
+	removed []uint64,
+) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	startTimer := time.Now()
+	snapshot := s.baseSnapshotLocked()
+	snapshot.setState(windowID, startTime, endTime, windowCount)
+	snapshot.applyDelta(added, removed, s.logger)
+
+	if err := s.writeLocked(snapshot); err != nil {
+		return err
+	}
+
+	s.logger.Debug("Delta checkpoint completed",
+		zap.Int("spans_saved", len(added)),
+		zap.Int("spans_removed", len(removed)),
+		zap.Duration("duration", time.Since(startTimer)))
+
+	return nil
+}
+
+// baseSnapshotLocked returns a copy of the last checkpoint to build the next one on (must be called with lock held)
+func (s *StorageCheckpointManager) baseSnapshotLocked() *spanSnapshot {
+	if !s.loaded {
+		if _, err := s.readLocked(); err != nil && !errors.Is(err, ErrNoCheckpoint) {
+			s.logger.Warn("Failed to read stored checkpoint, starting a new one", zap.Error(err))
+		}
+	}
+
+	return s.snapshot.clone()
+}
+
+// writeLocked replaces the stored snapshot (must be called with lock held)
+func (s *StorageCheckpointManager) writeLocked(snapshot *spanSnapshot) error {
+	var buf bytes.Buffer
+	if err := writeSnapshot(&buf, snapshot); err != nil {
+		return err
+	}
+
+	if err := s.client.Set(context.Background(), storageCheckpointKey, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to store checkpoint: %w", err)
+	}
+
+	s.snapshot = snapshot
+	s.lastCheckpoint = time.Now()
+	s.checkpointAgeGauge.Store(0)
+	s.sizeGauge.Store(int64(buf.Len()))
+
+	return nil
+}
+
+// LoadCheckpoint loads the state from storage.
+// It returns ErrNoCheckpoint if nothing has been stored yet.
+func (s *StorageCheckpointManager) LoadCheckpoint() (
+	windowID int64,
+	startTime time.Time,
+	endTime time.Time,
+	windowCount int64,
+	spans map[uint64]SpanWithResource,
+	err error) {
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	startTimer := time.Now()
+
+	snapshot, err := s.readLocked()
+	if err != nil {
+		return 0, time.Time{}, time.Time{}, 0, make(map[uint64]SpanWithResource), err
+	}
+
+	// The loaded state is as fresh as the checkpoint it came from
+	s.lastCheckpoint = time.Now()
+	s.checkpointAgeGauge.Store(0)
+
+	spans = snapshot.decodeSpans(s.logger)
+
+	s.logger.Info("Loaded checkpoint",
+		zap.Int64("window", snapshot.windowID),
+		zap.Int("spans_loaded", len(spans)),
+		zap.Duration("duration", time.Since(startTimer)))
+
+	return snapshot.windowID, snapshot.startTime, snapshot.endTime, snapshot.windowCount, spans, nil
+}
+
+// readLocked reads the stored snapshot and makes it the base of the next checkpoint (must be called with lock held)
+func (s *StorageCheckpointManager) readLocked() (*spanSnapshot, error) {
+	s.loaded = true
+	s.snapshot = nil
+
+	data, err := s.client.Get(context.Background(), storageCheckpointKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stored checkpoint: %w", err)
+	}
+	if data == nil {
+		return nil, ErrNoCheckpoint
+	}
+
+	snapshot, err := readSnapshot(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+
+	s.snapshot = snapshot
+	return snapshot, nil
+}
+
+// CheckpointTraceBuffer saves the traces waiting in the trace buffer under
+// their own key, in the trace buffer file format
+func (s *StorageCheckpointManager) CheckpointTraceBuffer(traces []BufferedTrace) error {
+	records, err := newBufferedTraceRecords(traces)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.writeTraceBufferLocked(records)
+}
+
+// CheckpointTraceBufferDelta saves the buffered traces changed and removed
+// since the previous trace buffer checkpoint. The stored trace buffer is
+// still replaced in full, but only the changed traces are encoded.
+func (s *StorageCheckpointManager) CheckpointTraceBufferDelta(changed []BufferedTrace, removed []pcommon.TraceID) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.traceBufferLoaded {
+		if _, err := s.readTraceBufferLocked(); err != nil {
+			s.logger.Warn("Failed to read stored trace buffer, starting a new one", zap.Error(err))
+		}
+	}
+
+	undo, err := s.traceBuffer.applyDelta(changed, removed)
+	if err != nil {
+		return err
+	}
+	if err := s.writeTraceBufferLocked(s.traceBuffer); err != nil {
+		// Keep the records matching what is stored
+		undo()
+		return err
+	}
+	return nil
+}
+
+// writeTraceBufferLocked replaces the stored trace buffer (must be called with lock held)
+func (s *StorageCheckpointManager) writeTraceBufferLocked(records bufferedTraceRecords) error {
+	var buf bytes.Buffer
+	if err := writeTraceBuffer(&buf, records); err != nil {
+		return err
+	}
+
+	if err := s.client.Set(context.Background(), storageTraceBufferKey, buf.Bytes()); err != nil {
+		return fmt.Errorf("failed to store trace buffer: %w", err)
+	}
+
+	s.traceBuffer = records
+	s.traceBufferLoaded = true
+	return nil
+}
+
+// LoadTraceBuffer loads the stored trace buffer
+func (s *StorageCheckpointManager) LoadTraceBuffer() ([]BufferedTrace, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	records, err := s.readTraceBufferLocked()
+	if err != nil {
+		return nil, err
+	}
+	return records.decode(s.logger), nil
+}
+
+// readTraceBufferLocked reads the stored trace buffer and makes it the base
+// of the next trace buffer delta (must be called with lock held)
+func (s *StorageCheckpointManager) readTraceBufferLocked() (bufferedTraceRecords, error) {
+	s.traceBufferLoaded = true
+	s.traceBuffer = nil
+
+	data, err := s.client.Get(context.Background(), storageTraceBufferKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read stored trace buffer: %w", err)
+	}
+	if data == nil {
+		return nil, nil
+	}
+
+	records, err := readTraceBuffer(bytes.NewReader(data), s.logger)
+	if err != nil {
+		return nil, err
+	}
+
+	s.traceBuffer = records
+	return records, nil
+}
+
+// Compact is a no-op, as compaction is configured on the storage extension
+func (s *StorageCheckpointManager) Compact() error {
+	return nil
+}
+
+// Close releases the storage client
+func (s *StorageCheckpointManager) Close() error {
+	return s.client.Close(context.Background())
+}
+
+// UpdateMetrics updates the checkpoint age metric
+func (s *StorageCheckpointManager) UpdateMetrics() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !s.lastCheckpoint.IsZero() {
+		elapsed := time.Since(s.lastCheckpoint)
+		s.checkpointAgeGauge.Store(int64(elapsed.Seconds()))
+	}
+}
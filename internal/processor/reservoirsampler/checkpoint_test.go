@@ -0,0 +1,983 @@
+package reservoirsampler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/extension/xextension/storage"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// newTestCheckpointManager opens a Badger checkpoint manager in the given directory
+func newTestCheckpointManager(t *testing.T, path string) *BadgerCheckpointManager {
+	return newTestCheckpointManagerRetaining(t, path, 0)
+}
+
+// newTestCheckpointManagerRetaining opens a Badger checkpoint manager that keeps past windows
+func newTestCheckpointManagerRetaining(t *testing.T, path string, retainedWindows int) *BadgerCheckpointManager {
+	cm, err := NewBadgerCheckpointManager(
+		path,
+		0,
+		retainedWindows,
+		atomic.NewInt64(0),
+		atomic.NewInt64(0),
+		atomic.NewInt64(0),
+		zap.NewNop(),
+	)
+	require.NoError(t, err)
+	return cm
+}
+
+// testSpans builds a span map keyed by span hash from generated traces
+func testSpans(numSpans int) map[uint64]SpanWithResource {
+	spans := make(map[uint64]SpanWithResource, numSpans)
+	rss := generateTraces(numSpans).ResourceSpans()
+	for i := 0; i < rss.Len(); i++ {
+		rs := rss.At(i)
+		ss := rs.ScopeSpans().At(0)
+		span := ss.Spans().At(0)
+		spans[hashSpanKey(createSpanKey(span))] = SpanWithResource{
+			Span:     span,
+			Resource: rs.Resource(),
+			Scope:    ss.Scope(),
+		}
+	}
+	return spans
+}
+
+// TestLoadCheckpointEmpty tests that an empty database reports ErrNoCheckpoint
+func TestLoadCheckpointEmpty(t *testing.T) {
+	cm := newTestCheckpointManager(t, filepath.Join(t.TempDir(), "badger"))
+	defer cm.Close()
+
+	_, _, _, _, spans, err := cm.LoadCheckpoint()
+	assert.ErrorIs(t, err, ErrNoCheckpoint)
+	assert.Empty(t, spans)
+}
+
+// TestCheckpointRoundtrip tests that a checkpoint survives closing and reopening the database
+func TestCheckpointRoundtrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "badger")
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(time.Minute)
+	spans := testSpans(25)
+
+	cm := newTestCheckpointManager(t, path)
+	require.NoError(t, cm.Checkpoint(7, startTime, endTime, 1234, spans))
+	require.NoError(t, cm.Close())
+
+	cm = newTestCheckpointManager(t, path)
+	defer cm.Close()
+
+	windowID, loadedStart, loadedEnd, windowCount, loaded, err := cm.LoadCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, int64(7), windowID)
+	assert.True(t, startTime.Equal(loadedStart))
+	assert.True(t, endTime.Equal(loadedEnd))
+	assert.Equal(t, int64(1234), windowCount)
+	require.Len(t, loaded, len(spans))
+
+	for hash, want := range spans {
+		got, ok := loaded[hash]
+		require.True(t, ok, "span %d missing after reload", hash)
+		assert.Equal(t, want.Span.TraceID(), got.Span.TraceID())
+		assert.Equal(t, want.Span.SpanID(), got.Span.SpanID())
+		assert.Equal(t, want.Span.Name(), got.Span.Name())
+		assert.Equal(t, want.Scope.Name(), got.Scope.Name())
+	}
+}
+
+// countKeys returns the number of keys stored under a prefix
+func countKeys(t *testing.T, cm *BadgerCheckpointManager, prefix []byte) int {
+	count := 0
+	err := cm.db.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			count++
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return count
+}
+
+// TestCheckpointDeletesReplacedSpans tests that spans evicted from the reservoir are removed from disk
+func TestCheckpointDeletesReplacedSpans(t *testing.T) {
+	cm := newTestCheckpointManager(t, filepath.Join(t.TempDir(), "badger"))
+	defer cm.Close()
+
+	startTime := time.Now()
+	endTime := startTime.Add(time.Minute)
+	spans := testSpans(20)
+	require.NoError(t, cm.Checkpoint(1, startTime, endTime, 20, spans))
+	assert.Equal(t, 20, countKeys(t, cm, reservoirKeyPrefix(1)))
+
+	// Replace half of the spans with new ones, as the reservoir does once it is full
+	fresh := testSpans(30)
+	for hash := range spans {
+		delete(fresh, hash)
+	}
+	replaced := 0
+	for hash := range spans {
+		if replaced == 10 {
+			break
+		}
+		delete(spans, hash)
+		replaced++
+	}
+	for hash, span := range fresh {
+		spans[hash] = span
+	}
+	require.NoError(t, cm.Checkpoint(1, startTime, endTime, 40, spans))
+
+	// The replaced spans are kept until the previous generation is superseded
+	assert.Equal(t, 30, countKeys(t, cm, reservoirKeyPrefix(1)))
+	require.NoError(t, cm.Checkpoint(1, startTime, endTime, 40, spans))
+	assert.Equal(t, 20, countKeys(t, cm, reservoirKeyPrefix(1)))
+
+	_, _, _, _, loaded, err := cm.LoadCheckpoint()
+	require.NoError(t, err)
+	require.Len(t, loaded, len(spans))
+	for hash := range spans {
+		assert.Contains(t, loaded, hash)
+	}
+}
+
+// TestCheckpointDropsClosedWindows tests that windows beyond the retention are removed from disk
+func TestCheckpointDropsClosedWindows(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "badger")
+	cm := newTestCheckpointManagerRetaining(t, path, 1)
+
+	startTime := time.Now()
+	endTime := startTime.Add(time.Minute)
+	for windowID := int64(1); windowID <= 3; windowID++ {
+		require.NoError(t, cm.Checkpoint(windowID, startTime, endTime, 5, testSpans(5)))
+	}
+
+	// Window 2 is retained, window 1 is gone
+	assert.Equal(t, 0, countKeys(t, cm, reservoirKeyPrefix(1)))
+	assert.Equal(t, 5, countKeys(t, cm, reservoirKeyPrefix(2)))
+	assert.Equal(t, 5, countKeys(t, cm, reservoirKeyPrefix(3)))
+
+	// Only the manifests of the retained window and the newest generation are left
+	assert.Equal(t, 2, countKeys(t, cm, []byte(keyPrefixManifest)))
+	require.NoError(t, cm.Close())
+
+	// After a restart the next window still drops what is no longer retained
+	cm = newTestCheckpointManagerRetaining(t, path, 1)
+	defer cm.Close()
+	require.NoError(t, cm.Checkpoint(4, startTime, endTime, 5, testSpans(5)))
+	assert.Equal(t, 0, countKeys(t, cm, reservoirKeyPrefix(2)))
+	assert.Equal(t, 5, countKeys(t, cm, reservoirKeyPrefix(3)))
+	assert.Equal(t, 5, countKeys(t, cm, reservoirKeyPrefix(4)))
+}
+
+// TestLoadRetainedWindow tests that a retained window keeps its last manifest and can be loaded
+func TestLoadRetainedWindow(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "badger")
+	cm := newTestCheckpointManagerRetaining(t, path, 2)
+
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(time.Minute)
+	require.NoError(t, cm.Checkpoint(1, startTime, endTime, 5, testSpans(5)))
+	closed := testSpans(7)
+	require.NoError(t, cm.Checkpoint(1, startTime, endTime, 7, closed))
+	for windowID := int64(2); windowID <= 3; windowID++ {
+		require.NoError(t, cm.Checkpoint(windowID, endTime, endTime.Add(time.Minute), 5, testSpans(5)))
+		require.NoError(t, cm.Checkpoint(windowID, endTime, endTime.Add(time.Minute), 6, testSpans(6)))
+	}
+	require.NoError(t, cm.Close())
+
+	cm = newTestCheckpointManagerRetaining(t, path, 2)
+	defer cm.Close()
+
+	loadedStart, loadedEnd, windowCount, loaded, err := cm.LoadWindow(1)
+	require.NoError(t, err)
+	assert.True(t, startTime.Equal(loadedStart))
+	assert.True(t, endTime.Equal(loadedEnd))
+	assert.Equal(t, int64(7), windowCount)
+	require.Len(t, loaded, len(closed))
+	for hash := range closed {
+		assert.Contains(t, loaded, hash)
+	}
+
+	_, _, windowCount, loaded, err = cm.LoadWindow(2)
+	require.NoError(t, err)
+	assert.Equal(t, int64(6), windowCount)
+	assert.Len(t, loaded, 6)
+
+	// Once the window falls out of the retention it can no longer be loaded
+	require.NoError(t, cm.Checkpoint(4, endTime, endTime.Add(time.Minute), 5, testSpans(5)))
+	_, _, _, _, err = cm.LoadWindow(1)
+	assert.ErrorIs(t, err, ErrNoCheckpoint)
+	_, _, _, _, err = cm.LoadWindow(2)
+	assert.NoError(t, err)
+}
+
+// TestLoadLegacyCheckpoint tests that a checkpoint written before manifests
+// is restored once, and its keys are deleted when the first manifest commits
+func TestLoadLegacyCheckpoint(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "badger")
+	startTime := time.Now().Truncate(time.Second)
+	endTime := startTime.Add(time.Minute)
+	spans := testSpans(10)
+
+	cm := newTestCheckpointManager(t, path)
+	state, err := encodeWindowState(3, startTime, endTime, 500)
+	require.NoError(t, err)
+	err = cm.db.Update(func(txn *badger.Txn) error {
+		for _, windowID := range []int64{2, 3} {
+			if err := txn.Set([]byte(fmt.Sprintf("%s%d", keyPrefixLegacyState, windowID)), state); err != nil {
+				return err
+			}
+		}
+		if err := txn.Set([]byte(legacyCurrentWindowKey), []byte("3")); err != nil {
+			return err
+		}
+		for hash, span := range spans {
+			spanBytes, err := serializeSpanWithResource(span)
+			if err != nil {
+				return err
+			}
+			if err := txn.Set(reservoirSpanKey(3, hash), spanBytes); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	require.NoError(t, cm.Close())
+
+	cm = newTestCheckpointManager(t, path)
+	defer cm.Close()
+
+	windowID, loadedStart, loadedEnd, windowCount, loaded, err := cm.LoadCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), windowID)
+	assert.True(t, startTime.Equal(loadedStart))
+	assert.True(t, endTime.Equal(loadedEnd))
+	assert.Equal(t, int64(500), windowCount)
+	assert.Len(t, loaded, len(spans))
+
+	// The first checkpoint builds on the legacy spans and retires the old keys
+	require.NoError(t, cm.Checkpoint(3, startTime, endTime, 600, spans))
+	assert.Equal(t, 0, countKeys(t, cm, []byte(keyPrefixLegacyState)))
+	assert.Equal(t, 0, countKeys(t, cm, []byte(legacyCurrentWindowKey)))
+	assert.Equal(t, len(spans), countKeys(t, cm, reservoirKeyPrefix(3)))
+
+	_, _, _, windowCount, loaded, err = cm.LoadCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, int64(600), windowCount)
+	assert.Len(t, loaded, len(spans))
+}
+
+// TestCheckpointDelta tests that a delta checkpoint writes added spans and deletes evicted ones
+func TestCheckpointDelta(t *testing.T) {
+	cm := newTestCheckpointManager(t, filepath.Join(t.TempDir(), "badger"))
+	defer cm.Close()
+
+	startTime := time.Now()
+	endTime := startTime.Add(time.Minute)
+	spans := testSpans(10)
+	require.NoError(t, cm.Checkpoint(1, startTime, endTime, 10, spans))
+
+	// Evict three persisted spans and add five new ones
+	removed := make([]uint64, 0, 3)
+	for hash := range spans {
+		if len(removed) == 3 {
+			break
+		}
+		removed = append(removed, hash)
+		delete(spans, hash)
+	}
+	added := make(map[uint64]SpanWithResource)
+	for hash, span := range testSpans(20) {
+		if _, exists := spans[hash]; exists || len(added) == 5 {
+			continue
+		}
+		if containsHash(removed, hash) {
+			continue
+		}
+		added[hash] = span
+		spans[hash] = span
+	}
+	require.NoError(t, cm.CheckpointDelta(1, startTime, endTime, 20, added, removed))
+	assert.Equal(t, 15, countKeys(t, cm, reservoirKeyPrefix(1)))
+
+	_, _, _, windowCount, loaded, err := cm.LoadCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, int64(20), windowCount)
+	require.Len(t, loaded, len(spans))
+	for hash := range spans {
+		assert.Contains(t, loaded, hash)
+	}
+}
+
+// TestCheckpointDeltaKeepsPreviousGeneration tests that a delta whose manifest never
+// commits leaves the spans of the previous generation untouched
+func TestCheckpointDeltaKeepsPreviousGeneration(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "badger")
+	cm := newTestCheckpointManager(t, path)
+
+	startTime := time.Now()
+	endTime := startTime.Add(time.Minute)
+	spans := testSpans(10)
+	require.NoError(t, cm.Checkpoint(1, startTime, endTime, 10, spans))
+
+	// Re-add a persisted span, once as a plain add and once evicted and re-added
+	added := make(map[uint64]SpanWithResource)
+	removed := make([]uint64, 0, 1)
+	for hash, span := range spans {
+		changed := SpanWithResource{
+			Span:     ptrace.NewSpan(),
+			Resource: span.Resource,
+			Scope:    span.Scope,
+		}
+		span.Span.CopyTo(changed.Span)
+		changed.Span.SetName("changed")
+		added[hash] = changed
+		if len(added) == 1 {
+			removed = append(removed, hash)
+		}
+		if len(added) == 2 {
+			break
+		}
+	}
+	require.NoError(t, cm.CheckpointDelta(1, startTime, endTime, 12, added, removed))
+
+	// Drop the delta's manifest as if it had failed to commit
+	require.NoError(t, cm.deleteKeys([][]byte{manifestKey(2)}))
+	require.NoError(t, cm.Close())
+
+	cm = newTestCheckpointManager(t, path)
+	defer cm.Close()
+
+	_, _, _, windowCount, loaded, err := cm.LoadCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), windowCount)
+	require.Len(t, loaded, len(spans))
+	for hash := range added {
+		assert.Equal(t, spans[hash].Span.Name(), loaded[hash].Span.Name())
+	}
+}
+
+// TestLoadCheckpointIgnoresUncommittedSpans tests that spans written without a manifest are not loaded
+func TestLoadCheckpointIgnoresUncommittedSpans(t *testing.T) {
+	cm := newTestCheckpointManager(t, filepath.Join(t.TempDir(), "badger"))
+	defer cm.Close()
+
+	startTime := time.Now()
+	endTime := startTime.Add(time.Minute)
+	spans := testSpans(10)
+	require.NoError(t, cm.Checkpoint(1, startTime, endTime, 10, spans))
+
+	// A checkpoint that crashed after writing its spans but before its manifest
+	extra := testSpans(15)
+	hashes := make([]uint64, 0)
+	for hash := range extra {
+		if _, exists := spans[hash]; !exists {
+			hashes = append(hashes, hash)
+		}
+	}
+	_, err := cm.writeSpansLocked(1, hashes, extra, make(map[uint64]uint32))
+	require.NoError(t, err)
+
+	_, _, _, windowCount, loaded, err := cm.LoadCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, int64(10), windowCount)
+	require.Len(t, loaded, len(spans))
+	for hash := range spans {
+		assert.Contains(t, loaded, hash)
+	}
+}
+
+// TestLoadCheckpointFallsBack tests that a generation that fails verification falls back to the previous one
+func TestLoadCheckpointFallsBack(t *testing.T) {
+	tests := []struct {
+		name    string
+		corrupt func(t *testing.T, cm *BadgerCheckpointManager, spans map[uint64]SpanWithResource)
+	}{
+		{
+			name: "damaged span",
+			corrupt: func(t *testing.T, cm *BadgerCheckpointManager, spans map[uint64]SpanWithResource) {
+				for hash := range spans {
+					require.NoError(t, cm.db.Update(func(txn *badger.Txn) error {
+						return txn.Set(reservoirSpanKey(2, hash), []byte("garbage"))
+					}))
+					return
+				}
+			},
+		},
+		{
+			name: "missing span",
+			corrupt: func(t *testing.T, cm *BadgerCheckpointManager, spans map[uint64]SpanWithResource) {
+				for hash := range spans {
+					require.NoError(t, cm.deleteKeys([][]byte{reservoirSpanKey(2, hash)}))
+					return
+				}
+			},
+		},
+		{
+			name: "damaged manifest",
+			corrupt: func(t *testing.T, cm *BadgerCheckpointManager, _ map[uint64]SpanWithResource) {
+				require.NoError(t, cm.db.Update(func(txn *badger.Txn) error {
+					item, err := txn.Get(manifestKey(2))
+					if err != nil {
+						return err
+					}
+					manifestBytes, err := item.ValueCopy(nil)
+					if err != nil {
+						return err
+					}
+					manifestBytes[10] ^= 0xFF
+					return txn.Set(manifestKey(2), manifestBytes)
+				}))
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "badger")
+			cm := newTestCheckpointManager(t, path)
+
+			startTime := time.Now()
+			endTime := startTime.Add(time.Minute)
+			first := testSpans(5)
+			second := testSpans(8)
+			require.NoError(t, cm.Checkpoint(1, startTime, endTime, 5, first))
+			require.NoError(t, cm.Checkpoint(2, startTime, endTime, 8, second))
+			tt.corrupt(t, cm, second)
+			require.NoError(t, cm.Close())
+
+			cm = newTestCheckpointManager(t, path)
+			defer cm.Close()
+
+			windowID, _, _, windowCount, loaded, err := cm.LoadCheckpoint()
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), windowID)
+			assert.Equal(t, int64(5), windowCount)
+			assert.Len(t, loaded, len(first))
+
+			// The next checkpoint supersedes the damaged generation
+			require.NoError(t, cm.Checkpoint(2, startTime, endTime, 9, second))
+			assert.Equal(t, uint64(3), cm.generation)
+			windowID, _, _, windowCount, loaded, err = cm.LoadCheckpoint()
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), windowID)
+			assert.Equal(t, int64(9), windowCount)
+			assert.Len(t, loaded, len(second))
+		})
+	}
+}
+
+// TestLoadCheckpointNoValidGeneration tests that an error is returned when no generation verifies
+func TestLoadCheckpointNoValidGeneration(t *testing.T) {
+	cm := newTestCheckpointManager(t, filepath.Join(t.TempDir(), "badger"))
+	defer cm.Close()
+
+	require.NoError(t, cm.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(manifestKey(1), []byte("garbage"))
+	}))
+
+	_, _, _, _, _, err := cm.LoadCheckpoint()
+	require.Error(t, err)
+	assert.NotErrorIs(t, err, ErrNoCheckpoint)
+}
+
+// containsHash reports whether a hash is in the slice
+func containsHash(hashes []uint64, hash uint64) bool {
+	for _, h := range hashes {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+// TestReservoirTakeDelta tests that the reservoir tracks added and evicted spans between checkpoints
+func TestReservoirTakeDelta(t *testing.T) {
+	window := NewWindowManager(time.Minute, nil, zap.NewNop())
+	r := NewReservoir(5, window, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+
+	// Span IDs are derived from the sequence number, so every call adds new spans
+	next := 0
+	addSpans := func(n int) {
+		traces := generateTraces(next + n)
+		rss := traces.ResourceSpans()
+		for i := next; i < rss.Len(); i++ {
+			rs := rss.At(i)
+			ss := rs.ScopeSpans().At(0)
+			r.AddSpan(ss.Spans().At(0), rs.Resource(), ss.Scope())
+		}
+		next += n
+	}
+
+	addSpans(5)
+	added, evicted := r.TakeDelta()
+	assert.Len(t, added, 5)
+	assert.Empty(t, evicted)
+
+	// Nothing changed since the previous delta
+	added, evicted = r.TakeDelta()
+	assert.Empty(t, added)
+	assert.Empty(t, evicted)
+
+	// Once full, every added span replaces an evicted one
+	before := r.GetAllSpans()
+	addSpans(200)
+	after := r.GetAllSpans()
+	added, evicted = r.TakeDelta()
+	for hash := range added {
+		assert.Contains(t, after, hash)
+	}
+	for hash := range after {
+		if _, persisted := before[hash]; !persisted {
+			assert.Contains(t, added, hash)
+		}
+	}
+	for hash := range before {
+		if _, kept := after[hash]; !kept {
+			assert.Contains(t, evicted, hash)
+		}
+	}
+
+	// A snapshot supersedes pending mutations
+	addSpans(200)
+	assert.Len(t, r.TakeSnapshot(), 5)
+	added, evicted = r.TakeDelta()
+	assert.Empty(t, added)
+	assert.Empty(t, evicted)
+}
+
+// TestCheckpointBackends tests the behavior every checkpoint backend shares
+func TestCheckpointBackends(t *testing.T) {
+	backends := map[string]func(t *testing.T) CheckpointManager{
+		CheckpointBackendBadger: func(t *testing.T) CheckpointManager {
+			return newTestCheckpointManager(t, filepath.Join(t.TempDir(), "badger"))
+		},
+		CheckpointBackendFile: func(t *testing.T) CheckpointManager {
+			cm, err := NewFileCheckpointManager(
+				filepath.Join(t.TempDir(), "snapshot"),
+				atomic.NewInt64(0),
+				atomic.NewInt64(0),
+				zap.NewNop(),
+			)
+			require.NoError(t, err)
+			return cm
+		},
+		CheckpointBackendMemory: func(t *testing.T) CheckpointManager {
+			return NewMemoryCheckpointManager(atomic.NewInt64(0), zap.NewNop())
+		},
+	}
+
+	for name, newManager := range backends {
+		t.Run(name, func(t *testing.T) {
+			cm := newManager(t)
+			defer cm.Close()
+
+			_, _, _, _, _, err := cm.LoadCheckpoint()
+			assert.ErrorIs(t, err, ErrNoCheckpoint)
+
+			startTime := time.Now().Truncate(time.Second)
+			endTime := startTime.Add(time.Minute)
+			all := testSpans(15)
+			spans := testSpans(10)
+			require.NoError(t, cm.Checkpoint(1, startTime, endTime, 10, spans))
+
+			// Swap one span for one of the five not yet checkpointed
+			added := make(map[uint64]SpanWithResource)
+			for hash, span := range all {
+				if _, exists := spans[hash]; !exists {
+					added[hash] = span
+					spans[hash] = span
+					break
+				}
+			}
+			var removed []uint64
+			for hash := range spans {
+				if _, isNew := added[hash]; !isNew {
+					removed = append(removed, hash)
+					delete(spans, hash)
+					break
+				}
+			}
+			require.NoError(t, cm.CheckpointDelta(1, startTime, endTime, 11, added, removed))
+
+			windowID, loadedStart, loadedEnd, windowCount, loaded, err := cm.LoadCheckpoint()
+			require.NoError(t, err)
+			assert.Equal(t, int64(1), windowID)
+			assert.True(t, startTime.Equal(loadedStart))
+			assert.True(t, endTime.Equal(loadedEnd))
+			assert.Equal(t, int64(11), windowCount)
+			require.Len(t, loaded, len(spans))
+			for hash, want := range spans {
+				require.Contains(t, loaded, hash)
+				assert.Equal(t, want.Span.SpanID(), loaded[hash].Span.SpanID())
+			}
+
+			// A delta for a new window starts from an empty reservoir
+			require.NoError(t, cm.CheckpointDelta(2, endTime, endTime.Add(time.Minute), 1, testSpans(1), nil))
+			windowID, _, _, _, loaded, err = cm.LoadCheckpoint()
+			require.NoError(t, err)
+			assert.Equal(t, int64(2), windowID)
+			assert.Len(t, loaded, 1)
+
+			// The trace buffer is saved alongside, each save replacing the last
+			buffered, err := cm.LoadTraceBuffer()
+			require.NoError(t, err)
+			assert.Empty(t, buffered)
+
+			traces := testBufferedTraces(startTime, 3)
+			require.NoError(t, cm.CheckpointTraceBuffer(traces))
+			require.NoError(t, cm.CheckpointTraceBuffer(traces[1:]))
+			buffered, err = cm.LoadTraceBuffer()
+			require.NoError(t, err)
+			require.Len(t, buffered, 2)
+			for _, trace := range buffered {
+				assert.NotEqual(t, traces[0].TraceID, trace.TraceID)
+				assert.True(t, startTime.Equal(trace.FirstSeen))
+				assert.True(t, startTime.Add(time.Second).Equal(trace.LastUpdated))
+				require.Len(t, trace.Spans, 2)
+				assert.Equal(t, trace.TraceID, trace.Spans[0].Span.TraceID())
+			}
+
+			// A delta only saves the traces changed and removed since
+			changed := testBufferedTraces(startTime.Add(time.Minute), 1)
+			require.NoError(t, cm.CheckpointTraceBufferDelta(changed, []pcommon.TraceID{traces[1].TraceID}))
+			buffered, err = cm.LoadTraceBuffer()
+			require.NoError(t, err)
+			lastUpdated := make(map[pcommon.TraceID]time.Time)
+			for _, trace := range buffered {
+				lastUpdated[trace.TraceID] = trace.LastUpdated
+			}
+			require.Len(t, lastUpdated, 2)
+			assert.True(t, changed[0].LastUpdated.Equal(lastUpdated[traces[0].TraceID]))
+			assert.True(t, traces[2].LastUpdated.Equal(lastUpdated[traces[2].TraceID]))
+		})
+	}
+}
+
+// testBufferedTraces returns traces of two spans each, as the trace buffer
+// checkpoints them
+func testBufferedTraces(lastSeen time.Time, numTraces int) []BufferedTrace {
+	traces := make([]BufferedTrace, 0, numTraces)
+	for i := 1; i <= numTraces; i++ {
+		trace := BufferedTrace{
+			TraceID:     generateTraceID(i),
+			FirstSeen:   lastSeen,
+			LastUpdated: lastSeen.Add(time.Second),
+		}
+		for j := 1; j <= 2; j++ {
+			span := ptrace.NewSpan()
+			span.SetTraceID(trace.TraceID)
+			span.SetSpanID(generateSpanID(j))
+			span.SetName(fmt.Sprintf("span-%d", j))
+			trace.Spans = append(trace.Spans, SpanWithResource{
+				Span:     span,
+				Resource: pcommon.NewResource(),
+				Scope:    pcommon.NewInstrumentationScope(),
+			})
+		}
+		traces = append(traces, trace)
+	}
+	return traces
+}
+
+// TestBufferedTraceRecordsUndo tests that a delta applied to the trace buffer records can be undone
+func TestBufferedTraceRecordsUndo(t *testing.T) {
+	traces := testBufferedTraces(time.Now(), 4)
+	records, err := newBufferedTraceRecords(traces[:3])
+	require.NoError(t, err)
+	original := make(bufferedTraceRecords, len(records))
+	for traceID, record := range records {
+		original[traceID] = record
+	}
+
+	// Change trace 1, remove trace 2, remove and re-add trace 3 and add trace 4
+	changed := testBufferedTraces(time.Now().Add(time.Minute), 4)
+	undo, err := records.applyDelta(
+		[]BufferedTrace{changed[0], changed[2], changed[3]},
+		[]pcommon.TraceID{traces[1].TraceID, traces[2].TraceID})
+	require.NoError(t, err)
+	assert.Len(t, records, 3)
+	assert.NotContains(t, records, traces[1].TraceID)
+	assert.NotEqual(t, original[traces[0].TraceID], records[traces[0].TraceID])
+
+	undo()
+	assert.Equal(t, original, records)
+}
+
+// TestFileCheckpointReopen tests that the snapshot file is replaced atomically and survives a restart
+func TestFileCheckpointReopen(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshot")
+	newManager := func() *FileCheckpointManager {
+		cm, err := NewFileCheckpointManager(path, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+		require.NoError(t, err)
+		return cm
+	}
+
+	startTime := time.Now()
+	endTime := startTime.Add(time.Minute)
+	spans := testSpans(20)
+
+	cm := newManager()
+	require.NoError(t, cm.Checkpoint(3, startTime, endTime, 20, spans))
+	require.NoError(t, cm.Close())
+	assert.NoFileExists(t, path+".tmp")
+
+	// A delta after a restart builds on the snapshot on disk
+	cm = newManager()
+	more := testSpans(21)
+	added := make(map[uint64]SpanWithResource)
+	for hash, span := range more {
+		if _, exists := spans[hash]; !exists {
+			added[hash] = span
+		}
+	}
+	require.NoError(t, cm.CheckpointDelta(3, startTime, endTime, 21, added, nil))
+
+	cm = newManager()
+	windowID, _, _, windowCount, loaded, err := cm.LoadCheckpoint()
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), windowID)
+	assert.Equal(t, int64(21), windowCount)
+	assert.Len(t, loaded, 21)
+
+	// So does a trace buffer delta
+	traces := testBufferedTraces(startTime, 3)
+	require.NoError(t, cm.CheckpointTraceBuffer(traces[:2]))
+	cm = newManager()
+	require.NoError(t, cm.CheckpointTraceBufferDelta(traces[2:], []pcommon.TraceID{traces[0].TraceID}))
+	cm = newManager()
+	buffered, err := cm.LoadTraceBuffer()
+	require.NoError(t, err)
+	require.Len(t, buffered, 2)
+	for _, trace := range buffered {
+		assert.NotEqual(t, traces[0].TraceID, trace.TraceID)
+	}
+}
+
+// TestProcessorRestoresCheckpoint tests that a restarted processor resumes the checkpointed window
+func TestProcessorRestoresCheckpoint(t *testing.T) {
+	for _, backend := range []string{CheckpointBackendBadger, CheckpointBackendFile, CheckpointBackendStorage} {
+		t.Run(backend, func(t *testing.T) {
+			testProcessorRestoresCheckpoint(t, backend)
+		})
+	}
+}
+
+// testProcessorRestoresCheckpoint restarts a processor using the given persistent backend
+func testProcessorRestoresCheckpoint(t *testing.T, backend string) {
+	storageID := component.NewID(component.MustNewType("file_storage"))
+	cfg := &Config{
+		SizeK:               10,
+		WindowDuration:      time.Minute,
+		CheckpointBackend:   backend,
+		CheckpointPath:      filepath.Join(t.TempDir(), "checkpoint"),
+		CheckpointStorage:   &storageID,
+		CheckpointInterval:  time.Minute,
+		ExportQueueSize:     10,
+		CheckpointFullEvery: 3,
+		TraceAware:          false,
+	}
+	set := newTestSettings()
+	ctx := context.Background()
+	host := newTestStorageHost(storageID)
+
+	// First run: fill the reservoir and shut down, which writes a final checkpoint
+	proc, err := newReservoirProcessor(ctx, set, cfg, consumertest.NewNop(), nil)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, host))
+	require.NoError(t, proc.ConsumeTraces(ctx, generateTraces(50)))
+
+	p := proc.(*reservoirProcessor)
+	windowID, _, _, _ := p.windowManager.GetCurrentState()
+	before := p.reservoir.GetAllSpans()
+	require.NoError(t, proc.Shutdown(ctx))
+
+	// Second run: the same window and sample must be restored
+	proc, err = newReservoirProcessor(ctx, set, cfg, consumertest.NewNop(), nil)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, host))
+	defer func() {
+		require.NoError(t, proc.Shutdown(ctx))
+	}()
+
+	p = proc.(*reservoirProcessor)
+	restoredID, _, _, restoredCount := p.windowManager.GetCurrentState()
+	assert.Equal(t, windowID, restoredID)
+	assert.Equal(t, int64(50), restoredCount)
+
+	after := p.reservoir.GetAllSpans()
+	require.Len(t, after, len(before))
+	for hash := range before {
+		assert.Contains(t, after, hash)
+	}
+}
+
+// TestProcessorRestoresTraceBuffer tests that traces waiting in the trace
+// buffer survive a restart and still time out on schedule
+func TestProcessorRestoresTraceBuffer(t *testing.T) {
+	for _, backend := range []string{CheckpointBackendBadger, CheckpointBackendFile, CheckpointBackendStorage} {
+		t.Run(backend, func(t *testing.T) {
+			storageID := component.NewID(component.MustNewType("file_storage"))
+			cfg := &Config{
+				SizeK:               10,
+				WindowDuration:      time.Minute,
+				CheckpointBackend:   backend,
+				CheckpointPath:      filepath.Join(t.TempDir(), "checkpoint"),
+				CheckpointStorage:   &storageID,
+				CheckpointInterval:  time.Minute,
+				ExportQueueSize:     10,
+				CheckpointFullEvery: 10,
+				TraceAware:          true,
+				TraceBufferMaxSize:  100,
+				TraceBufferTimeout:  time.Minute,
+				TraceReservoirUnit:  TraceReservoirUnitSpans,
+			}
+			set := newTestSettings()
+			ctx := context.Background()
+			host := newTestStorageHost(storageID)
+
+			// First run: the traces are still waiting in the buffer at
+			// shutdown, the last of them saved by a delta checkpoint
+			proc, err := newReservoirProcessor(ctx, set, cfg, consumertest.NewNop(), nil)
+			require.NoError(t, err)
+			require.NoError(t, proc.Start(ctx, host))
+			p := proc.(*reservoirProcessor)
+			for i := 1; i <= 3; i++ {
+				require.NoError(t, proc.ConsumeTraces(ctx, newTestTrace(i, 2)))
+				if i == 2 {
+					require.NoError(t, p.checkpoint())
+				}
+			}
+			require.Equal(t, 3, p.traceBuffer.Size())
+			before := p.traceBuffer.Snapshot()
+			require.NoError(t, proc.Shutdown(ctx))
+
+			// Second run: the buffer is restored with its arrival times
+			proc, err = newReservoirProcessor(ctx, set, cfg, consumertest.NewNop(), nil)
+			require.NoError(t, err)
+			require.NoError(t, proc.Start(ctx, host))
+			defer func() {
+				require.NoError(t, proc.Shutdown(ctx))
+			}()
+
+			p = proc.(*reservoirProcessor)
+			assert.Equal(t, 3, p.traceBuffer.Size())
+			assert.Equal(t, 6, p.traceBuffer.SpanCount())
+			after := p.traceBuffer.Snapshot()
+			require.Len(t, after, len(before))
+			lastUpdated := make(map[pcommon.TraceID]time.Time)
+			for _, trace := range before {
+				lastUpdated[trace.TraceID] = trace.LastUpdated
+			}
+			for _, trace := range after {
+				require.Contains(t, lastUpdated, trace.TraceID)
+				assert.True(t, lastUpdated[trace.TraceID].Equal(trace.LastUpdated))
+			}
+		})
+	}
+}
+
+// TestProcessorStorageExtensionMissing tests that Start fails when the storage extension is not configured
+func TestProcessorStorageExtensionMissing(t *testing.T) {
+	storageID := component.NewID(component.MustNewType("file_storage"))
+	cfg := &Config{
+		SizeK:              10,
+		WindowDuration:     time.Minute,
+		CheckpointBackend:  CheckpointBackendStorage,
+		CheckpointStorage:  &storageID,
+		CheckpointInterval: time.Minute,
+		ExportQueueSize:    10,
+	}
+	ctx := context.Background()
+
+	proc, err := newReservoirProcessor(ctx, newTestSettings(), cfg, consumertest.NewNop(), nil)
+	require.NoError(t, err)
+	other := component.NewIDWithName(component.MustNewType("file_storage"), "other")
+	assert.Error(t, proc.Start(ctx, newTestStorageHost(other)))
+}
+
+// testStorageHost is a component.Host offering a single storage extension
+type testStorageHost struct {
+	extensions map[component.ID]component.Component
+}
+
+// newTestStorageHost returns a host with an in-memory storage extension under the given ID
+func newTestStorageHost(id component.ID) *testStorageHost {
+	return &testStorageHost{
+		extensions: map[component.ID]component.Component{
+			id: &testStorageExtension{client: &memoryStorageClient{values: make(map[string][]byte)}},
+		},
+	}
+}
+
+func (h *testStorageHost) GetExtensions() map[component.ID]component.Component {
+	return h.extensions
+}
+
+// testStorageExtension is a storage extension handing out one shared client
+// and recording the kind of the component that asked for it last
+type testStorageExtension struct {
+	component.StartFunc
+	component.ShutdownFunc
+	client *memoryStorageClient
+	kind   component.Kind
+}
+
+func (e *testStorageExtension) GetClient(_ context.Context, kind component.Kind, _ component.ID, _ string) (storage.Client, error) {
+	e.kind = kind
+	return e.client, nil
+}
+
+// memoryStorageClient is a storage.Client keeping values in a map
+type memoryStorageClient struct {
+	mu     sync.Mutex
+	values map[string][]byte
+}
+
+func (c *memoryStorageClient) Get(_ context.Context, key string) ([]byte, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.values[key], nil
+}
+
+func (c *memoryStorageClient) Set(_ context.Context, key string, value []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[key] = append([]byte(nil), value...)
+	return nil
+}
+
+func (c *memoryStorageClient) Delete(_ context.Context, key string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.values, key)
+	return nil
+}
+
+func (c *memoryStorageClient) Batch(context.Context, ...*storage.Operation) error {
+	return errors.New("batch not supported")
+}
+
+func (c *memoryStorageClient) Close(context.Context) error {
+	return nil
+}
@@ -2,35 +2,266 @@ package reservoirsampler
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"time"
 
 	"go.opentelemetry.io/collector/component"
 )
 
+// Checkpoint backends
+const (
+	// CheckpointBackendBadger stores checkpoints in a Badger database
+	CheckpointBackendBadger = "badger"
+
+	// CheckpointBackendFile stores each checkpoint as a single compressed file
+	CheckpointBackendFile = "file"
+
+	// CheckpointBackendMemory keeps checkpoints in memory only
+	CheckpointBackendMemory = "memory"
+
+	// CheckpointBackendStorage stores checkpoints through a collector storage extension
+	CheckpointBackendStorage = "storage"
+)
+
+// Strata capacity policies
+const (
+	// StrataPolicyEqual gives every stratum the same capacity
+	StrataPolicyEqual = "equal"
+
+	// StrataPolicyProportional gives strata capacity in proportion to their traffic, above a floor
+	StrataPolicyProportional = "proportional"
+
+	// StrataPolicyQuota gives listed strata a fixed capacity and splits the rest evenly
+	StrataPolicyQuota = "quota"
+
+	// StratifyBySpanKind stratifies spans by their span kind rather than an attribute
+	StratifyBySpanKind = "span.kind"
+)
+
+// Uniform reservoir sampling algorithms
+const (
+	// ReservoirAlgorithmR draws a random number for every span once the reservoir is full
+	ReservoirAlgorithmR = "r"
+
+	// ReservoirAlgorithmL draws how many spans to skip between replacements,
+	// so most spans cost a counter check
+	ReservoirAlgorithmL = "l"
+)
+
+// Trace reservoir capacity units
+const (
+	// TraceReservoirUnitSpans counts the trace reservoir capacity in spans
+	TraceReservoirUnitSpans = "spans"
+
+	// TraceReservoirUnitTraces counts the trace reservoir capacity in traces
+	TraceReservoirUnitTraces = "traces"
+)
+
+// Trace completion strategies
+const (
+	// TraceCompletionRootSpan completes a trace once its root span has arrived
+	// and no span is missing from its parent-child graph
+	TraceCompletionRootSpan = "root_span"
+
+	// TraceCompletionSpanCount completes a trace once it has the number of
+	// spans given by expected_span_count_attribute
+	TraceCompletionSpanCount = "span_count"
+
+	// TraceCompletionMaxAge completes a trace trace_max_age after its first span
+	TraceCompletionMaxAge = "max_age"
+)
+
+// Window modes
+const (
+	// WindowModeTumbling samples each window on its own, starting empty
+	WindowModeTumbling = "tumbling"
+
+	// WindowModeSliding samples the spans of the last sliding_window
+	WindowModeSliding = "sliding"
+
+	// WindowModeDecaying samples all spans, with weights halving every decay_half_life
+	WindowModeDecaying = "decaying"
+)
+
 // Config defines configuration for the reservoir sampler processor.
 type Config struct {
 	// SizeK is the max number of spans to store in the reservoir
 	SizeK int `mapstructure:"size_k"`
 
+	// ReservoirShards splits the reservoir into shards, each with its own
+	// lock and an even share of size_k, that spans are spread over at random
+	// so they can be added in parallel; 0 or 1 keeps a single reservoir. Only
+	// the span reservoir of the tumbling window mode can be sharded.
+	ReservoirShards int `mapstructure:"reservoir_shards"`
+
+	// ReservoirAlgorithm selects the uniform sampling algorithm of the span
+	// reservoir: r (Algorithm R) or l (Algorithm L). Both keep each span
+	// with the same probability.
+	ReservoirAlgorithm string `mapstructure:"reservoir_algorithm"`
+
 	// WindowDuration is the duration of each sampling window
 	WindowDuration time.Duration `mapstructure:"window_duration"`
 
+	// AlignWindows starts windows on multiples of window_duration since the
+	// Unix epoch, so every replica has the same window boundaries and IDs
+	AlignWindows bool `mapstructure:"align_windows"`
+
+	// WindowMode selects how the reservoir spans windows: tumbling, sliding or decaying
+	WindowMode string `mapstructure:"window_mode"`
+
+	// SlidingWindow is the span of time the sliding reservoir samples,
+	// rounded up to whole windows
+	SlidingWindow time.Duration `mapstructure:"sliding_window"`
+
+	// DecayHalfLife is the age at which a span's weight has halved in the decaying reservoir
+	DecayHalfLife time.Duration `mapstructure:"decay_half_life"`
+
+	// CheckpointBackend selects where checkpoints are stored: badger, file, memory or storage
+	CheckpointBackend string `mapstructure:"checkpoint_backend"`
+
+	// CheckpointStorage is the ID of the storage extension used by the storage backend
+	CheckpointStorage *component.ID `mapstructure:"checkpoint_storage"`
+
 	// CheckpointPath is the file path to use for reservoir checkpoints
 	CheckpointPath string `mapstructure:"checkpoint_path"`
 
 	// CheckpointInterval is how often to checkpoint the reservoir state to disk
 	CheckpointInterval time.Duration `mapstructure:"checkpoint_interval"`
 
+	// CheckpointFullEvery makes every Nth checkpoint a full snapshot; the ones
+	// in between only persist the spans added and evicted, and the buffered
+	// traces changed and removed, since the previous one
+	CheckpointFullEvery int `mapstructure:"checkpoint_full_every"`
+
+	// CheckpointRetainedWindows is how many closed windows to keep on disk
+	// for forensics before their checkpoint data is deleted
+	CheckpointRetainedWindows int `mapstructure:"checkpoint_retained_windows"`
+
+	// WeightedSampling keeps spans with a probability proportional to their
+	// weight instead of uniformly
+	WeightedSampling bool `mapstructure:"weighted_sampling"`
+
+	// ErrorSpanWeight is the weight factor of spans with error status
+	ErrorSpanWeight float64 `mapstructure:"error_span_weight"`
+
+	// SlowSpanThreshold is the duration from which a span counts as slow; 0 disables it
+	SlowSpanThreshold time.Duration `mapstructure:"slow_span_threshold"`
+
+	// SlowSpanWeight is the weight factor of slow spans
+	SlowSpanWeight float64 `mapstructure:"slow_span_weight"`
+
+	// AttributeWeights are weight factors for spans with given attribute values
+	AttributeWeights []AttributeWeight `mapstructure:"attribute_weights"`
+
+	// StratifyBy partitions spans into strata, each sampled in its own
+	// reservoir, by a span or resource attribute or by span.kind; empty disables it
+	StratifyBy string `mapstructure:"stratify_by"`
+
+	// StrataPolicy divides the reservoir size between strata: equal, proportional or quota
+	StrataPolicy string `mapstructure:"strata_policy"`
+
+	// StrataMinSize is the capacity every stratum gets under the proportional policy
+	StrataMinSize int `mapstructure:"strata_min_size"`
+
+	// StrataQuotas are the capacities of listed strata under the quota policy
+	StrataQuotas map[string]int `mapstructure:"strata_quotas"`
+
+	// MaxStrata limits the number of strata; spans of further strata share one
+	MaxStrata int `mapstructure:"max_strata"`
+
+	// ExportQueueSize is how many closed windows can wait for export; when
+	// the queue is full, further windows are dropped
+	ExportQueueSize int `mapstructure:"export_queue_size"`
+
+	// ExportQueuePath is the directory of a Badger database that keeps closed
+	// windows until they are exported, across restarts; empty keeps them in
+	// memory only
+	ExportQueuePath string `mapstructure:"export_queue_path"`
+
+	// ExportRetryInitialInterval is the wait before retrying a failed export,
+	// doubled after each further failure; 0 disables retries. Windows
+	// persisted in export_queue_path are then tried again after
+	// export_retry_max_interval, or 30s if it is 0.
+	ExportRetryInitialInterval time.Duration `mapstructure:"export_retry_initial_interval"`
+
+	// ExportRetryMaxInterval caps the wait between export retries
+	ExportRetryMaxInterval time.Duration `mapstructure:"export_retry_max_interval"`
+
+	// ExportRetryMaxElapsedTime is how long a window's export is retried
+	// before it is dropped; 0 retries until shutdown. Windows persisted in
+	// export_queue_path are retried for that long after they closed, across
+	// restarts, and until they are exported if it is 0.
+	ExportRetryMaxElapsedTime time.Duration `mapstructure:"export_retry_max_elapsed_time"`
+
+	// AdjustedCountAttribute, if set, is the span attribute exported spans
+	// carry their adjusted count in: the number of spans each one stands for.
+	// The sampling probability is always recorded in the tracestate.
+	AdjustedCountAttribute string `mapstructure:"adjusted_count_attribute"`
+
+	// SummaryDurationBuckets are the bucket bounds of the span duration
+	// histogram in the per-window summary sent to the metrics consumer.
+	// Only the connector has a metrics consumer; the processor ignores them.
+	SummaryDurationBuckets []time.Duration `mapstructure:"summary_duration_buckets"`
+
 	// TraceAware determines whether to use trace-aware sampling
 	TraceAware bool `mapstructure:"trace_aware"`
 
 	// TraceBufferMaxSize is the maximum number of traces to keep in memory at once
 	TraceBufferMaxSize int `mapstructure:"trace_buffer_max_size"`
 
+	// TraceBufferMaxBytes is the most memory, in estimated bytes, the trace
+	// buffer holds before evicting the least recently used traces; 0 means no
+	// limit
+	TraceBufferMaxBytes int64 `mapstructure:"trace_buffer_max_bytes"`
+
+	// TraceMaxSpans caps the spans buffered of any one trace, dropping the
+	// rest; 0 means no limit
+	TraceMaxSpans int `mapstructure:"trace_max_spans"`
+
+	// TraceMaxBytes caps the estimated bytes buffered of any one trace,
+	// dropping the spans past it; 0 means no limit
+	TraceMaxBytes int64 `mapstructure:"trace_max_bytes"`
+
+	// TraceBufferShards is the number of shards the trace buffer is split
+	// into by trace ID, each with its own lock and an even share of the
+	// buffer's limits; 0 means one per CPU
+	TraceBufferShards int `mapstructure:"trace_buffer_shards"`
+
+	// TraceBufferSpill parks traces evicted from the trace buffer in the
+	// Badger checkpoint database rather than dropping them; they keep
+	// collecting spans there until they complete
+	TraceBufferSpill bool `mapstructure:"trace_buffer_spill"`
+
+	// TraceBufferSpillMaxBytes is the most estimated span bytes the spill
+	// tier holds; traces evicted while it is full are dropped, as are spans
+	// of spilled traces that would take it past the limit. 0 means no limit.
+	TraceBufferSpillMaxBytes int64 `mapstructure:"trace_buffer_spill_max_bytes"`
+
 	// TraceBufferTimeout is how long to wait for a trace to complete
 	TraceBufferTimeout time.Duration `mapstructure:"trace_buffer_timeout"`
 
+	// TraceCompletion lists the strategies that can complete a buffered trace
+	// before trace_buffer_timeout of inactivity: root_span, span_count and
+	// max_age. A trace completes as soon as any of them, or the timeout, says so.
+	TraceCompletion []string `mapstructure:"trace_completion"`
+
+	// TraceCompletionGrace is how long root_span waits for late spans once a
+	// trace looks complete, counted from its last span
+	TraceCompletionGrace time.Duration `mapstructure:"trace_completion_grace"`
+
+	// ExpectedSpanCountAttribute is the span attribute that span_count reads
+	// the number of spans in a trace from
+	ExpectedSpanCountAttribute string `mapstructure:"expected_span_count_attribute"`
+
+	// TraceMaxAge is how long max_age lets a trace stay in the buffer after
+	// its first span, however busy it is
+	TraceMaxAge time.Duration `mapstructure:"trace_max_age"`
+
+	// TraceReservoirUnit is the unit of size_k in trace-aware mode, where the
+	// reservoir keeps whole traces: spans or traces
+	TraceReservoirUnit string `mapstructure:"trace_reservoir_unit"`
+
 	// DbCompactionScheduleCron is the cron schedule for DB compaction
 	DbCompactionScheduleCron string `mapstructure:"db_compaction_schedule_cron"`
 
@@ -51,22 +282,228 @@ func (cfg *Config) Validate() error {
 		return fmt.Errorf("window_duration must be positive, got %s", cfg.WindowDuration)
 	}
 
-	if cfg.CheckpointPath == "" {
-		return fmt.Errorf("checkpoint_path must be specified")
+	switch cfg.WindowMode {
+	case WindowModeTumbling:
+	case WindowModeSliding:
+		if cfg.SlidingWindow < cfg.WindowDuration {
+			return fmt.Errorf("sliding_window must be at least window_duration %s, got %s", cfg.WindowDuration, cfg.SlidingWindow)
+		}
+	case WindowModeDecaying:
+		if cfg.DecayHalfLife <= 0 {
+			return fmt.Errorf("decay_half_life must be positive in the %s window mode, got %s", cfg.WindowMode, cfg.DecayHalfLife)
+		}
+	default:
+		return fmt.Errorf("window_mode must be one of %s, %s or %s, got %q",
+			WindowModeTumbling, WindowModeSliding, WindowModeDecaying, cfg.WindowMode)
+	}
+
+	if cfg.WindowMode != WindowModeTumbling && cfg.StratifyBy != "" {
+		return fmt.Errorf("stratify_by is not supported in the %s window mode", cfg.WindowMode)
+	}
+
+	switch cfg.ReservoirAlgorithm {
+	case ReservoirAlgorithmR:
+	case ReservoirAlgorithmL:
+		switch {
+		case cfg.WindowMode != WindowModeTumbling:
+			return fmt.Errorf("reservoir_algorithm %s is not supported in the %s window mode", cfg.ReservoirAlgorithm, cfg.WindowMode)
+		case cfg.TraceAware:
+			return fmt.Errorf("reservoir_algorithm %s is not supported in trace-aware mode", cfg.ReservoirAlgorithm)
+		case cfg.WeightedSampling:
+			return fmt.Errorf("reservoir_algorithm %s is not supported with weighted sampling, which skips spans already", cfg.ReservoirAlgorithm)
+		}
+	default:
+		return fmt.Errorf("reservoir_algorithm must be %s or %s, got %q",
+			ReservoirAlgorithmR, ReservoirAlgorithmL, cfg.ReservoirAlgorithm)
+	}
+
+	if cfg.ReservoirShards < 0 {
+		return fmt.Errorf("reservoir_shards must not be negative, got %d", cfg.ReservoirShards)
+	}
+	if cfg.ReservoirShards > 1 {
+		switch {
+		case cfg.WindowMode != WindowModeTumbling:
+			return fmt.Errorf("reservoir_shards is not supported in the %s window mode", cfg.WindowMode)
+		case cfg.StratifyBy != "":
+			return errors.New("reservoir_shards is not supported with stratify_by")
+		case cfg.TraceAware:
+			return errors.New("reservoir_shards is not supported in trace-aware mode")
+		}
+	}
+
+	switch cfg.CheckpointBackend {
+	case CheckpointBackendBadger, CheckpointBackendFile:
+		if cfg.CheckpointPath == "" {
+			return fmt.Errorf("checkpoint_path must be specified for the %s checkpoint backend", cfg.CheckpointBackend)
+		}
+	case CheckpointBackendMemory:
+	case CheckpointBackendStorage:
+		if cfg.CheckpointStorage == nil {
+			return fmt.Errorf("checkpoint_storage must name a storage extension for the %s checkpoint backend", cfg.CheckpointBackend)
+		}
+	default:
+		return fmt.Errorf("checkpoint_backend must be one of %s, %s, %s or %s, got %q",
+			CheckpointBackendBadger, CheckpointBackendFile, CheckpointBackendMemory, CheckpointBackendStorage, cfg.CheckpointBackend)
 	}
 
 	if cfg.CheckpointInterval <= 0 {
 		return fmt.Errorf("checkpoint_interval must be positive, got %s", cfg.CheckpointInterval)
 	}
 
+	if cfg.CheckpointFullEvery <= 0 {
+		return fmt.Errorf("checkpoint_full_every must be greater than 0, got %d", cfg.CheckpointFullEvery)
+	}
+
+	if cfg.CheckpointRetainedWindows < 0 {
+		return fmt.Errorf("checkpoint_retained_windows must not be negative, got %d", cfg.CheckpointRetainedWindows)
+	}
+
+	if cfg.ExportQueueSize <= 0 {
+		return fmt.Errorf("export_queue_size must be greater than 0, got %d", cfg.ExportQueueSize)
+	}
+
+	if cfg.ExportRetryInitialInterval < 0 {
+		return fmt.Errorf("export_retry_initial_interval must not be negative, got %s", cfg.ExportRetryInitialInterval)
+	}
+
+	if cfg.ExportRetryMaxInterval < cfg.ExportRetryInitialInterval {
+		return fmt.Errorf("export_retry_max_interval must be at least export_retry_initial_interval %s, got %s",
+			cfg.ExportRetryInitialInterval, cfg.ExportRetryMaxInterval)
+	}
+
+	if cfg.ExportRetryMaxElapsedTime < 0 {
+		return fmt.Errorf("export_retry_max_elapsed_time must not be negative, got %s", cfg.ExportRetryMaxElapsedTime)
+	}
+
+	if cfg.WeightedSampling {
+		if cfg.ErrorSpanWeight <= 0 {
+			return fmt.Errorf("error_span_weight must be positive, got %g", cfg.ErrorSpanWeight)
+		}
+
+		if cfg.SlowSpanThreshold < 0 {
+			return fmt.Errorf("slow_span_threshold must not be negative, got %s", cfg.SlowSpanThreshold)
+		}
+
+		if cfg.SlowSpanWeight <= 0 {
+			return fmt.Errorf("slow_span_weight must be positive, got %g", cfg.SlowSpanWeight)
+		}
+
+		for i, aw := range cfg.AttributeWeights {
+			if aw.Key == "" {
+				return fmt.Errorf("attribute_weights[%d]: key must be specified", i)
+			}
+			if aw.Weight <= 0 {
+				return fmt.Errorf("attribute_weights[%d]: weight must be positive, got %g", i, aw.Weight)
+			}
+		}
+	}
+
+	if cfg.StratifyBy != "" {
+		switch cfg.StrataPolicy {
+		case StrataPolicyEqual, StrataPolicyProportional, StrataPolicyQuota:
+		default:
+			return fmt.Errorf("strata_policy must be one of %s, %s or %s, got %q",
+				StrataPolicyEqual, StrataPolicyProportional, StrataPolicyQuota, cfg.StrataPolicy)
+		}
+
+		if cfg.StrataMinSize < 0 {
+			return fmt.Errorf("strata_min_size must not be negative, got %d", cfg.StrataMinSize)
+		}
+
+		if cfg.MaxStrata <= 0 {
+			return fmt.Errorf("max_strata must be greater than 0, got %d", cfg.MaxStrata)
+		}
+
+		reserved := 0
+		for key, quota := range cfg.StrataQuotas {
+			if quota <= 0 {
+				return fmt.Errorf("strata_quotas[%q]: quota must be positive, got %d", key, quota)
+			}
+			reserved += quota
+		}
+		if reserved > cfg.SizeK {
+			return fmt.Errorf("strata_quotas reserve %d spans, more than size_k %d", reserved, cfg.SizeK)
+		}
+	}
+
+	for i, bucket := range cfg.SummaryDurationBuckets {
+		if bucket <= 0 {
+			return fmt.Errorf("summary_duration_buckets[%d] must be positive, got %s", i, bucket)
+		}
+		if i > 0 && bucket <= cfg.SummaryDurationBuckets[i-1] {
+			return fmt.Errorf("summary_duration_buckets must be increasing, got %s after %s", bucket, cfg.SummaryDurationBuckets[i-1])
+		}
+	}
+
 	if cfg.TraceAware {
 		if cfg.TraceBufferMaxSize <= 0 {
 			return fmt.Errorf("trace_buffer_max_size must be greater than 0 when trace_aware is true, got %d", cfg.TraceBufferMaxSize)
 		}
 
+		if cfg.TraceBufferMaxBytes < 0 {
+			return fmt.Errorf("trace_buffer_max_bytes must not be negative, got %d", cfg.TraceBufferMaxBytes)
+		}
+
+		if cfg.TraceMaxSpans < 0 {
+			return fmt.Errorf("trace_max_spans must not be negative, got %d", cfg.TraceMaxSpans)
+		}
+
+		if cfg.TraceMaxBytes < 0 {
+			return fmt.Errorf("trace_max_bytes must not be negative, got %d", cfg.TraceMaxBytes)
+		}
+
+		if cfg.TraceBufferShards < 0 {
+			return fmt.Errorf("trace_buffer_shards must not be negative, got %d", cfg.TraceBufferShards)
+		}
+
+		if cfg.TraceBufferMaxBytes > 0 && cfg.TraceMaxBytes > cfg.TraceBufferMaxBytes {
+			return fmt.Errorf("trace_max_bytes %d must not exceed trace_buffer_max_bytes %d", cfg.TraceMaxBytes, cfg.TraceBufferMaxBytes)
+		}
+
+		if cfg.TraceBufferSpill && (cfg.CheckpointBackend != CheckpointBackendBadger || cfg.CheckpointPath == "") {
+			return fmt.Errorf("trace_buffer_spill needs the %s checkpoint_backend with a checkpoint_path", CheckpointBackendBadger)
+		}
+
+		if cfg.TraceBufferSpillMaxBytes < 0 {
+			return fmt.Errorf("trace_buffer_spill_max_bytes must not be negative, got %d", cfg.TraceBufferSpillMaxBytes)
+		}
+
 		if cfg.TraceBufferTimeout <= 0 {
 			return fmt.Errorf("trace_buffer_timeout must be positive when trace_aware is true, got %s", cfg.TraceBufferTimeout)
 		}
+
+		seen := make(map[string]bool, len(cfg.TraceCompletion))
+		for _, strategy := range cfg.TraceCompletion {
+			if seen[strategy] {
+				return fmt.Errorf("trace_completion lists %q more than once", strategy)
+			}
+			seen[strategy] = true
+
+			switch strategy {
+			case TraceCompletionRootSpan:
+				if cfg.TraceCompletionGrace < 0 {
+					return fmt.Errorf("trace_completion_grace must not be negative, got %s", cfg.TraceCompletionGrace)
+				}
+			case TraceCompletionSpanCount:
+				if cfg.ExpectedSpanCountAttribute == "" {
+					return fmt.Errorf("expected_span_count_attribute must be set for the %s trace completion", TraceCompletionSpanCount)
+				}
+			case TraceCompletionMaxAge:
+				if cfg.TraceMaxAge <= 0 {
+					return fmt.Errorf("trace_max_age must be positive for the %s trace completion, got %s", TraceCompletionMaxAge, cfg.TraceMaxAge)
+				}
+			default:
+				return fmt.Errorf("trace_completion must list %s, %s or %s, got %q",
+					TraceCompletionRootSpan, TraceCompletionSpanCount, TraceCompletionMaxAge, strategy)
+			}
+		}
+
+		switch cfg.TraceReservoirUnit {
+		case TraceReservoirUnitSpans, TraceReservoirUnitTraces:
+		default:
+			return fmt.Errorf("trace_reservoir_unit must be %s or %s, got %q",
+				TraceReservoirUnitSpans, TraceReservoirUnitTraces, cfg.TraceReservoirUnit)
+		}
 	}
 
 	return nil
@@ -81,11 +518,27 @@ func (cfg *Config) MarshalJSON() ([]byte, error) {
 		WindowDuration     string `json:"window_duration"`
 		CheckpointInterval string `json:"checkpoint_interval"`
 		TraceBufferTimeout string `json:"trace_buffer_timeout"`
+		SlowSpanThreshold  string `json:"slow_span_threshold"`
+		SlidingWindow      string `json:"sliding_window"`
+		DecayHalfLife      string `json:"decay_half_life"`
+		RetryInitial       string `json:"export_retry_initial_interval"`
+		RetryMax           string `json:"export_retry_max_interval"`
+		RetryMaxElapsed    string `json:"export_retry_max_elapsed_time"`
+		CompletionGrace    string `json:"trace_completion_grace"`
+		TraceMaxAge        string `json:"trace_max_age"`
 		*Alias
 	}{
 		WindowDuration:     cfg.WindowDuration.String(),
 		CheckpointInterval: cfg.CheckpointInterval.String(),
 		TraceBufferTimeout: cfg.TraceBufferTimeout.String(),
+		SlowSpanThreshold:  cfg.SlowSpanThreshold.String(),
+		SlidingWindow:      cfg.SlidingWindow.String(),
+		DecayHalfLife:      cfg.DecayHalfLife.String(),
+		RetryInitial:       cfg.ExportRetryInitialInterval.String(),
+		RetryMax:           cfg.ExportRetryMaxInterval.String(),
+		RetryMaxElapsed:    cfg.ExportRetryMaxElapsedTime.String(),
+		CompletionGrace:    cfg.TraceCompletionGrace.String(),
+		TraceMaxAge:        cfg.TraceMaxAge.String(),
 		Alias:              (*Alias)(cfg),
 	}
 	
@@ -101,6 +554,14 @@ func (cfg *Config) UnmarshalJSON(data []byte) error {
 		WindowDuration     string `json:"window_duration"`
 		CheckpointInterval string `json:"checkpoint_interval"`
 		TraceBufferTimeout string `json:"trace_buffer_timeout"`
+		SlowSpanThreshold  string `json:"slow_span_threshold"`
+		SlidingWindow      string `json:"sliding_window"`
+		DecayHalfLife      string `json:"decay_half_life"`
+		RetryInitial       string `json:"export_retry_initial_interval"`
+		RetryMax           string `json:"export_retry_max_interval"`
+		RetryMaxElapsed    string `json:"export_retry_max_elapsed_time"`
+		CompletionGrace    string `json:"trace_completion_grace"`
+		TraceMaxAge        string `json:"trace_max_age"`
 		*Alias
 	}{
 		Alias: (*Alias)(cfg),
@@ -133,20 +594,111 @@ func (cfg *Config) UnmarshalJSON(data []byte) error {
 		}
 	}
 	
+	if aux.SlowSpanThreshold != "" {
+		cfg.SlowSpanThreshold, err = time.ParseDuration(aux.SlowSpanThreshold)
+		if err != nil {
+			return fmt.Errorf("invalid slow_span_threshold: %w", err)
+		}
+	}
+	
+	if aux.SlidingWindow != "" {
+		cfg.SlidingWindow, err = time.ParseDuration(aux.SlidingWindow)
+		if err != nil {
+			return fmt.Errorf("invalid sliding_window: %w", err)
+		}
+	}
+	
+	if aux.DecayHalfLife != "" {
+		cfg.DecayHalfLife, err = time.ParseDuration(aux.DecayHalfLife)
+		if err != nil {
+			return fmt.Errorf("invalid decay_half_life: %w", err)
+		}
+	}
+	
+	if aux.RetryInitial != "" {
+		cfg.ExportRetryInitialInterval, err = time.ParseDuration(aux.RetryInitial)
+		if err != nil {
+			return fmt.Errorf("invalid export_retry_initial_interval: %w", err)
+		}
+	}
+	
+	if aux.RetryMax != "" {
+		cfg.ExportRetryMaxInterval, err = time.ParseDuration(aux.RetryMax)
+		if err != nil {
+			return fmt.Errorf("invalid export_retry_max_interval: %w", err)
+		}
+	}
+	
+	if aux.RetryMaxElapsed != "" {
+		cfg.ExportRetryMaxElapsedTime, err = time.ParseDuration(aux.RetryMaxElapsed)
+		if err != nil {
+			return fmt.Errorf("invalid export_retry_max_elapsed_time: %w", err)
+		}
+	}
+	
+	if aux.CompletionGrace != "" {
+		cfg.TraceCompletionGrace, err = time.ParseDuration(aux.CompletionGrace)
+		if err != nil {
+			return fmt.Errorf("invalid trace_completion_grace: %w", err)
+		}
+	}
+	
+	if aux.TraceMaxAge != "" {
+		cfg.TraceMaxAge, err = time.ParseDuration(aux.TraceMaxAge)
+		if err != nil {
+			return fmt.Errorf("invalid trace_max_age: %w", err)
+		}
+	}
+	
 	return nil
 }
 
 // CreateDefaultConfig creates the default configuration for the processor.
 func createDefaultConfig() component.Config {
 	return &Config{
-		SizeK:                    5000,
-		WindowDuration:           60 * time.Second,
-		CheckpointPath:           "",
-		CheckpointInterval:       10 * time.Second,
-		TraceAware:               true,
-		TraceBufferMaxSize:       100000,
-		TraceBufferTimeout:       10 * time.Second,
-		DbCompactionScheduleCron: "",
-		DbCompactionTargetSize:   0,
+		SizeK:                      5000,
+		ReservoirShards:            0,
+		ReservoirAlgorithm:         ReservoirAlgorithmR,
+		WindowDuration:             60 * time.Second,
+		AlignWindows:               false,
+		WindowMode:                 WindowModeTumbling,
+		SlidingWindow:              0,
+		DecayHalfLife:              0,
+		CheckpointBackend:          CheckpointBackendBadger,
+		CheckpointPath:             "",
+		CheckpointInterval:         10 * time.Second,
+		CheckpointFullEvery:        10,
+		CheckpointRetainedWindows:  0,
+		WeightedSampling:           false,
+		ErrorSpanWeight:            1,
+		SlowSpanThreshold:          0,
+		SlowSpanWeight:             1,
+		StratifyBy:                 "",
+		StrataPolicy:               StrataPolicyEqual,
+		StrataMinSize:              10,
+		MaxStrata:                  100,
+		ExportQueueSize:            10,
+		ExportQueuePath:            "",
+		ExportRetryInitialInterval: time.Second,
+		ExportRetryMaxInterval:     30 * time.Second,
+		ExportRetryMaxElapsedTime:  5 * time.Minute,
+		AdjustedCountAttribute:     "",
+		SummaryDurationBuckets:     defaultSummaryDurationBuckets,
+		TraceAware:                 true,
+		TraceBufferMaxSize:         100000,
+		TraceBufferMaxBytes:        256 << 20,
+		TraceMaxSpans:              0,
+		TraceMaxBytes:              0,
+		TraceBufferShards:          0,
+		TraceBufferSpill:           false,
+		TraceBufferSpillMaxBytes:   1 << 30,
+		TraceBufferTimeout:         10 * time.Second,
+		TraceCompletion:            nil,
+		TraceCompletionGrace:       time.Second,
+		ExpectedSpanCountAttribute: "trace.expected_span_count",
+		TraceMaxAge:                5 * time.Minute,
+		TraceReservoirUnit:         TraceReservoirUnitSpans,
+		DbCompactionScheduleCron:   "",
+		DbCompactionTargetSize:     0,
 	}
 }
\ No newline at end of file
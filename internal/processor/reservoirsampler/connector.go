@@ -0,0 +1,138 @@
+package reservoirsampler
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/connector"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.opentelemetry.io/collector/processor"
+)
+
+// The collector creates a connector once for each pair of pipeline types it
+// joins, so the traces and metrics outputs of one configured connector are
+// two components. Both share a single sampler, keyed by their config.
+var (
+	connectorsMu sync.Mutex
+	connectors   = make(map[*Config]*reservoirConnector)
+)
+
+// reservoirConnector is the sampler shared by the outputs of one connector
+type reservoirConnector struct {
+	set connector.Settings
+	cfg *Config
+
+	// Consumers of the outputs created so far
+	tracesConsumer  consumer.Traces
+	metricsConsumer consumer.Metrics
+
+	// Sampler, created when the first output starts
+	processor processor.Traces
+	running   int
+
+	// Synchronization
+	mu sync.RWMutex
+}
+
+// connectorOutput is the component of one output of a reservoir connector
+type connectorOutput struct {
+	connector *reservoirConnector
+	traces    bool
+}
+
+// Ensure the connector outputs implement required interfaces
+var _ connector.Traces = (*connectorOutput)(nil)
+
+// getReservoirConnector returns the connector for cfg, creating it on first use
+func getReservoirConnector(set connector.Settings, cfg *Config) *reservoirConnector {
+	connectorsMu.Lock()
+	defer connectorsMu.Unlock()
+
+	c, ok := connectors[cfg]
+	if !ok {
+		c = &reservoirConnector{set: set, cfg: cfg}
+		connectors[cfg] = c
+	}
+	return c
+}
+
+// Start implements the Component interface. The first output to start
+// creates and starts the sampler, once every output has been created.
+func (o *connectorOutput) Start(ctx context.Context, host component.Host) error {
+	c := o.connector
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running == 0 {
+		nextConsumer := c.tracesConsumer
+		if nextConsumer == nil {
+			// Without a traces output the sample is dropped
+			nextConsumer, _ = consumer.NewTraces(func(context.Context, ptrace.Traces) error { return nil })
+		}
+
+		proc, err := newReservoirSampler(ctx, processor.Settings{
+			ID:                c.set.ID,
+			TelemetrySettings: c.set.TelemetrySettings,
+			BuildInfo:         c.set.BuildInfo,
+		}, component.KindConnector, c.cfg, nextConsumer, c.metricsConsumer)
+		if err != nil {
+			return fmt.Errorf("failed to create reservoir sampler: %w", err)
+		}
+		if err := proc.Start(ctx, host); err != nil {
+			return err
+		}
+		c.processor = proc
+	}
+	c.running++
+
+	return nil
+}
+
+// Shutdown implements the Component interface. The last output to shut
+// down shuts the sampler down.
+func (o *connectorOutput) Shutdown(ctx context.Context) error {
+	c := o.connector
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running == 0 {
+		return nil
+	}
+	c.running--
+	if c.running > 0 {
+		return nil
+	}
+
+	connectorsMu.Lock()
+	delete(connectors, c.cfg)
+	connectorsMu.Unlock()
+
+	err := c.processor.Shutdown(ctx)
+	c.processor = nil
+	return err
+}
+
+// ConsumeTraces implements the consumer.Traces interface. Every output
+// receives the incoming traces, so only one of them feeds the sampler: the
+// traces output, or the metrics output if the connector has no traces output.
+func (o *connectorOutput) ConsumeTraces(ctx context.Context, traces ptrace.Traces) error {
+	c := o.connector
+	c.mu.RLock()
+	proc := c.processor
+	feeds := o.traces || c.tracesConsumer == nil
+	c.mu.RUnlock()
+
+	if proc == nil || !feeds {
+		return nil
+	}
+	return proc.ConsumeTraces(ctx, traces)
+}
+
+// Capabilities implements the consumer.Traces interface. The sampler copies
+// the spans it keeps, so the incoming traces are not modified.
+func (o *connectorOutput) Capabilities() consumer.Capabilities {
+	return consumer.Capabilities{MutatesData: false}
+}
@@ -0,0 +1,118 @@
+package reservoirsampler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/connector"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+)
+
+// newTestConnectorSettings creates connector settings for tests
+func newTestConnectorSettings() connector.Settings {
+	set := newTestSettings()
+	return connector.Settings{
+		ID:                set.ID,
+		TelemetrySettings: set.TelemetrySettings,
+	}
+}
+
+// newTestConnectorConfig creates a connector config with a short window
+func newTestConnectorConfig() *Config {
+	cfg := createDefaultConfig().(*Config)
+	cfg.SizeK = 10
+	cfg.WindowDuration = 100 * time.Millisecond
+	cfg.TraceAware = false
+	return cfg
+}
+
+// TestConnectorOutputs tests that one connector sends the sample to its
+// traces output and the window summary to its metrics output
+func TestConnectorOutputs(t *testing.T) {
+	factory := NewConnectorFactory()
+	cfg := newTestConnectorConfig()
+	ctx := context.Background()
+
+	tracesSink := new(consumertest.TracesSink)
+	tracesOutput, err := factory.CreateTracesToTraces(ctx, newTestConnectorSettings(), cfg, tracesSink)
+	require.NoError(t, err)
+	metricsSink := new(consumertest.MetricsSink)
+	metricsOutput, err := factory.CreateTracesToMetrics(ctx, newTestConnectorSettings(), cfg, metricsSink)
+	require.NoError(t, err)
+
+	require.NoError(t, tracesOutput.Start(ctx, nil))
+	require.NoError(t, metricsOutput.Start(ctx, nil))
+
+	// The pipeline sends the same traces to both outputs
+	consume := func(numSpans int) {
+		traces := generateTraces(numSpans)
+		require.NoError(t, tracesOutput.ConsumeTraces(ctx, traces))
+		require.NoError(t, metricsOutput.ConsumeTraces(ctx, traces))
+	}
+	consume(100)
+	time.Sleep(150 * time.Millisecond)
+	consume(1)
+
+	// The spans were sampled and counted once
+	require.Len(t, tracesSink.AllTraces(), 1)
+	assert.Equal(t, 10, tracesSink.AllTraces()[0].SpanCount())
+	require.Len(t, metricsSink.AllMetrics(), 1)
+	values := summaryValues(metricsSink.AllMetrics()[0])
+	assert.Equal(t, int64(100), values["test-service"]["reservoir_sampler.window_spans"]["test-span"].IntValue())
+	assert.GreaterOrEqual(t, values[""]["reservoir_sampler.sampled_spans"][""].IntValue(), int64(10))
+
+	require.NoError(t, tracesOutput.Shutdown(ctx))
+	require.NoError(t, metricsOutput.Shutdown(ctx))
+	assert.Empty(t, connectors)
+}
+
+// TestConnectorMetricsOnly tests a connector with only a metrics output
+func TestConnectorMetricsOnly(t *testing.T) {
+	cfg := newTestConnectorConfig()
+	ctx := context.Background()
+
+	metricsSink := new(consumertest.MetricsSink)
+	output, err := NewConnectorFactory().CreateTracesToMetrics(ctx, newTestConnectorSettings(), cfg, metricsSink)
+	require.NoError(t, err)
+	require.NoError(t, output.Start(ctx, nil))
+	defer func() {
+		require.NoError(t, output.Shutdown(ctx))
+	}()
+
+	require.NoError(t, output.ConsumeTraces(ctx, generateTraces(50)))
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, output.ConsumeTraces(ctx, generateTraces(1)))
+
+	require.Len(t, metricsSink.AllMetrics(), 1)
+	values := summaryValues(metricsSink.AllMetrics()[0])
+	assert.Equal(t, int64(50), values["test-service"]["reservoir_sampler.window_spans"]["test-span"].IntValue())
+}
+
+// TestConnectorStorageClientKind tests that the connector asks the storage
+// extension for a client as a connector, and the processor as a processor
+func TestConnectorStorageClientKind(t *testing.T) {
+	storageID := component.NewID(component.MustNewType("file_storage"))
+	cfg := newTestConnectorConfig()
+	cfg.CheckpointBackend = CheckpointBackendStorage
+	cfg.CheckpointStorage = &storageID
+	ctx := context.Background()
+
+	host := newTestStorageHost(storageID)
+	ext := host.extensions[storageID].(*testStorageExtension)
+
+	output, err := NewConnectorFactory().CreateTracesToTraces(ctx, newTestConnectorSettings(), cfg, consumertest.NewNop())
+	require.NoError(t, err)
+	require.NoError(t, output.Start(ctx, host))
+	require.NoError(t, output.Shutdown(ctx))
+	assert.Equal(t, component.KindConnector, ext.kind)
+
+	proc, err := newReservoirProcessor(ctx, newTestSettings(), cfg, consumertest.NewNop(), nil)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, host))
+	require.NoError(t, proc.Shutdown(ctx))
+	assert.Equal(t, component.KindProcessor, ext.kind)
+}
@@ -0,0 +1,468 @@
+package reservoirsampler
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// storedExportRetryInterval is how long the worker waits before trying a
+// stored window again when retries are disabled and no maximum retry
+// interval is set
+const storedExportRetryInterval = 30 * time.Second
+
+// pendingExport is the output of a closed window waiting to be delivered
+type pendingExport struct {
+	// Position in the export queue, which keys the window in the store
+	seq uint64
+
+	// The window's sample, and its summary if there is a metrics consumer
+	traces     ptrace.Traces
+	metrics    pmetric.Metrics
+	hasMetrics bool
+
+	// When the window closed
+	closedAt time.Time
+
+	// Which parts have been delivered, so a retry only resends the rest
+	tracesSent  bool
+	metricsSent bool
+
+	// Whether the worker has written the window to the store, or tried to
+	stored bool
+}
+
+// exportQueue delivers the output of closed windows from a background
+// worker, so a slow or failing exporter never holds up the rollover or the
+// ingestion waiting on it. Windows wait in a bounded queue, and when it is
+// full a newly closed window is dropped. A failed delivery is retried with
+// exponential backoff, and a window the consumer rejects with a permanent
+// error is dropped without retrying.
+//
+// With a store, queued windows are persisted until they are delivered, so
+// they survive restarts. The worker writes them to the store, so queueing a
+// window never waits for the disk. A stored window is retried, across restarts, until
+// its retry time since it closed runs out; with retries disabled, it is tried
+// again after a fixed wait or when another window is queued. Without a
+// store, a window is dropped once its retry time runs out or the queue shuts
+// down.
+type exportQueue struct {
+	// Consumers of the window outputs
+	tracesConsumer  consumer.Traces
+	metricsConsumer consumer.Metrics
+
+	// Retry policy; an initial interval of 0 disables retries
+	initialInterval time.Duration
+	maxInterval     time.Duration
+	maxElapsedTime  time.Duration
+
+	// Queued windows, the first of them being delivered, and the position of
+	// the next one. The store, if any, holds the same windows.
+	items   []*pendingExport
+	size    int
+	nextSeq uint64
+	store   *badgerExportStore
+	notify  chan struct{}
+
+	// Worker lifecycle; closed is guarded by mu so nothing is queued after
+	// the worker has drained the queue
+	ctx     context.Context
+	cancel  context.CancelFunc
+	stop    chan struct{}
+	done    chan struct{}
+	mu      sync.Mutex
+	started bool
+	closed  bool
+
+	// Metrics
+	depthGauge  *atomic.Int64
+	oldestGauge *atomic.Int64
+
+	// Logging
+	logger *zap.Logger
+}
+
+// newExportQueue creates an export queue for the configured queue size and
+// retry policy, persisting windows in store if it is not nil. Windows left
+// in the store by a previous run are queued ahead of new ones. Its worker
+// runs once Start is called.
+func newExportQueue(
+	cfg *Config,
+	store *badgerExportStore,
+	tracesConsumer consumer.Traces,
+	metricsConsumer consumer.Metrics,
+	depthGauge, oldestGauge *atomic.Int64,
+	logger *zap.Logger,
+) (*exportQueue, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &exportQueue{
+		tracesConsumer:  tracesConsumer,
+		metricsConsumer: metricsConsumer,
+		initialInterval: cfg.ExportRetryInitialInterval,
+		maxInterval:     cfg.ExportRetryMaxInterval,
+		maxElapsedTime:  cfg.ExportRetryMaxElapsedTime,
+		size:            cfg.ExportQueueSize,
+		store:           store,
+		notify:          make(chan struct{}, 1),
+		ctx:             ctx,
+		cancel:          cancel,
+		stop:            make(chan struct{}),
+		done:            make(chan struct{}),
+		depthGauge:      depthGauge,
+		oldestGauge:     oldestGauge,
+		logger:          logger,
+	}
+
+	if store != nil {
+		items, err := store.Load()
+		if err != nil {
+			cancel()
+			return nil, err
+		}
+		for _, item := range items {
+			item.stored = true
+		}
+		q.items = items
+		if len(items) > 0 {
+			q.nextSeq = items[len(items)-1].seq + 1
+			logger.Info("Resuming export of windows from the previous run",
+				zap.Int("windows", len(items)),
+				zap.Time("oldest", items[0].closedAt))
+		}
+	}
+	q.updateMetricsLocked()
+
+	return q, nil
+}
+
+// Start starts the worker
+func (q *exportQueue) Start() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.started || q.closed {
+		return
+	}
+	q.started = true
+	go q.run()
+}
+
+// Enqueue queues the output of a closed window without waiting for it to be
+// stored or delivered. It returns false if the window was dropped because the queue is
+// full or shut down.
+func (q *exportQueue) Enqueue(item *pendingExport) bool {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		q.logger.Error("Export queue is shut down, dropping window",
+			zap.Int("span_count", item.traces.SpanCount()))
+		return false
+	}
+	if len(q.items) >= q.size {
+		q.logger.Error("Export queue is full, dropping window",
+			zap.Int("queue_size", q.size),
+			zap.Int("span_count", item.traces.SpanCount()))
+		return false
+	}
+
+	// The worker persists the window, outside the caller's locks
+	item.seq = q.nextSeq
+	q.nextSeq++
+	q.items = append(q.items, item)
+	q.updateMetricsLocked()
+
+	select {
+	case q.notify <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// Len returns the number of windows waiting for delivery, including the one
+// being delivered
+func (q *exportQueue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return len(q.items)
+}
+
+// updateMetricsLocked publishes the depth of the queue and the close time of
+// its oldest window (must be called with lock held)
+func (q *exportQueue) updateMetricsLocked() {
+	q.depthGauge.Store(int64(len(q.items)))
+	if len(q.items) > 0 {
+		q.oldestGauge.Store(q.items[0].closedAt.UnixNano())
+	} else {
+		q.oldestGauge.Store(0)
+	}
+}
+
+// Shutdown stops accepting windows and waits for the worker to deliver the
+// queued ones, each with a single attempt, until ctx is done. Stored windows
+// that are not delivered stay in the store for the next run.
+func (q *exportQueue) Shutdown(ctx context.Context) error {
+	q.mu.Lock()
+	started := q.started
+	if !q.closed {
+		q.closed = true
+		close(q.stop)
+	}
+	q.mu.Unlock()
+
+	var err error
+	if !started {
+		// No worker has persisted the queued windows
+		q.persistQueued()
+	}
+	if started {
+		select {
+		case <-q.done:
+		case <-ctx.Done():
+			// Abort the delivery in progress
+			q.cancel()
+			<-q.done
+			err = ctx.Err()
+		}
+	}
+	q.cancel()
+
+	if q.store != nil {
+		if closeErr := q.store.Close(); closeErr != nil && err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// run delivers queued windows in order until the queue shuts down, then
+// makes a final attempt at what is left
+func (q *exportQueue) run() {
+	defer close(q.done)
+
+	draining := false
+	for {
+		q.persistQueued()
+
+		q.mu.Lock()
+		var item *pendingExport
+		if len(q.items) > 0 {
+			item = q.items[0]
+		}
+		q.mu.Unlock()
+
+		if item == nil {
+			if draining {
+				return
+			}
+			select {
+			case <-q.notify:
+			case <-q.stop:
+				draining = true
+			}
+			continue
+		}
+
+		if !q.deliver(item, !draining) {
+			if draining {
+				// Leave the rest for the next run
+				q.persistQueued()
+				return
+			}
+
+			// Keep the stored window at the head of the queue and try it again
+			timer := time.NewTimer(q.storedRetryInterval())
+			select {
+			case <-timer.C:
+			case <-q.notify:
+			case <-q.stop:
+				draining = true
+			}
+			timer.Stop()
+			continue
+		}
+
+		q.mu.Lock()
+		q.items = q.items[1:]
+		q.updateMetricsLocked()
+		q.mu.Unlock()
+
+		select {
+		case <-q.stop:
+			draining = true
+		default:
+		}
+	}
+}
+
+// deliver sends a window to the consumers, retrying failures if retry is set
+// and the retry policy allows it. It returns whether the window is done
+// with: delivered, or dropped because the error was permanent, its retry
+// time ran out or it is not stored.
+func (q *exportQueue) deliver(item *pendingExport, retry bool) bool {
+	backoff := q.initialInterval
+
+	// A stored window's retry time counts from when it closed, so it also
+	// runs out across restarts
+	start := time.Now()
+	if q.store != nil && !item.closedAt.IsZero() {
+		start = item.closedAt
+	}
+
+	for {
+		err := q.send(item)
+		if err == nil {
+			q.removeStored(item)
+			return true
+		}
+
+		if consumererror.IsPermanent(err) {
+			q.logger.Error("Failed to export window with a permanent error, dropping it",
+				zap.Time("closed_at", item.closedAt),
+				zap.Int("span_count", item.traces.SpanCount()),
+				zap.Error(err))
+			q.removeStored(item)
+			return true
+		}
+
+		if q.maxElapsedTime > 0 && time.Since(start)+backoff > q.maxElapsedTime {
+			q.logger.Error("Failed to export window within the retry time, dropping it",
+				zap.Time("closed_at", item.closedAt),
+				zap.Int("span_count", item.traces.SpanCount()),
+				zap.Error(err))
+			q.removeStored(item)
+			return true
+		}
+
+		if !retry || q.initialInterval <= 0 {
+			if q.store != nil {
+				q.logger.Error("Failed to export window, keeping it to try again",
+					zap.Time("closed_at", item.closedAt),
+					zap.Int("span_count", item.traces.SpanCount()),
+					zap.Error(err))
+				return false
+			}
+			q.logger.Error("Failed to export window, dropping it",
+				zap.Time("closed_at", item.closedAt),
+				zap.Int("span_count", item.traces.SpanCount()),
+				zap.Error(err))
+			return true
+		}
+
+		q.logger.Warn("Failed to export window, will retry",
+			zap.Duration("backoff", backoff),
+			zap.Int("span_count", item.traces.SpanCount()),
+			zap.Error(err))
+
+		if !q.waitBackoff(backoff) {
+			// Make the final attempt while draining
+			retry = false
+			continue
+		}
+
+		backoff *= 2
+		if q.maxInterval > 0 && backoff > q.maxInterval {
+			backoff = q.maxInterval
+		}
+	}
+}
+
+// waitBackoff waits before retrying a window, persisting windows queued in
+// the meantime. It returns false if the queue shut down first.
+func (q *exportQueue) waitBackoff(backoff time.Duration) bool {
+	timer := time.NewTimer(backoff)
+	defer timer.Stop()
+
+	for {
+		select {
+		case <-timer.C:
+			return true
+		case <-q.notify:
+			q.persistQueued()
+		case <-q.stop:
+			return false
+		}
+	}
+}
+
+// persistQueued writes the queued windows that are not stored yet to the
+// store, if any. Only the worker calls it once it has started.
+func (q *exportQueue) persistQueued() {
+	if q.store == nil {
+		return
+	}
+
+	q.mu.Lock()
+	var unstored []*pendingExport
+	for _, item := range q.items {
+		if !item.stored {
+			unstored = append(unstored, item)
+		}
+	}
+	q.mu.Unlock()
+
+	for _, item := range unstored {
+		// The window is still delivered if it cannot be stored, but is lost
+		// if the process stops first
+		if err := q.store.Put(item); err != nil {
+			q.logger.Error("Failed to persist window for export", zap.Error(err))
+		}
+		item.stored = true
+	}
+}
+
+// removeStored removes a window that is done with from the store, if any
+func (q *exportQueue) removeStored(item *pendingExport) {
+	if q.store == nil {
+		return
+	}
+	if err := q.store.Delete(item.seq); err != nil {
+		q.logger.Error("Failed to remove window from the export queue", zap.Error(err))
+	}
+}
+
+// storedRetryInterval returns how long to wait before trying a stored window
+// again after it failed without retries
+func (q *exportQueue) storedRetryInterval() time.Duration {
+	if q.maxInterval > 0 {
+		return q.maxInterval
+	}
+	return storedExportRetryInterval
+}
+
+// send delivers the parts of a window not delivered yet, recording in the
+// store which parts are done so they are not sent again after a restart
+func (q *exportQueue) send(item *pendingExport) error {
+	if !item.tracesSent {
+		if item.traces.SpanCount() > 0 {
+			q.logger.Info("Exporting reservoir", zap.Int("span_count", item.traces.SpanCount()))
+			if err := q.tracesConsumer.ConsumeTraces(q.ctx, item.traces); err != nil {
+				return err
+			}
+		}
+		item.tracesSent = true
+
+		if item.hasMetrics && q.store != nil {
+			if err := q.store.Put(item); err != nil {
+				q.logger.Warn("Failed to record exported traces of a window", zap.Error(err))
+			}
+		}
+	}
+
+	if item.hasMetrics && !item.metricsSent {
+		q.logger.Debug("Exporting window summary", zap.Int("data_points", item.metrics.DataPointCount()))
+		if err := q.metricsConsumer.ConsumeMetrics(q.ctx, item.metrics); err != nil {
+			return err
+		}
+		item.metricsSent = true
+	}
+
+	return nil
+}
@@ -0,0 +1,481 @@
+package reservoirsampler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/consumer/consumererror"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// newTestExportQueueConfig returns a config with a small queue and fast retries
+func newTestExportQueueConfig() *Config {
+	return &Config{
+		ExportQueueSize:            2,
+		ExportRetryInitialInterval: 10 * time.Millisecond,
+		ExportRetryMaxInterval:     20 * time.Millisecond,
+	}
+}
+
+// newTestExportQueue creates an export queue with its own gauges, persisting
+// windows in store if it is not nil
+func newTestExportQueue(t *testing.T, cfg *Config, store *badgerExportStore, tracesConsumer consumer.Traces, metricsConsumer consumer.Metrics) *exportQueue {
+	q, err := newExportQueue(cfg, store, tracesConsumer, metricsConsumer, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+	require.NoError(t, err)
+	return q
+}
+
+// newFailingTracesConsumer returns a consumer that fails the first failures
+// calls and then passes traces on to sink
+func newFailingTracesConsumer(t *testing.T, failures int64, sink consumer.Traces) (consumer.Traces, *atomic.Int64) {
+	calls := atomic.NewInt64(0)
+	next, err := consumer.NewTraces(func(ctx context.Context, traces ptrace.Traces) error {
+		if calls.Inc() <= failures {
+			return errors.New("exporter unavailable")
+		}
+		return sink.ConsumeTraces(ctx, traces)
+	})
+	require.NoError(t, err)
+	return next, calls
+}
+
+// TestExportQueueRetries tests that a failed export is retried until it succeeds
+func TestExportQueueRetries(t *testing.T) {
+	sink := new(consumertest.TracesSink)
+	next, calls := newFailingTracesConsumer(t, 2, sink)
+
+	// The summary fails once, after the sample was delivered
+	metricsSink := new(consumertest.MetricsSink)
+	metricsCalls := atomic.NewInt64(0)
+	metricsNext, err := consumer.NewMetrics(func(ctx context.Context, metrics pmetric.Metrics) error {
+		if metricsCalls.Inc() == 1 {
+			return errors.New("exporter unavailable")
+		}
+		return metricsSink.ConsumeMetrics(ctx, metrics)
+	})
+	require.NoError(t, err)
+
+	q := newTestExportQueue(t, newTestExportQueueConfig(), nil, next, metricsNext)
+	q.Start()
+	defer func() {
+		require.NoError(t, q.Shutdown(context.Background()))
+	}()
+
+	assert.True(t, q.Enqueue(&pendingExport{
+		traces:     generateTraces(5),
+		metrics:    pmetric.NewMetrics(),
+		hasMetrics: true,
+		closedAt:   time.Now(),
+	}))
+
+	require.Eventually(t, func() bool { return len(metricsSink.AllMetrics()) == 1 }, time.Second, 5*time.Millisecond)
+	require.Len(t, sink.AllTraces(), 1)
+	assert.Equal(t, 5, sink.AllTraces()[0].SpanCount())
+	assert.Equal(t, int64(3), calls.Load())
+	assert.Equal(t, int64(2), metricsCalls.Load())
+}
+
+// TestExportQueueGivesUp tests that an export is dropped once its retry time runs out
+func TestExportQueueGivesUp(t *testing.T) {
+	sink := new(consumertest.TracesSink)
+	next, calls := newFailingTracesConsumer(t, 1000, sink)
+
+	cfg := newTestExportQueueConfig()
+	cfg.ExportRetryMaxElapsedTime = 50 * time.Millisecond
+	q := newTestExportQueue(t, cfg, nil, next, nil)
+	q.Start()
+	defer func() {
+		require.NoError(t, q.Shutdown(context.Background()))
+	}()
+
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(5)}))
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(5)}))
+
+	// Both windows are given up on, one after the other
+	require.Eventually(t, func() bool { return q.Len() == 0 && calls.Load() >= 4 }, time.Second, 5*time.Millisecond)
+	time.Sleep(100 * time.Millisecond)
+	assert.Less(t, calls.Load(), int64(20))
+	assert.Empty(t, sink.AllTraces())
+}
+
+// TestExportQueueFull tests that windows closed while the queue is full are dropped
+func TestExportQueueFull(t *testing.T) {
+	release := make(chan struct{})
+	sink := new(consumertest.TracesSink)
+	next, err := consumer.NewTraces(func(ctx context.Context, traces ptrace.Traces) error {
+		<-release
+		return sink.ConsumeTraces(ctx, traces)
+	})
+	require.NoError(t, err)
+
+	q := newTestExportQueue(t, newTestExportQueueConfig(), nil, next, nil)
+	q.Start()
+
+	// The worker blocks on the first window while the second waits
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(1)}))
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(2)}))
+	assert.False(t, q.Enqueue(&pendingExport{traces: generateTraces(3)}))
+	assert.Equal(t, 2, q.Len())
+
+	// Shutting down delivers the queued windows
+	close(release)
+	require.NoError(t, q.Shutdown(context.Background()))
+	require.Len(t, sink.AllTraces(), 2)
+	assert.Equal(t, 3, sink.SpanCount())
+	assert.Equal(t, 0, q.Len())
+	assert.False(t, q.Enqueue(&pendingExport{traces: generateTraces(1)}))
+}
+
+// TestExportQueueShutdownStopsRetrying tests that shutdown ends the backoff
+// with a final attempt instead of waiting it out
+func TestExportQueueShutdownStopsRetrying(t *testing.T) {
+	sink := new(consumertest.TracesSink)
+	next, calls := newFailingTracesConsumer(t, 1000, sink)
+
+	cfg := newTestExportQueueConfig()
+	cfg.ExportRetryInitialInterval = time.Hour
+	cfg.ExportRetryMaxInterval = time.Hour
+	q := newTestExportQueue(t, cfg, nil, next, nil)
+	q.Start()
+
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(1)}))
+	require.Eventually(t, func() bool { return calls.Load() == 1 }, time.Second, 5*time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	require.NoError(t, q.Shutdown(ctx))
+	assert.Equal(t, int64(2), calls.Load())
+}
+
+// TestProcessorRolloverDoesNotWaitForExport tests that a blocked exporter
+// holds up neither the rollover nor ingestion into the new window
+func TestProcessorRolloverDoesNotWaitForExport(t *testing.T) {
+	cfg := &Config{
+		SizeK:              10,
+		WindowDuration:     time.Minute,
+		CheckpointInterval: time.Second,
+		ExportQueueSize:    10,
+	}
+
+	release := make(chan struct{})
+	sink := new(consumertest.TracesSink)
+	next, err := consumer.NewTraces(func(ctx context.Context, traces ptrace.Traces) error {
+		<-release
+		return sink.ConsumeTraces(ctx, traces)
+	})
+	require.NoError(t, err)
+
+	ctx := context.Background()
+	proc, err := newReservoirProcessor(ctx, newTestSettings(), cfg, next, nil)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, nil))
+	defer func() {
+		require.NoError(t, proc.Shutdown(ctx))
+	}()
+
+	rp := proc.(*reservoirProcessor)
+	require.NoError(t, proc.ConsumeTraces(ctx, generateTraces(20)))
+
+	done := make(chan struct{})
+	go func() {
+		rp.onWindowRollover()
+		rp.windowManager.initializeWindow()
+		assert.NoError(t, proc.ConsumeTraces(ctx, generateTraces(5)))
+		rp.onWindowRollover()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("rollover waited for the exporter")
+	}
+	assert.Empty(t, sink.AllTraces())
+
+	close(release)
+	require.Eventually(t, func() bool { return len(sink.AllTraces()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 10, sink.AllTraces()[0].SpanCount())
+	assert.Equal(t, 5, sink.AllTraces()[1].SpanCount())
+}
+
+// newTestExportStore opens an export store at path
+func newTestExportStore(t *testing.T, path string) *badgerExportStore {
+	store, err := newBadgerExportStore(path, zap.NewNop())
+	require.NoError(t, err)
+	return store
+}
+
+// TestExportStoreRoundtrip tests that stored windows load back in queue order
+func TestExportStoreRoundtrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export")
+	closedAt := time.Now().Round(0)
+
+	summary := pmetric.NewMetrics()
+	summary.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty().Metrics().AppendEmpty().SetName("window_spans")
+
+	store := newTestExportStore(t, path)
+	require.NoError(t, store.Put(&pendingExport{seq: 2, traces: generateTraces(3), closedAt: closedAt}))
+	require.NoError(t, store.Put(&pendingExport{seq: 1, traces: generateTraces(2), metrics: summary, hasMetrics: true, tracesSent: true, closedAt: closedAt}))
+	require.NoError(t, store.Put(&pendingExport{seq: 3, traces: generateTraces(1), closedAt: closedAt}))
+	require.NoError(t, store.Delete(3))
+
+	// An unreadable record is dropped
+	require.NoError(t, store.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(exportKey(4), []byte("garbage"))
+	}))
+	require.NoError(t, store.Close())
+
+	store = newTestExportStore(t, path)
+	defer store.Close()
+	items, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, items, 2)
+
+	assert.Equal(t, uint64(1), items[0].seq)
+	assert.Equal(t, 2, items[0].traces.SpanCount())
+	assert.True(t, items[0].hasMetrics)
+	assert.True(t, items[0].tracesSent)
+	assert.False(t, items[0].metricsSent)
+	assert.Equal(t, "window_spans", items[0].metrics.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics().At(0).Name())
+	assert.True(t, closedAt.Equal(items[0].closedAt))
+
+	assert.Equal(t, uint64(2), items[1].seq)
+	assert.Equal(t, 3, items[1].traces.SpanCount())
+	assert.False(t, items[1].hasMetrics)
+
+	items, err = store.Load()
+	require.NoError(t, err)
+	assert.Len(t, items, 2)
+}
+
+// TestDurableExportQueueResumes tests that windows that could not be
+// exported are delivered by the next run
+func TestDurableExportQueueResumes(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export")
+	cfg := newTestExportQueueConfig()
+
+	failing, calls := newFailingTracesConsumer(t, 1000, new(consumertest.TracesSink))
+	q := newTestExportQueue(t, cfg, newTestExportStore(t, path), failing, nil)
+	q.Start()
+	first := time.Now().Add(-time.Minute)
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(3), closedAt: first}))
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(2), closedAt: time.Now()}))
+	require.Eventually(t, func() bool { return calls.Load() >= 2 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, q.Shutdown(context.Background()))
+
+	// The next run picks up both windows, oldest first
+	sink := new(consumertest.TracesSink)
+	depth, oldest := atomic.NewInt64(0), atomic.NewInt64(0)
+	q, err := newExportQueue(cfg, newTestExportStore(t, path), sink, nil, depth, oldest, zap.NewNop())
+	require.NoError(t, err)
+	assert.Equal(t, 2, q.Len())
+	assert.Equal(t, int64(2), depth.Load())
+	assert.Equal(t, first.UnixNano(), oldest.Load())
+
+	q.Start()
+	require.Eventually(t, func() bool { return len(sink.AllTraces()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 3, sink.AllTraces()[0].SpanCount())
+	assert.Equal(t, 2, sink.AllTraces()[1].SpanCount())
+	require.Eventually(t, func() bool { return depth.Load() == 0 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(0), oldest.Load())
+	require.NoError(t, q.Shutdown(context.Background()))
+
+	// Exported windows are gone from the store
+	store := newTestExportStore(t, path)
+	defer store.Close()
+	items, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, items)
+}
+
+// TestDurableExportQueuePersistsOnWorker tests that windows are written to
+// the store by the worker rather than by Enqueue, which runs under the
+// window lock, and still by Shutdown if the worker never started
+func TestDurableExportQueuePersistsOnWorker(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export")
+	cfg := newTestExportQueueConfig()
+	cfg.ExportQueueSize = 3
+
+	failing, _ := newFailingTracesConsumer(t, 1000, new(consumertest.TracesSink))
+	store := newTestExportStore(t, path)
+	q := newTestExportQueue(t, cfg, store, failing, nil)
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(3), closedAt: time.Now()}))
+	items, err := store.Load()
+	require.NoError(t, err)
+	assert.Empty(t, items)
+
+	q.Start()
+	require.Eventually(t, func() bool {
+		items, err := store.Load()
+		return err == nil && len(items) == 1
+	}, time.Second, 5*time.Millisecond)
+
+	// So is a window queued while the first one is being retried
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(2), closedAt: time.Now()}))
+	require.Eventually(t, func() bool {
+		items, err := store.Load()
+		return err == nil && len(items) == 2
+	}, time.Second, 5*time.Millisecond)
+	require.NoError(t, q.Shutdown(context.Background()))
+
+	q = newTestExportQueue(t, cfg, newTestExportStore(t, path), failing, nil)
+	require.Equal(t, 2, q.Len())
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(1), closedAt: time.Now()}))
+	require.NoError(t, q.Shutdown(context.Background()))
+
+	q = newTestExportQueue(t, cfg, newTestExportStore(t, path), failing, nil)
+	assert.Equal(t, 3, q.Len())
+	require.NoError(t, q.Shutdown(context.Background()))
+}
+
+// TestDurableExportQueueKeepsRetrying tests that a stored window is retried
+// until it is exported when its retry time is not limited
+func TestDurableExportQueueKeepsRetrying(t *testing.T) {
+	cfg := newTestExportQueueConfig()
+
+	sink := new(consumertest.TracesSink)
+	next, calls := newFailingTracesConsumer(t, 5, sink)
+	q := newTestExportQueue(t, cfg, newTestExportStore(t, filepath.Join(t.TempDir(), "export")), next, nil)
+	q.Start()
+	defer func() {
+		require.NoError(t, q.Shutdown(context.Background()))
+	}()
+
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(4), closedAt: time.Now()}))
+	require.Eventually(t, func() bool { return len(sink.AllTraces()) == 1 }, 2*time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(6), calls.Load())
+}
+
+// TestDurableExportQueueGivesUp tests that a stored window is dropped and
+// removed from the store once its retry time since it closed runs out, even
+// if that happened before a restart
+func TestDurableExportQueueGivesUp(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export")
+	cfg := newTestExportQueueConfig()
+	cfg.ExportRetryMaxElapsedTime = time.Minute
+
+	sink := new(consumertest.TracesSink)
+	next, calls := newFailingTracesConsumer(t, 1000, sink)
+	q := newTestExportQueue(t, cfg, newTestExportStore(t, path), next, nil)
+	q.Start()
+
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(4), closedAt: time.Now().Add(-time.Hour)}))
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(2), closedAt: time.Now()}))
+
+	// The old window is tried once, and the new one is retried after it
+	require.Eventually(t, func() bool { return q.Len() == 1 && calls.Load() >= 3 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, q.Shutdown(context.Background()))
+
+	store := newTestExportStore(t, path)
+	defer store.Close()
+	items, err := store.Load()
+	require.NoError(t, err)
+	require.Len(t, items, 1)
+	assert.Equal(t, 2, items[0].traces.SpanCount())
+}
+
+// TestDurableExportQueueWithoutRetries tests that with retries disabled the
+// worker keeps a stored window that failed and tries it again, rather than
+// stopping until the next run
+func TestDurableExportQueueWithoutRetries(t *testing.T) {
+	cfg := newTestExportQueueConfig()
+	cfg.ExportRetryInitialInterval = 0
+	cfg.ExportRetryMaxInterval = 10 * time.Millisecond
+
+	sink := new(consumertest.TracesSink)
+	next, calls := newFailingTracesConsumer(t, 3, sink)
+	q := newTestExportQueue(t, cfg, newTestExportStore(t, filepath.Join(t.TempDir(), "export")), next, nil)
+	q.Start()
+	defer func() {
+		require.NoError(t, q.Shutdown(context.Background()))
+	}()
+
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(3), closedAt: time.Now()}))
+	require.Eventually(t, func() bool { return len(sink.AllTraces()) == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, int64(4), calls.Load())
+
+	// The worker is still running
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(2), closedAt: time.Now()}))
+	require.Eventually(t, func() bool { return len(sink.AllTraces()) == 2 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, q.Len())
+}
+
+// TestExportQueuePermanentError tests that a window rejected with a
+// permanent error is dropped at once, and removed from the store
+func TestExportQueuePermanentError(t *testing.T) {
+	for _, durable := range []bool{false, true} {
+		t.Run(fmt.Sprintf("durable=%t", durable), func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "export")
+			var store *badgerExportStore
+			if durable {
+				store = newTestExportStore(t, path)
+			}
+
+			sink := new(consumertest.TracesSink)
+			calls := atomic.NewInt64(0)
+			next, err := consumer.NewTraces(func(ctx context.Context, traces ptrace.Traces) error {
+				if calls.Inc() == 1 {
+					return consumererror.NewPermanent(errors.New("malformed data"))
+				}
+				return sink.ConsumeTraces(ctx, traces)
+			})
+			require.NoError(t, err)
+
+			q := newTestExportQueue(t, newTestExportQueueConfig(), store, next, nil)
+			q.Start()
+			assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(3), closedAt: time.Now()}))
+			assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(2), closedAt: time.Now()}))
+
+			require.Eventually(t, func() bool { return len(sink.AllTraces()) == 1 }, time.Second, 5*time.Millisecond)
+			assert.Equal(t, 2, sink.AllTraces()[0].SpanCount())
+			assert.Equal(t, int64(2), calls.Load())
+			require.NoError(t, q.Shutdown(context.Background()))
+
+			if durable {
+				store := newTestExportStore(t, path)
+				defer store.Close()
+				items, err := store.Load()
+				require.NoError(t, err)
+				assert.Empty(t, items)
+			}
+		})
+	}
+}
+
+// TestDurableExportQueueResumesPartialDelivery tests that the traces of a
+// window are not sent again when only its summary is left to deliver
+func TestDurableExportQueueResumesPartialDelivery(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "export")
+	cfg := newTestExportQueueConfig()
+
+	sink := new(consumertest.TracesSink)
+	failingMetrics, err := consumer.NewMetrics(func(context.Context, pmetric.Metrics) error {
+		return errors.New("exporter unavailable")
+	})
+	require.NoError(t, err)
+
+	q := newTestExportQueue(t, cfg, newTestExportStore(t, path), sink, failingMetrics)
+	q.Start()
+	assert.True(t, q.Enqueue(&pendingExport{traces: generateTraces(3), metrics: pmetric.NewMetrics(), hasMetrics: true, closedAt: time.Now()}))
+	require.Eventually(t, func() bool { return len(sink.AllTraces()) == 1 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, q.Shutdown(context.Background()))
+
+	metricsSink := new(consumertest.MetricsSink)
+	q = newTestExportQueue(t, cfg, newTestExportStore(t, path), sink, metricsSink)
+	q.Start()
+	require.Eventually(t, func() bool { return len(metricsSink.AllMetrics()) == 1 }, time.Second, 5*time.Millisecond)
+	require.NoError(t, q.Shutdown(context.Background()))
+	assert.Len(t, sink.AllTraces(), 1)
+}
@@ -0,0 +1,243 @@
+package reservoirsampler
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/dgraph-io/badger/v3/options"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+const (
+	// keyPrefixExport is the Badger key prefix of windows waiting for export
+	keyPrefixExport = "export:"
+
+	// exportRecordVersion is the version of the encoded pending export
+	exportRecordVersion = 1
+
+	// exportRecordHeaderSize is the encoded size of a pending export without
+	// its payloads: version, flags, close time and the two payload lengths,
+	// plus the trailing checksum
+	exportRecordHeaderSize = 1 + 1 + 8 + 4 + 4 + 4
+)
+
+// Flags of an encoded pending export
+const (
+	exportFlagHasMetrics = 1 << iota
+	exportFlagTracesSent
+	exportFlagMetricsSent
+)
+
+// errCorruptExport is returned when a stored pending export cannot be decoded
+var errCorruptExport = errors.New("corrupt pending export")
+
+// badgerExportStore persists closed windows in a Badger database until they
+// are exported, keyed by their position in the export queue
+type badgerExportStore struct {
+	db     *badger.DB
+	logger *zap.Logger
+}
+
+// newBadgerExportStore opens the export queue database at path
+func newBadgerExportStore(path string, logger *zap.Logger) (*badgerExportStore, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return nil, fmt.Errorf("failed to create export queue directory: %w", err)
+	}
+
+	badgerOptions := badger.DefaultOptions(path).
+		WithLogger(zapToBadgerLogger{logger.Named("badger")}).
+		WithSyncWrites(true).
+		WithCompression(options.ZSTD)
+
+	db, err := badger.Open(badgerOptions)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open export queue database: %w", err)
+	}
+
+	return &badgerExportStore{db: db, logger: logger}, nil
+}
+
+// exportKey returns the key of the pending export at position seq
+func exportKey(seq uint64) []byte {
+	key := make([]byte, len(keyPrefixExport)+8)
+	copy(key, keyPrefixExport)
+	binary.BigEndian.PutUint64(key[len(keyPrefixExport):], seq)
+	return key
+}
+
+// Put stores a pending export, replacing any earlier version of it
+func (s *badgerExportStore) Put(item *pendingExport) error {
+	value, err := encodePendingExport(item)
+	if err != nil {
+		return err
+	}
+
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Set(exportKey(item.seq), value)
+	}); err != nil {
+		return fmt.Errorf("failed to store pending export: %w", err)
+	}
+	return nil
+}
+
+// Delete removes an exported window
+func (s *badgerExportStore) Delete(seq uint64) error {
+	if err := s.db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(exportKey(seq))
+	}); err != nil {
+		return fmt.Errorf("failed to delete pending export: %w", err)
+	}
+	return nil
+}
+
+// Load returns the stored pending exports in queue order. Records that
+// cannot be decoded are deleted, since they can never be delivered.
+func (s *badgerExportStore) Load() ([]*pendingExport, error) {
+	var items []*pendingExport
+	var corrupt [][]byte
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(keyPrefixExport)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().KeyCopy(nil)
+			if len(key) != len(prefix)+8 {
+				corrupt = append(corrupt, key)
+				continue
+			}
+
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			item, err := decodePendingExport(value)
+			if err != nil {
+				s.logger.Warn("Dropping unreadable pending export", zap.Error(err))
+				corrupt = append(corrupt, key)
+				continue
+			}
+			item.seq = binary.BigEndian.Uint64(key[len(prefix):])
+			items = append(items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load pending exports: %w", err)
+	}
+
+	if len(corrupt) > 0 {
+		if err := s.db.Update(func(txn *badger.Txn) error {
+			for _, key := range corrupt {
+				if err := txn.Delete(key); err != nil {
+					return err
+				}
+			}
+			return nil
+		}); err != nil {
+			return nil, fmt.Errorf("failed to delete unreadable pending exports: %w", err)
+		}
+	}
+
+	return items, nil
+}
+
+// Close closes the database
+func (s *badgerExportStore) Close() error {
+	return s.db.Close()
+}
+
+// encodePendingExport encodes a pending export as its version, flags, close
+// time, the OTLP protobuf encodings of its traces and metrics, and a CRC-32C
+// of all of it
+func encodePendingExport(item *pendingExport) ([]byte, error) {
+	traces, err := (&ptrace.ProtoMarshaler{}).MarshalTraces(item.traces)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal pending traces: %w", err)
+	}
+
+	var metrics []byte
+	var flags byte
+	if item.hasMetrics {
+		flags |= exportFlagHasMetrics
+		metrics, err = (&pmetric.ProtoMarshaler{}).MarshalMetrics(item.metrics)
+		if err != nil {
+			return nil, fmt.Errorf("failed to marshal pending metrics: %w", err)
+		}
+	}
+	if item.tracesSent {
+		flags |= exportFlagTracesSent
+	}
+	if item.metricsSent {
+		flags |= exportFlagMetricsSent
+	}
+
+	buf := make([]byte, 0, exportRecordHeaderSize+len(traces)+len(metrics))
+	buf = append(buf, exportRecordVersion, flags)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(item.closedAt.UnixNano()))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(traces)))
+	buf = append(buf, traces...)
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(metrics)))
+	buf = append(buf, metrics...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoliTable))
+
+	return buf, nil
+}
+
+// decodePendingExport decodes a pending export encoded by encodePendingExport
+func decodePendingExport(data []byte) (*pendingExport, error) {
+	if len(data) < exportRecordHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", errCorruptExport, len(data))
+	}
+
+	body, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, castagnoliTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptExport)
+	}
+	if body[0] != exportRecordVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errCorruptExport, body[0])
+	}
+
+	flags := body[1]
+	item := &pendingExport{
+		closedAt:    time.Unix(0, int64(binary.BigEndian.Uint64(body[2:10]))),
+		hasMetrics:  flags&exportFlagHasMetrics != 0,
+		tracesSent:  flags&exportFlagTracesSent != 0,
+		metricsSent: flags&exportFlagMetricsSent != 0,
+	}
+
+	rest := body[10:]
+	tracesLen := int(binary.BigEndian.Uint32(rest))
+	if len(rest) < 4+tracesLen+4 {
+		return nil, fmt.Errorf("%w: truncated traces", errCorruptExport)
+	}
+	traces, err := (&ptrace.ProtoUnmarshaler{}).UnmarshalTraces(rest[4 : 4+tracesLen])
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", errCorruptExport, err)
+	}
+	item.traces = traces
+
+	rest = rest[4+tracesLen:]
+	metricsLen := int(binary.BigEndian.Uint32(rest))
+	if len(rest) != 4+metricsLen {
+		return nil, fmt.Errorf("%w: truncated metrics", errCorruptExport)
+	}
+	if item.hasMetrics {
+		metrics, err := (&pmetric.ProtoUnmarshaler{}).UnmarshalMetrics(rest[4:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", errCorruptExport, err)
+		}
+		item.metrics = metrics
+	}
+
+	return item, nil
+}
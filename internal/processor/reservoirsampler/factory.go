@@ -4,6 +4,7 @@ import (
 	"context"
 
 	"go.opentelemetry.io/collector/component"
+	"go.opentelemetry.io/collector/connector"
 	"go.opentelemetry.io/collector/consumer"
 	"go.opentelemetry.io/collector/processor"
 )
@@ -17,14 +18,58 @@ func NewFactory() processor.Factory {
 	)
 }
 
-// createTracesProcessor creates a trace processor based on this config.
+// createTracesProcessor creates a trace processor based on this config. A
+// processor has no metrics output, so it sends no window summaries.
 func createTracesProcessor(
 	ctx context.Context,
 	params processor.Settings,
 	cfg component.Config,
 	nextConsumer consumer.Traces,
 ) (processor.Traces, error) {
-	return newReservoirProcessor(ctx, params.TelemetrySettings, cfg.(*Config), nextConsumer)
+	return newReservoirProcessor(ctx, params, cfg.(*Config), nextConsumer, nil)
+}
+
+// NewConnectorFactory returns a new factory for the reservoir sampler
+// connector. The connector takes traces in and has two outputs: a traces
+// pipeline that receives each window's sample, and a metrics pipeline that
+// receives each window's summary and the sampler's own telemetry.
+func NewConnectorFactory() connector.Factory {
+	return connector.NewFactory(
+		component.MustNewType("reservoir_sampler"),
+		createDefaultConfig,
+		connector.WithTracesToTraces(createTracesToTracesConnector, component.StabilityLevelAlpha),
+		connector.WithTracesToMetrics(createTracesToMetricsConnector, component.StabilityLevelAlpha),
+	)
+}
+
+// createTracesToTracesConnector creates the traces output of a connector
+func createTracesToTracesConnector(
+	_ context.Context,
+	set connector.Settings,
+	cfg component.Config,
+	nextConsumer consumer.Traces,
+) (connector.Traces, error) {
+	c := getReservoirConnector(set, cfg.(*Config))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.tracesConsumer = nextConsumer
+	return &connectorOutput{connector: c, traces: true}, nil
+}
+
+// createTracesToMetricsConnector creates the metrics output of a connector
+func createTracesToMetricsConnector(
+	_ context.Context,
+	set connector.Settings,
+	cfg component.Config,
+	nextConsumer consumer.Metrics,
+) (connector.Traces, error) {
+	c := getReservoirConnector(set, cfg.(*Config))
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.metricsConsumer = nextConsumer
+	return &connectorOutput{connector: c}, nil
 }
 
 // ForceReservoirExport is a test helper that triggers export of the current reservoir.
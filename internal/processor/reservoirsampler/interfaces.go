@@ -13,12 +13,34 @@ type ReservoirStore interface {
 	// AddSpan adds a span to the reservoir
 	AddSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope)
 	
-	// Reset clears the reservoir and initializes a new window
-	Reset(windowID int64, startTime time.Time, endTime time.Time)
+	// AddTrace adds all spans of a completed trace to the reservoir
+	AddTrace(traces ptrace.Traces)
+	
+	// SetWeightFunc switches the reservoir to weighted sampling
+	SetWeightFunc(weightFn WeightFunc)
+	
+	// Reset clears the reservoir for a new window
+	Reset()
+	
+	// CloseWindow returns the spans to export for the closing window and
+	// readies the reservoir for the next one, as one atomic step
+	CloseWindow(ctx context.Context) (ptrace.Traces, error)
+	
+	// RestoreSpans loads spans from a checkpoint without resampling them
+	RestoreSpans(spans map[uint64]SpanWithResource) int
 	
 	// Export returns all spans in the reservoir as traces
 	Export(ctx context.Context) (ptrace.Traces, error)
 	
+	// GetAllSpans returns a copy of all spans in the reservoir
+	GetAllSpans() map[uint64]SpanWithResource
+	
+	// TakeDelta returns the spans added and evicted since the previous checkpoint
+	TakeDelta() (added map[uint64]SpanWithResource, evicted []uint64)
+	
+	// TakeSnapshot returns a copy of all spans in the reservoir for a full checkpoint
+	TakeSnapshot() map[uint64]SpanWithResource
+	
 	// Size returns the number of spans in the reservoir
 	Size() int
 }
@@ -43,12 +65,28 @@ type CheckpointManager interface {
 	// Checkpoint saves the current state to persistent storage
 	Checkpoint(windowID int64, startTime time.Time, endTime time.Time, windowCount int64, spans map[uint64]SpanWithResource) error
 	
-	// LoadCheckpoint loads the most recent state from persistent storage
+	// CheckpointDelta saves only the spans added and removed since the previous checkpoint
+	CheckpointDelta(windowID int64, startTime time.Time, endTime time.Time, windowCount int64, added map[uint64]SpanWithResource, removed []uint64) error
+	
+	// LoadCheckpoint loads the most recent state from persistent storage.
+	// It returns ErrNoCheckpoint if nothing has been checkpointed yet.
 	LoadCheckpoint() (windowID int64, startTime time.Time, endTime time.Time, windowCount int64, spans map[uint64]SpanWithResource, err error)
 	
+	// CheckpointTraceBuffer saves the traces waiting in the trace buffer, replacing those saved before
+	CheckpointTraceBuffer(traces []BufferedTrace) error
+	
+	// CheckpointTraceBufferDelta saves only the buffered traces changed and removed since the previous trace buffer checkpoint
+	CheckpointTraceBufferDelta(changed []BufferedTrace, removed []pcommon.TraceID) error
+	
+	// LoadTraceBuffer loads the traces saved by CheckpointTraceBuffer, or none if nothing was saved
+	LoadTraceBuffer() ([]BufferedTrace, error)
+	
 	// Close releases any resources used by the checkpoint manager
 	Close() error
 	
 	// Compact performs database compaction
 	Compact() error
+	
+	// UpdateMetrics refreshes the checkpoint age metric
+	UpdateMetrics()
 }
\ No newline at end of file
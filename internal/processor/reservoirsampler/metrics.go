@@ -3,7 +3,10 @@ package reservoirsampler
 import (
 	"context"
 	"fmt"
+	"time"
 
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/otel/metric"
 	"go.uber.org/atomic"
 )
@@ -18,10 +21,20 @@ type MetricsManager struct {
 	compactionCountCounter *atomic.Int64
 	lruEvictionsCounter    *atomic.Int64
 	sampledSpansCounter    *atomic.Int64
+	exportQueueDepthGauge  *atomic.Int64
+	traceBufferBytesGauge  *atomic.Int64
+	droppedSpansCounter    *atomic.Int64
+	spilledTracesGauge     *atomic.Int64
+	
+	// Close time of the oldest window waiting for export in Unix nanoseconds, 0 if none
+	exportQueueOldest *atomic.Int64
 	
 	// Context and meter
 	metricCtx context.Context
 	meter     metric.Meter
+	
+	// Start of the cumulative counters
+	startTime time.Time
 }
 
 // NewMetricsManager creates a new metrics manager
@@ -34,8 +47,14 @@ func NewMetricsManager(ctx context.Context, meter metric.Meter) *MetricsManager
 		compactionCountCounter: atomic.NewInt64(0),
 		lruEvictionsCounter:    atomic.NewInt64(0),
 		sampledSpansCounter:    atomic.NewInt64(0),
+		exportQueueDepthGauge:  atomic.NewInt64(0),
+		traceBufferBytesGauge:  atomic.NewInt64(0),
+		droppedSpansCounter:    atomic.NewInt64(0),
+		spilledTracesGauge:     atomic.NewInt64(0),
+		exportQueueOldest:      atomic.NewInt64(0),
 		metricCtx:              ctx,
 		meter:                  meter,
+		startTime:              time.Now(),
 	}
 }
 
@@ -141,9 +160,88 @@ func (m *MetricsManager) RegisterMetrics() error {
 		return fmt.Errorf("failed to register sampled spans counter: %w", err)
 	}
 	
+	// Register the export queue depth gauge
+	_, err = m.meter.Int64ObservableGauge(
+		"reservoir_sampler.export_queue_depth",
+		metric.WithDescription("Number of closed windows waiting for export"),
+		metric.WithUnit("{windows}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(m.exportQueueDepthGauge.Load())
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register export queue depth gauge: %w", err)
+	}
+	
+	// Register the export queue age gauge
+	_, err = m.meter.Int64ObservableGauge(
+		"reservoir_sampler.export_queue_age",
+		metric.WithDescription("Age of the oldest closed window waiting for export in seconds"),
+		metric.WithUnit("s"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(m.exportQueueAge(time.Now()))
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register export queue age gauge: %w", err)
+	}
+	
+	// Register the trace buffer bytes gauge
+	_, err = m.meter.Int64ObservableGauge(
+		"reservoir_sampler.trace_buffer_bytes",
+		metric.WithDescription("Estimated size of the spans in the trace buffer in bytes"),
+		metric.WithUnit("By"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(m.traceBufferBytesGauge.Load())
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register trace buffer bytes gauge: %w", err)
+	}
+	
+	// Register the dropped spans counter
+	_, err = m.meter.Int64ObservableCounter(
+		"reservoir_sampler.trace_buffer_dropped_spans",
+		metric.WithDescription("Number of spans the trace buffer dropped, over a per-trace or spill limit or failing to spill"),
+		metric.WithUnit("{spans}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(m.droppedSpansCounter.Load())
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register dropped spans counter: %w", err)
+	}
+	
+	// Register the spilled traces gauge
+	_, err = m.meter.Int64ObservableGauge(
+		"reservoir_sampler.trace_buffer_spilled_traces",
+		metric.WithDescription("Number of traces spilled from the trace buffer to disk"),
+		metric.WithUnit("{traces}"),
+		metric.WithInt64Callback(func(_ context.Context, o metric.Int64Observer) error {
+			o.Observe(m.spilledTracesGauge.Load())
+			return nil
+		}),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to register spilled traces gauge: %w", err)
+	}
+	
 	return nil
 }
 
+// exportQueueAge returns the age in seconds of the oldest window waiting for export at now
+func (m *MetricsManager) exportQueueAge(now time.Time) int64 {
+	oldest := m.exportQueueOldest.Load()
+	if oldest == 0 {
+		return 0
+	}
+	return int64(now.Sub(time.Unix(0, oldest)) / time.Second)
+}
+
 // GetReservoirSizeGauge returns the reservoir size gauge
 func (m *MetricsManager) GetReservoirSizeGauge() *atomic.Int64 {
 	return m.reservoirSizeGauge
@@ -177,4 +275,81 @@ func (m *MetricsManager) GetLruEvictionsCounter() *atomic.Int64 {
 // GetSampledSpansCounter returns the sampled spans counter
 func (m *MetricsManager) GetSampledSpansCounter() *atomic.Int64 {
 	return m.sampledSpansCounter
-}
\ No newline at end of file
+}
+
+// GetExportQueueDepthGauge returns the export queue depth gauge
+func (m *MetricsManager) GetExportQueueDepthGauge() *atomic.Int64 {
+	return m.exportQueueDepthGauge
+}
+
+// GetTraceBufferBytesGauge returns the trace buffer bytes gauge
+func (m *MetricsManager) GetTraceBufferBytesGauge() *atomic.Int64 {
+	return m.traceBufferBytesGauge
+}
+
+// GetDroppedSpansCounter returns the counter of spans dropped by the trace buffer
+func (m *MetricsManager) GetDroppedSpansCounter() *atomic.Int64 {
+	return m.droppedSpansCounter
+}
+
+// GetSpilledTracesGauge returns the spilled traces gauge
+func (m *MetricsManager) GetSpilledTracesGauge() *atomic.Int64 {
+	return m.spilledTracesGauge
+}
+
+// GetExportQueueOldestGauge returns the close time of the oldest window waiting for export
+func (m *MetricsManager) GetExportQueueOldestGauge() *atomic.Int64 {
+	return m.exportQueueOldest
+}
+
+// AppendTo appends the current value of every metric to sm as OTLP metrics,
+// for consumers that receive the sampler's telemetry in the pipeline rather
+// than through the meter. Counters are cumulative since the processor started.
+func (m *MetricsManager) AppendTo(sm pmetric.ScopeMetrics, now time.Time) {
+	timestamp := pcommon.NewTimestampFromTime(now)
+	
+	gauges := []struct {
+		name, description, unit string
+		value                   int64
+	}{
+		{"reservoir_sampler.reservoir_size", "Number of spans currently in the reservoir", "{spans}", m.reservoirSizeGauge.Load()},
+		{"reservoir_sampler.checkpoint_age", "Age of the last checkpoint in seconds", "s", m.checkpointAgeGauge.Load()},
+		{"reservoir_sampler.db_size", "Size of the reservoir checkpoint database in bytes", "By", m.reservoirDbSizeGauge.Load()},
+		{"reservoir_sampler.export_queue_depth", "Number of closed windows waiting for export", "{windows}", m.exportQueueDepthGauge.Load()},
+		{"reservoir_sampler.export_queue_age", "Age of the oldest closed window waiting for export in seconds", "s", m.exportQueueAge(now)},
+		{"reservoir_sampler.trace_buffer_bytes", "Estimated size of the spans in the trace buffer in bytes", "By", m.traceBufferBytesGauge.Load()},
+		{"reservoir_sampler.trace_buffer_spilled_traces", "Number of traces spilled from the trace buffer to disk", "{traces}", m.spilledTracesGauge.Load()},
+	}
+	for _, g := range gauges {
+		metric := sm.Metrics().AppendEmpty()
+		metric.SetName(g.name)
+		metric.SetDescription(g.description)
+		metric.SetUnit(g.unit)
+		dp := metric.SetEmptyGauge().DataPoints().AppendEmpty()
+		dp.SetTimestamp(timestamp)
+		dp.SetIntValue(g.value)
+	}
+	
+	counters := []struct {
+		name, description, unit string
+		value                   *atomic.Int64
+	}{
+		{"reservoir_sampler.db_compactions", "Number of database compactions performed", "{compactions}", m.compactionCountCounter},
+		{"reservoir_sampler.lru_evictions", "Number of trace evictions from the LRU cache", "{evictions}", m.lruEvictionsCounter},
+		{"reservoir_sampler.sampled_spans", "Number of spans sampled (added to reservoir)", "{spans}", m.sampledSpansCounter},
+		{"reservoir_sampler.trace_buffer_dropped_spans", "Number of spans the trace buffer dropped, over a per-trace or spill limit or failing to spill", "{spans}", m.droppedSpansCounter},
+	}
+	for _, c := range counters {
+		metric := sm.Metrics().AppendEmpty()
+		metric.SetName(c.name)
+		metric.SetDescription(c.description)
+		metric.SetUnit(c.unit)
+		sum := metric.SetEmptySum()
+		sum.SetAggregationTemporality(pmetric.AggregationTemporalityCumulative)
+		sum.SetIsMonotonic(true)
+		dp := sum.DataPoints().AppendEmpty()
+		dp.SetStartTimestamp(pcommon.NewTimestampFromTime(m.startTime))
+		dp.SetTimestamp(timestamp)
+		dp.SetIntValue(c.value.Load())
+	}
+}
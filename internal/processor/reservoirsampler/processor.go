@@ -2,12 +2,17 @@ package reservoirsampler
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"runtime"
+	"slices"
+	"sync"
 	"time"
 
 	"github.com/robfig/cron/v3"
 	"go.opentelemetry.io/collector/component"
 	"go.opentelemetry.io/collector/consumer"
+	"go.opentelemetry.io/collector/pdata/pmetric"
 	"go.opentelemetry.io/collector/pdata/ptrace"
 	"go.opentelemetry.io/collector/processor"
 	"go.uber.org/zap"
@@ -20,6 +25,8 @@ type reservoirProcessor struct {
 	component.ShutdownFunc
 
 	// Core dependencies
+	id        component.ID
+	kind      component.Kind
 	ctx       context.Context
 	ctxCancel context.CancelFunc
 	logger    *zap.Logger
@@ -28,12 +35,24 @@ type reservoirProcessor struct {
 	// Next consumer in the pipeline
 	nextConsumer consumer.Traces
 
+	// Optional consumer of the per-window summary and telemetry metrics
+	metricsConsumer consumer.Metrics
+
 	// Components
 	metricsManager    *MetricsManager
 	windowManager     *WindowManager
-	reservoir         *Reservoir
+	reservoir         ReservoirStore
 	checkpointManager CheckpointManager
 	traceBuffer       *TraceBuffer
+	summary           *WindowSummary
+	exportQueue       *exportQueue
+	
+	// Checkpoint state, serialized by checkpointMu
+	checkpointMu                  sync.Mutex
+	checkpointCount               int
+	fullCheckpointOwed            bool
+	fullTraceBufferCheckpointOwed bool
+	checkpointWindow              int64
 	
 	// Background tasks
 	checkpointTicker *time.Ticker
@@ -45,13 +64,29 @@ type reservoirProcessor struct {
 var _ processor.Traces = (*reservoirProcessor)(nil)
 var _ component.Component = (*reservoirProcessor)(nil)
 
-// newReservoirProcessor creates a new reservoir sampler processor
+// newReservoirProcessor creates a new reservoir sampler processor. If
+// metricsConsumer is not nil, it receives a summary of every span seen in
+// each window when the window rolls over.
 func newReservoirProcessor(
 	ctx context.Context,
-	set component.TelemetrySettings,
+	set processor.Settings,
 	cfg *Config,
 	nextConsumer consumer.Traces,
+	metricsConsumer consumer.Metrics,
 ) (processor.Traces, error) {
+	return newReservoirSampler(ctx, set, component.KindProcessor, cfg, nextConsumer, metricsConsumer)
+}
+
+// newReservoirSampler creates a reservoir sampler running as a component of
+// the given kind, which it identifies itself by to storage extensions
+func newReservoirSampler(
+	ctx context.Context,
+	set processor.Settings,
+	kind component.Kind,
+	cfg *Config,
+	nextConsumer consumer.Traces,
+	metricsConsumer consumer.Metrics,
+) (*reservoirProcessor, error) {
 	processorCtx, processorCancel := context.WithCancel(ctx)
 	logger := set.Logger
 
@@ -60,58 +95,184 @@ func newReservoirProcessor(
 
 	// Create a processor instance
 	p := &reservoirProcessor{
+		id:             set.ID,
+		kind:           kind,
 		ctx:            processorCtx,
 		ctxCancel:      processorCancel,
 		logger:         logger,
 		config:         cfg,
-		nextConsumer:   nextConsumer,
-		metricsManager: metricsManager,
-		stopChan:       make(chan struct{}),
+		nextConsumer:    nextConsumer,
+		metricsConsumer: metricsConsumer,
+		metricsManager:  metricsManager,
+		stopChan:        make(chan struct{}),
 	}
 
 	// Create window manager with rollover callback
 	p.windowManager = NewWindowManager(cfg.WindowDuration, p.onWindowRollover, logger)
+	if cfg.AlignWindows {
+		p.windowManager.SetAligned(true)
+	}
 
-	// Create reservoir
-	p.reservoir = NewReservoir(
-		cfg.SizeK,
-		p.windowManager,
-		metricsManager.GetReservoirSizeGauge(),
-		metricsManager.GetSampledSpansCounter(),
-		logger,
-	)
+	// Create reservoir, with a reservoir per stratum if stratified. In
+	// trace-aware mode the reservoir keeps whole traces. Sliding and
+	// decaying reservoirs outlive their windows.
+	if cfg.WindowMode == WindowModeSliding || cfg.WindowMode == WindowModeDecaying {
+		p.reservoir = NewTimedReservoir(
+			cfg,
+			p.windowManager,
+			metricsManager.GetReservoirSizeGauge(),
+			metricsManager.GetSampledSpansCounter(),
+			logger,
+		)
+		logger.Info("Timed reservoir enabled",
+			zap.String("window_mode", cfg.WindowMode),
+			zap.Duration("sliding_window", cfg.SlidingWindow),
+			zap.Duration("decay_half_life", cfg.DecayHalfLife))
+	} else if cfg.StratifyBy != "" {
+		p.reservoir = NewStratifiedReservoir(
+			cfg,
+			p.windowManager,
+			metricsManager.GetReservoirSizeGauge(),
+			metricsManager.GetSampledSpansCounter(),
+			logger,
+		)
+		logger.Info("Stratified sampling enabled",
+			zap.String("stratify_by", cfg.StratifyBy),
+			zap.String("policy", cfg.StrataPolicy),
+			zap.Int("max_strata", cfg.MaxStrata))
+	} else if cfg.TraceAware {
+		p.reservoir = NewTraceReservoir(
+			cfg.SizeK,
+			cfg.TraceReservoirUnit,
+			p.windowManager,
+			metricsManager.GetReservoirSizeGauge(),
+			metricsManager.GetSampledSpansCounter(),
+			logger,
+		)
+	} else if cfg.ReservoirShards > 1 {
+		sharded := NewShardedReservoir(
+			cfg.ReservoirShards,
+			cfg.SizeK,
+			p.windowManager,
+			metricsManager.GetReservoirSizeGauge(),
+			metricsManager.GetSampledSpansCounter(),
+			logger,
+		)
+		sharded.SetAlgorithm(cfg.ReservoirAlgorithm)
+		p.reservoir = sharded
+		logger.Info("Sharded reservoir enabled", zap.Int("shards", cfg.ReservoirShards))
+	} else {
+		reservoir := NewReservoir(
+			cfg.SizeK,
+			p.windowManager,
+			metricsManager.GetReservoirSizeGauge(),
+			metricsManager.GetSampledSpansCounter(),
+			logger,
+		)
+		reservoir.SetAlgorithm(cfg.ReservoirAlgorithm)
+		p.reservoir = reservoir
+	}
+	if cfg.WeightedSampling {
+		p.reservoir.SetWeightFunc(newWeightFunc(cfg))
+		logger.Info("Weighted sampling enabled",
+			zap.Float64("error_span_weight", cfg.ErrorSpanWeight),
+			zap.Duration("slow_span_threshold", cfg.SlowSpanThreshold),
+			zap.Float64("slow_span_weight", cfg.SlowSpanWeight),
+			zap.Int("attribute_weights", len(cfg.AttributeWeights)))
+	}
 
 	// Create trace buffer if trace-aware mode is enabled
 	if cfg.TraceAware {
-		p.traceBuffer = NewTraceBuffer(cfg.TraceBufferMaxSize, cfg.TraceBufferTimeout, logger)
+		shards := cfg.TraceBufferShards
+		if shards == 0 {
+			shards = runtime.GOMAXPROCS(0)
+		}
+		p.traceBuffer = NewShardedTraceBuffer(shards, cfg.TraceBufferMaxSize, cfg.TraceBufferTimeout, logger)
 		p.traceBuffer.SetEvictionCounter(metricsManager.GetLruEvictionsCounter())
+		p.traceBuffer.SetDroppedSpansCounter(metricsManager.GetDroppedSpansCounter())
+		p.traceBuffer.SetBytesGauge(metricsManager.GetTraceBufferBytesGauge())
+		p.traceBuffer.SetMemoryLimits(cfg.TraceBufferMaxBytes, cfg.TraceMaxBytes, cfg.TraceMaxSpans)
+		p.traceBuffer.SetCompletionStrategies(newCompletionStrategies(cfg))
+		if slices.Contains(cfg.TraceCompletion, TraceCompletionSpanCount) {
+			p.traceBuffer.SetExpectedSpanCountAttribute(cfg.ExpectedSpanCountAttribute)
+		}
 		logger.Info("Trace-aware sampling enabled",
 			zap.Int("buffer_size", cfg.TraceBufferMaxSize),
-			zap.Duration("buffer_timeout", cfg.TraceBufferTimeout))
+			zap.Int64("buffer_max_bytes", cfg.TraceBufferMaxBytes),
+			zap.Duration("buffer_timeout", cfg.TraceBufferTimeout),
+			zap.Strings("completion", cfg.TraceCompletion),
+			zap.String("reservoir_unit", cfg.TraceReservoirUnit))
 	}
 
-	// Set up checkpoint manager if checkpoint path is specified
-	if cfg.CheckpointPath != "" {
-		var err error
-		p.checkpointManager, err = NewBadgerCheckpointManager(
-			cfg.CheckpointPath,
-			cfg.DbCompactionTargetSize,
-			metricsManager.GetCheckpointAgeGauge(),
-			metricsManager.GetReservoirDbSizeGauge(),
-			metricsManager.GetCompactionCountCounter(),
-			logger,
-		)
-		if err != nil {
-			return nil, fmt.Errorf("failed to create checkpoint manager: %w", err)
+	// Summarize each window for the metrics consumer
+	if metricsConsumer != nil {
+		p.summary = NewWindowSummary(cfg.SummaryDurationBuckets)
+		logger.Info("Window summary enabled",
+			zap.Int("duration_buckets", len(cfg.SummaryDurationBuckets)))
+	}
+
+	// Set up checkpoint manager if checkpoint path is specified. The storage
+	// backend needs the host, so its manager is created in Start.
+	if cfg.CheckpointPath != "" || cfg.CheckpointBackend == CheckpointBackendMemory || cfg.CheckpointBackend == CheckpointBackendStorage {
+		if cfg.CheckpointBackend != CheckpointBackendStorage {
+			var err error
+			p.checkpointManager, err = newCheckpointManager(cfg, metricsManager, logger)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create checkpoint manager: %w", err)
+			}
 		}
 
 		// Create checkpoint ticker
 		p.checkpointTicker = time.NewTicker(cfg.CheckpointInterval)
 		logger.Info("Checkpoint storage initialized",
+			zap.String("backend", cfg.CheckpointBackend),
 			zap.String("path", cfg.CheckpointPath),
 			zap.Duration("interval", cfg.CheckpointInterval))
 	}
 
+	// Park traces evicted from the trace buffer in the checkpoint database
+	if p.traceBuffer != nil && cfg.TraceBufferSpill {
+		if manager, ok := p.checkpointManager.(*BadgerCheckpointManager); ok {
+			p.traceBuffer.SetSpill(newTraceSpill(manager.db, logger), cfg.TraceBufferSpillMaxBytes, metricsManager.GetSpilledTracesGauge())
+			logger.Info("Trace buffer spill enabled",
+				zap.String("path", cfg.CheckpointPath),
+				zap.Int64("max_bytes", cfg.TraceBufferSpillMaxBytes))
+		}
+	}
+
+	// Deliver closed windows in the background, from a queue persisted in
+	// Badger if configured
+	var exportStore *badgerExportStore
+	if cfg.ExportQueuePath != "" {
+		var err error
+		exportStore, err = newBadgerExportStore(cfg.ExportQueuePath, logger)
+		if err != nil {
+			if p.checkpointManager != nil {
+				p.checkpointManager.Close()
+			}
+			return nil, fmt.Errorf("failed to create export queue: %w", err)
+		}
+	}
+	exportQueue, err := newExportQueue(
+		cfg,
+		exportStore,
+		nextConsumer,
+		metricsConsumer,
+		metricsManager.GetExportQueueDepthGauge(),
+		metricsManager.GetExportQueueOldestGauge(),
+		logger,
+	)
+	if err != nil {
+		if exportStore != nil {
+			exportStore.Close()
+		}
+		if p.checkpointManager != nil {
+			p.checkpointManager.Close()
+		}
+		return nil, fmt.Errorf("failed to create export queue: %w", err)
+	}
+	p.exportQueue = exportQueue
+
 	// Set up compaction cron if configured
 	if cfg.DbCompactionScheduleCron != "" && cfg.DbCompactionTargetSize > 0 && p.checkpointManager != nil {
 		p.compactionCron = cron.New()
@@ -132,11 +293,40 @@ func newReservoirProcessor(
 	logger.Info("Reservoir sampler processor created",
 		zap.Int("size", cfg.SizeK),
 		zap.Duration("window", cfg.WindowDuration),
+		zap.Bool("align_windows", cfg.AlignWindows),
+		zap.Bool("weighted", cfg.WeightedSampling),
 		zap.Bool("trace_aware", cfg.TraceAware))
 
 	return p, nil
 }
 
+// newCheckpointManager creates the checkpoint manager for the configured backend
+func newCheckpointManager(cfg *Config, metricsManager *MetricsManager, logger *zap.Logger) (CheckpointManager, error) {
+	switch cfg.CheckpointBackend {
+	case CheckpointBackendBadger, "":
+		return NewBadgerCheckpointManager(
+			cfg.CheckpointPath,
+			cfg.DbCompactionTargetSize,
+			cfg.CheckpointRetainedWindows,
+			metricsManager.GetCheckpointAgeGauge(),
+			metricsManager.GetReservoirDbSizeGauge(),
+			metricsManager.GetCompactionCountCounter(),
+			logger,
+		)
+	case CheckpointBackendFile:
+		return NewFileCheckpointManager(
+			cfg.CheckpointPath,
+			metricsManager.GetCheckpointAgeGauge(),
+			metricsManager.GetReservoirDbSizeGauge(),
+			logger,
+		)
+	case CheckpointBackendMemory:
+		return NewMemoryCheckpointManager(metricsManager.GetCheckpointAgeGauge(), logger), nil
+	default:
+		return nil, fmt.Errorf("unknown checkpoint backend %q", cfg.CheckpointBackend)
+	}
+}
+
 // Start implements the Component interface
 func (p *reservoirProcessor) Start(ctx context.Context, host component.Host) error {
 	p.logger.Info("Starting reservoir sampler processor")
@@ -146,10 +336,28 @@ func (p *reservoirProcessor) Start(ctx context.Context, host component.Host) err
 		p.logger.Error("Failed to register metrics", zap.Error(err))
 	}
 
+	// Connect to the storage extension holding the checkpoints
+	if p.config.CheckpointBackend == CheckpointBackendStorage {
+		client, err := getStorageClient(ctx, host, *p.config.CheckpointStorage, p.kind, p.id)
+		if err != nil {
+			return fmt.Errorf("failed to get checkpoint storage client: %w", err)
+		}
+		p.checkpointManager = NewStorageCheckpointManager(
+			client,
+			p.metricsManager.GetCheckpointAgeGauge(),
+			p.metricsManager.GetReservoirDbSizeGauge(),
+			p.logger,
+		)
+		p.logger.Info("Checkpoint storage extension connected",
+			zap.String("extension", p.config.CheckpointStorage.String()))
+	}
+
 	// Try to load previous state from checkpoint
 	if p.checkpointManager != nil {
 		windowID, startTime, endTime, windowCount, spans, err := p.checkpointManager.LoadCheckpoint()
-		if err != nil {
+		if errors.Is(err, ErrNoCheckpoint) {
+			p.logger.Info("No checkpoint found, starting with empty reservoir")
+		} else if err != nil {
 			p.logger.Error("Failed to load checkpoint, starting with empty reservoir", zap.Error(err))
 		} else {
 			// Check if the window is still valid (not expired)
@@ -158,24 +366,46 @@ func (p *reservoirProcessor) Start(ctx context.Context, host component.Host) err
 				// Restore window state
 				p.windowManager.SetState(windowID, startTime, endTime, windowCount)
 
-				// Restore reservoir spans
-				for hash, span := range spans {
-					p.reservoir.AddSpan(span.Span, span.Resource, span.Scope)
-				}
+				// Restore reservoir spans as they were sampled
+				restored := p.reservoir.RestoreSpans(spans)
 
 				p.logger.Info("Loaded previous state from checkpoint",
 					zap.Int64("window", windowID),
 					zap.Time("start", startTime),
 					zap.Time("end", endTime),
-					zap.Int("spans", len(spans)))
+					zap.Int64("window_count", windowCount),
+					zap.Int("spans", restored))
 			} else {
-				p.logger.Info("Previous window expired, starting with empty reservoir")
+				// Continue numbering after the expired window so the new
+				// window never reuses its checkpoint keys
+				p.windowManager.StartNewWindow(windowID)
+
+				p.logger.Info("Previous window expired, starting with empty reservoir",
+					zap.Int64("window", windowID),
+					zap.Time("end", endTime))
 			}
 		}
 	}
 
-	// Start background goroutines
-	if p.checkpointTicker != nil {
+	// Bring back the traces that were waiting in the trace buffer, so they
+	// are not sampled as fragments when the rest of their spans arrive
+	if p.checkpointManager != nil && p.traceBuffer != nil {
+		traces, err := p.checkpointManager.LoadTraceBuffer()
+		if err != nil {
+			p.logger.Error("Failed to load trace buffer, starting with empty buffer", zap.Error(err))
+		} else if len(traces) > 0 {
+			restored := p.traceBuffer.Restore(traces)
+			p.logger.Info("Restored trace buffer from checkpoint",
+				zap.Int("traces", restored),
+				zap.Int("spans", p.traceBuffer.SpanCount()))
+		}
+	}
+
+	// Start background goroutines. Windows roll over on time even when no
+	// spans arrive.
+	p.exportQueue.Start()
+	go p.windowManager.RunRolloverScheduler(p.stopChan)
+	if p.checkpointTicker != nil && p.checkpointManager != nil {
 		go p.checkpointLoop()
 	}
 
@@ -200,6 +430,11 @@ func (p *reservoirProcessor) Shutdown(ctx context.Context) error {
 	p.ctxCancel()
 	close(p.stopChan)
 
+	// Deliver the windows still waiting for export
+	if err := p.exportQueue.Shutdown(ctx); err != nil {
+		p.logger.Error("Failed to export queued windows", zap.Error(err))
+	}
+
 	// Stop checkpoint ticker
 	if p.checkpointTicker != nil {
 		p.checkpointTicker.Stop()
@@ -212,20 +447,15 @@ func (p *reservoirProcessor) Shutdown(ctx context.Context) error {
 
 	// Final checkpoint
 	if p.checkpointManager != nil {
-		// Get the current window state
-		windowID, startTime, endTime, count := p.windowManager.GetCurrentState()
-
-		// Checkpoint the current state
-		if err := p.checkpointManager.Checkpoint(
-			windowID,
-			startTime,
-			endTime,
-			count,
-			p.reservoir.GetAllSpans(),
-		); err != nil {
+		if err := p.checkpoint(); err != nil {
 			p.logger.Error("Failed to perform final checkpoint", zap.Error(err))
 		}
 
+		// Leave spilled traces for the next run before the database closes
+		if p.traceBuffer != nil {
+			p.traceBuffer.CloseSpill()
+		}
+
 		// Close the checkpoint manager
 		if err := p.checkpointManager.Close(); err != nil {
 			p.logger.Error("Failed to close checkpoint manager", zap.Error(err))
@@ -243,6 +473,11 @@ func (p *reservoirProcessor) ConsumeTraces(ctx context.Context, traces ptrace.Tr
 	// Check if we need to roll over to a new window
 	p.windowManager.CheckRollover()
 
+	// Count every span in the window summary before sampling
+	if p.summary != nil {
+		p.summary.Record(traces)
+	}
+
 	// Process through the appropriate mode
 	if p.config.TraceAware {
 		err = p.consumeTracesAware(ctx, traces)
@@ -313,47 +548,52 @@ func (p *reservoirProcessor) consumeTracesAware(ctx context.Context, traces ptra
 	return nil
 }
 
-// onWindowRollover is called when a new window starts
+// onWindowRollover is called when a new window starts. It swaps the closing
+// window's sample out of the reservoir and hands it to the export queue, so
+// spans of the new window are accepted while it is delivered. It runs under
+// the window lock, so completed traces are left in the trace buffer for
+// processTraceBuffer to add to the new window.
 func (p *reservoirProcessor) onWindowRollover() {
-	// Export the current reservoir
-	traces, err := p.reservoir.Export(p.ctx)
+	// A timed reservoir only gives up the spans of the closing window, since
+	// it keeps sampling the others
+	traces, err := p.reservoir.CloseWindow(p.ctx)
 	if err != nil {
 		p.logger.Error("Failed to export reservoir", zap.Error(err))
 		return
 	}
-
-	// Only export if there are spans to export
-	if traces.SpanCount() > 0 {
-		p.logger.Info("Exporting reservoir", zap.Int("span_count", traces.SpanCount()))
-		
-		// Export to the next consumer
-		if err := p.nextConsumer.ConsumeTraces(p.ctx, traces); err != nil {
-			p.logger.Error("Failed to export traces to next consumer", zap.Error(err))
-		}
+	if p.config.AdjustedCountAttribute != "" {
+		setAdjustedCounts(traces, p.config.AdjustedCountAttribute)
 	}
 
-	// Reset the reservoir for the new window
-	p.reservoir.Reset()
+	item := &pendingExport{traces: traces, closedAt: time.Now()}
 
-	// Process any complete traces in the trace buffer
-	if p.traceBuffer != nil {
-		completedTraces := p.traceBuffer.GetCompletedTraces()
-		for _, traces := range completedTraces {
-			if err := p.consumeTracesSimple(p.ctx, traces); err != nil {
-				p.logger.Error("Failed to process completed trace after window rollover", zap.Error(err))
-			}
-		}
+	// Export the summary of everything the window has seen
+	if p.summary != nil {
+		item.metrics = p.summaryMetrics(item.closedAt)
+		item.hasMetrics = true
+	}
+
+	if traces.SpanCount() > 0 || item.hasMetrics {
+		p.exportQueue.Enqueue(item)
 	}
 }
 
+// summaryMetrics takes the summary of the window closing at now, along with
+// the sampler's own telemetry
+func (p *reservoirProcessor) summaryMetrics(now time.Time) pmetric.Metrics {
+	metrics := p.summary.Take(now)
+
+	sm := metrics.ResourceMetrics().AppendEmpty().ScopeMetrics().AppendEmpty()
+	sm.Scope().SetName(summaryScopeName)
+	p.metricsManager.AppendTo(sm, now)
+
+	return metrics
+}
+
 // processTraceBuffer periodically processes the trace buffer to add complete traces to the reservoir
 func (p *reservoirProcessor) processTraceBuffer() {
-	// Create a ticker with 1/10th of the trace timeout interval
-	checkInterval := p.config.TraceBufferTimeout / 10
-	if checkInterval < time.Second {
-		checkInterval = time.Second
-	}
-	ticker := time.NewTicker(checkInterval)
+	// Check at a tenth of the shortest wait for a trace to complete
+	ticker := time.NewTicker(traceBufferCheckInterval(p.config))
 	defer ticker.Stop()
 
 	for {
@@ -367,10 +607,8 @@ func (p *reservoirProcessor) processTraceBuffer() {
 			}
 
 			for _, traces := range completedTraces {
-				// Forward each trace to consumeTracesSimple for normal reservoir sampling
-				if err := p.consumeTracesSimple(p.ctx, traces); err != nil {
-					p.logger.Error("Failed to process completed trace", zap.Error(err))
-				}
+				// Add each trace whole, so a stratified reservoir keeps it in one stratum
+				p.reservoir.AddTrace(traces)
 			}
 
 		case <-p.ctx.Done():
@@ -389,17 +627,7 @@ func (p *reservoirProcessor) checkpointLoop() {
 	for {
 		select {
 		case <-p.checkpointTicker.C:
-			// Get the current window state
-			windowID, startTime, endTime, count := p.windowManager.GetCurrentState()
-
-			// Checkpoint the current state
-			if err := p.checkpointManager.Checkpoint(
-				windowID,
-				startTime,
-				endTime,
-				count,
-				p.reservoir.GetAllSpans(),
-			); err != nil {
+			if err := p.checkpoint(); err != nil {
 				p.logger.Error("Failed to checkpoint", zap.Error(err))
 			}
 
@@ -412,6 +640,74 @@ func (p *reservoirProcessor) checkpointLoop() {
 	}
 }
 
+// checkpoint persists the reservoir and the trace buffer. Every
+// CheckpointFullEvery-th checkpoint, and the one after a failure, is a full
+// snapshot; the others only persist the mutations since the previous
+// checkpoint. The reservoir and the trace buffer recover from failures
+// separately.
+func (p *reservoirProcessor) checkpoint() error {
+	p.checkpointMu.Lock()
+	defer p.checkpointMu.Unlock()
+
+	full := p.fullCheckpointOwed ||
+		p.config.CheckpointFullEvery <= 1 ||
+		p.checkpointCount%p.config.CheckpointFullEvery == 0
+	p.checkpointCount++
+
+	// Capture the window state and reservoir together so a concurrent
+	// rollover cannot attribute spans to the wrong window
+	var (
+		windowID           int64
+		startTime, endTime time.Time
+		count              int64
+		spans              map[uint64]SpanWithResource
+		evicted            []uint64
+	)
+	p.windowManager.ViewState(func(id int64, start time.Time, end time.Time, c int64) {
+		windowID, startTime, endTime, count = id, start, end, c
+
+		// A timed reservoir keeps its spans across windows, while
+		// checkpoints of a new window start from nothing
+		if _, isTimed := p.reservoir.(*TimedReservoir); isTimed && id != p.checkpointWindow {
+			full = true
+		}
+		p.checkpointWindow = id
+
+		if full {
+			spans = p.reservoir.TakeSnapshot()
+		} else {
+			spans, evicted = p.reservoir.TakeDelta()
+		}
+	})
+
+	var err error
+	if full {
+		err = p.checkpointManager.Checkpoint(windowID, startTime, endTime, count, spans)
+	} else {
+		err = p.checkpointManager.CheckpointDelta(windowID, startTime, endTime, count, spans, evicted)
+	}
+
+	// The taken mutations are gone from the reservoir, so only a full
+	// snapshot can recover from a failed checkpoint
+	p.fullCheckpointOwed = err != nil
+
+	if p.traceBuffer != nil {
+		var bufferErr error
+		if full || p.fullTraceBufferCheckpointOwed {
+			bufferErr = p.checkpointManager.CheckpointTraceBuffer(p.traceBuffer.TakeSnapshot())
+		} else {
+			changed, removed := p.traceBuffer.TakeDelta()
+			bufferErr = p.checkpointManager.CheckpointTraceBufferDelta(changed, removed)
+		}
+		p.fullTraceBufferCheckpointOwed = bufferErr != nil
+		if bufferErr != nil {
+			err = errors.Join(err, fmt.Errorf("failed to checkpoint trace buffer: %w", bufferErr))
+		}
+	}
+
+	return err
+}
+
 // Capabilities implements the processor.Traces interface
 func (p *reservoirProcessor) Capabilities() consumer.Capabilities {
 	return consumer.Capabilities{MutatesData: true}
@@ -423,6 +719,9 @@ func (p *reservoirProcessor) ForceExport() error {
 	if err != nil {
 		return err
 	}
+	if p.config.AdjustedCountAttribute != "" {
+		setAdjustedCounts(traces, p.config.AdjustedCountAttribute)
+	}
 
 	if traces.SpanCount() > 0 {
 		if err := p.nextConsumer.ConsumeTraces(p.ctx, traces); err != nil {
@@ -2,6 +2,7 @@ package reservoirsampler
 
 import (
 	"context"
+	"encoding/binary"
 	"testing"
 	"time"
 
@@ -11,10 +12,29 @@ import (
 	"go.opentelemetry.io/collector/consumer/consumertest"
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.opentelemetry.io/collector/processor"
 	"go.opentelemetry.io/otel/metric/noop"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
+// newTestSettings returns processor settings with no-op telemetry
+func newTestSettings() processor.Settings {
+	return processor.Settings{
+		ID: component.NewID(component.MustNewType("reservoir_sampler")),
+		TelemetrySettings: component.TelemetrySettings{
+			Logger:        zap.NewNop(),
+			MeterProvider: noop.NewMeterProvider(),
+		},
+	}
+}
+
+// newTestWindow creates a one minute window along with the size gauge and
+// sampled spans counter of a reservoir sampling it
+func newTestWindow() (*WindowManager, *atomic.Int64, *atomic.Int64) {
+	return NewWindowManager(time.Minute, nil, zap.NewNop()), atomic.NewInt64(0), atomic.NewInt64(0)
+}
+
 // TestCreateDefaultConfig tests that a default configuration can be created
 func TestCreateDefaultConfig(t *testing.T) {
 	factory := NewFactory()
@@ -35,16 +55,13 @@ func TestCreateProcessor(t *testing.T) {
 	// Create processor manually instead of using the factory method
 	// since the interface has changed
 	ctx := context.Background()
-	set := component.TelemetrySettings{
-		Logger: zap.NewNop(),
-		// Add MeterProvider to prevent nil pointer
-		MeterProvider: noop.NewMeterProvider(),
-	}
+	set := newTestSettings()
 	proc, err := newReservoirProcessor(
 		ctx,
 		set,
 		rcfg,
 		consumertest.NewNop(),
+		nil,
 	)
 	require.NoError(t, err)
 	require.NotNil(t, proc)
@@ -57,12 +74,12 @@ func TestConfigValidation(t *testing.T) {
 
 	// Valid config
 	cfg.SizeK = 100
-	cfg.WindowDuration = "30s"
+	cfg.WindowDuration = 30 * time.Second
 	cfg.CheckpointPath = "/tmp/checkpoint.db"
-	cfg.CheckpointInterval = "5s"
+	cfg.CheckpointInterval = 5 * time.Second
 	cfg.TraceAware = true
 	cfg.TraceBufferMaxSize = 1000
-	cfg.TraceBufferTimeout = "5s"
+	cfg.TraceBufferTimeout = 5 * time.Second
 
 	assert.NoError(t, cfg.Validate())
 
@@ -72,19 +89,99 @@ func TestConfigValidation(t *testing.T) {
 	cfg.SizeK = 100 // Reset
 
 	// Invalid config: empty window duration
-	cfg.WindowDuration = ""
+	cfg.WindowDuration = 0
 	assert.Error(t, cfg.Validate())
-	cfg.WindowDuration = "30s" // Reset
+	cfg.WindowDuration = 30 * time.Second // Reset
 
 	// Invalid config: empty checkpoint path
 	cfg.CheckpointPath = ""
 	assert.Error(t, cfg.Validate())
 	cfg.CheckpointPath = "/tmp/checkpoint.db" // Reset
 
+	// Invalid config: unknown checkpoint backend
+	cfg.CheckpointBackend = "bolt"
+	assert.Error(t, cfg.Validate())
+
+	// Valid config: the memory backend needs no checkpoint path
+	cfg.CheckpointBackend = CheckpointBackendMemory
+	cfg.CheckpointPath = ""
+	assert.NoError(t, cfg.Validate())
+
+	// Invalid config: the storage backend needs a storage extension
+	cfg.CheckpointBackend = CheckpointBackendStorage
+	assert.Error(t, cfg.Validate())
+	storageID := component.NewID(component.MustNewType("file_storage"))
+	cfg.CheckpointStorage = &storageID
+	assert.NoError(t, cfg.Validate())
+	cfg.CheckpointBackend = CheckpointBackendBadger // Reset
+	cfg.CheckpointPath = "/tmp/checkpoint.db"       // Reset
+	cfg.CheckpointStorage = nil                     // Reset
+
 	// Invalid config: empty checkpoint interval
-	cfg.CheckpointInterval = ""
+	cfg.CheckpointInterval = 0
+	assert.Error(t, cfg.Validate())
+	cfg.CheckpointInterval = 5 * time.Second // Reset
+
+	// Invalid config: no full checkpoints
+	cfg.CheckpointFullEvery = 0
+	assert.Error(t, cfg.Validate())
+	cfg.CheckpointFullEvery = 10 // Reset
+
+	// Invalid config: weighted sampling with a non-positive weight
+	cfg.WeightedSampling = true
+	assert.NoError(t, cfg.Validate())
+	cfg.ErrorSpanWeight = 0
 	assert.Error(t, cfg.Validate())
-	cfg.CheckpointInterval = "5s" // Reset
+	cfg.ErrorSpanWeight = 1 // Reset
+	cfg.AttributeWeights = []AttributeWeight{{Key: "http.route", Value: "/checkout", Weight: -1}}
+	assert.Error(t, cfg.Validate())
+	cfg.AttributeWeights = nil   // Reset
+	cfg.WeightedSampling = false // Reset
+
+	// Invalid config: stratified sampling with a bad policy or quotas
+	cfg.StratifyBy = "service.name"
+	assert.NoError(t, cfg.Validate())
+	cfg.StrataPolicy = "random"
+	assert.Error(t, cfg.Validate())
+	cfg.StrataPolicy = StrataPolicyQuota
+	cfg.StrataQuotas = map[string]int{"checkout": 60, "cart": 60}
+	assert.Error(t, cfg.Validate())
+	cfg.StrataQuotas = map[string]int{"checkout": 0}
+	assert.Error(t, cfg.Validate())
+	cfg.StrataQuotas = nil               // Reset
+	cfg.StrataPolicy = StrataPolicyEqual // Reset
+	cfg.MaxStrata = 0
+	assert.Error(t, cfg.Validate())
+	cfg.MaxStrata = 100 // Reset
+	cfg.StratifyBy = "" // Reset
+
+	// Invalid config: unknown reservoir algorithm, or Algorithm L for a
+	// reservoir other than the uniform span reservoir
+	cfg.ReservoirAlgorithm = "x"
+	assert.Error(t, cfg.Validate())
+	cfg.ReservoirAlgorithm = ReservoirAlgorithmL
+	assert.Error(t, cfg.Validate())
+	cfg.TraceAware = false
+	assert.NoError(t, cfg.Validate())
+	cfg.WeightedSampling = true
+	assert.Error(t, cfg.Validate())
+	cfg.WeightedSampling = false                 // Reset
+	cfg.TraceAware = true                        // Reset
+	cfg.ReservoirAlgorithm = ReservoirAlgorithmR // Reset
+
+	// Invalid config: negative reservoir shards, or sharding a reservoir
+	// other than the span reservoir
+	cfg.ReservoirShards = -1
+	assert.Error(t, cfg.Validate())
+	cfg.ReservoirShards = 4
+	assert.Error(t, cfg.Validate())
+	cfg.TraceAware = false
+	assert.NoError(t, cfg.Validate())
+	cfg.StratifyBy = "service.name"
+	assert.Error(t, cfg.Validate())
+	cfg.StratifyBy = ""     // Reset
+	cfg.TraceAware = true   // Reset
+	cfg.ReservoirShards = 0 // Reset
 
 	// Invalid config: trace-aware enabled but missing buffer configs
 	cfg.TraceAware = true
@@ -92,9 +189,91 @@ func TestConfigValidation(t *testing.T) {
 	assert.Error(t, cfg.Validate())
 	cfg.TraceBufferMaxSize = 1000 // Reset
 
-	cfg.TraceBufferTimeout = ""
+	cfg.TraceBufferTimeout = 0
+	assert.Error(t, cfg.Validate())
+	cfg.TraceBufferTimeout = 5 * time.Second // Reset
+
+	cfg.TraceReservoirUnit = "bytes"
+	assert.Error(t, cfg.Validate())
+	cfg.TraceReservoirUnit = TraceReservoirUnitTraces
+	assert.NoError(t, cfg.Validate())
+
+	// Invalid config: summary histogram buckets not positive and increasing
+	cfg.SummaryDurationBuckets = []time.Duration{10 * time.Millisecond, 0}
+	assert.Error(t, cfg.Validate())
+	cfg.SummaryDurationBuckets = []time.Duration{10 * time.Millisecond, 5 * time.Millisecond}
+	assert.Error(t, cfg.Validate())
+	cfg.SummaryDurationBuckets = []time.Duration{5 * time.Millisecond, 10 * time.Millisecond}
+	assert.NoError(t, cfg.Validate())
+
+	// Invalid config: timed window modes without their durations or with strata
+	cfg.WindowMode = "hopping"
+	assert.Error(t, cfg.Validate())
+	cfg.WindowMode = WindowModeSliding
+	cfg.SlidingWindow = 10 * time.Second
+	assert.Error(t, cfg.Validate())
+	cfg.SlidingWindow = 2 * time.Minute
+	assert.NoError(t, cfg.Validate())
+	cfg.StratifyBy = "service.name"
+	assert.Error(t, cfg.Validate())
+	cfg.StratifyBy = "" // Reset
+	cfg.WindowMode = WindowModeDecaying
+	assert.Error(t, cfg.Validate())
+	cfg.DecayHalfLife = time.Minute
+	assert.NoError(t, cfg.Validate())
+	cfg.WindowMode = WindowModeTumbling // Reset
+
+	// Invalid config: export queue without room or with a backward retry policy
+	cfg.ExportQueueSize = 0
+	assert.Error(t, cfg.Validate())
+	cfg.ExportQueueSize = 10 // Reset
+	cfg.ExportRetryMaxInterval = 500 * time.Millisecond
+	assert.Error(t, cfg.Validate())
+	cfg.ExportRetryMaxInterval = 30 * time.Second // Reset
+	cfg.ExportRetryInitialInterval = 0
+	assert.NoError(t, cfg.Validate())
+
+	// Invalid config: unknown or repeated trace completion strategies, or
+	// ones missing their settings
+	cfg.TraceCompletion = []string{"idle"}
+	assert.Error(t, cfg.Validate())
+	cfg.TraceCompletion = []string{TraceCompletionRootSpan, TraceCompletionRootSpan}
+	assert.Error(t, cfg.Validate())
+	cfg.TraceCompletion = []string{TraceCompletionRootSpan, TraceCompletionSpanCount, TraceCompletionMaxAge}
+	assert.NoError(t, cfg.Validate())
+	cfg.TraceCompletionGrace = -time.Second
+	assert.Error(t, cfg.Validate())
+	cfg.TraceCompletionGrace = time.Second // Reset
+	cfg.ExpectedSpanCountAttribute = ""
+	assert.Error(t, cfg.Validate())
+	cfg.ExpectedSpanCountAttribute = "trace.expected_span_count" // Reset
+	cfg.TraceMaxAge = 0
+	assert.Error(t, cfg.Validate())
+	cfg.TraceCompletion = nil // Reset
+
+	// Invalid config: negative memory limits, or a trace allowed more than the buffer
+	cfg.TraceBufferMaxBytes = -1
+	assert.Error(t, cfg.Validate())
+	cfg.TraceBufferMaxBytes = 1 << 20
+	cfg.TraceMaxSpans = -1
+	assert.Error(t, cfg.Validate())
+	cfg.TraceMaxSpans = 1000
+	cfg.TraceMaxBytes = 2 << 20
+	assert.Error(t, cfg.Validate())
+	cfg.TraceMaxBytes = 1 << 20
+	assert.NoError(t, cfg.Validate())
+	cfg.TraceBufferShards = -1
+	assert.Error(t, cfg.Validate())
+	cfg.TraceBufferShards = 0 // Reset
+
+	// Invalid config: trace buffer spill without a Badger checkpoint database
+	cfg.TraceBufferSpill = true
+	assert.NoError(t, cfg.Validate())
+	cfg.CheckpointBackend = CheckpointBackendFile
+	assert.Error(t, cfg.Validate())
+	cfg.CheckpointBackend = CheckpointBackendBadger // Reset
+	cfg.CheckpointPath = ""
 	assert.Error(t, cfg.Validate())
-	cfg.TraceBufferTimeout = "5s" // Reset
 }
 
 // TestReservoirSampling tests the core reservoir sampling algorithm functionality
@@ -102,20 +281,18 @@ func TestReservoirSampling(t *testing.T) {
 	// Create processor with in-memory storage (no checkpoints)
 	cfg := &Config{
 		SizeK:              10,
-		WindowDuration:     "10s",
+		WindowDuration:     10 * time.Second,
 		CheckpointPath:     "",
-		CheckpointInterval: "1s",
+		CheckpointInterval: 1 * time.Second,
+		ExportQueueSize:    10,
 		TraceAware:         false,
 	}
 
 	sink := new(consumertest.TracesSink)
-	set := component.TelemetrySettings{
-		Logger:        zap.NewNop(),
-		MeterProvider: noop.NewMeterProvider(),
-	}
+	set := newTestSettings()
 
 	ctx := context.Background()
-	proc, err := newReservoirProcessor(ctx, set, cfg, sink)
+	proc, err := newReservoirProcessor(ctx, set, cfg, sink, nil)
 	require.NoError(t, err)
 
 	// Start the processor
@@ -138,36 +315,91 @@ func TestReservoirSampling(t *testing.T) {
 	p, ok := proc.(*reservoirProcessor)
 	require.True(t, ok)
 
-	p.lock.RLock()
-	reservoirSize := len(p.reservoir)
-	windowCount := p.windowCount.Load()
-	p.lock.RUnlock()
+	reservoirSize := p.reservoir.Size()
+	_, _, _, windowCount := p.windowManager.GetCurrentState()
 
 	assert.Equal(t, int64(numSpans), windowCount, "Window count should match the number of spans processed")
 	assert.LessOrEqual(t, reservoirSize, cfg.SizeK, "Reservoir size should not exceed the configured limit")
 }
 
+// TestReservoirCloseWindow tests that closing a window exports and empties each kind of reservoir
+func TestReservoirCloseWindow(t *testing.T) {
+	cfg := &Config{
+		SizeK:              10,
+		StrataPolicy:       StrataPolicyEqual,
+		MaxStrata:          10,
+		TraceReservoirUnit: TraceReservoirUnitSpans,
+	}
+	// Each reservoir samples a window of its own
+	newWindow := func() *WindowManager { return NewWindowManager(time.Minute, nil, zap.NewNop()) }
+	reservoirs := map[string]ReservoirStore{
+		"spans":      NewReservoir(10, newWindow(), atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop()),
+		"traces":     NewTraceReservoir(10, TraceReservoirUnitSpans, newWindow(), atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop()),
+		"stratified": NewStratifiedReservoir(cfg, newWindow(), atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop()),
+		"sharded":    NewShardedReservoir(2, 10, newWindow(), atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop()),
+	}
+
+	for name, r := range reservoirs {
+		t.Run(name, func(t *testing.T) {
+			for i := 0; i < 50; i++ {
+				r.AddTrace(newTestTrace(i, 1))
+			}
+
+			traces, err := r.CloseWindow(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, 10, traces.SpanCount())
+			assert.Equal(t, 0, r.Size())
+		})
+	}
+}
+
+// TestRolloverWithoutTraffic tests that a window is exported when it ends
+// even if no further spans arrive
+func TestRolloverWithoutTraffic(t *testing.T) {
+	cfg := &Config{
+		SizeK:              10,
+		WindowDuration:     100 * time.Millisecond,
+		CheckpointInterval: 1 * time.Second,
+		ExportQueueSize:    10,
+		TraceAware:         false,
+	}
+
+	sink := new(consumertest.TracesSink)
+	ctx := context.Background()
+	proc, err := newReservoirProcessor(ctx, newTestSettings(), cfg, sink, nil)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, nil))
+	defer func() {
+		require.NoError(t, proc.Shutdown(ctx))
+	}()
+
+	require.NoError(t, proc.ConsumeTraces(ctx, generateTraces(100)))
+
+	// Only the window with spans is exported
+	time.Sleep(350 * time.Millisecond)
+	require.Len(t, sink.AllTraces(), 1)
+	assert.Equal(t, 10, sink.AllTraces()[0].SpanCount())
+}
+
 // TestTraceAwareSampling tests trace-aware sampling functionality
 func TestTraceAwareSampling(t *testing.T) {
 	// Create processor with trace-aware sampling
 	cfg := &Config{
 		SizeK:              10,
-		WindowDuration:     "10s",
+		WindowDuration:     10 * time.Second,
 		CheckpointPath:     "",
-		CheckpointInterval: "1s",
+		CheckpointInterval: 1 * time.Second,
+		ExportQueueSize:    10,
 		TraceAware:         true,
 		TraceBufferMaxSize: 100,
-		TraceBufferTimeout: "50ms", // Short timeout for testing
+		TraceBufferTimeout: 50 * time.Millisecond, // Short timeout for testing
 	}
 
 	sink := new(consumertest.TracesSink)
-	set := component.TelemetrySettings{
-		Logger:        zap.NewNop(),
-		MeterProvider: noop.NewMeterProvider(),
-	}
+	set := newTestSettings()
 
 	ctx := context.Background()
-	proc, err := newReservoirProcessor(ctx, set, cfg, sink)
+	proc, err := newReservoirProcessor(ctx, set, cfg, sink, nil)
 	require.NoError(t, err)
 
 	// Start the processor
@@ -200,6 +432,63 @@ func TestTraceAwareSampling(t *testing.T) {
 	}
 }
 
+// TestTraceAwareRootSpanCompletion tests that a trace is sampled soon after
+// its root span arrives rather than after the idle timeout
+func TestTraceAwareRootSpanCompletion(t *testing.T) {
+	cfg := &Config{
+		SizeK:                10,
+		WindowDuration:       time.Minute,
+		CheckpointInterval:   time.Second,
+		ExportQueueSize:      10,
+		TraceAware:           true,
+		TraceBufferMaxSize:   100,
+		TraceBufferTimeout:   time.Hour,
+		TraceCompletion:      []string{TraceCompletionRootSpan},
+		TraceCompletionGrace: 0,
+	}
+
+	ctx := context.Background()
+	proc, err := newReservoirProcessor(ctx, newTestSettings(), cfg, new(consumertest.TracesSink), nil)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, nil))
+	defer func() {
+		require.NoError(t, proc.Shutdown(ctx))
+	}()
+
+	rp := proc.(*reservoirProcessor)
+	require.NoError(t, proc.ConsumeTraces(ctx, newTestTrace(1, 3)))
+	require.Eventually(t, func() bool { return rp.reservoir.Size() == 3 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, 0, rp.traceBuffer.Size())
+}
+
+// TestRolloverLeavesTraceBuffer tests that a window rollover leaves completed
+// traces in the trace buffer, for the trace buffer loop to add to the new
+// window outside the window lock
+func TestRolloverLeavesTraceBuffer(t *testing.T) {
+	cfg := &Config{
+		SizeK:                10,
+		WindowDuration:       time.Minute,
+		CheckpointInterval:   time.Second,
+		ExportQueueSize:      10,
+		TraceAware:           true,
+		TraceBufferMaxSize:   100,
+		TraceBufferTimeout:   time.Hour,
+		TraceCompletion:      []string{TraceCompletionRootSpan},
+		TraceCompletionGrace: 0,
+	}
+
+	// The processor is not started, so nothing else drains the buffer
+	proc, err := newReservoirProcessor(context.Background(), newTestSettings(), cfg, new(consumertest.TracesSink), nil)
+	require.NoError(t, err)
+	rp := proc.(*reservoirProcessor)
+	forEachSpan(newTestTrace(1, 3), rp.traceBuffer.AddSpan)
+
+	rp.onWindowRollover()
+	assert.Equal(t, 1, rp.traceBuffer.Size())
+	assert.Equal(t, 0, rp.reservoir.Size())
+	assert.Len(t, rp.traceBuffer.GetCompletedTraces(), 1)
+}
+
 // generateTraces creates test trace data with the specified number of spans
 func generateTraces(numSpans int) ptrace.Traces {
 	traces := ptrace.NewTraces()
@@ -247,15 +536,22 @@ func generateTracesWithSharedIDs(numSpans, numTraces int) ptrace.Traces {
 	return traces
 }
 
-// generateTraceID creates a trace ID from an integer
+// generateTraceID creates a trace ID from an integer, distinct for every
+// integer, which is kept in its first 8 bytes
 func generateTraceID(id int) pcommon.TraceID {
 	var traceID [16]byte
 	for i := 0; i < 16; i++ {
 		traceID[i] = byte((id + i) % 256)
 	}
+	binary.BigEndian.PutUint64(traceID[:8], uint64(id))
 	return pcommon.TraceID(traceID)
 }
 
+// traceNumber returns the integer a trace ID was generated from
+func traceNumber(traceID pcommon.TraceID) int {
+	return int(binary.BigEndian.Uint64(traceID[:8]))
+}
+
 // generateSpanID creates a span ID from an integer
 func generateSpanID(id int) pcommon.SpanID {
 	var spanID [8]byte
@@ -270,20 +566,18 @@ func BenchmarkReservoirSampling(b *testing.B) {
 	// Create processor with in-memory storage (no checkpoints)
 	cfg := &Config{
 		SizeK:              1000,
-		WindowDuration:     "60s",
+		WindowDuration:     60 * time.Second,
 		CheckpointPath:     "",
-		CheckpointInterval: "1s",
+		CheckpointInterval: 1 * time.Second,
+		ExportQueueSize:    10,
 		TraceAware:         false,
 	}
 
 	sink := new(consumertest.TracesSink)
-	set := component.TelemetrySettings{
-		Logger:        zap.NewNop(),
-		MeterProvider: noop.NewMeterProvider(),
-	}
+	set := newTestSettings()
 
 	ctx := context.Background()
-	proc, err := newReservoirProcessor(ctx, set, cfg, sink)
+	proc, err := newReservoirProcessor(ctx, set, cfg, sink, nil)
 	require.NoError(b, err)
 
 	// Start the processor
@@ -312,22 +606,20 @@ func BenchmarkTraceAwareSampling(b *testing.B) {
 	// Create processor with trace-aware sampling
 	cfg := &Config{
 		SizeK:              1000,
-		WindowDuration:     "60s",
+		WindowDuration:     60 * time.Second,
 		CheckpointPath:     "",
-		CheckpointInterval: "1s",
+		CheckpointInterval: 1 * time.Second,
+		ExportQueueSize:    10,
 		TraceAware:         true,
 		TraceBufferMaxSize: 10000,
-		TraceBufferTimeout: "10s",
+		TraceBufferTimeout: 10 * time.Second,
 	}
 
 	sink := new(consumertest.TracesSink)
-	set := component.TelemetrySettings{
-		Logger:        zap.NewNop(),
-		MeterProvider: noop.NewMeterProvider(),
-	}
+	set := newTestSettings()
 
 	ctx := context.Background()
-	proc, err := newReservoirProcessor(ctx, set, cfg, sink)
+	proc, err := newReservoirProcessor(ctx, set, cfg, sink, nil)
 	require.NoError(b, err)
 
 	// Start the processor
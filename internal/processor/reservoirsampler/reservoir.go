@@ -1,10 +1,11 @@
 package reservoirsampler
 
 import (
+	"container/heap"
 	"context"
+	"math"
 	"math/rand"
 	"sync"
-	"time"
 
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/ptrace"
@@ -18,18 +19,44 @@ type Reservoir struct {
 	spanMap  map[uint64]SpanWithResource
 	spanKeys []uint64
 	
+	// Weighted sampling: the weight function, the sampled spans' keys in a
+	// min-heap that replaces spanKeys, and the weight left to skip before the
+	// next replacement
+	weightFn   WeightFunc
+	keyHeap    spanKeyHeap
+	skipWeight float64
+	
+	// Algorithm L: the largest random key among the sampled spans, and the
+	// count of the next span to replace one, or 0 until it is drawn. Spans
+	// before it are skipped without taking the lock.
+	skipping        bool
+	threshold       float64
+	nextReplacement atomic.Int64
+	
+	// Mutations since the last checkpoint, for delta checkpointing
+	dirtyAdded   map[uint64]struct{}
+	dirtyEvicted map[uint64]struct{}
+	
 	// Configuration
 	size   int
 	window *WindowManager
 	
-	// Thread safety
-	mu        sync.RWMutex
-	randomMu  sync.Mutex
-	random    *rand.Rand
+	// Without a window manager, the reservoir counts the spans it sees itself
+	seen atomic.Int64
 	
-	// Metrics
+	// The stratum recorded on sampled spans, if the reservoir is part of a
+	// StratifiedReservoir
+	stratum string
+	
+	// Thread safety. Random numbers come from the lock-free top-level
+	// math/rand functions, so drawing one takes no lock of its own.
+	mu sync.RWMutex
+	
+	// Metrics. The size gauge is moved by the change in size since it was
+	// last reported, so the shards of a ShardedReservoir can share it.
 	sizeGauge       *atomic.Int64
 	sampledCounter  *atomic.Int64
+	reportedSize    int64
 	
 	// Logging
 	logger *zap.Logger
@@ -42,23 +69,21 @@ var spanWithResourcePool = sync.Pool{
 	},
 }
 
-// NewReservoir creates a new reservoir with the given size
+// NewReservoir creates a new reservoir with the given size.
+// A reservoir without a window manager counts the spans it sees itself.
 func NewReservoir(
 	size int, 
 	window *WindowManager, 
 	sizeGauge, sampledCounter *atomic.Int64, 
 	logger *zap.Logger,
 ) *Reservoir {
-	// Use a cryptographically secure seed for the random number generator
-	seed := time.Now().UnixNano()
-	source := rand.NewSource(seed)
-	
 	return &Reservoir{
 		spanMap:        make(map[uint64]SpanWithResource, size),
 		spanKeys:       make([]uint64, 0, size),
+		dirtyAdded:     make(map[uint64]struct{}),
+		dirtyEvicted:   make(map[uint64]struct{}),
 		size:           size,
 		window:         window,
-		random:         rand.New(source),
 		sizeGauge:      sizeGauge,
 		sampledCounter: sampledCounter,
 		logger:         logger,
@@ -70,11 +95,63 @@ func (r *Reservoir) Reset() {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	
+	r.resetLocked()
+}
+
+// CloseWindow exports the reservoir and clears it for a new window in one
+// step, so no span added in between is lost
+func (r *Reservoir) CloseWindow(ctx context.Context) (ptrace.Traces, error) {
+	exportTraces := ptrace.NewTraces()
+	r.closeWindowTo(exportTraces)
+	
+	return exportTraces, nil
+}
+
+// closeWindowTo inserts the sampled spans into traces and clears the
+// reservoir for a new window in one step
+func (r *Reservoir) closeWindowTo(traces ptrace.Traces) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	r.exportToLocked(traces)
+	r.resetLocked()
+}
+
+// resetLocked clears the reservoir (must be called with lock held)
+func (r *Reservoir) resetLocked() {
 	r.spanMap = make(map[uint64]SpanWithResource, r.size)
 	r.spanKeys = make([]uint64, 0, r.size)
+	r.keyHeap = nil
+	r.skipWeight = 0
+	r.seen.Store(0)
+	r.nextReplacement.Store(0)
+	
+	// The new window starts with nothing persisted
+	r.dirtyAdded = make(map[uint64]struct{})
+	r.dirtyEvicted = make(map[uint64]struct{})
 	
 	// Update metrics
-	r.sizeGauge.Store(0)
+	r.updateSizeGaugeLocked()
+}
+
+// SetWeightFunc switches the reservoir to weighted sampling with the given weight function
+func (r *Reservoir) SetWeightFunc(weightFn WeightFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	r.weightFn = weightFn
+	r.nextReplacement.Store(0)
+}
+
+// SetAlgorithm selects how the reservoir samples uniformly once it is full:
+// Algorithm R draws a random number for every span, while Algorithm L draws
+// how many spans to skip before the next one it keeps
+func (r *Reservoir) SetAlgorithm(algorithm string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	r.skipping = algorithm == ReservoirAlgorithmL
+	r.nextReplacement.Store(0)
 }
 
 // AddSpan adds a span to the reservoir using reservoir sampling algorithm
@@ -85,44 +162,71 @@ func (r *Reservoir) Reset() {
 //     where:
 //     n = the number of elements we have seen so far
 //     k = the size of our reservoir
+//
+// Most spans are rejected once the reservoir is full, so the decision is made
+// first: a rejected span is neither hashed nor copied. With Algorithm L the
+// spans before the next replacement are rejected without taking the lock.
 func (r *Reservoir) AddSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
 	// Increment the total count for this window
-	count := r.window.IncrementCount()
+	var count int64
+	if r.window != nil {
+		count = r.window.IncrementCount()
+	} else {
+		count = r.seen.Inc()
+	}
 	
-	// Create span key and hash
-	key := createSpanKey(span)
-	hash := hashSpanKey(key)
+	if next := r.nextReplacement.Load(); next > 0 && count < next {
+		return
+	}
 	
 	// Acquire lock for modifying the reservoir
 	r.mu.Lock()
 	defer r.mu.Unlock()
 	
-	if int(count) <= r.size {
+	// A stratum may be left without capacity
+	if r.size <= 0 {
+		return
+	}
+	
+	if r.weightFn != nil {
+		r.addSpanWeightedLocked(span, resource, scope)
+	} else if int(count) <= r.size && len(r.spanKeys) < r.size {
 		// Reservoir not full yet, add span directly
+		hash := hashSpanKey(createSpanKey(span))
 		r.addSpanToReservoirLocked(hash, span, resource, scope)
+		r.spanKeys = append(r.spanKeys, hash)
+	} else if r.skipping && len(r.spanKeys) >= r.size {
+		r.addSpanSkippingLocked(count, span, resource, scope)
 	} else {
-		// Reservoir is full, use reservoir sampling algorithm
+		// Reservoir is full, or was grown by Resize after more spans than
+		// its size were seen, use reservoir sampling algorithm
 		// Generate a random index in [0, count)
-		r.randomMu.Lock()
-		j := r.random.Int63n(count)
-		r.randomMu.Unlock()
+		j := rand.Int63n(count)
 		
 		if j < int64(r.size) {
-			// Replace the span at index j
-			oldHash := r.spanKeys[j]
-			delete(r.spanMap, oldHash)
-			
-			// Add the new span
-			r.addSpanToReservoirLocked(hash, span, resource, scope)
-			
-			// Replace the key at index j
-			r.spanKeys[j] = hash
+			hash := hashSpanKey(createSpanKey(span))
+			if len(r.spanKeys) < r.size {
+				// Fill the room left by Resize
+				r.addSpanToReservoirLocked(hash, span, resource, scope)
+				r.spanKeys = append(r.spanKeys, hash)
+			} else {
+				// Replace the span at index j
+				oldHash := r.spanKeys[j]
+				delete(r.spanMap, oldHash)
+				r.markEvictedLocked(oldHash)
+				
+				// Add the new span
+				r.addSpanToReservoirLocked(hash, span, resource, scope)
+				
+				// Replace the key at index j
+				r.spanKeys[j] = hash
+			}
 		}
 		// If j >= size, just skip this span
 	}
 	
 	// Update metrics
-	r.sizeGauge.Store(int64(len(r.spanMap)))
+	r.updateSizeGaugeLocked()
 }
 
 // addSpanToReservoirLocked adds a span to the reservoir (must be called with lock held)
@@ -133,9 +237,15 @@ func (r *Reservoir) addSpanToReservoirLocked(hash uint64, span ptrace.Span, reso
 	// Clone the span and its context
 	FillSpanWithResource(spanWithRes, span, resource, scope)
 	
+	// Record the stratum the span was sampled in
+	if r.stratum != "" {
+		spanWithRes.Span.Attributes().PutStr(stratumAttributeKey, r.stratum)
+	}
+	
 	// Add to the reservoir
 	r.spanMap[hash] = *spanWithRes
-	r.spanKeys = append(r.spanKeys, hash)
+	r.dirtyAdded[hash] = struct{}{}
+	delete(r.dirtyEvicted, hash)
 	
 	// Return the span to the pool (after copying to map)
 	PutSpanWithResource(spanWithRes)
@@ -144,6 +254,289 @@ func (r *Reservoir) addSpanToReservoirLocked(hash uint64, span ptrace.Span, reso
 	r.sampledCounter.Inc()
 }
 
+// addSpanSkippingLocked adds a span to the full reservoir using skips between
+// replacements (must be called with lock held)
+//
+// This implements Algorithm L (Kim-Hung Li):
+//  1. Each span gets a uniform random key, and the reservoir keeps the k
+//     spans with the smallest keys; W is the largest of those
+//  2. Rather than drawing a key for every span, the number of spans to skip
+//     before the next one with a key below W is drawn from its geometric
+//     distribution
+//  3. That span replaces a sampled span at random, and W becomes the largest
+//     key of the new sample, W * u^(1/k) for a uniform random u
+//
+// Each replacement comes with the same probability k/n as in Algorithm R.
+func (r *Reservoir) addSpanSkippingLocked(count int64, span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+	next := r.nextReplacement.Load()
+	if next == 0 {
+		// The reservoir has just filled up, or was restored or resized: W
+		// is the k-th smallest of the keys of the count-1 spans before this one
+		r.threshold = betaVariate(float64(r.size), float64(count-int64(r.size)))
+		next = count + r.skipLengthLocked()
+	}
+	
+	// The span falls within the skip, drawn after it passed the lock-free check
+	if count < next {
+		r.nextReplacement.Store(next)
+		return
+	}
+	
+	// Replace a span at random
+	j := rand.Intn(len(r.spanKeys))
+	oldHash := r.spanKeys[j]
+	delete(r.spanMap, oldHash)
+	r.markEvictedLocked(oldHash)
+	
+	hash := hashSpanKey(createSpanKey(span))
+	r.addSpanToReservoirLocked(hash, span, resource, scope)
+	r.spanKeys[j] = hash
+	
+	// Spans that raced ahead of this one count towards the next skip, so
+	// the replacements stay where they were drawn
+	r.threshold *= math.Exp(math.Log(r.uniformLocked()) / float64(r.size))
+	r.nextReplacement.Store(next + r.skipLengthLocked() + 1)
+}
+
+// skipLengthLocked draws the number of spans to skip before the next one
+// whose key falls below the threshold (must be called with lock held)
+func (r *Reservoir) skipLengthLocked() int64 {
+	skip := math.Floor(math.Log(r.uniformLocked()) / math.Log1p(-r.threshold))
+	
+	// The threshold can be too small to ever be crossed
+	if !(skip < maxSkipLength) {
+		return maxSkipLength
+	}
+	return int64(skip)
+}
+
+// maxSkipLength bounds the skips of Algorithm L, so adding them to a span count cannot overflow
+const maxSkipLength = 1 << 62
+
+// betaVariate draws from the Beta(a, b) distribution, for a and b of at
+// least 1, as X/(X+Y) with X and Y drawn from Gamma(a) and Gamma(b)
+func betaVariate(a, b float64) float64 {
+	x := gammaVariate(a)
+	return x / (x + gammaVariate(b))
+}
+
+// gammaVariate draws from the Gamma(a, 1) distribution, for a of at least 1,
+// using the method of Marsaglia and Tsang
+func gammaVariate(a float64) float64 {
+	d := a - 1.0/3
+	c := 1 / math.Sqrt(9*d)
+	for {
+		x := rand.NormFloat64()
+		v := 1 + c*x
+		if v <= 0 {
+			continue
+		}
+		v = v * v * v
+		if math.Log(rand.Float64()) < x*x/2+d-d*v+d*math.Log(v) {
+			return d * v
+		}
+	}
+}
+
+// addSpanWeightedLocked adds a span using weighted reservoir sampling (must be called with lock held)
+//
+// This implements Algorithm A-ExpJ (Efraimidis and Spirakis):
+//  1. Each span gets the key u^(1/w), for a uniform random u and its weight w,
+//     and the reservoir keeps the k spans with the largest keys
+//  2. Once the reservoir is full, rather than drawing a key for every span,
+//     an exponential jump decides how much weight to skip before the next
+//     span that replaces the one with the smallest key
+func (r *Reservoir) addSpanWeightedLocked(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+	weight := r.weightFn(span, resource)
+	if !(weight > 0) || math.IsInf(weight, 1) {
+		return
+	}
+	
+	if len(r.keyHeap) < r.size {
+		// The span is already sampled
+		hash := hashSpanKey(createSpanKey(span))
+		if _, exists := r.spanMap[hash]; exists {
+			return
+		}
+		
+		// Reservoir not full yet, add span with a fresh key
+		r.addSpanToReservoirLocked(hash, span, resource, scope)
+		heap.Push(&r.keyHeap, keyedSpan{hash: hash, logKey: math.Log(r.uniformLocked()) / weight})
+		if len(r.keyHeap) == r.size {
+			r.skipWeight = r.nextJumpLocked()
+		}
+		return
+	}
+	
+	r.skipWeight -= weight
+	if r.skipWeight > 0 {
+		return
+	}
+	
+	// The span is already sampled; the next span takes the replacement
+	hash := hashSpanKey(createSpanKey(span))
+	if _, exists := r.spanMap[hash]; exists {
+		return
+	}
+	
+	// The span's key is drawn from above the smallest key in the reservoir,
+	// u in (Tw^w, 1) where Tw is the smallest key
+	tw := math.Exp(weight * r.keyHeap[0].logKey)
+	logKey := math.Log(tw+(1-tw)*r.uniformLocked()) / weight
+	
+	// Replace the span with the smallest key
+	oldHash := r.keyHeap[0].hash
+	delete(r.spanMap, oldHash)
+	r.markEvictedLocked(oldHash)
+	
+	r.addSpanToReservoirLocked(hash, span, resource, scope)
+	r.keyHeap[0] = keyedSpan{hash: hash, logKey: logKey}
+	heap.Fix(&r.keyHeap, 0)
+	
+	r.skipWeight = r.nextJumpLocked()
+}
+
+// nextJumpLocked draws the weight to skip before the next replacement (must be called with lock held).
+// This is log(u)/log(Tw), where log(Tw) is the smallest log key.
+func (r *Reservoir) nextJumpLocked() float64 {
+	return math.Log(r.uniformLocked()) / r.keyHeap[0].logKey
+}
+
+// uniformLocked returns a uniform random number in (0, 1) (must be called with lock held)
+func (r *Reservoir) uniformLocked() float64 {
+	u := rand.Float64()
+	if u == 0 {
+		u = math.SmallestNonzeroFloat64
+	}
+	return u
+}
+
+// updateSizeGaugeLocked moves the size gauge by the change in the number of
+// sampled spans since it was last reported (must be called with lock held)
+func (r *Reservoir) updateSizeGaugeLocked() {
+	size := int64(len(r.spanMap))
+	r.sizeGauge.Add(size - r.reportedSize)
+	r.reportedSize = size
+}
+
+// markEvictedLocked records that a span left the reservoir (must be called with lock held)
+func (r *Reservoir) markEvictedLocked(hash uint64) {
+	// Deleting a span that was added since the last checkpoint is harmless,
+	// and it may have overwritten a persisted span with the same hash
+	delete(r.dirtyAdded, hash)
+	r.dirtyEvicted[hash] = struct{}{}
+}
+
+// AddTrace adds every span of a completed trace to the reservoir
+func (r *Reservoir) AddTrace(traces ptrace.Traces) {
+	forEachSpan(traces, r.AddSpan)
+}
+
+// Resize changes the reservoir size. Shrinking evicts spans at random in
+// uniform mode and the spans with the smallest keys in weighted mode, so the
+// spans that remain are still a sample of the same kind. Growing leaves room
+// that later spans fill only as often as they would replace a span, so every
+// span of the window keeps the inclusion probability it is reported with.
+func (r *Reservoir) Resize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	if size < 0 {
+		size = 0
+	}
+	r.size = size
+	r.nextReplacement.Store(0)
+	
+	if r.weightFn != nil {
+		for len(r.keyHeap) > size {
+			ks := heap.Pop(&r.keyHeap).(keyedSpan)
+			delete(r.spanMap, ks.hash)
+			r.markEvictedLocked(ks.hash)
+		}
+		if size > 0 && len(r.keyHeap) == size {
+			r.skipWeight = r.nextJumpLocked()
+		}
+	} else {
+		for len(r.spanKeys) > size {
+			j := rand.Intn(len(r.spanKeys))
+			
+			hash := r.spanKeys[j]
+			last := len(r.spanKeys) - 1
+			r.spanKeys[j] = r.spanKeys[last]
+			r.spanKeys = r.spanKeys[:last]
+			delete(r.spanMap, hash)
+			r.markEvictedLocked(hash)
+		}
+	}
+	
+	// Update metrics
+	r.updateSizeGaugeLocked()
+}
+
+// RestoreSpans loads spans from a checkpoint into the reservoir.
+// Unlike AddSpan it neither counts nor resamples the spans: they were already
+// selected before the checkpoint was taken, and the window count is restored
+// separately. In weighted mode the spans get fresh keys from their weights,
+// as keys are not checkpointed. Spans beyond the reservoir size are dropped.
+// It returns the number of spans restored.
+func (r *Reservoir) RestoreSpans(spans map[uint64]SpanWithResource) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	r.nextReplacement.Store(0)
+	restored := 0
+	for hash, spanWithRes := range spans {
+		if len(r.spanMap) >= r.size {
+			break
+		}
+		if _, exists := r.spanMap[hash]; exists {
+			continue
+		}
+		
+		r.spanMap[hash] = spanWithRes
+		if r.weightFn != nil {
+			weight := r.weightFn(spanWithRes.Span, spanWithRes.Resource)
+			if !(weight > 0) {
+				weight = 1
+			}
+			heap.Push(&r.keyHeap, keyedSpan{hash: hash, logKey: math.Log(r.uniformLocked()) / weight})
+		} else {
+			r.spanKeys = append(r.spanKeys, hash)
+		}
+		restored++
+	}
+	
+	if r.weightFn != nil && len(r.keyHeap) == r.size {
+		r.skipWeight = r.nextJumpLocked()
+	}
+	
+	// Update metrics
+	r.updateSizeGaugeLocked()
+	
+	return restored
+}
+
+// seenCount returns the number of spans the reservoir has counted itself
+func (r *Reservoir) seenCount() int64 {
+	return r.seen.Load()
+}
+
+// setSeenCount sets the number of spans the reservoir has counted itself, as
+// restored from a checkpoint
+func (r *Reservoir) setSeenCount(seen int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen.Store(seen)
+	r.nextReplacement.Store(0)
+}
+
+// setStratum sets the stratum recorded on sampled spans
+func (r *Reservoir) setStratum(stratum string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stratum = stratum
+}
+
 // Export returns all spans in the reservoir as traces
 func (r *Reservoir) Export(ctx context.Context) (ptrace.Traces, error) {
 	r.mu.RLock()
@@ -158,13 +551,66 @@ func (r *Reservoir) Export(ctx context.Context) (ptrace.Traces, error) {
 	}
 	
 	// Add all spans from the reservoir to the traces
-	for _, hash := range r.spanKeys {
+	r.exportToLocked(exportTraces)
+	
+	return exportTraces, nil
+}
+
+// exportTo inserts the sampled spans into traces in reservoir order
+func (r *Reservoir) exportTo(traces ptrace.Traces) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.exportToLocked(traces)
+}
+
+// exportToLocked inserts the sampled spans into traces in reservoir order,
+// recording the probability each was sampled with (must be called with lock held)
+func (r *Reservoir) exportToLocked(traces ptrace.Traces) {
+	for _, hash := range r.hashesLocked() {
 		if spanWithRes, ok := r.spanMap[hash]; ok {
-			insertSpanIntoTraces(exportTraces, spanWithRes)
+			span := insertSpanIntoTraces(traces, spanWithRes)
+			applySamplingProbability(span, r.inclusionProbabilityLocked(spanWithRes))
 		}
 	}
+}
+
+// inclusionProbabilityLocked returns the probability that a sampled span was
+// kept (must be called with lock held).
+//
+// In uniform mode this is k/n for a reservoir of size k that has seen n spans.
+// In weighted mode a span of weight w is kept if its key u^(1/w) exceeds the
+// smallest key T in the reservoir, which happens with probability 1 - T^w.
+func (r *Reservoir) inclusionProbabilityLocked(spanWithRes SpanWithResource) float64 {
+	count := r.seen.Load()
+	if r.window != nil {
+		count = r.window.Count()
+	}
+	if count <= int64(r.size) {
+		return 1
+	}
+
+	if r.weightFn == nil || len(r.keyHeap) == 0 {
+		return float64(r.size) / float64(count)
+	}
+
+	weight := r.weightFn(spanWithRes.Span, spanWithRes.Resource)
+	if !(weight > 0) {
+		weight = 1
+	}
+	return -math.Expm1(weight * r.keyHeap[0].logKey)
+}
+
+// hashesLocked returns the hashes of the sampled spans in reservoir order (must be called with lock held)
+func (r *Reservoir) hashesLocked() []uint64 {
+	if r.weightFn == nil {
+		return r.spanKeys
+	}
 	
-	return exportTraces, nil
+	hashes := make([]uint64, 0, len(r.keyHeap))
+	for _, ks := range r.keyHeap {
+		hashes = append(hashes, ks.hash)
+	}
+	return hashes
 }
 
 // GetAllSpans returns a copy of all spans in the reservoir
@@ -181,6 +627,48 @@ func (r *Reservoir) GetAllSpans() map[uint64]SpanWithResource {
 	return spansCopy
 }
 
+// TakeDelta returns the spans added and the hashes evicted since the previous
+// TakeDelta or TakeSnapshot, and starts tracking mutations afresh
+func (r *Reservoir) TakeDelta() (added map[uint64]SpanWithResource, evicted []uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	added = make(map[uint64]SpanWithResource, len(r.dirtyAdded))
+	for hash := range r.dirtyAdded {
+		if spanWithRes, ok := r.spanMap[hash]; ok {
+			added[hash] = spanWithRes
+		}
+	}
+	
+	evicted = make([]uint64, 0, len(r.dirtyEvicted))
+	for hash := range r.dirtyEvicted {
+		evicted = append(evicted, hash)
+	}
+	
+	r.dirtyAdded = make(map[uint64]struct{})
+	r.dirtyEvicted = make(map[uint64]struct{})
+	
+	return added, evicted
+}
+
+// TakeSnapshot returns a copy of all spans in the reservoir and starts
+// tracking mutations afresh, as the snapshot supersedes any pending delta
+func (r *Reservoir) TakeSnapshot() map[uint64]SpanWithResource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	
+	// Create a copy of the span map
+	spansCopy := make(map[uint64]SpanWithResource, len(r.spanMap))
+	for hash, spanWithRes := range r.spanMap {
+		spansCopy[hash] = spanWithRes
+	}
+	
+	r.dirtyAdded = make(map[uint64]struct{})
+	r.dirtyEvicted = make(map[uint64]struct{})
+	
+	return spansCopy
+}
+
 // Size returns the number of spans in the reservoir
 func (r *Reservoir) Size() int {
 	r.mu.RLock()
@@ -0,0 +1,207 @@
+package reservoirsampler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// sampleIndexes samples the spans of traces, each with a trace numbered by
+// newTestTrace, in a new reservoir and returns the numbers of the sampled
+// spans and how many spans were added to the reservoir along the way
+func sampleIndexes(t *testing.T, algorithm string, size int, traces ptrace.Traces) ([]int, int64) {
+	sampled := atomic.NewInt64(0)
+	r := NewReservoir(size, nil, atomic.NewInt64(0), sampled, zap.NewNop())
+	r.SetAlgorithm(algorithm)
+	forEachSpan(traces, r.AddSpan)
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	return traceNumbers(exported), sampled.Load()
+}
+
+// traceNumbers returns the numbers given by newTestTrace to the traces of the spans
+func traceNumbers(traces ptrace.Traces) []int {
+	var numbers []int
+	forEachSpan(traces, func(span ptrace.Span, _ pcommon.Resource, _ pcommon.InstrumentationScope) {
+		numbers = append(numbers, traceNumber(span.TraceID()))
+	})
+	return numbers
+}
+
+// TestReservoirAlgorithmEquivalence tests that Algorithm L samples like
+// Algorithm R: every span is kept with probability k/n, and spans enter the
+// reservoir as often
+func TestReservoirAlgorithmEquivalence(t *testing.T) {
+	const (
+		trials   = 1000
+		numSpans = 1000
+		size     = 50
+		buckets  = 10
+	)
+
+	traces := ptrace.NewTraces()
+	for i := 1; i <= numSpans; i++ {
+		newTestTrace(i, 1).ResourceSpans().MoveAndAppendTo(traces.ResourceSpans())
+	}
+
+	// A span enters the reservoir with probability k/i once i > k
+	expectedAdded := float64(size)
+	for i := size + 1; i <= numSpans; i++ {
+		expectedAdded += float64(size) / float64(i)
+	}
+
+	for _, algorithm := range []string{ReservoirAlgorithmR, ReservoirAlgorithmL} {
+		t.Run(algorithm, func(t *testing.T) {
+			counts := make([]int, buckets)
+			var added int64
+			for trial := 0; trial < trials; trial++ {
+				numbers, trialAdded := sampleIndexes(t, algorithm, size, traces)
+				require.Len(t, numbers, size)
+				for _, number := range numbers {
+					counts[(number-1)*buckets/numSpans]++
+				}
+				added += trialAdded
+			}
+
+			// Spans are kept evenly across the window. The critical value is
+			// for a significance level of 0.0001 with 9 degrees of freedom.
+			expected := float64(trials * size / buckets)
+			var chiSquare float64
+			for _, count := range counts {
+				chiSquare += (float64(count) - expected) * (float64(count) - expected) / expected
+			}
+			assert.Less(t, chiSquare, 33.72, "sampled spans by position: %v", counts)
+
+			assert.InEpsilon(t, expectedAdded, float64(added)/trials, 0.02)
+		})
+	}
+}
+
+// TestReservoirAlgorithmLRestore tests that Algorithm L resumes sampling
+// uniformly after the reservoir is restored in the middle of a window
+func TestReservoirAlgorithmLRestore(t *testing.T) {
+	const (
+		trials = 500
+		size   = 50
+	)
+
+	var early, late int
+	for trial := 0; trial < trials; trial++ {
+		r := NewReservoir(size, nil, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+		for i := 1; i <= 500; i++ {
+			r.AddTrace(newTestTrace(i, 1))
+		}
+		spans := r.TakeSnapshot()
+
+		restored := NewReservoir(size, nil, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+		restored.SetAlgorithm(ReservoirAlgorithmL)
+		restored.setSeenCount(500)
+		require.Equal(t, size, restored.RestoreSpans(spans))
+		for i := 501; i <= 1000; i++ {
+			restored.AddTrace(newTestTrace(i, 1))
+		}
+
+		exported, err := restored.Export(context.Background())
+		require.NoError(t, err)
+		for _, number := range traceNumbers(exported) {
+			if number <= 500 {
+				early++
+			} else {
+				late++
+			}
+		}
+	}
+
+	// Spans before and after the restore are kept alike
+	assert.InEpsilon(t, trials*size/2, early, 0.05)
+	assert.InEpsilon(t, trials*size/2, late, 0.05)
+}
+
+// TestReservoirAlgorithmLSkipsWithoutLock tests that spans within a skip
+// are rejected before the reservoir's lock is taken
+func TestReservoirAlgorithmLSkipsWithoutLock(t *testing.T) {
+	sampled := atomic.NewInt64(0)
+	r := NewReservoir(10, nil, atomic.NewInt64(0), sampled, zap.NewNop())
+	r.SetAlgorithm(ReservoirAlgorithmL)
+	for i := 1; i <= 100; i++ {
+		r.AddTrace(newTestTrace(i, 1))
+	}
+	before := sampled.Load()
+
+	// Spans counted before the next replacement are skipped even while the
+	// lock is held
+	next := r.nextReplacement.Load()
+	require.Greater(t, next, int64(100))
+	r.mu.Lock()
+	for i := int64(101); i < next && i <= 1000; i++ {
+		r.AddTrace(newTestTrace(int(i), 1))
+	}
+	r.mu.Unlock()
+
+	assert.Equal(t, before, sampled.Load())
+	assert.Equal(t, 10, r.Size())
+}
+
+// TestReservoirAlgorithmLConcurrent tests Algorithm L with spans added from
+// many goroutines, which race between the lock-free skip and the lock
+func TestReservoirAlgorithmLConcurrent(t *testing.T) {
+	window := NewWindowManager(time.Minute, nil, zap.NewNop())
+	r := NewReservoir(100, window, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+	r.SetAlgorithm(ReservoirAlgorithmL)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 1; i <= 5000; i++ {
+				r.AddTrace(newTestTrace(g*5000+i, 1))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(20000), window.Count())
+	assert.Equal(t, 100, r.Size())
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	assert.InEpsilon(t, 20000, sumAdjustedCounts(t, exported), 0.01)
+}
+
+// TestReservoirResizeGrow tests that a reservoir grown in the middle of a
+// window fills the new room at the sampling rate rather than with whichever
+// spans come next
+func TestReservoirResizeGrow(t *testing.T) {
+	window, sizeGauge, sampled := newTestWindow()
+	r := NewReservoir(10, window, sizeGauge, sampled, zap.NewNop())
+	for i := 1; i <= 1000; i++ {
+		r.AddTrace(newTestTrace(i, 1))
+	}
+	r.Resize(20)
+
+	// Each of the next spans is kept with probability 20/1000 or so
+	for i := 1001; i <= 1010; i++ {
+		r.AddTrace(newTestTrace(i, 1))
+	}
+	assert.Less(t, r.Size(), 15)
+
+	for i := 1011; i <= 20000; i++ {
+		r.AddTrace(newTestTrace(i, 1))
+	}
+	assert.Equal(t, 20, r.Size())
+	assert.Equal(t, int64(20), sizeGauge.Load())
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	assert.InEpsilon(t, 20000, sumAdjustedCounts(t, exported), 0.01)
+}
@@ -0,0 +1,135 @@
+package reservoirsampler
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// Sampling thresholds follow the OpenTelemetry tracestate convention: a span
+// kept with probability p carries ot=th:T in its tracestate, where T is the
+// rejection threshold (1-p)*2^56 written as up to 14 hex digits with trailing
+// zeros removed. Its adjusted count, the number of spans it stands for, is 1/p.
+const (
+	// maxThreshold is the exclusive upper bound of a 56-bit threshold
+	maxThreshold = 1 << 56
+
+	// thresholdDigits is the number of hex digits of a full-precision threshold
+	thresholdDigits = 14
+
+	// otTraceStateKey is the tracestate key of the OpenTelemetry vendor entry
+	otTraceStateKey = "ot"
+
+	// thresholdSubKey is the subkey of the threshold in the OpenTelemetry entry
+	thresholdSubKey = "th"
+)
+
+// probabilityToThreshold converts a sampling probability to a rejection threshold
+func probabilityToThreshold(probability float64) uint64 {
+	if !(probability < 1) {
+		return 0
+	}
+
+	threshold := math.Round((1 - probability) * maxThreshold)
+	if threshold >= maxThreshold {
+		// The smallest probability that can be expressed
+		return maxThreshold - 1
+	}
+	return uint64(threshold)
+}
+
+// thresholdToProbability converts a rejection threshold to a sampling probability
+func thresholdToProbability(threshold uint64) float64 {
+	return float64(maxThreshold-threshold) / maxThreshold
+}
+
+// encodeThreshold writes a threshold as hex digits without trailing zeros
+func encodeThreshold(threshold uint64) string {
+	encoded := strings.TrimRight(fmt.Sprintf("%0*x", thresholdDigits, threshold), "0")
+	if encoded == "" {
+		return "0"
+	}
+	return encoded
+}
+
+// decodeThreshold parses a threshold written by encodeThreshold
+func decodeThreshold(encoded string) (uint64, error) {
+	if encoded == "" || len(encoded) > thresholdDigits {
+		return 0, fmt.Errorf("invalid sampling threshold %q", encoded)
+	}
+
+	threshold, err := strconv.ParseUint(encoded, 16, 64)
+	if err != nil {
+		return 0, fmt.Errorf("invalid sampling threshold %q: %w", encoded, err)
+	}
+	return threshold << (4 * (thresholdDigits - len(encoded))), nil
+}
+
+// spanSamplingProbability returns the probability recorded in a span's
+// tracestate, or false if it has none
+func spanSamplingProbability(span ptrace.Span) (float64, bool) {
+	_, otValue := splitTraceState(span.TraceState().AsRaw())
+	for _, field := range strings.Split(otValue, ";") {
+		if value, ok := strings.CutPrefix(field, thresholdSubKey+":"); ok {
+			threshold, err := decodeThreshold(value)
+			if err != nil {
+				return 0, false
+			}
+			return thresholdToProbability(threshold), true
+		}
+	}
+	return 0, false
+}
+
+// applySamplingProbability records in a span's tracestate that the span was
+// kept with the given probability. A threshold set by an upstream sampler is
+// combined with it, as the span was sampled by both.
+func applySamplingProbability(span ptrace.Span, probability float64) {
+	if upstream, ok := spanSamplingProbability(span); ok {
+		probability *= upstream
+	}
+
+	others, otValue := splitTraceState(span.TraceState().AsRaw())
+
+	// Replace the threshold and keep the other OpenTelemetry subkeys
+	fields := []string{thresholdSubKey + ":" + encodeThreshold(probabilityToThreshold(probability))}
+	for _, field := range strings.Split(otValue, ";") {
+		if field != "" && !strings.HasPrefix(field, thresholdSubKey+":") {
+			fields = append(fields, field)
+		}
+	}
+
+	// The updated entry moves to the front of the tracestate
+	entries := append([]string{otTraceStateKey + "=" + strings.Join(fields, ";")}, others...)
+	span.TraceState().FromRaw(strings.Join(entries, ","))
+}
+
+// splitTraceState separates the OpenTelemetry entry of a tracestate from the others
+func splitTraceState(traceState string) (others []string, otValue string) {
+	for _, entry := range strings.Split(traceState, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if value, ok := strings.CutPrefix(entry, otTraceStateKey+"="); ok {
+			otValue = value
+			continue
+		}
+		others = append(others, entry)
+	}
+	return others, otValue
+}
+
+// setAdjustedCounts sets an attribute holding the adjusted count, 1/p, on
+// every span that has a sampling threshold
+func setAdjustedCounts(traces ptrace.Traces, attribute string) {
+	forEachSpan(traces, func(span ptrace.Span, _ pcommon.Resource, _ pcommon.InstrumentationScope) {
+		if probability, ok := spanSamplingProbability(span); ok && probability > 0 {
+			span.Attributes().PutDouble(attribute, 1/probability)
+		}
+	})
+}
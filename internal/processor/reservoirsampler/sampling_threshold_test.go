@@ -0,0 +1,157 @@
+package reservoirsampler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// sumAdjustedCounts adds up the adjusted counts recorded in the spans' tracestate
+func sumAdjustedCounts(t *testing.T, traces ptrace.Traces) float64 {
+	total := 0.0
+	forEachSpan(traces, func(span ptrace.Span, _ pcommon.Resource, _ pcommon.InstrumentationScope) {
+		probability, ok := spanSamplingProbability(span)
+		require.True(t, ok, "exported span without a sampling threshold")
+		total += 1 / probability
+	})
+	return total
+}
+
+// TestSamplingThreshold tests the tracestate threshold encoding
+func TestSamplingThreshold(t *testing.T) {
+	assert.Equal(t, "0", encodeThreshold(probabilityToThreshold(1)))
+	assert.Equal(t, "8", encodeThreshold(probabilityToThreshold(0.5)))
+	assert.Equal(t, "c", encodeThreshold(probabilityToThreshold(0.25)))
+	assert.Equal(t, "ffffffffffffff", encodeThreshold(probabilityToThreshold(0)))
+
+	for _, probability := range []float64{1, 0.5, 0.1, 1.0 / 3, 1e-9} {
+		threshold, err := decodeThreshold(encodeThreshold(probabilityToThreshold(probability)))
+		require.NoError(t, err)
+		assert.InEpsilon(t, probability, thresholdToProbability(threshold), 1e-6)
+	}
+
+	_, err := decodeThreshold("")
+	assert.Error(t, err)
+	_, err = decodeThreshold("123456789abcdef")
+	assert.Error(t, err)
+	_, err = decodeThreshold("xyz")
+	assert.Error(t, err)
+}
+
+// TestApplySamplingProbability tests that the threshold combines with an
+// upstream one and leaves the rest of the tracestate alone
+func TestApplySamplingProbability(t *testing.T) {
+	span := ptrace.NewSpan()
+	applySamplingProbability(span, 0.25)
+	assert.Equal(t, "ot=th:c", span.TraceState().AsRaw())
+
+	span = ptrace.NewSpan()
+	span.TraceState().FromRaw("vendor=x, ot=rv:abcdef01234567;th:8")
+	applySamplingProbability(span, 0.5)
+	assert.Equal(t, "ot=th:c;rv:abcdef01234567,vendor=x", span.TraceState().AsRaw())
+
+	probability, ok := spanSamplingProbability(span)
+	require.True(t, ok)
+	assert.Equal(t, 0.25, probability)
+
+	setAdjustedCounts(func() ptrace.Traces {
+		traces := ptrace.NewTraces()
+		span.CopyTo(traces.ResourceSpans().AppendEmpty().ScopeSpans().AppendEmpty().Spans().AppendEmpty())
+		span = traces.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0)
+		return traces
+	}(), "sampling.adjusted_count")
+	count, ok := span.Attributes().Get("sampling.adjusted_count")
+	require.True(t, ok)
+	assert.Equal(t, 4.0, count.Double())
+}
+
+// TestReservoirAdjustedCounts tests that exported spans add up to the spans seen
+func TestReservoirAdjustedCounts(t *testing.T) {
+	t.Run("uniform", func(t *testing.T) {
+		window := NewWindowManager(time.Minute, nil, zap.NewNop())
+		r := NewReservoir(10, window, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+		forEachSpan(generateTraces(100), r.AddSpan)
+
+		exported, err := r.Export(context.Background())
+		require.NoError(t, err)
+		assert.InDelta(t, 100, sumAdjustedCounts(t, exported), 1e-6)
+	})
+
+	t.Run("not full", func(t *testing.T) {
+		window := NewWindowManager(time.Minute, nil, zap.NewNop())
+		r := NewReservoir(10, window, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+		forEachSpan(generateTraces(5), r.AddSpan)
+
+		exported, err := r.Export(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, sumAdjustedCounts(t, exported))
+	})
+
+	t.Run("weighted", func(t *testing.T) {
+		r := newTestWeightedReservoir(500, newWeightFunc(&Config{ErrorSpanWeight: 10, SlowSpanWeight: 1}))
+		for i := 0; i < 10000; i++ {
+			trace := newTestTrace(i, 1)
+			if i%10 == 0 {
+				trace.ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).Status().SetCode(ptrace.StatusCodeError)
+			}
+			r.AddTrace(trace)
+		}
+
+		exported, err := r.Export(context.Background())
+		require.NoError(t, err)
+		assert.InEpsilon(t, 10000, sumAdjustedCounts(t, exported), 0.2)
+	})
+
+	t.Run("traces", func(t *testing.T) {
+		r := newTestTraceReservoir(500, TraceReservoirUnitTraces)
+		for i := 0; i < 5000; i++ {
+			r.AddTrace(newTestTrace(i, 2))
+		}
+
+		exported, err := r.Export(context.Background())
+		require.NoError(t, err)
+		// Both spans of a trace carry the trace's adjusted count
+		assert.InEpsilon(t, 2*5000, sumAdjustedCounts(t, exported), 0.2)
+	})
+}
+
+// TestProcessorAdjustedCountAttribute tests that exported spans carry the configured attribute
+func TestProcessorAdjustedCountAttribute(t *testing.T) {
+	cfg := &Config{
+		SizeK:                  10,
+		WindowDuration:         time.Minute,
+		CheckpointInterval:     time.Second,
+		ExportQueueSize:        10,
+		AdjustedCountAttribute: "sampling.adjusted_count",
+	}
+
+	sink := new(consumertest.TracesSink)
+	ctx := context.Background()
+	proc, err := newReservoirProcessor(ctx, newTestSettings(), cfg, sink, nil)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, nil))
+	defer func() {
+		require.NoError(t, proc.Shutdown(ctx))
+	}()
+
+	require.NoError(t, proc.ConsumeTraces(ctx, generateTraces(40)))
+	require.NoError(t, proc.(*reservoirProcessor).ForceExport())
+
+	require.Len(t, sink.AllTraces(), 1)
+	exported := sink.AllTraces()[0]
+	assert.Equal(t, 10, exported.SpanCount())
+	forEachSpan(exported, func(span ptrace.Span, _ pcommon.Resource, _ pcommon.InstrumentationScope) {
+		count, ok := span.Attributes().Get("sampling.adjusted_count")
+		require.True(t, ok)
+		assert.InDelta(t, 4.0, count.Double(), 1e-9)
+		assert.Equal(t, "ot=th:c", span.TraceState().AsRaw())
+	})
+}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"math"
 
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/ptrace"
@@ -11,15 +12,34 @@ import (
 
 // Magic bytes for our binary format
 const (
-	SerializationMagic   = "SPAN"
-	SerializationVersion = byte(1)
+	SerializationMagic = "SPAN"
+
+	// SerializationVersion1 is the original lossy format. It is still decoded
+	// so that checkpoints written by older releases can be restored.
+	SerializationVersion1 = byte(1)
+
+	// SerializationVersion2 round-trips every field of the span, its resource
+	// and its instrumentation scope.
+	SerializationVersion2 = byte(2)
+
+	// SerializationVersion is the version written by serializeSpanWithResource
+	SerializationVersion = SerializationVersion2
+
+	// serializationHeaderSize is the size of magic, version, flags and section sizes
+	serializationHeaderSize = 20
+
+	// maxValueDepth bounds the nesting of map and slice values on decode so
+	// corrupt input cannot recurse without limit
+	maxValueDepth = 64
 )
 
 // Binary serialization format:
 // - Magic (4 bytes): "SPAN"
-// - Version (1 byte): 1
+// - Version (1 byte)
 // - Flags (3 bytes): [hasSpanSection, hasResourceSection, hasScopeSection]
 // - Section Sizes (12 bytes): [spanSectionSize, resourceSectionSize, scopeSectionSize]
+//
+// Version 1 sections:
 // - Span Section:
 //   - TraceID (16 bytes)
 //   - SpanID (8 bytes)
@@ -36,160 +56,411 @@ const (
 // - Scope Section:
 //   - Scope Name Length (4 bytes)
 //   - Scope Name (variable)
+//
+// Version 2 sections (all three are always present):
+// - Span Section:
+//   - TraceID (16 bytes), SpanID (8 bytes), ParentSpanID (8 bytes)
+//   - TraceState (string)
+//   - Name (string)
+//   - Kind (4 bytes)
+//   - Start Timestamp (8 bytes), End Timestamp (8 bytes)
+//   - Attributes (map), Dropped Attributes Count (4 bytes)
+//   - Event Count (4 bytes), then per event:
+//     Timestamp (8 bytes), Name (string), Attributes (map), Dropped Attributes Count (4 bytes)
+//   - Dropped Events Count (4 bytes)
+//   - Link Count (4 bytes), then per link:
+//     TraceID (16 bytes), SpanID (8 bytes), TraceState (string), Attributes (map),
+//     Dropped Attributes Count (4 bytes)
+//   - Dropped Links Count (4 bytes)
+//   - Status Code (4 bytes), Status Message (string)
+// - Resource Section:
+//   - Attributes (map), Dropped Attributes Count (4 bytes)
+// - Scope Section:
+//   - Name (string), Version (string), Attributes (map), Dropped Attributes Count (4 bytes)
+//
+// Strings and byte slices are a 4-byte length followed by the data. A map is a
+// 4-byte entry count followed by (key string, value) pairs. A value is a
+// 1-byte pcommon.ValueType followed by its payload: string, 8-byte int,
+// 8-byte IEEE 754 double, 1-byte bool, nested map, slice (4-byte count and
+// values) or byte slice. Empty values have no payload.
 
 // serializeSpanWithResource serializes a SpanWithResource to bytes
 // This implementation completely avoids using Protocol Buffers to prevent stack overflow
 func serializeSpanWithResource(swr SpanWithResource) ([]byte, error) {
-	// Calculate required buffer size for serialized data
-	// Custom binary format: Magic (4) + Version (1) + Sections (3) + SectionLengths (12) + Data
-	bufSize := 20 // header bytes
-
-	// Get span data
-	traceID := swr.Span.TraceID()
-	spanID := swr.Span.SpanID()
-	parentSpanID := swr.Span.ParentSpanID()
-	name := swr.Span.Name()
-	startTime := swr.Span.StartTimestamp()
-	endTime := swr.Span.EndTimestamp()
-
-	// Calculate span section size
-	spanSectionSize := 16 + 8 + 8 + 4 + len(name) + 16 // IDs + name length + name + timestamps
-	bufSize += spanSectionSize
-
-	// Calculate resource section size - only include service.name
-	resourceSectionSize := 0
-	var serviceName string
-	swr.Resource.Attributes().Range(func(k string, v pcommon.Value) bool {
-		if k == "service.name" {
-			serviceName = v.AsString()
-			resourceSectionSize = 4 + len(k) + 4 + len(serviceName)
-			return false // Exit after getting service name
-		}
-		return true
-	})
-	bufSize += resourceSectionSize
+	spanSection := &spanEncoder{}
+	spanSection.writeSpan(swr.Span)
 
-	// Calculate scope section size - just name
-	scopeSectionSize := 0
-	scopeName := swr.Scope.Name()
-	if scopeName != "" {
-		scopeSectionSize = 4 + len(scopeName)
-	}
-	bufSize += scopeSectionSize
+	resourceSection := &spanEncoder{}
+	resourceSection.writeMap(swr.Resource.Attributes())
+	resourceSection.writeUint32(swr.Resource.DroppedAttributesCount())
+
+	scopeSection := &spanEncoder{}
+	scopeSection.writeString(swr.Scope.Name())
+	scopeSection.writeString(swr.Scope.Version())
+	scopeSection.writeMap(swr.Scope.Attributes())
+	scopeSection.writeUint32(swr.Scope.DroppedAttributesCount())
+
+	sections := [][]byte{spanSection.buf.Bytes(), resourceSection.buf.Bytes(), scopeSection.buf.Bytes()}
 
 	// Create buffer with exact size
-	buf := bytes.NewBuffer(make([]byte, 0, bufSize))
+	bufSize := serializationHeaderSize
+	for _, section := range sections {
+		bufSize += len(section)
+	}
+	out := &spanEncoder{}
+	out.buf.Grow(bufSize)
 
 	// Write header
-	if _, err := buf.WriteString(SerializationMagic); err != nil {
-		return nil, fmt.Errorf("failed to write magic bytes: %w", err)
+	out.buf.WriteString(SerializationMagic)
+	out.buf.WriteByte(SerializationVersion2)
+	for range sections {
+		out.buf.WriteByte(1)
 	}
-	if err := buf.WriteByte(SerializationVersion); err != nil {
-		return nil, fmt.Errorf("failed to write version: %w", err)
+	for _, section := range sections {
+		out.writeUint32(uint32(len(section)))
 	}
 
-	// Write section flags (1 byte each)
-	// 1 = section present, 0 = section absent
-	if err := buf.WriteByte(1); err != nil { // Span section (always present)
-		return nil, fmt.Errorf("failed to write span section flag: %w", err)
+	// Write sections
+	for _, section := range sections {
+		out.buf.Write(section)
 	}
-	if resourceSectionSize > 0 {
-		if err := buf.WriteByte(1); err != nil {
-			return nil, fmt.Errorf("failed to write resource section flag: %w", err)
-		}
-	} else {
-		if err := buf.WriteByte(0); err != nil {
-			return nil, fmt.Errorf("failed to write resource section flag: %w", err)
-		}
+
+	return out.buf.Bytes(), nil
+}
+
+// deserializeSpanWithResource deserializes bytes to a SpanWithResource
+// This implementation uses direct binary parsing to avoid Protocol Buffers
+func deserializeSpanWithResource(data []byte) (SpanWithResource, error) {
+	if len(data) < serializationHeaderSize {
+		return SpanWithResource{}, fmt.Errorf("invalid span data: too short (expected at least %d bytes, got %d)", serializationHeaderSize, len(data))
 	}
-	if scopeSectionSize > 0 {
-		if err := buf.WriteByte(1); err != nil {
-			return nil, fmt.Errorf("failed to write scope section flag: %w", err)
-		}
-	} else {
-		if err := buf.WriteByte(0); err != nil {
-			return nil, fmt.Errorf("failed to write scope section flag: %w", err)
+
+	if string(data[:4]) != SerializationMagic {
+		return SpanWithResource{}, fmt.Errorf("invalid magic bytes: expected %s, got %s", SerializationMagic, string(data[:4]))
+	}
+
+	switch version := data[4]; version {
+	case SerializationVersion1:
+		return deserializeSpanWithResourceV1(data)
+	case SerializationVersion2:
+		return deserializeSpanWithResourceV2(data)
+	default:
+		return SpanWithResource{}, fmt.Errorf("unsupported version: %d", version)
+	}
+}
+
+// deserializeSpanWithResourceV2 decodes the full-fidelity version 2 format
+func deserializeSpanWithResourceV2(data []byte) (SpanWithResource, error) {
+	// Create a minimal traces object
+	traces := ptrace.NewTraces()
+	rs := traces.ResourceSpans().AppendEmpty()
+	ss := rs.ScopeSpans().AppendEmpty()
+	span := ss.Spans().AppendEmpty()
+
+	// Locate the sections
+	header := data[8:serializationHeaderSize]
+	sections := make([][]byte, 3)
+	offset := serializationHeaderSize
+	for i := range sections {
+		size := int(binary.BigEndian.Uint32(header[i*4:]))
+		if size > len(data)-offset {
+			return SpanWithResource{}, fmt.Errorf("invalid span data: section %d overruns buffer", i)
 		}
+		sections[i] = data[offset : offset+size]
+		offset += size
 	}
 
-	// Write section sizes
-	if err := binary.Write(buf, binary.BigEndian, uint32(spanSectionSize)); err != nil {
-		return nil, fmt.Errorf("failed to write span section size: %w", err)
+	// Read span data
+	spanSection := &spanDecoder{data: sections[0]}
+	spanSection.readSpan(span)
+	if err := spanSection.finish(); err != nil {
+		return SpanWithResource{}, fmt.Errorf("failed to read span section: %w", err)
 	}
-	if err := binary.Write(buf, binary.BigEndian, uint32(resourceSectionSize)); err != nil {
-		return nil, fmt.Errorf("failed to write resource section size: %w", err)
+
+	// Read resource data
+	resource := rs.Resource()
+	resourceSection := &spanDecoder{data: sections[1]}
+	resourceSection.readMap(resource.Attributes(), 0)
+	resource.SetDroppedAttributesCount(resourceSection.readUint32())
+	if err := resourceSection.finish(); err != nil {
+		return SpanWithResource{}, fmt.Errorf("failed to read resource section: %w", err)
 	}
-	if err := binary.Write(buf, binary.BigEndian, uint32(scopeSectionSize)); err != nil {
-		return nil, fmt.Errorf("failed to write scope section size: %w", err)
+
+	// Read scope data
+	scope := ss.Scope()
+	scopeSection := &spanDecoder{data: sections[2]}
+	scope.SetName(scopeSection.readString())
+	scope.SetVersion(scopeSection.readString())
+	scopeSection.readMap(scope.Attributes(), 0)
+	scope.SetDroppedAttributesCount(scopeSection.readUint32())
+	if err := scopeSection.finish(); err != nil {
+		return SpanWithResource{}, fmt.Errorf("failed to read scope section: %w", err)
 	}
 
-	// Write span data
-	if _, err := buf.Write(traceID[:]); err != nil {
-		return nil, fmt.Errorf("failed to write trace ID: %w", err)
+	return SpanWithResource{
+		Span:     span,
+		Resource: resource,
+		Scope:    scope,
+	}, nil
+}
+
+// spanEncoder writes the version 2 primitives. Writes to a bytes.Buffer
+// cannot fail, so the methods do not return errors.
+type spanEncoder struct {
+	buf bytes.Buffer
+}
+
+func (e *spanEncoder) writeUint32(v uint32) {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *spanEncoder) writeUint64(v uint64) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	e.buf.Write(b[:])
+}
+
+func (e *spanEncoder) writeString(s string) {
+	e.writeUint32(uint32(len(s)))
+	e.buf.WriteString(s)
+}
+
+func (e *spanEncoder) writeBytes(b []byte) {
+	e.writeUint32(uint32(len(b)))
+	e.buf.Write(b)
+}
+
+func (e *spanEncoder) writeMap(m pcommon.Map) {
+	e.writeUint32(uint32(m.Len()))
+	m.Range(func(k string, v pcommon.Value) bool {
+		e.writeString(k)
+		e.writeValue(v)
+		return true
+	})
+}
+
+func (e *spanEncoder) writeValue(v pcommon.Value) {
+	e.buf.WriteByte(byte(v.Type()))
+	switch v.Type() {
+	case pcommon.ValueTypeStr:
+		e.writeString(v.Str())
+	case pcommon.ValueTypeInt:
+		e.writeUint64(uint64(v.Int()))
+	case pcommon.ValueTypeDouble:
+		e.writeUint64(math.Float64bits(v.Double()))
+	case pcommon.ValueTypeBool:
+		if v.Bool() {
+			e.buf.WriteByte(1)
+		} else {
+			e.buf.WriteByte(0)
+		}
+	case pcommon.ValueTypeMap:
+		e.writeMap(v.Map())
+	case pcommon.ValueTypeSlice:
+		slice := v.Slice()
+		e.writeUint32(uint32(slice.Len()))
+		for i := 0; i < slice.Len(); i++ {
+			e.writeValue(slice.At(i))
+		}
+	case pcommon.ValueTypeBytes:
+		e.writeBytes(v.Bytes().AsRaw())
 	}
-	if _, err := buf.Write(spanID[:]); err != nil {
-		return nil, fmt.Errorf("failed to write span ID: %w", err)
+}
+
+func (e *spanEncoder) writeSpan(span ptrace.Span) {
+	traceID := span.TraceID()
+	spanID := span.SpanID()
+	parentSpanID := span.ParentSpanID()
+	e.buf.Write(traceID[:])
+	e.buf.Write(spanID[:])
+	e.buf.Write(parentSpanID[:])
+	e.writeString(span.TraceState().AsRaw())
+	e.writeString(span.Name())
+	e.writeUint32(uint32(span.Kind()))
+	e.writeUint64(uint64(span.StartTimestamp()))
+	e.writeUint64(uint64(span.EndTimestamp()))
+	e.writeMap(span.Attributes())
+	e.writeUint32(span.DroppedAttributesCount())
+
+	events := span.Events()
+	e.writeUint32(uint32(events.Len()))
+	for i := 0; i < events.Len(); i++ {
+		event := events.At(i)
+		e.writeUint64(uint64(event.Timestamp()))
+		e.writeString(event.Name())
+		e.writeMap(event.Attributes())
+		e.writeUint32(event.DroppedAttributesCount())
+	}
+	e.writeUint32(span.DroppedEventsCount())
+
+	links := span.Links()
+	e.writeUint32(uint32(links.Len()))
+	for i := 0; i < links.Len(); i++ {
+		link := links.At(i)
+		linkTraceID := link.TraceID()
+		linkSpanID := link.SpanID()
+		e.buf.Write(linkTraceID[:])
+		e.buf.Write(linkSpanID[:])
+		e.writeString(link.TraceState().AsRaw())
+		e.writeMap(link.Attributes())
+		e.writeUint32(link.DroppedAttributesCount())
+	}
+	e.writeUint32(span.DroppedLinksCount())
+
+	e.writeUint32(uint32(span.Status().Code()))
+	e.writeString(span.Status().Message())
+}
+
+// spanDecoder reads the version 2 primitives. The first error is sticky:
+// later reads return zero values and finish reports it.
+type spanDecoder struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+// next returns the next n bytes, or nil once the input is exhausted
+func (d *spanDecoder) next(n int) []byte {
+	if d.err != nil {
+		return nil
 	}
-	if _, err := buf.Write(parentSpanID[:]); err != nil {
-		return nil, fmt.Errorf("failed to write parent span ID: %w", err)
+	if n < 0 || n > len(d.data)-d.pos {
+		d.err = fmt.Errorf("unexpected end of data at offset %d (need %d bytes)", d.pos, n)
+		return nil
 	}
+	b := d.data[d.pos : d.pos+n]
+	d.pos += n
+	return b
+}
 
-	// Write span name with length prefix
-	if err := binary.Write(buf, binary.BigEndian, uint32(len(name))); err != nil {
-		return nil, fmt.Errorf("failed to write name length: %w", err)
+// finish reports the first decode error, or trailing bytes left in the section
+func (d *spanDecoder) finish() error {
+	if d.err == nil && d.pos != len(d.data) {
+		return fmt.Errorf("%d trailing bytes", len(d.data)-d.pos)
 	}
-	if _, err := buf.WriteString(name); err != nil {
-		return nil, fmt.Errorf("failed to write name: %w", err)
+	return d.err
+}
+
+func (d *spanDecoder) readByte() byte {
+	if b := d.next(1); b != nil {
+		return b[0]
 	}
+	return 0
+}
 
-	// Write timestamps
-	if err := binary.Write(buf, binary.BigEndian, uint64(startTime)); err != nil {
-		return nil, fmt.Errorf("failed to write start timestamp: %w", err)
+func (d *spanDecoder) readUint32() uint32 {
+	if b := d.next(4); b != nil {
+		return binary.BigEndian.Uint32(b)
 	}
-	if err := binary.Write(buf, binary.BigEndian, uint64(endTime)); err != nil {
-		return nil, fmt.Errorf("failed to write end timestamp: %w", err)
+	return 0
+}
+
+func (d *spanDecoder) readUint64() uint64 {
+	if b := d.next(8); b != nil {
+		return binary.BigEndian.Uint64(b)
 	}
+	return 0
+}
 
-	// Write resource data if present
-	if resourceSectionSize > 0 {
-		// Write service name key
-		key := "service.name"
-		if err := binary.Write(buf, binary.BigEndian, uint32(len(key))); err != nil {
-			return nil, fmt.Errorf("failed to write service name key length: %w", err)
-		}
-		if _, err := buf.WriteString(key); err != nil {
-			return nil, fmt.Errorf("failed to write service name key: %w", err)
-		}
+func (d *spanDecoder) readString() string {
+	return string(d.next(int(d.readUint32())))
+}
 
-		// Write service name value
-		if err := binary.Write(buf, binary.BigEndian, uint32(len(serviceName))); err != nil {
-			return nil, fmt.Errorf("failed to write service name value length: %w", err)
-		}
-		if _, err := buf.WriteString(serviceName); err != nil {
-			return nil, fmt.Errorf("failed to write service name value: %w", err)
-		}
+func (d *spanDecoder) readTraceID() pcommon.TraceID {
+	var id pcommon.TraceID
+	copy(id[:], d.next(len(id)))
+	return id
+}
+
+func (d *spanDecoder) readSpanID() pcommon.SpanID {
+	var id pcommon.SpanID
+	copy(id[:], d.next(len(id)))
+	return id
+}
+
+func (d *spanDecoder) readMap(m pcommon.Map, depth int) {
+	count := int(d.readUint32())
+	for i := 0; i < count && d.err == nil; i++ {
+		key := d.readString()
+		d.readValue(m.PutEmpty(key), depth)
 	}
+}
 
-	// Write scope data if present
-	if scopeSectionSize > 0 {
-		if err := binary.Write(buf, binary.BigEndian, uint32(len(scopeName))); err != nil {
-			return nil, fmt.Errorf("failed to write scope name length: %w", err)
+func (d *spanDecoder) readValue(v pcommon.Value, depth int) {
+	if depth > maxValueDepth {
+		d.err = fmt.Errorf("value nesting exceeds %d levels", maxValueDepth)
+		return
+	}
+
+	switch valueType := pcommon.ValueType(d.readByte()); valueType {
+	case pcommon.ValueTypeEmpty:
+	case pcommon.ValueTypeStr:
+		v.SetStr(d.readString())
+	case pcommon.ValueTypeInt:
+		v.SetInt(int64(d.readUint64()))
+	case pcommon.ValueTypeDouble:
+		v.SetDouble(math.Float64frombits(d.readUint64()))
+	case pcommon.ValueTypeBool:
+		v.SetBool(d.readByte() == 1)
+	case pcommon.ValueTypeMap:
+		d.readMap(v.SetEmptyMap(), depth+1)
+	case pcommon.ValueTypeSlice:
+		slice := v.SetEmptySlice()
+		count := int(d.readUint32())
+		for i := 0; i < count && d.err == nil; i++ {
+			d.readValue(slice.AppendEmpty(), depth+1)
 		}
-		if _, err := buf.WriteString(scopeName); err != nil {
-			return nil, fmt.Errorf("failed to write scope name: %w", err)
+	case pcommon.ValueTypeBytes:
+		v.SetEmptyBytes().FromRaw(d.next(int(d.readUint32())))
+	default:
+		if d.err == nil {
+			d.err = fmt.Errorf("unknown value type %d", valueType)
 		}
 	}
-
-	return buf.Bytes(), nil
 }
 
-// deserializeSpanWithResource deserializes bytes to a SpanWithResource
-// This implementation uses direct binary parsing to avoid Protocol Buffers
-func deserializeSpanWithResource(data []byte) (SpanWithResource, error) {
-	if len(data) < 20 {
-		return SpanWithResource{}, fmt.Errorf("invalid span data: too short (expected at least 20 bytes, got %d)", len(data))
-	}
+func (d *spanDecoder) readSpan(span ptrace.Span) {
+	span.SetTraceID(d.readTraceID())
+	span.SetSpanID(d.readSpanID())
+	span.SetParentSpanID(d.readSpanID())
+	span.TraceState().FromRaw(d.readString())
+	span.SetName(d.readString())
+	span.SetKind(ptrace.SpanKind(d.readUint32()))
+	span.SetStartTimestamp(pcommon.Timestamp(d.readUint64()))
+	span.SetEndTimestamp(pcommon.Timestamp(d.readUint64()))
+	d.readMap(span.Attributes(), 0)
+	span.SetDroppedAttributesCount(d.readUint32())
+
+	eventCount := int(d.readUint32())
+	for i := 0; i < eventCount && d.err == nil; i++ {
+		event := span.Events().AppendEmpty()
+		event.SetTimestamp(pcommon.Timestamp(d.readUint64()))
+		event.SetName(d.readString())
+		d.readMap(event.Attributes(), 0)
+		event.SetDroppedAttributesCount(d.readUint32())
+	}
+	span.SetDroppedEventsCount(d.readUint32())
+
+	linkCount := int(d.readUint32())
+	for i := 0; i < linkCount && d.err == nil; i++ {
+		link := span.Links().AppendEmpty()
+		link.SetTraceID(d.readTraceID())
+		link.SetSpanID(d.readSpanID())
+		link.TraceState().FromRaw(d.readString())
+		d.readMap(link.Attributes(), 0)
+		link.SetDroppedAttributesCount(d.readUint32())
+	}
+	span.SetDroppedLinksCount(d.readUint32())
+
+	span.Status().SetCode(ptrace.StatusCode(d.readUint32()))
+	span.Status().SetMessage(d.readString())
+}
 
+// deserializeSpanWithResourceV1 decodes the version 1 format, which only
+// carries IDs, name, timestamps, service.name and the scope name
+func deserializeSpanWithResourceV1(data []byte) (SpanWithResource, error) {
 	// Create a minimal traces object
 	traces := ptrace.NewTraces()
 	rs := traces.ResourceSpans().AppendEmpty()
@@ -215,7 +486,7 @@ func deserializeSpanWithResource(data []byte) (SpanWithResource, error) {
 		return SpanWithResource{}, fmt.Errorf("failed to read version: %w", err)
 	}
 
-	if version != SerializationVersion {
+	if version != SerializationVersion1 {
 		return SpanWithResource{}, fmt.Errorf("unsupported version: %d", version)
 	}
 
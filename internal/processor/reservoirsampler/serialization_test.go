@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/binary"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -109,7 +110,7 @@ func TestBinaryFormat(t *testing.T) {
 	// Check version
 	version, err := buf.ReadByte()
 	require.NoError(t, err)
-	assert.Equal(t, byte(1), version)
+	assert.Equal(t, SerializationVersion, version)
 
 	// Skip 3 flag bytes and 12 section size bytes
 	skipBytes := make([]byte, 15)
@@ -126,3 +127,152 @@ func TestBinaryFormat(t *testing.T) {
 	expectedTraceID := createTestTraceID(42)
 	assert.Equal(t, expectedTraceID[:], traceID)
 }
+
+// TestSerializationFullFidelity tests that every span, resource and scope field survives a roundtrip
+func TestSerializationFullFidelity(t *testing.T) {
+	traces := ptrace.NewTraces()
+	rs := traces.ResourceSpans().AppendEmpty()
+	res := rs.Resource()
+	res.Attributes().PutStr("service.name", "checkout")
+	res.Attributes().PutInt("process.pid", 4242)
+	res.Attributes().PutEmptySlice("host.ip").FromRaw([]any{"10.0.0.1", "10.0.0.2"})
+	res.SetDroppedAttributesCount(3)
+
+	ss := rs.ScopeSpans().AppendEmpty()
+	scope := ss.Scope()
+	scope.SetName("io.opentelemetry.contrib.http")
+	scope.SetVersion("1.2.3")
+	scope.Attributes().PutBool("scope.enabled", true)
+	scope.SetDroppedAttributesCount(1)
+
+	now := time.Now()
+	span := ss.Spans().AppendEmpty()
+	span.SetTraceID(createTestTraceID(7))
+	span.SetSpanID(createTestSpanID(8))
+	span.SetParentSpanID(createTestSpanID(9))
+	span.TraceState().FromRaw("ot=th:8;rv:01,vendor=abc")
+	span.SetName("POST /checkout")
+	span.SetKind(ptrace.SpanKindServer)
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(now.Add(-time.Second)))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(now))
+	span.Attributes().PutStr("http.route", "/checkout")
+	span.Attributes().PutDouble("cart.total", 99.95)
+	span.Attributes().PutEmptyBytes("payload.digest").FromRaw([]byte{0xde, 0xad, 0xbe, 0xef})
+	nested := span.Attributes().PutEmptyMap("nested")
+	nested.PutStr("level", "one")
+	nested.PutEmptyMap("deeper").PutInt("level", 2)
+	span.Attributes().PutEmpty("empty")
+	span.SetDroppedAttributesCount(2)
+
+	event := span.Events().AppendEmpty()
+	event.SetTimestamp(pcommon.NewTimestampFromTime(now.Add(-500 * time.Millisecond)))
+	event.SetName("exception")
+	event.Attributes().PutStr("exception.type", "TimeoutError")
+	event.SetDroppedAttributesCount(4)
+	span.SetDroppedEventsCount(5)
+
+	link := span.Links().AppendEmpty()
+	link.SetTraceID(createTestTraceID(10))
+	link.SetSpanID(createTestSpanID(11))
+	link.TraceState().FromRaw("vendor=xyz")
+	link.Attributes().PutStr("link.kind", "follows_from")
+	link.SetDroppedAttributesCount(6)
+	span.SetDroppedLinksCount(7)
+
+	span.Status().SetCode(ptrace.StatusCodeError)
+	span.Status().SetMessage("deadline exceeded")
+
+	original := SpanWithResource{Span: span, Resource: res, Scope: scope}
+
+	serialized, err := serializeSpanWithResource(original)
+	require.NoError(t, err)
+
+	deserialized, err := deserializeSpanWithResource(serialized)
+	require.NoError(t, err)
+
+	// Compare the complete OTLP representation of both
+	assert.Equal(t, marshalSpanWithResource(t, original), marshalSpanWithResource(t, deserialized))
+}
+
+// TestDeserializeVersion1 tests that records in the original format still decode
+func TestDeserializeVersion1(t *testing.T) {
+	data := encodeVersion1(createTestTraceID(3), createTestSpanID(4), "legacy-span", 100, 200, "legacy-service", "legacy-scope")
+
+	deserialized, err := deserializeSpanWithResource(data)
+	require.NoError(t, err)
+
+	assert.Equal(t, createTestTraceID(3), deserialized.Span.TraceID())
+	assert.Equal(t, createTestSpanID(4), deserialized.Span.SpanID())
+	assert.Equal(t, "legacy-span", deserialized.Span.Name())
+	assert.Equal(t, pcommon.Timestamp(100), deserialized.Span.StartTimestamp())
+	assert.Equal(t, pcommon.Timestamp(200), deserialized.Span.EndTimestamp())
+
+	serviceName, found := deserialized.Resource.Attributes().Get("service.name")
+	assert.True(t, found)
+	assert.Equal(t, "legacy-service", serviceName.Str())
+	assert.Equal(t, "legacy-scope", deserialized.Scope.Name())
+}
+
+// TestDeserializeCorruptData tests that truncated and unknown records are rejected
+func TestDeserializeCorruptData(t *testing.T) {
+	traces := generateTraces(1)
+	rs := traces.ResourceSpans().At(0)
+	ss := rs.ScopeSpans().At(0)
+	serialized, err := serializeSpanWithResource(SpanWithResource{
+		Span:     ss.Spans().At(0),
+		Resource: rs.Resource(),
+		Scope:    ss.Scope(),
+	})
+	require.NoError(t, err)
+
+	_, err = deserializeSpanWithResource(serialized[:len(serialized)-3])
+	assert.Error(t, err, "truncated record should fail")
+
+	unknown := append([]byte(nil), serialized...)
+	unknown[4] = 99
+	_, err = deserializeSpanWithResource(unknown)
+	assert.Error(t, err, "unknown version should fail")
+}
+
+// marshalSpanWithResource renders a SpanWithResource as OTLP JSON for comparison
+func marshalSpanWithResource(t *testing.T, swr SpanWithResource) string {
+	traces := ptrace.NewTraces()
+	insertSpanIntoTraces(traces, swr)
+	data, err := (&ptrace.JSONMarshaler{}).MarshalTraces(traces)
+	require.NoError(t, err)
+	return string(data)
+}
+
+// encodeVersion1 builds a record in the original version 1 layout
+func encodeVersion1(traceID pcommon.TraceID, spanID pcommon.SpanID, name string, start, end uint64, serviceName, scopeName string) []byte {
+	span := &bytes.Buffer{}
+	span.Write(traceID[:])
+	span.Write(spanID[:])
+	span.Write(make([]byte, 8)) // parent span ID
+	_ = binary.Write(span, binary.BigEndian, uint32(len(name)))
+	span.WriteString(name)
+	_ = binary.Write(span, binary.BigEndian, start)
+	_ = binary.Write(span, binary.BigEndian, end)
+
+	resource := &bytes.Buffer{}
+	_ = binary.Write(resource, binary.BigEndian, uint32(len("service.name")))
+	resource.WriteString("service.name")
+	_ = binary.Write(resource, binary.BigEndian, uint32(len(serviceName)))
+	resource.WriteString(serviceName)
+
+	scope := &bytes.Buffer{}
+	_ = binary.Write(scope, binary.BigEndian, uint32(len(scopeName)))
+	scope.WriteString(scopeName)
+
+	out := &bytes.Buffer{}
+	out.WriteString(SerializationMagic)
+	out.WriteByte(SerializationVersion1)
+	out.Write([]byte{1, 1, 1})
+	_ = binary.Write(out, binary.BigEndian, uint32(span.Len()))
+	_ = binary.Write(out, binary.BigEndian, uint32(resource.Len()))
+	_ = binary.Write(out, binary.BigEndian, uint32(scope.Len()))
+	out.Write(span.Bytes())
+	out.Write(resource.Bytes())
+	out.Write(scope.Bytes())
+	return out.Bytes()
+}
@@ -0,0 +1,199 @@
+package reservoirsampler
+
+import (
+	"context"
+	"math/rand"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// ShardedReservoir splits a reservoir into shards, each a Reservoir with its
+// own lock and an even share of the size, so spans can be added from many
+// goroutines at once without contending on one lock. Each span goes to a
+// shard drawn at random, so every shard samples a uniform random part of the
+// window's traffic, and each sampled span records the probability its shard
+// kept it with. The shards are merged when the reservoir is exported.
+//
+// A shard only holds its share of the size, so a window with fewer spans
+// than the size may fill some shards and drop spans that a single reservoir
+// would have kept.
+type ShardedReservoir struct {
+	shards []*Reservoir
+	window *WindowManager
+	logger *zap.Logger
+}
+
+// Ensure ShardedReservoir implements ReservoirStore
+var _ ReservoirStore = (*ShardedReservoir)(nil)
+
+// NewShardedReservoir creates a reservoir of the given size split into
+// shards. There are at most as many shards as spans, and at least one.
+func NewShardedReservoir(
+	shards, size int,
+	window *WindowManager,
+	sizeGauge, sampledCounter *atomic.Int64,
+	logger *zap.Logger,
+) *ShardedReservoir {
+	if shards > size {
+		shards = size
+	}
+	if shards < 1 {
+		shards = 1
+	}
+
+	s := &ShardedReservoir{
+		shards: make([]*Reservoir, shards),
+		window: window,
+		logger: logger,
+	}
+
+	// The window counts spans across all shards and each shard counts its
+	// own. The shards report their sizes through the shared gauge.
+	for i := range s.shards {
+		s.shards[i] = NewReservoir(int(splitLimit(int64(size), shards, i)), nil, sizeGauge, sampledCounter, logger)
+	}
+
+	return s
+}
+
+// AddSpan adds a span to a shard drawn at random. The lock-free top-level
+// math/rand functions draw the shard, so only the shard's lock is taken.
+func (s *ShardedReservoir) AddSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+	if s.window != nil {
+		s.window.IncrementCount()
+	}
+
+	shard := s.shards[0]
+	if len(s.shards) > 1 {
+		shard = s.shards[rand.Intn(len(s.shards))]
+	}
+	shard.AddSpan(span, resource, scope)
+}
+
+// AddTrace adds every span of a completed trace to the reservoir
+func (s *ShardedReservoir) AddTrace(traces ptrace.Traces) {
+	forEachSpan(traces, s.AddSpan)
+}
+
+// SetWeightFunc switches every shard to weighted sampling with the given weight function
+func (s *ShardedReservoir) SetWeightFunc(weightFn WeightFunc) {
+	for _, shard := range s.shards {
+		shard.SetWeightFunc(weightFn)
+	}
+}
+
+// SetAlgorithm selects the uniform sampling algorithm of every shard
+func (s *ShardedReservoir) SetAlgorithm(algorithm string) {
+	for _, shard := range s.shards {
+		shard.SetAlgorithm(algorithm)
+	}
+}
+
+// Reset clears every shard for a new window
+func (s *ShardedReservoir) Reset() {
+	for _, shard := range s.shards {
+		shard.Reset()
+	}
+}
+
+// CloseWindow exports the spans of all shards and clears them for a new
+// window. Each shard is closed in one step, so no span added in between is
+// lost: it is exported now if its shard had not closed yet, or with the next
+// window otherwise.
+func (s *ShardedReservoir) CloseWindow(ctx context.Context) (ptrace.Traces, error) {
+	exportTraces := ptrace.NewTraces()
+	for _, shard := range s.shards {
+		shard.closeWindowTo(exportTraces)
+	}
+	return exportTraces, nil
+}
+
+// RestoreSpans loads spans from a checkpoint, dealing them out to the shards
+// in turn. Per-shard counts are not checkpointed, so the restored window
+// count is divided between the shards in proportion to their restored spans.
+// It returns the number of spans restored.
+func (s *ShardedReservoir) RestoreSpans(spans map[uint64]SpanWithResource) int {
+	groups := make([]map[uint64]SpanWithResource, len(s.shards))
+	for i := range groups {
+		groups[i] = make(map[uint64]SpanWithResource)
+	}
+	i := 0
+	for hash, spanWithRes := range spans {
+		groups[i%len(groups)][hash] = spanWithRes
+		i++
+	}
+
+	var windowCount int64
+	if s.window != nil {
+		windowCount = s.window.Count()
+	}
+
+	restored := 0
+	for i, shard := range s.shards {
+		seen := int64(len(groups[i]))
+		if len(spans) > 0 && windowCount*seen/int64(len(spans)) > seen {
+			seen = windowCount * seen / int64(len(spans))
+		}
+		shard.setSeenCount(seen)
+		restored += shard.RestoreSpans(groups[i])
+	}
+	return restored
+}
+
+// Export returns the spans of all shards as traces
+func (s *ShardedReservoir) Export(ctx context.Context) (ptrace.Traces, error) {
+	exportTraces := ptrace.NewTraces()
+	for _, shard := range s.shards {
+		shard.exportTo(exportTraces)
+	}
+	return exportTraces, nil
+}
+
+// GetAllSpans returns a copy of the spans of all shards
+func (s *ShardedReservoir) GetAllSpans() map[uint64]SpanWithResource {
+	spans := make(map[uint64]SpanWithResource)
+	for _, shard := range s.shards {
+		for hash, spanWithRes := range shard.GetAllSpans() {
+			spans[hash] = spanWithRes
+		}
+	}
+	return spans
+}
+
+// TakeDelta returns the spans added and the hashes evicted in all shards
+// since the previous TakeDelta or TakeSnapshot
+func (s *ShardedReservoir) TakeDelta() (added map[uint64]SpanWithResource, evicted []uint64) {
+	added = make(map[uint64]SpanWithResource)
+	for _, shard := range s.shards {
+		shardAdded, shardEvicted := shard.TakeDelta()
+		for hash, spanWithRes := range shardAdded {
+			added[hash] = spanWithRes
+		}
+		evicted = append(evicted, shardEvicted...)
+	}
+	return added, evicted
+}
+
+// TakeSnapshot returns a copy of the spans of all shards and starts
+// tracking mutations afresh
+func (s *ShardedReservoir) TakeSnapshot() map[uint64]SpanWithResource {
+	spans := make(map[uint64]SpanWithResource)
+	for _, shard := range s.shards {
+		for hash, spanWithRes := range shard.TakeSnapshot() {
+			spans[hash] = spanWithRes
+		}
+	}
+	return spans
+}
+
+// Size returns the number of spans in all shards
+func (s *ShardedReservoir) Size() int {
+	size := 0
+	for _, shard := range s.shards {
+		size += shard.Size()
+	}
+	return size
+}
@@ -0,0 +1,129 @@
+package reservoirsampler
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// TestShardedReservoir tests that spans added in parallel are sampled across
+// the shards and merged on export with their adjusted counts
+func TestShardedReservoir(t *testing.T) {
+	window := NewWindowManager(time.Minute, nil, zap.NewNop())
+	sizeGauge := atomic.NewInt64(0)
+	r := NewShardedReservoir(8, 100, window, sizeGauge, atomic.NewInt64(0), zap.NewNop())
+	require.Len(t, r.shards, 8)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 1; i <= 5000; i++ {
+				r.AddTrace(newTestTrace(g*5000+i, 1))
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	assert.Equal(t, int64(20000), window.Count())
+	assert.Equal(t, 100, r.Size())
+	assert.Equal(t, int64(100), sizeGauge.Load())
+
+	// Every span is counted by exactly one shard
+	var seen int64
+	for _, shard := range r.shards {
+		seen += shard.seenCount()
+	}
+	assert.Equal(t, int64(20000), seen)
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 100, exported.SpanCount())
+	assert.InEpsilon(t, 20000, sumAdjustedCounts(t, exported), 0.05)
+
+	closed, err := r.CloseWindow(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 100, closed.SpanCount())
+	assert.Equal(t, 0, r.Size())
+	assert.Equal(t, int64(0), sizeGauge.Load())
+}
+
+// TestShardedReservoirUniform tests that the shards together keep every span
+// with the same probability, wherever it falls in the window
+func TestShardedReservoirUniform(t *testing.T) {
+	const (
+		trials   = 200
+		numSpans = 1000
+		size     = 100
+	)
+
+	var early, late int
+	for trial := 0; trial < trials; trial++ {
+		r := NewShardedReservoir(4, size, nil, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+		for i := 1; i <= numSpans; i++ {
+			r.AddTrace(newTestTrace(i, 1))
+		}
+
+		exported, err := r.Export(context.Background())
+		require.NoError(t, err)
+		for _, number := range traceNumbers(exported) {
+			if number <= numSpans/2 {
+				early++
+			} else {
+				late++
+			}
+		}
+	}
+
+	// Each half of the window should make up half of the sample
+	assert.InEpsilon(t, trials*size/2, early, 0.05)
+	assert.InEpsilon(t, trials*size/2, late, 0.05)
+}
+
+// TestShardedReservoirRestore tests that restored spans are dealt out to the
+// shards, which share the restored window count
+func TestShardedReservoirRestore(t *testing.T) {
+	window := NewWindowManager(time.Minute, nil, zap.NewNop())
+	r := NewShardedReservoir(4, 40, window, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+	for i := 1; i <= 1000; i++ {
+		r.AddTrace(newTestTrace(i, 1))
+	}
+	spans := r.TakeSnapshot()
+	require.Len(t, spans, 40)
+
+	restoredWindow := NewWindowManager(time.Minute, nil, zap.NewNop())
+	restoredWindow.AddCount(1000)
+	restored := NewShardedReservoir(4, 40, restoredWindow, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+	assert.Equal(t, 40, restored.RestoreSpans(spans))
+	assert.Equal(t, 40, restored.Size())
+
+	for _, shard := range restored.shards {
+		assert.Equal(t, 10, shard.Size())
+		assert.Equal(t, int64(250), shard.seenCount())
+	}
+
+	exported, err := restored.Export(context.Background())
+	require.NoError(t, err)
+	assert.InEpsilon(t, 1000, sumAdjustedCounts(t, exported), 0.01)
+}
+
+// TestShardedReservoirShardCount tests that there is at least one shard and
+// no more shards than spans
+func TestShardedReservoirShardCount(t *testing.T) {
+	r := NewShardedReservoir(16, 5, nil, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+	assert.Len(t, r.shards, 5)
+
+	r = NewShardedReservoir(0, 5, nil, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+	assert.Len(t, r.shards, 1)
+	for i := 1; i <= 10; i++ {
+		r.AddTrace(newTestTrace(i, 1))
+	}
+	assert.Equal(t, 5, r.Size())
+}
@@ -44,9 +44,6 @@ func hashSpanKey(key SpanKey) uint64 {
 }
 
 // isRootSpan determines if a span is a root span (has no parent)
-// This function is currently not used but is kept for potential future use
-// in trace-aware sampling where root spans may need special handling.
-//nolint:unused // Kept for future use
 func isRootSpan(span ptrace.Span) bool {
 	return span.ParentSpanID().IsEmpty()
 }
@@ -83,8 +80,8 @@ func cloneSpanWithContext(span ptrace.Span, resource pcommon.Resource, scope pco
 	}
 }
 
-// insertSpanIntoTraces inserts a SpanWithResource into a ptrace.Traces object
-func insertSpanIntoTraces(traces ptrace.Traces, swr SpanWithResource) {
+// insertSpanIntoTraces inserts a SpanWithResource into a ptrace.Traces object and returns the inserted span
+func insertSpanIntoTraces(traces ptrace.Traces, swr SpanWithResource) ptrace.Span {
 	// Try to find a matching resource
 	resourceSpans := traces.ResourceSpans()
 	var matchingRS ptrace.ResourceSpans
@@ -148,4 +145,87 @@ func insertSpanIntoTraces(traces ptrace.Traces, swr SpanWithResource) {
 	// Add the span to the scope
 	newSpan := matchingSS.Spans().AppendEmpty()
 	swr.Span.CopyTo(newSpan)
+	return newSpan
+}
+
+// forEachSpan calls fn for every span in traces with its resource and scope
+func forEachSpan(traces ptrace.Traces, fn func(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope)) {
+	rss := traces.ResourceSpans()
+	for i := 0; i < rss.Len(); i++ {
+		rs := rss.At(i)
+		ilss := rs.ScopeSpans()
+		for j := 0; j < ilss.Len(); j++ {
+			ils := ilss.At(j)
+			spans := ils.Spans()
+			for k := 0; k < spans.Len(); k++ {
+				fn(spans.At(k), rs.Resource(), ils.Scope())
+			}
+		}
+	}
+}
+
+// Fixed costs of buffered span data in bytes, beyond the variable-length
+// strings and values they hold: the span's IDs, timestamps, kind and status,
+// and the bookkeeping of each nested element
+const (
+	spanBaseSize      = 128
+	spanEventBaseSize = 48
+	spanLinkBaseSize  = 64
+	attributeBaseSize = 32
+)
+
+// estimateSpanSize estimates the memory a span takes when buffered with its
+// own copies of its resource and scope
+func estimateSpanSize(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) int64 {
+	size := spanBaseSize + len(span.Name()) + len(span.TraceState().AsRaw()) + len(span.Status().Message())
+	size += estimateMapSize(span.Attributes())
+
+	events := span.Events()
+	for i := 0; i < events.Len(); i++ {
+		event := events.At(i)
+		size += spanEventBaseSize + len(event.Name()) + estimateMapSize(event.Attributes())
+	}
+
+	links := span.Links()
+	for i := 0; i < links.Len(); i++ {
+		link := links.At(i)
+		size += spanLinkBaseSize + len(link.TraceState().AsRaw()) + estimateMapSize(link.Attributes())
+	}
+
+	size += estimateMapSize(resource.Attributes())
+	size += len(scope.Name()) + len(scope.Version()) + estimateMapSize(scope.Attributes())
+
+	return int64(size)
+}
+
+// estimateMapSize estimates the memory an attribute map takes
+func estimateMapSize(attrs pcommon.Map) int {
+	size := 0
+	attrs.Range(func(key string, value pcommon.Value) bool {
+		size += attributeBaseSize + len(key) + estimateValueSize(value)
+		return true
+	})
+	return size
+}
+
+// estimateValueSize estimates the memory an attribute value takes beyond its
+// fixed cost
+func estimateValueSize(value pcommon.Value) int {
+	switch value.Type() {
+	case pcommon.ValueTypeStr:
+		return len(value.Str())
+	case pcommon.ValueTypeBytes:
+		return value.Bytes().Len()
+	case pcommon.ValueTypeMap:
+		return estimateMapSize(value.Map())
+	case pcommon.ValueTypeSlice:
+		size := 0
+		slice := value.Slice()
+		for i := 0; i < slice.Len(); i++ {
+			size += attributeBaseSize + estimateValueSize(slice.At(i))
+		}
+		return size
+	default:
+		return 0
+	}
 }
@@ -0,0 +1,509 @@
+package reservoirsampler
+
+import (
+	"context"
+	"sort"
+	"sync"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+const (
+	// stratumAttributeKey is the span attribute recording the stratum a span was sampled in
+	stratumAttributeKey = "sampling.reservoir.stratum"
+
+	// stratumNone is the stratum of spans without a value for the stratification key
+	stratumNone = "(none)"
+
+	// stratumOther is shared by the spans of new strata once max_strata is reached
+	stratumOther = "(other)"
+
+	// strataRebalanceInterval is how many spans the proportional policy adds
+	// between recomputing the strata capacities
+	strataRebalanceInterval = 1000
+)
+
+// stratumStore is a reservoir that can serve as one stratum of a StratifiedReservoir
+type stratumStore interface {
+	ReservoirStore
+
+	// Resize changes the capacity of the stratum
+	Resize(size int)
+
+	// exportTo inserts the sampled spans into traces
+	exportTo(traces ptrace.Traces)
+
+	// seenCount and setSeenCount get and set the traffic the stratum has seen
+	seenCount() int64
+	setSeenCount(seen int64)
+
+	// setStratum sets the stratum recorded on sampled spans
+	setStratum(stratum string)
+}
+
+// StratifiedReservoir partitions spans by a key, such as a service name or
+// span kind, and samples each partition in a reservoir of its own, so a busy
+// stratum cannot crowd the others out of the sample. The total size is
+// divided between the strata by the configured capacity policy, and strata
+// are resized as new ones appear. In trace-aware mode each stratum is a
+// TraceReservoir and whole traces are assigned to a stratum.
+type StratifiedReservoir struct {
+	// The reservoir of each stratum and its capacity
+	strata     map[string]stratumStore
+	capacities map[string]int
+
+	// Creates the reservoir of a new stratum
+	newStratum func() stratumStore
+
+	// Configuration
+	size       int
+	stratifyBy string
+	policy     string
+	minSize    int
+	quotas     map[string]int
+	maxStrata  int
+	weightFn   WeightFunc
+	window     *WindowManager
+
+	// Sampled spans across all strata, and spans added since the last rebalance
+	total          int
+	sinceRebalance int
+
+	// Thread safety
+	mu sync.Mutex
+
+	// Metrics
+	sizeGauge      *atomic.Int64
+	sampledCounter *atomic.Int64
+
+	// Logging
+	logger *zap.Logger
+}
+
+// Ensure the reservoirs implement ReservoirStore
+var _ stratumStore = (*Reservoir)(nil)
+var _ stratumStore = (*TraceReservoir)(nil)
+var _ ReservoirStore = (*StratifiedReservoir)(nil)
+
+// NewStratifiedReservoir creates a stratified reservoir as described by the configuration
+func NewStratifiedReservoir(
+	cfg *Config,
+	window *WindowManager,
+	sizeGauge, sampledCounter *atomic.Int64,
+	logger *zap.Logger,
+) *StratifiedReservoir {
+	s := &StratifiedReservoir{
+		strata:         make(map[string]stratumStore),
+		capacities:     make(map[string]int),
+		size:           cfg.SizeK,
+		stratifyBy:     cfg.StratifyBy,
+		policy:         cfg.StrataPolicy,
+		minSize:        cfg.StrataMinSize,
+		quotas:         cfg.StrataQuotas,
+		maxStrata:      cfg.MaxStrata,
+		window:         window,
+		sizeGauge:      sizeGauge,
+		sampledCounter: sampledCounter,
+		logger:         logger,
+	}
+
+	// Each stratum reports its size through the total, so its own gauge is private
+	if cfg.TraceAware {
+		s.newStratum = func() stratumStore {
+			return NewTraceReservoir(0, cfg.TraceReservoirUnit, nil, atomic.NewInt64(0), sampledCounter, logger)
+		}
+	} else {
+		s.newStratum = func() stratumStore {
+			r := NewReservoir(0, nil, atomic.NewInt64(0), sampledCounter, logger)
+			r.SetAlgorithm(cfg.ReservoirAlgorithm)
+			return r
+		}
+	}
+
+	return s
+}
+
+// stratumKey returns the stratum of a span: its span kind, or the value of
+// the stratification attribute on the span or else its resource
+func (s *StratifiedReservoir) stratumKey(span ptrace.Span, resource pcommon.Resource) string {
+	if s.stratifyBy == StratifyBySpanKind {
+		return span.Kind().String()
+	}
+
+	value, ok := span.Attributes().Get(s.stratifyBy)
+	if !ok {
+		value, ok = resource.Attributes().Get(s.stratifyBy)
+	}
+	if !ok || value.AsString() == "" {
+		return stratumNone
+	}
+	return value.AsString()
+}
+
+// stratumLocked returns the reservoir of a stratum and the stratum it
+// resolved to, creating it and rebalancing the capacities if it is new (must
+// be called with lock held)
+func (s *StratifiedReservoir) stratumLocked(key string) (string, stratumStore) {
+	if r, ok := s.strata[key]; ok {
+		return key, r
+	}
+
+	if len(s.strata) >= s.maxStrata && key != stratumOther {
+		if r, ok := s.strata[stratumOther]; ok {
+			return stratumOther, r
+		}
+		s.logger.Warn("Maximum number of strata reached, sampling new strata together",
+			zap.Int("max_strata", s.maxStrata),
+			zap.String("stratum", key))
+		key = stratumOther
+	}
+
+	r := s.newStratum()
+	r.setStratum(key)
+	if s.weightFn != nil {
+		r.SetWeightFunc(s.weightFn)
+	}
+	s.strata[key] = r
+	s.capacities[key] = 0
+
+	s.logger.Debug("New stratum", zap.String("stratum", key), zap.Int("strata", len(s.strata)))
+
+	s.rebalanceLocked()
+	return key, r
+}
+
+// rebalanceLocked resizes the strata to the capacities given by the policy (must be called with lock held)
+func (s *StratifiedReservoir) rebalanceLocked() {
+	seen := make(map[string]int64, len(s.strata))
+	for key, r := range s.strata {
+		seen[key] = r.seenCount()
+	}
+
+	s.total = 0
+	for key, capacity := range strataCapacities(s.policy, s.size, s.minSize, s.quotas, seen) {
+		r := s.strata[key]
+		if s.capacities[key] != capacity {
+			r.Resize(capacity)
+			s.capacities[key] = capacity
+		}
+		s.total += r.Size()
+	}
+	s.sinceRebalance = 0
+
+	// Update metrics
+	s.sizeGauge.Store(int64(s.total))
+}
+
+// strataCapacities divides size spans between the strata seen so far.
+//
+// The equal policy splits the size evenly. The proportional policy gives each
+// stratum minSize spans and splits the rest in proportion to the spans each
+// stratum has seen. The quota policy reserves the quota of every listed key,
+// whether or not it has been seen, and splits the rest evenly between the
+// other strata.
+func strataCapacities(policy string, size, minSize int, quotas map[string]int, seen map[string]int64) map[string]int {
+	keys := make([]string, 0, len(seen))
+	for key := range seen {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	capacities := make(map[string]int, len(keys))
+	if len(keys) == 0 {
+		return capacities
+	}
+
+	switch policy {
+	case StrataPolicyProportional:
+		floor := minSize
+		if floor*len(keys) > size {
+			floor = size / len(keys)
+		}
+		spare := size - floor*len(keys)
+
+		var total int64
+		for _, key := range keys {
+			total += seen[key]
+		}
+
+		assigned := 0
+		for _, key := range keys {
+			capacities[key] = floor
+			if total > 0 {
+				capacities[key] += int(int64(spare) * seen[key] / total)
+			}
+			assigned += capacities[key]
+		}
+
+		// Hand what rounding left over to the busiest strata
+		sort.SliceStable(keys, func(i, j int) bool { return seen[keys[i]] > seen[keys[j]] })
+		for i := 0; i < size-assigned; i++ {
+			capacities[keys[i%len(keys)]]++
+		}
+	case StrataPolicyQuota:
+		remaining := size
+		for _, quota := range quotas {
+			remaining -= quota
+		}
+		if remaining < 0 {
+			remaining = 0
+		}
+
+		unlisted := make([]string, 0, len(keys))
+		for _, key := range keys {
+			if quota, ok := quotas[key]; ok {
+				capacities[key] = quota
+			} else {
+				unlisted = append(unlisted, key)
+			}
+		}
+		splitEvenly(capacities, unlisted, remaining)
+	default:
+		splitEvenly(capacities, keys, size)
+	}
+
+	return capacities
+}
+
+// splitEvenly divides size between keys, giving the remainder to the first ones
+func splitEvenly(capacities map[string]int, keys []string, size int) {
+	for i, key := range keys {
+		capacities[key] = size / len(keys)
+		if i < size%len(keys) {
+			capacities[key]++
+		}
+	}
+}
+
+// AddSpan adds a span to the reservoir of its stratum
+func (s *StratifiedReservoir) AddSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+	key := s.stratumKey(span, resource)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, stratum := s.stratumLocked(key)
+	s.addLocked(stratum, 1, func() { stratum.AddSpan(span, resource, scope) })
+}
+
+// AddTrace adds every span of a completed trace to one stratum, chosen by
+// the trace's root span, or its first span if the root was never received
+func (s *StratifiedReservoir) AddTrace(traces ptrace.Traces) {
+	key := ""
+	forEachSpan(traces, func(span ptrace.Span, resource pcommon.Resource, _ pcommon.InstrumentationScope) {
+		if key == "" || isRootSpan(span) {
+			key = s.stratumKey(span, resource)
+		}
+	})
+	if key == "" {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, stratum := s.stratumLocked(key)
+	s.addLocked(stratum, traces.SpanCount(), func() { stratum.AddTrace(traces) })
+}
+
+// addLocked runs add, which adds spans to a stratum, and accounts for them (must be called with lock held)
+func (s *StratifiedReservoir) addLocked(stratum stratumStore, spans int, add func()) {
+	// The window counts spans across all strata
+	if s.window != nil {
+		s.window.AddCount(int64(spans))
+	}
+
+	before := stratum.Size()
+	add()
+	s.total += stratum.Size() - before
+
+	// Update metrics
+	s.sizeGauge.Store(int64(s.total))
+
+	// Proportional capacities follow the traffic as it shifts
+	s.sinceRebalance += spans
+	if s.policy == StrataPolicyProportional && s.sinceRebalance >= strataRebalanceInterval {
+		s.rebalanceLocked()
+	}
+}
+
+// SetWeightFunc switches every stratum to weighted sampling with the given weight function
+func (s *StratifiedReservoir) SetWeightFunc(weightFn WeightFunc) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.weightFn = weightFn
+	for _, r := range s.strata {
+		r.SetWeightFunc(weightFn)
+	}
+}
+
+// Reset clears the reservoir for a new window. Strata are dropped as well,
+// so each window divides its capacity between the strata it sees.
+func (s *StratifiedReservoir) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resetLocked()
+}
+
+// CloseWindow exports the spans of all strata and clears the reservoir for a
+// new window in one step, so no span added in between is lost
+func (s *StratifiedReservoir) CloseWindow(ctx context.Context) (ptrace.Traces, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exportTraces := ptrace.NewTraces()
+	for _, key := range s.keysLocked() {
+		s.strata[key].exportTo(exportTraces)
+	}
+	s.resetLocked()
+
+	return exportTraces, nil
+}
+
+// resetLocked drops all strata (must be called with lock held)
+func (s *StratifiedReservoir) resetLocked() {
+	s.strata = make(map[string]stratumStore)
+	s.capacities = make(map[string]int)
+	s.total = 0
+	s.sinceRebalance = 0
+
+	// Update metrics
+	s.sizeGauge.Store(0)
+}
+
+// RestoreSpans loads spans from a checkpoint into the reservoirs of their strata.
+// The stratum is read from the attribute recorded when the span was sampled.
+// Per-stratum counts are not checkpointed, so the restored window count is
+// divided between the strata in proportion to their restored spans.
+// It returns the number of spans restored.
+func (s *StratifiedReservoir) RestoreSpans(spans map[uint64]SpanWithResource) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups := make(map[stratumStore]map[uint64]SpanWithResource)
+	for hash, spanWithRes := range spans {
+		var key string
+		if value, ok := spanWithRes.Span.Attributes().Get(stratumAttributeKey); ok {
+			key = value.AsString()
+		} else {
+			key = s.stratumKey(spanWithRes.Span, spanWithRes.Resource)
+		}
+
+		key, r := s.stratumLocked(key)
+		spanWithRes.Span.Attributes().PutStr(stratumAttributeKey, key)
+		if groups[r] == nil {
+			groups[r] = make(map[uint64]SpanWithResource)
+		}
+		groups[r][hash] = spanWithRes
+	}
+
+	var windowCount int64
+	if s.window != nil {
+		windowCount = s.window.Count()
+	}
+	for r, group := range groups {
+		seen := int64(len(group))
+		if len(spans) > 0 && windowCount*seen/int64(len(spans)) > seen {
+			seen = windowCount * seen / int64(len(spans))
+		}
+		r.setSeenCount(seen)
+	}
+	s.rebalanceLocked()
+
+	restored := 0
+	for r, group := range groups {
+		restored += r.RestoreSpans(group)
+	}
+
+	s.total = 0
+	for _, r := range s.strata {
+		s.total += r.Size()
+	}
+
+	// Update metrics
+	s.sizeGauge.Store(int64(s.total))
+
+	return restored
+}
+
+// Export returns the spans of all strata as traces, each span carrying its
+// stratum in the sampling.reservoir.stratum attribute
+func (s *StratifiedReservoir) Export(ctx context.Context) (ptrace.Traces, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	exportTraces := ptrace.NewTraces()
+	for _, key := range s.keysLocked() {
+		s.strata[key].exportTo(exportTraces)
+	}
+
+	return exportTraces, nil
+}
+
+// keysLocked returns the stratum keys in order (must be called with lock held)
+func (s *StratifiedReservoir) keysLocked() []string {
+	keys := make([]string, 0, len(s.strata))
+	for key := range s.strata {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// GetAllSpans returns a copy of the spans of all strata
+func (s *StratifiedReservoir) GetAllSpans() map[uint64]SpanWithResource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	spans := make(map[uint64]SpanWithResource, s.total)
+	for _, r := range s.strata {
+		for hash, spanWithRes := range r.GetAllSpans() {
+			spans[hash] = spanWithRes
+		}
+	}
+	return spans
+}
+
+// TakeDelta returns the spans added and the hashes evicted in all strata
+// since the previous TakeDelta or TakeSnapshot
+func (s *StratifiedReservoir) TakeDelta() (added map[uint64]SpanWithResource, evicted []uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	added = make(map[uint64]SpanWithResource)
+	for _, r := range s.strata {
+		stratumAdded, stratumEvicted := r.TakeDelta()
+		for hash, spanWithRes := range stratumAdded {
+			added[hash] = spanWithRes
+		}
+		evicted = append(evicted, stratumEvicted...)
+	}
+	return added, evicted
+}
+
+// TakeSnapshot returns a copy of the spans of all strata and starts
+// tracking mutations afresh
+func (s *StratifiedReservoir) TakeSnapshot() map[uint64]SpanWithResource {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	spans := make(map[uint64]SpanWithResource, s.total)
+	for _, r := range s.strata {
+		for hash, spanWithRes := range r.TakeSnapshot() {
+			spans[hash] = spanWithRes
+		}
+	}
+	return spans
+}
+
+// Size returns the number of spans in all strata
+func (s *StratifiedReservoir) Size() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.total
+}
@@ -0,0 +1,183 @@
+package reservoirsampler
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+// newTestStratifiedReservoir creates a reservoir stratified by service name
+func newTestStratifiedReservoir(size int, policy string) *StratifiedReservoir {
+	window, sizeGauge, sampled := newTestWindow()
+	return NewStratifiedReservoir(&Config{
+		SizeK:         size,
+		StratifyBy:    "service.name",
+		StrataPolicy:  policy,
+		StrataMinSize: 10,
+		StrataQuotas:  map[string]int{"checkout": 50},
+		MaxStrata:     4,
+	}, window, sizeGauge, sampled, zap.NewNop())
+}
+
+// addServiceSpans adds numSpans spans of a service, numbering them from next
+func addServiceSpans(r ReservoirStore, service string, next, numSpans int) {
+	traces := ptrace.NewTraces()
+	rs := traces.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", service)
+	ss := rs.ScopeSpans().AppendEmpty()
+	for i := next; i < next+numSpans; i++ {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(generateTraceID(i))
+		span.SetSpanID(generateSpanID(i / 256))
+		span.Attributes().PutInt("index", int64(i))
+	}
+
+	forEachSpan(traces, r.AddSpan)
+}
+
+// countStrata counts spans by the stratum attribute set on export
+func countStrata(t *testing.T, traces ptrace.Traces) map[string]int {
+	counts := make(map[string]int)
+	forEachSpan(traces, func(span ptrace.Span, _ pcommon.Resource, _ pcommon.InstrumentationScope) {
+		value, ok := span.Attributes().Get(stratumAttributeKey)
+		require.True(t, ok, "exported span without a stratum")
+		counts[value.AsString()]++
+	})
+	return counts
+}
+
+// TestStrataCapacities tests how each policy divides the reservoir size
+func TestStrataCapacities(t *testing.T) {
+	seen := map[string]int64{"cart": 100, "checkout": 800, "search": 100}
+	quotas := map[string]int{"checkout": 50, "payments": 20}
+
+	assert.Equal(t, map[string]int{"cart": 34, "checkout": 33, "search": 33},
+		strataCapacities(StrataPolicyEqual, 100, 10, quotas, seen))
+
+	// 10 each, and the remaining 70 split 7:56:7
+	assert.Equal(t, map[string]int{"cart": 17, "checkout": 66, "search": 17},
+		strataCapacities(StrataPolicyProportional, 100, 10, quotas, seen))
+
+	// The floor shrinks when the strata cannot all have it
+	assert.Equal(t, map[string]int{"cart": 3, "checkout": 4, "search": 3},
+		strataCapacities(StrataPolicyProportional, 10, 10, quotas, seen))
+
+	// Unseen quota keys keep their reservation
+	assert.Equal(t, map[string]int{"cart": 15, "checkout": 50, "search": 15},
+		strataCapacities(StrataPolicyQuota, 100, 10, quotas, seen))
+
+	assert.Empty(t, strataCapacities(StrataPolicyEqual, 100, 10, nil, nil))
+}
+
+// TestStratifiedReservoirProtectsQuietStrata tests that a busy stratum cannot
+// crowd the others out of the sample
+func TestStratifiedReservoirProtectsQuietStrata(t *testing.T) {
+	for _, policy := range []string{StrataPolicyEqual, StrataPolicyProportional, StrataPolicyQuota} {
+		t.Run(policy, func(t *testing.T) {
+			r := newTestStratifiedReservoir(100, policy)
+
+			addServiceSpans(r, "checkout", 0, 5000)
+			addServiceSpans(r, "cart", 5000, 5)
+			addServiceSpans(r, "search", 5005, 5)
+			addServiceSpans(r, "checkout", 5010, 5000)
+
+			exported, err := r.Export(context.Background())
+			require.NoError(t, err)
+
+			counts := countStrata(t, exported)
+			assert.Equal(t, 5, counts["cart"])
+			assert.Equal(t, 5, counts["search"])
+			assert.LessOrEqual(t, counts["checkout"], 100-10)
+			assert.LessOrEqual(t, r.Size(), 100)
+			assert.Equal(t, exported.SpanCount(), r.Size())
+		})
+	}
+}
+
+// TestStratifiedReservoirEqualSplit tests that busy strata share the size evenly
+func TestStratifiedReservoirEqualSplit(t *testing.T) {
+	r := newTestStratifiedReservoir(90, StrataPolicyEqual)
+
+	addServiceSpans(r, "checkout", 0, 1000)
+	addServiceSpans(r, "cart", 1000, 1000)
+	addServiceSpans(r, "search", 2000, 1000)
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"cart": 30, "checkout": 30, "search": 30}, countStrata(t, exported))
+}
+
+// TestStratifiedReservoirMaxStrata tests that strata beyond the limit share one
+func TestStratifiedReservoirMaxStrata(t *testing.T) {
+	r := newTestStratifiedReservoir(200, StrataPolicyEqual)
+
+	for i := 0; i < 6; i++ {
+		addServiceSpans(r, fmt.Sprintf("service-%d", i), i*10, 10)
+	}
+	// So do spans without a value for the attribute, past the limit
+	addServiceSpans(r, "", 60, 10)
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+
+	counts := countStrata(t, exported)
+	assert.Len(t, counts, 5)
+	assert.Equal(t, 30, counts[stratumOther])
+	assert.Equal(t, 70, r.Size())
+}
+
+// TestStratifiedReservoirAddTrace tests that a trace is kept in the stratum of its root span
+func TestStratifiedReservoirAddTrace(t *testing.T) {
+	r := newTestStratifiedReservoir(100, StrataPolicyEqual)
+
+	traces := ptrace.NewTraces()
+	for i, service := range []string{"cart", "checkout", "search"} {
+		rs := traces.ResourceSpans().AppendEmpty()
+		rs.Resource().Attributes().PutStr("service.name", service)
+		span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+		span.SetTraceID(generateTraceID(1))
+		span.SetSpanID(generateSpanID(i))
+		if service != "checkout" {
+			span.SetParentSpanID(generateSpanID(1))
+		}
+	}
+	r.AddTrace(traces)
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"checkout": 3}, countStrata(t, exported))
+}
+
+// TestStratifiedReservoirRestore tests that restored spans return to their strata
+func TestStratifiedReservoirRestore(t *testing.T) {
+	r := newTestStratifiedReservoir(60, StrataPolicyEqual)
+	addServiceSpans(r, "checkout", 0, 1000)
+	addServiceSpans(r, "cart", 1000, 10)
+
+	snapshot := r.TakeSnapshot()
+	require.Len(t, snapshot, 40)
+
+	restored := newTestStratifiedReservoir(60, StrataPolicyEqual)
+	assert.Equal(t, 40, restored.RestoreSpans(snapshot))
+	assert.Equal(t, 40, restored.Size())
+
+	exported, err := restored.Export(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"cart": 10, "checkout": 30}, countStrata(t, exported))
+
+	// A new stratum makes the restored ones shrink
+	addServiceSpans(restored, "search", 2000, 20)
+	exported, err = restored.Export(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int{"cart": 10, "checkout": 20, "search": 20}, countStrata(t, exported))
+
+	added, evicted := restored.TakeDelta()
+	assert.Len(t, added, 20)
+	assert.Len(t, evicted, 10)
+}
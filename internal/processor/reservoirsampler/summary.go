@@ -0,0 +1,210 @@
+package reservoirsampler
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+const (
+	// summaryScopeName is the instrumentation scope of the window summary metrics
+	summaryScopeName = "reservoirsampler"
+
+	// unknownService is the service of spans whose resource has no service.name
+	unknownService = "unknown_service"
+)
+
+// defaultSummaryDurationBuckets are the default bucket bounds of the span duration histogram
+var defaultSummaryDurationBuckets = []time.Duration{
+	5 * time.Millisecond,
+	10 * time.Millisecond,
+	25 * time.Millisecond,
+	50 * time.Millisecond,
+	100 * time.Millisecond,
+	250 * time.Millisecond,
+	500 * time.Millisecond,
+	time.Second,
+	2500 * time.Millisecond,
+	5 * time.Second,
+	10 * time.Second,
+}
+
+// summaryKey identifies the spans a summary series counts
+type summaryKey struct {
+	service  string
+	spanName string
+}
+
+// summarySeries holds the counts of one service and span name
+type summarySeries struct {
+	spans        int64
+	errors       int64
+	durationSum  float64
+	bucketCounts []uint64
+}
+
+// WindowSummary counts every span of a window before sampling, so the
+// window can be described exactly even though only a sample of it is kept.
+// It counts spans, errors and span durations per service and span name, and
+// distinct traces per service.
+type WindowSummary struct {
+	// Histogram bucket bounds in milliseconds
+	bounds []float64
+
+	// State of the current window
+	start  time.Time
+	series map[summaryKey]*summarySeries
+	traces map[string]map[uint64]struct{}
+
+	// Synchronization
+	mu sync.Mutex
+}
+
+// NewWindowSummary creates a window summary with the given duration histogram buckets
+func NewWindowSummary(buckets []time.Duration) *WindowSummary {
+	bounds := make([]float64, len(buckets))
+	for i, bucket := range buckets {
+		bounds[i] = float64(bucket) / float64(time.Millisecond)
+	}
+
+	return &WindowSummary{
+		bounds: bounds,
+		start:  time.Now(),
+		series: make(map[summaryKey]*summarySeries),
+		traces: make(map[string]map[uint64]struct{}),
+	}
+}
+
+// Record counts the spans of a batch
+func (s *WindowSummary) Record(traces ptrace.Traces) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	forEachSpan(traces, func(span ptrace.Span, resource pcommon.Resource, _ pcommon.InstrumentationScope) {
+		service := unknownService
+		if value, ok := resource.Attributes().Get("service.name"); ok {
+			service = value.AsString()
+		}
+
+		key := summaryKey{service: service, spanName: span.Name()}
+		series, ok := s.series[key]
+		if !ok {
+			series = &summarySeries{bucketCounts: make([]uint64, len(s.bounds)+1)}
+			s.series[key] = series
+		}
+
+		series.spans++
+		if span.Status().Code() == ptrace.StatusCodeError {
+			series.errors++
+		}
+
+		var duration float64
+		if span.EndTimestamp() > span.StartTimestamp() {
+			duration = float64(span.EndTimestamp()-span.StartTimestamp()) / float64(time.Millisecond)
+		}
+		series.durationSum += duration
+		series.bucketCounts[sort.SearchFloat64s(s.bounds, duration)]++
+
+		traceIDs, ok := s.traces[service]
+		if !ok {
+			traceIDs = make(map[uint64]struct{})
+			s.traces[service] = traceIDs
+		}
+		traceIDs[hashTraceID(span.TraceID())] = struct{}{}
+	})
+}
+
+// Take returns the summary of the window ending at end as delta metrics,
+// one resource per service, and starts counting a new window
+func (s *WindowSummary) Take(end time.Time) pmetric.Metrics {
+	s.mu.Lock()
+	start, series, traces := s.start, s.series, s.traces
+	s.start = end
+	s.series = make(map[summaryKey]*summarySeries)
+	s.traces = make(map[string]map[uint64]struct{})
+	s.mu.Unlock()
+
+	startTimestamp := pcommon.NewTimestampFromTime(start)
+	endTimestamp := pcommon.NewTimestampFromTime(end)
+
+	// Group the series by service, in a stable order
+	keys := make([]summaryKey, 0, len(series))
+	for key := range series {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		return keys[i].spanName < keys[j].spanName
+	})
+
+	metrics := pmetric.NewMetrics()
+	for i := 0; i < len(keys); {
+		service := keys[i].service
+
+		rm := metrics.ResourceMetrics().AppendEmpty()
+		rm.Resource().Attributes().PutStr("service.name", service)
+		sm := rm.ScopeMetrics().AppendEmpty()
+		sm.Scope().SetName(summaryScopeName)
+
+		spans := newDeltaSum(sm, "reservoir_sampler.window_spans", "Spans seen in the window", "{spans}")
+		errors := newDeltaSum(sm, "reservoir_sampler.window_errors", "Spans with error status seen in the window", "{spans}")
+
+		durations := sm.Metrics().AppendEmpty()
+		durations.SetName("reservoir_sampler.window_span_duration")
+		durations.SetDescription("Durations of the spans seen in the window")
+		durations.SetUnit("ms")
+		durations.SetEmptyHistogram().SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+
+		tracesSeen := newDeltaSum(sm, "reservoir_sampler.window_traces", "Distinct traces seen in the window", "{traces}")
+		dp := tracesSeen.DataPoints().AppendEmpty()
+		dp.SetStartTimestamp(startTimestamp)
+		dp.SetTimestamp(endTimestamp)
+		dp.SetIntValue(int64(len(traces[service])))
+
+		for ; i < len(keys) && keys[i].service == service; i++ {
+			counts := series[keys[i]]
+
+			dp := spans.DataPoints().AppendEmpty()
+			dp.SetStartTimestamp(startTimestamp)
+			dp.SetTimestamp(endTimestamp)
+			dp.Attributes().PutStr("span.name", keys[i].spanName)
+			dp.SetIntValue(counts.spans)
+
+			dp = errors.DataPoints().AppendEmpty()
+			dp.SetStartTimestamp(startTimestamp)
+			dp.SetTimestamp(endTimestamp)
+			dp.Attributes().PutStr("span.name", keys[i].spanName)
+			dp.SetIntValue(counts.errors)
+
+			hdp := durations.Histogram().DataPoints().AppendEmpty()
+			hdp.SetStartTimestamp(startTimestamp)
+			hdp.SetTimestamp(endTimestamp)
+			hdp.Attributes().PutStr("span.name", keys[i].spanName)
+			hdp.SetCount(uint64(counts.spans))
+			hdp.SetSum(counts.durationSum)
+			hdp.ExplicitBounds().FromRaw(s.bounds)
+			hdp.BucketCounts().FromRaw(counts.bucketCounts)
+		}
+	}
+
+	return metrics
+}
+
+// newDeltaSum appends a monotonic delta sum metric to sm
+func newDeltaSum(sm pmetric.ScopeMetrics, name, description, unit string) pmetric.Sum {
+	metric := sm.Metrics().AppendEmpty()
+	metric.SetName(name)
+	metric.SetDescription(description)
+	metric.SetUnit(unit)
+
+	sum := metric.SetEmptySum()
+	sum.SetAggregationTemporality(pmetric.AggregationTemporalityDelta)
+	sum.SetIsMonotonic(true)
+	return sum
+}
@@ -0,0 +1,143 @@
+package reservoirsampler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/pmetric"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// summaryValues indexes the sum data points of summary metrics by service,
+// metric and span name
+func summaryValues(metrics pmetric.Metrics) map[string]map[string]map[string]pmetric.NumberDataPoint {
+	values := make(map[string]map[string]map[string]pmetric.NumberDataPoint)
+	for i := 0; i < metrics.ResourceMetrics().Len(); i++ {
+		rm := metrics.ResourceMetrics().At(i)
+		service := ""
+		if value, ok := rm.Resource().Attributes().Get("service.name"); ok {
+			service = value.AsString()
+		}
+		byMetric := make(map[string]map[string]pmetric.NumberDataPoint)
+		values[service] = byMetric
+
+		ms := rm.ScopeMetrics().At(0).Metrics()
+		for j := 0; j < ms.Len(); j++ {
+			if ms.At(j).Type() != pmetric.MetricTypeSum {
+				continue
+			}
+			bySpanName := make(map[string]pmetric.NumberDataPoint)
+			byMetric[ms.At(j).Name()] = bySpanName
+			dps := ms.At(j).Sum().DataPoints()
+			for k := 0; k < dps.Len(); k++ {
+				spanName := ""
+				if value, ok := dps.At(k).Attributes().Get("span.name"); ok {
+					spanName = value.AsString()
+				}
+				bySpanName[spanName] = dps.At(k)
+			}
+		}
+	}
+	return values
+}
+
+// addSummarySpan appends a span of the given service, trace, name and duration to traces
+func addSummarySpan(traces ptrace.Traces, service string, traceID int, name string, duration time.Duration, isError bool) {
+	rs := traces.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", service)
+	span := rs.ScopeSpans().AppendEmpty().Spans().AppendEmpty()
+	span.SetName(name)
+	span.SetTraceID(generateTraceID(traceID))
+	start := time.Unix(1700000000, 0)
+	span.SetStartTimestamp(pcommon.NewTimestampFromTime(start))
+	span.SetEndTimestamp(pcommon.NewTimestampFromTime(start.Add(duration)))
+	if isError {
+		span.Status().SetCode(ptrace.StatusCodeError)
+	}
+}
+
+// TestWindowSummary tests that the summary counts every span of the window
+func TestWindowSummary(t *testing.T) {
+	summary := NewWindowSummary([]time.Duration{10 * time.Millisecond, 100 * time.Millisecond})
+
+	traces := ptrace.NewTraces()
+	addSummarySpan(traces, "checkout", 1, "GET /cart", 5*time.Millisecond, false)
+	addSummarySpan(traces, "checkout", 1, "GET /cart", 10*time.Millisecond, true)
+	addSummarySpan(traces, "checkout", 2, "POST /pay", 500*time.Millisecond, false)
+	addSummarySpan(traces, "search", 3, "query", 50*time.Millisecond, true)
+	summary.Record(traces)
+
+	end := time.Now()
+	metrics := summary.Take(end)
+	require.Equal(t, 2, metrics.ResourceMetrics().Len())
+
+	values := summaryValues(metrics)
+	assert.Equal(t, int64(2), values["checkout"]["reservoir_sampler.window_spans"]["GET /cart"].IntValue())
+	assert.Equal(t, int64(1), values["checkout"]["reservoir_sampler.window_spans"]["POST /pay"].IntValue())
+	assert.Equal(t, int64(1), values["checkout"]["reservoir_sampler.window_errors"]["GET /cart"].IntValue())
+	assert.Equal(t, int64(0), values["checkout"]["reservoir_sampler.window_errors"]["POST /pay"].IntValue())
+	assert.Equal(t, int64(2), values["checkout"]["reservoir_sampler.window_traces"][""].IntValue())
+	assert.Equal(t, int64(1), values["search"]["reservoir_sampler.window_traces"][""].IntValue())
+	assert.Equal(t, pcommon.NewTimestampFromTime(end), values["search"]["reservoir_sampler.window_spans"]["query"].Timestamp())
+
+	// Durations on a bound fall into the bucket the bound closes
+	ms := metrics.ResourceMetrics().At(0).ScopeMetrics().At(0).Metrics()
+	var histogram pmetric.Histogram
+	for i := 0; i < ms.Len(); i++ {
+		if ms.At(i).Name() == "reservoir_sampler.window_span_duration" {
+			histogram = ms.At(i).Histogram()
+		}
+	}
+	require.Equal(t, 2, histogram.DataPoints().Len())
+	cart := histogram.DataPoints().At(0)
+	assert.Equal(t, uint64(2), cart.Count())
+	assert.Equal(t, 15.0, cart.Sum())
+	assert.Equal(t, []float64{10, 100}, cart.ExplicitBounds().AsRaw())
+	assert.Equal(t, []uint64{2, 0, 0}, cart.BucketCounts().AsRaw())
+	assert.Equal(t, []uint64{0, 0, 1}, histogram.DataPoints().At(1).BucketCounts().AsRaw())
+
+	// Taking the summary starts a new window
+	next := summary.Take(time.Now())
+	assert.Equal(t, 0, next.DataPointCount())
+}
+
+// TestProcessorWindowSummary tests that the processor sends the summary of
+// every span seen in a window, not only the sampled ones
+func TestProcessorWindowSummary(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	cfg.SizeK = 10
+	cfg.WindowDuration = 100 * time.Millisecond
+	cfg.TraceAware = false
+
+	sink := new(consumertest.TracesSink)
+	metricsSink := new(consumertest.MetricsSink)
+	ctx := context.Background()
+	proc, err := newReservoirProcessor(ctx, newTestSettings(), cfg, sink, metricsSink)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, nil))
+	defer func() {
+		require.NoError(t, proc.Shutdown(ctx))
+	}()
+
+	require.NoError(t, proc.ConsumeTraces(ctx, generateTraces(100)))
+
+	// The next batch rolls the window over
+	time.Sleep(150 * time.Millisecond)
+	require.NoError(t, proc.ConsumeTraces(ctx, generateTraces(1)))
+
+	require.Len(t, sink.AllTraces(), 1)
+	assert.Equal(t, 10, sink.AllTraces()[0].SpanCount())
+
+	require.Len(t, metricsSink.AllMetrics(), 1)
+	values := summaryValues(metricsSink.AllMetrics()[0])
+	assert.Equal(t, int64(100), values["test-service"]["reservoir_sampler.window_spans"]["test-span"].IntValue())
+	assert.Equal(t, int64(100), values["test-service"]["reservoir_sampler.window_traces"][""].IntValue())
+
+	// The sampler's own telemetry comes along
+	assert.GreaterOrEqual(t, values[""]["reservoir_sampler.sampled_spans"][""].IntValue(), int64(10))
+}
@@ -0,0 +1,504 @@
+package reservoirsampler
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// timedItem is a span, or in trace-aware mode a whole trace, kept by a TimedReservoir
+type timedItem struct {
+	// The hashes of the item's spans in arrival order
+	spanHashes []uint64
+
+	// The item's score without its random part, log(w) plus the decay boost
+	// of its arrival time, and the window it arrived in
+	baseScore float64
+	window    int64
+}
+
+// timedPool holds the candidates of one window of a sliding reservoir, or
+// all candidates of a decaying one, with their scores in a min-heap
+type timedPool struct {
+	window int64
+	scores spanKeyHeap
+	cost   int
+
+	// The highest score the pool has dropped
+	maxDropped float64
+}
+
+// TimedReservoir is a reservoir that is never cleared. A sliding reservoir
+// samples the last few windows, and a decaying one samples all spans with a
+// weight that halves every half-life, favoring recent spans. Either way the
+// sample changes smoothly instead of starting empty at each window.
+//
+// Each candidate, a span or a trace, gets the score log(w) + λt - log(-log u)
+// for a uniform random u, its weight w and arrival time t, where λ is 0 in
+// sliding mode. This orders candidates like the keys u^(1/w') of weighted
+// sampling with the decayed weight w' = w·e^(λt), without the keys
+// underflowing as t grows. The sample is the candidates with the highest
+// scores that fit in the capacity.
+//
+// A sliding reservoir keeps the best candidates of each window it covers, so
+// it holds up to its capacity per window, and forgets a window's candidates
+// when the window slides out. When a window closes, the sampled spans that
+// arrived in it are exported, so each span is exported at most once.
+type TimedReservoir struct {
+	// The candidates keyed by span or trace ID hash, their pools from the
+	// oldest window on, and all of their spans
+	items   map[uint64]*timedItem
+	pools   []*timedPool
+	spanMap map[uint64]SpanWithResource
+
+	// Optional weight function; without it every candidate has weight 1
+	weightFn WeightFunc
+
+	// The sampled spans persisted by the last checkpoint
+	checkpointed map[uint64]struct{}
+
+	// Configuration
+	size       int
+	perTrace   bool
+	countTrace bool
+	sliding    bool
+	numPools   int
+	decayRate  float64
+	landmark   time.Time
+	window     *WindowManager
+
+	// The window spans are added to
+	currentWindow int64
+
+	// Thread safety
+	mu     sync.Mutex
+	random *rand.Rand
+	now    func() time.Time
+
+	// Metrics
+	sizeGauge      *atomic.Int64
+	sampledCounter *atomic.Int64
+
+	// Logging
+	logger *zap.Logger
+}
+
+// NewTimedReservoir creates a sliding or decaying reservoir as configured by
+// cfg. In trace-aware mode it keeps whole traces, with its capacity counted in
+// the configured unit.
+func NewTimedReservoir(
+	cfg *Config,
+	window *WindowManager,
+	sizeGauge, sampledCounter *atomic.Int64,
+	logger *zap.Logger,
+) *TimedReservoir {
+	r := &TimedReservoir{
+		items:          make(map[uint64]*timedItem),
+		spanMap:        make(map[uint64]SpanWithResource),
+		checkpointed:   make(map[uint64]struct{}),
+		size:           cfg.SizeK,
+		perTrace:       cfg.TraceAware,
+		countTrace:     cfg.TraceAware && cfg.TraceReservoirUnit == TraceReservoirUnitTraces,
+		sliding:        cfg.WindowMode == WindowModeSliding,
+		numPools:       1,
+		landmark:       time.Now(),
+		window:         window,
+		random:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:            time.Now,
+		sizeGauge:      sizeGauge,
+		sampledCounter: sampledCounter,
+		logger:         logger,
+	}
+
+	if r.sliding {
+		// The current window and enough closed ones to cover the sliding window
+		r.numPools = int((cfg.SlidingWindow + cfg.WindowDuration - 1) / cfg.WindowDuration)
+	} else if cfg.DecayHalfLife > 0 {
+		r.decayRate = math.Ln2 / cfg.DecayHalfLife.Seconds()
+	}
+	r.pools = []*timedPool{newTimedPool(0)}
+
+	return r
+}
+
+// newTimedPool creates an empty pool for a window
+func newTimedPool(window int64) *timedPool {
+	return &timedPool{window: window, maxDropped: math.Inf(-1)}
+}
+
+// SetWeightFunc switches the reservoir to weighted sampling with the given weight function
+func (r *TimedReservoir) SetWeightFunc(weightFn WeightFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.weightFn = weightFn
+}
+
+// Reset drops the whole sample
+func (r *TimedReservoir) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.items = make(map[uint64]*timedItem)
+	r.pools = []*timedPool{newTimedPool(r.currentWindow)}
+	r.spanMap = make(map[uint64]SpanWithResource)
+
+	// Update metrics
+	r.sizeGauge.Store(0)
+}
+
+// AddSpan adds a span. In trace-aware mode a span of a trace that is already
+// a candidate joins it, and any other span is sampled as a trace of one span.
+func (r *TimedReservoir) AddSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.addSpansLocked(span.TraceID(), []traceSpan{{
+		hash:     hashSpanKey(createSpanKey(span)),
+		span:     span,
+		resource: resource,
+		scope:    scope,
+	}})
+}
+
+// AddTrace adds the spans of a completed trace, sampled together in trace-aware mode
+func (r *TimedReservoir) AddTrace(traces ptrace.Traces) {
+	order, groups := groupSpansByTrace(traces)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, traceID := range order {
+		r.addSpansLocked(traceID, groups[traceID])
+	}
+}
+
+// addSpansLocked adds the spans of one trace, as one candidate in
+// trace-aware mode and as a candidate each otherwise (must be called with lock held)
+func (r *TimedReservoir) addSpansLocked(traceID pcommon.TraceID, spans []traceSpan) {
+	// Increment the total count for this window
+	if r.window != nil {
+		r.window.AddCount(int64(len(spans)))
+	}
+
+	if !r.perTrace {
+		for _, ts := range spans {
+			r.addItemLocked(ts.hash, []traceSpan{ts})
+		}
+	} else {
+		r.addItemLocked(hashTraceID(traceID), spans)
+	}
+
+	// Update metrics
+	r.sizeGauge.Store(int64(len(r.spanMap)))
+}
+
+// addItemLocked adds spans to the candidate with the given key, creating it
+// if it is new (must be called with lock held)
+func (r *TimedReservoir) addItemLocked(key uint64, spans []traceSpan) {
+	if item, ok := r.items[key]; ok {
+		// Late spans join their candidate, which may push it or others out
+		// of its pool if the capacity is counted in spans
+		pool := r.poolLocked(item.window)
+		if pool == nil {
+			return
+		}
+		pool.cost += r.appendSpansLocked(item, spans)
+		r.trimPoolLocked(pool)
+		return
+	}
+
+	if r.costOf(len(spans)) > r.size {
+		// The candidate can never fit
+		return
+	}
+
+	weight := 1.0
+	if r.weightFn != nil {
+		weight = 0
+		for _, ts := range spans {
+			weight = math.Max(weight, r.weightFn(ts.span, ts.resource))
+		}
+		if !(weight > 0) || math.IsInf(weight, 1) {
+			return
+		}
+	}
+
+	item := &timedItem{
+		spanHashes: make([]uint64, 0, len(spans)),
+		baseScore:  math.Log(weight) + r.decayRate*r.now().Sub(r.landmark).Seconds(),
+		window:     r.currentWindow,
+	}
+	pool := r.pools[len(r.pools)-1]
+	r.items[key] = item
+	heap.Push(&pool.scores, keyedSpan{hash: key, logKey: item.baseScore - math.Log(-math.Log(r.uniformLocked()))})
+	pool.cost += r.appendSpansLocked(item, spans)
+	r.trimPoolLocked(pool)
+}
+
+// appendSpansLocked copies spans into a candidate and returns the capacity
+// they take (must be called with lock held)
+func (r *TimedReservoir) appendSpansLocked(item *timedItem, spans []traceSpan) int {
+	before := r.costOf(len(item.spanHashes))
+
+	for _, ts := range spans {
+		if _, exists := r.spanMap[ts.hash]; exists {
+			continue
+		}
+		r.spanMap[ts.hash] = cloneSpanWithContext(ts.span, ts.resource, ts.scope)
+		item.spanHashes = append(item.spanHashes, ts.hash)
+		r.sampledCounter.Inc()
+	}
+
+	return r.costOf(len(item.spanHashes)) - before
+}
+
+// trimPoolLocked drops the candidates with the lowest scores until the pool
+// is within the capacity (must be called with lock held)
+func (r *TimedReservoir) trimPoolLocked(pool *timedPool) {
+	for pool.cost > r.size && len(pool.scores) > 0 {
+		victim := heap.Pop(&pool.scores).(keyedSpan)
+		pool.maxDropped = math.Max(pool.maxDropped, victim.logKey)
+		pool.cost -= r.costOf(len(r.items[victim.hash].spanHashes))
+		r.dropItemLocked(victim.hash)
+	}
+}
+
+// dropItemLocked removes a candidate and its spans (must be called with lock held)
+func (r *TimedReservoir) dropItemLocked(key uint64) {
+	for _, hash := range r.items[key].spanHashes {
+		delete(r.spanMap, hash)
+	}
+	delete(r.items, key)
+}
+
+// poolLocked returns the pool of a window, or nil if it is gone (must be called with lock held)
+func (r *TimedReservoir) poolLocked(window int64) *timedPool {
+	if !r.sliding {
+		return r.pools[0]
+	}
+	for _, pool := range r.pools {
+		if pool.window == window {
+			return pool
+		}
+	}
+	return nil
+}
+
+// costOf returns the capacity taken by a candidate of n spans
+func (r *TimedReservoir) costOf(n int) int {
+	if r.countTrace && n > 0 {
+		return 1
+	}
+	return n
+}
+
+// uniformLocked returns a uniform random number in (0, 1) (must be called with lock held)
+func (r *TimedReservoir) uniformLocked() float64 {
+	u := r.random.Float64()
+	if u == 0 {
+		u = math.SmallestNonzeroFloat64
+	}
+	return u
+}
+
+// sampleLocked returns the sampled candidates, best first, and the score a
+// candidate had to beat to be sampled (must be called with lock held)
+func (r *TimedReservoir) sampleLocked() (sample []keyedSpan, threshold float64) {
+	threshold = math.Inf(-1)
+	var candidates []keyedSpan
+	for _, pool := range r.pools {
+		candidates = append(candidates, pool.scores...)
+		threshold = math.Max(threshold, pool.maxDropped)
+	}
+	sort.Slice(candidates, func(i, j int) bool { return candidates[i].logKey > candidates[j].logKey })
+
+	// Take the best candidates that fit; a pool never exceeds the capacity,
+	// so with a single pool this is all of them
+	used := 0
+	for i, candidate := range candidates {
+		cost := r.costOf(len(r.items[candidate.hash].spanHashes))
+		if used+cost > r.size {
+			return candidates[:i], math.Max(threshold, candidate.logKey)
+		}
+		used += cost
+	}
+	return candidates, threshold
+}
+
+// inclusionProbability returns the probability that a candidate beats the
+// threshold score: log(w) + λt - log(-log u) > T holds with probability
+// 1 - exp(-e^(log(w) + λt - T))
+func inclusionProbability(item *timedItem, threshold float64) float64 {
+	if math.IsInf(threshold, -1) {
+		return 1
+	}
+	return -math.Expm1(-math.Exp(item.baseScore - threshold))
+}
+
+// CloseWindow returns the sampled spans that arrived in the closing window,
+// and moves on to the next window. A sliding reservoir forgets the window
+// that slides out.
+func (r *TimedReservoir) CloseWindow(ctx context.Context) (ptrace.Traces, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	traces := ptrace.NewTraces()
+	sample, threshold := r.sampleLocked()
+	for _, candidate := range sample {
+		if item := r.items[candidate.hash]; item.window == r.currentWindow {
+			r.exportItemLocked(traces, item, threshold)
+		}
+	}
+
+	r.currentWindow++
+	if r.sliding {
+		r.pools = append(r.pools, newTimedPool(r.currentWindow))
+		for len(r.pools) > r.numPools {
+			for _, candidate := range r.pools[0].scores {
+				r.dropItemLocked(candidate.hash)
+			}
+			r.pools = r.pools[1:]
+		}
+	}
+
+	// Update metrics
+	r.sizeGauge.Store(int64(len(r.spanMap)))
+
+	return traces, nil
+}
+
+// exportItemLocked inserts a candidate's spans into traces, recording the
+// probability it was sampled with (must be called with lock held)
+func (r *TimedReservoir) exportItemLocked(traces ptrace.Traces, item *timedItem, threshold float64) {
+	probability := inclusionProbability(item, threshold)
+	for _, hash := range item.spanHashes {
+		span := insertSpanIntoTraces(traces, r.spanMap[hash])
+		applySamplingProbability(span, probability)
+	}
+}
+
+// Export returns the whole sample, whichever window its spans arrived in
+func (r *TimedReservoir) Export(ctx context.Context) (ptrace.Traces, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	traces := ptrace.NewTraces()
+	sample, threshold := r.sampleLocked()
+	for _, candidate := range sample {
+		r.exportItemLocked(traces, r.items[candidate.hash], threshold)
+	}
+
+	return traces, nil
+}
+
+// sampleSpansLocked returns the hashes of the sampled spans (must be called with lock held)
+func (r *TimedReservoir) sampleSpansLocked() map[uint64]struct{} {
+	sample, _ := r.sampleLocked()
+	hashes := make(map[uint64]struct{})
+	for _, candidate := range sample {
+		for _, hash := range r.items[candidate.hash].spanHashes {
+			hashes[hash] = struct{}{}
+		}
+	}
+	return hashes
+}
+
+// GetAllSpans returns a copy of the sampled spans
+func (r *TimedReservoir) GetAllSpans() map[uint64]SpanWithResource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sampled := r.sampleSpansLocked()
+	spansCopy := make(map[uint64]SpanWithResource, len(sampled))
+	for hash := range sampled {
+		spansCopy[hash] = r.spanMap[hash]
+	}
+	return spansCopy
+}
+
+// TakeDelta returns the spans that joined and the hashes of the spans that
+// left the sample since the previous TakeDelta or TakeSnapshot
+func (r *TimedReservoir) TakeDelta() (added map[uint64]SpanWithResource, evicted []uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sampled := r.sampleSpansLocked()
+	added = make(map[uint64]SpanWithResource)
+	for hash := range sampled {
+		if _, ok := r.checkpointed[hash]; !ok {
+			added[hash] = r.spanMap[hash]
+		}
+	}
+	evicted = make([]uint64, 0)
+	for hash := range r.checkpointed {
+		if _, ok := sampled[hash]; !ok {
+			evicted = append(evicted, hash)
+		}
+	}
+
+	r.checkpointed = sampled
+	return added, evicted
+}
+
+// TakeSnapshot returns a copy of the sampled spans
+func (r *TimedReservoir) TakeSnapshot() map[uint64]SpanWithResource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	sampled := r.sampleSpansLocked()
+	spansCopy := make(map[uint64]SpanWithResource, len(sampled))
+	for hash := range sampled {
+		spansCopy[hash] = r.spanMap[hash]
+	}
+
+	r.checkpointed = sampled
+	return spansCopy
+}
+
+// RestoreSpans loads spans from a checkpoint into the current window, as
+// candidates with fresh scores since scores are not checkpointed, so
+// restored spans of earlier windows are exported again when it closes. In
+// trace-aware mode spans are regrouped into their traces. It returns the
+// number of spans restored.
+func (r *TimedReservoir) RestoreSpans(spans map[uint64]SpanWithResource) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for hash, spanWithRes := range spans {
+		key := hash
+		if r.perTrace {
+			key = hashTraceID(spanWithRes.Span.TraceID())
+		}
+		r.addItemLocked(key, []traceSpan{{
+			hash:     hash,
+			span:     spanWithRes.Span,
+			resource: spanWithRes.Resource,
+			scope:    spanWithRes.Scope,
+		}})
+	}
+
+	// The restored spans are already persisted
+	r.checkpointed = r.sampleSpansLocked()
+
+	// Update metrics
+	r.sizeGauge.Store(int64(len(r.spanMap)))
+
+	return len(r.checkpointed)
+}
+
+// Size returns the number of sampled spans
+func (r *TimedReservoir) Size() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sampleSpansLocked())
+}
@@ -0,0 +1,227 @@
+package reservoirsampler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// newTestTimedReservoir creates a timed reservoir of the given size with one minute windows
+func newTestTimedReservoir(size int, mode string) *TimedReservoir {
+	cfg := &Config{
+		SizeK:          size,
+		WindowDuration: time.Minute,
+		WindowMode:     mode,
+		SlidingWindow:  3 * time.Minute,
+		DecayHalfLife:  time.Second,
+	}
+	window, sizeGauge, sampled := newTestWindow()
+	return NewTimedReservoir(cfg, window, sizeGauge, sampled, zap.NewNop())
+}
+
+// addTestSpans adds single-span traces with IDs from first up to last
+func addTestSpans(r ReservoirStore, first, last int) {
+	for i := first; i < last; i++ {
+		forEachSpan(newTestTrace(i, 1), r.AddSpan)
+	}
+}
+
+// traceIDs returns the distinct trace IDs of traces
+func traceIDs(traces ptrace.Traces) map[pcommon.TraceID]struct{} {
+	ids := make(map[pcommon.TraceID]struct{})
+	forEachSpan(traces, func(span ptrace.Span, _ pcommon.Resource, _ pcommon.InstrumentationScope) {
+		ids[span.TraceID()] = struct{}{}
+	})
+	return ids
+}
+
+// TestTimedReservoirSliding tests that a sliding reservoir exports each
+// window's spans once and forgets them once they slide out
+func TestTimedReservoirSliding(t *testing.T) {
+	ctx := context.Background()
+	r := newTestTimedReservoir(10, WindowModeSliding)
+
+	addTestSpans(r, 0, 100)
+	first, err := r.CloseWindow(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 10, first.SpanCount())
+
+	// The sample survives the window, and new spans compete with it
+	assert.Equal(t, 10, r.Size())
+	addTestSpans(r, 100, 200)
+	assert.Equal(t, 10, r.Size())
+
+	second, err := r.CloseWindow(ctx)
+	require.NoError(t, err)
+	assert.LessOrEqual(t, second.SpanCount(), 10)
+	for id := range traceIDs(second) {
+		_, exported := traceIDs(first)[id]
+		assert.False(t, exported, "span exported twice")
+	}
+
+	// The whole sample covers both windows
+	all, err := r.Export(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 10, all.SpanCount())
+
+	// Once both windows slide out, the sample is empty
+	for i := 0; i < 2; i++ {
+		traces, err := r.CloseWindow(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, 0, traces.SpanCount())
+	}
+	assert.Equal(t, 0, r.Size())
+}
+
+// TestTimedReservoirAdjustedCounts tests that the sample of a sliding
+// reservoir adds up to the spans of the windows it covers
+func TestTimedReservoirAdjustedCounts(t *testing.T) {
+	ctx := context.Background()
+	r := newTestTimedReservoir(500, WindowModeSliding)
+
+	addTestSpans(r, 0, 5000)
+	first, err := r.CloseWindow(ctx)
+	require.NoError(t, err)
+	assert.InEpsilon(t, 5000, sumAdjustedCounts(t, first), 0.2)
+
+	addTestSpans(r, 5000, 10000)
+	all, err := r.Export(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 500, all.SpanCount())
+	assert.InEpsilon(t, 10000, sumAdjustedCounts(t, all), 0.2)
+}
+
+// TestTimedReservoirDecaying tests that a decaying reservoir favors recent spans
+func TestTimedReservoirDecaying(t *testing.T) {
+	ctx := context.Background()
+	r := newTestTimedReservoir(10, WindowModeDecaying)
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	addTestSpans(r, 0, 100)
+	first, err := r.CloseWindow(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 10, first.SpanCount())
+
+	// Twenty half-lives later, new spans weigh a million times more
+	now = now.Add(20 * time.Second)
+	addTestSpans(r, 100, 200)
+
+	second, err := r.CloseWindow(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 10, second.SpanCount())
+	forEachSpan(second, func(span ptrace.Span, _ pcommon.Resource, _ pcommon.InstrumentationScope) {
+		assert.GreaterOrEqual(t, traceNumber(span.TraceID()), 100)
+	})
+
+	// The decaying reservoir is never emptied by windows closing
+	_, err = r.CloseWindow(ctx)
+	require.NoError(t, err)
+	assert.Equal(t, 10, r.Size())
+}
+
+// TestTimedReservoirTraceAware tests that a timed reservoir keeps whole traces
+func TestTimedReservoirTraceAware(t *testing.T) {
+	cfg := &Config{
+		SizeK:              500,
+		WindowDuration:     time.Minute,
+		WindowMode:         WindowModeSliding,
+		SlidingWindow:      time.Minute,
+		TraceAware:         true,
+		TraceReservoirUnit: TraceReservoirUnitTraces,
+	}
+	window := NewWindowManager(cfg.WindowDuration, nil, zap.NewNop())
+	r := NewTimedReservoir(cfg, window, atomic.NewInt64(0), atomic.NewInt64(0), zap.NewNop())
+
+	for i := 0; i < 5000; i++ {
+		r.AddTrace(newTestTrace(i, 3))
+	}
+
+	exported, err := r.CloseWindow(context.Background())
+	require.NoError(t, err)
+	counts := countTraceSpans(exported)
+	assert.Len(t, counts, 500)
+	for _, count := range counts {
+		assert.Equal(t, 3, count)
+	}
+	assert.InEpsilon(t, 3*5000, sumAdjustedCounts(t, exported), 0.2)
+}
+
+// TestTimedReservoirTakeDelta tests that deltas applied to a snapshot give the sample
+func TestTimedReservoirTakeDelta(t *testing.T) {
+	ctx := context.Background()
+	r := newTestTimedReservoir(10, WindowModeSliding)
+
+	addTestSpans(r, 0, 50)
+	persisted := r.TakeSnapshot()
+	assert.Len(t, persisted, 10)
+
+	_, err := r.CloseWindow(ctx)
+	require.NoError(t, err)
+	addTestSpans(r, 50, 100)
+
+	added, evicted := r.TakeDelta()
+	for _, hash := range evicted {
+		delete(persisted, hash)
+	}
+	for hash, span := range added {
+		persisted[hash] = span
+	}
+
+	sample := r.GetAllSpans()
+	assert.Len(t, persisted, len(sample))
+	for hash := range sample {
+		assert.Contains(t, persisted, hash)
+	}
+
+	// Restoring the sample keeps it whole
+	restored := newTestTimedReservoir(10, WindowModeSliding)
+	assert.Equal(t, 10, restored.RestoreSpans(sample))
+	added, evicted = restored.TakeDelta()
+	assert.Empty(t, added)
+	assert.Empty(t, evicted)
+}
+
+// TestProcessorSlidingWindow tests that the processor keeps a sliding sample across rollovers
+func TestProcessorSlidingWindow(t *testing.T) {
+	cfg := &Config{
+		SizeK:              10,
+		WindowDuration:     time.Minute,
+		WindowMode:         WindowModeSliding,
+		SlidingWindow:      3 * time.Minute,
+		CheckpointInterval: time.Second,
+		ExportQueueSize:    10,
+	}
+
+	sink := new(consumertest.TracesSink)
+	ctx := context.Background()
+	proc, err := newReservoirProcessor(ctx, newTestSettings(), cfg, sink, nil)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, nil))
+	defer func() {
+		require.NoError(t, proc.Shutdown(ctx))
+	}()
+
+	rp := proc.(*reservoirProcessor)
+	require.NoError(t, proc.ConsumeTraces(ctx, generateTraces(40)))
+	rp.onWindowRollover()
+	require.Eventually(t, func() bool { return len(sink.AllTraces()) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, 10, sink.AllTraces()[0].SpanCount())
+
+	// The next window has nothing new to export but still holds the sample
+	rp.onWindowRollover()
+	assert.Len(t, sink.AllTraces(), 1)
+	assert.Equal(t, 10, rp.reservoir.Size())
+
+	// The first window slides out after two more
+	rp.onWindowRollover()
+	assert.Equal(t, 0, rp.reservoir.Size())
+}
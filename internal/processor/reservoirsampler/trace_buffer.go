@@ -2,7 +2,7 @@ package reservoirsampler
 
 import (
 	"container/list"
-	"sync"
+	"sort"
 	"time"
 
 	"go.opentelemetry.io/collector/pdata/pcommon"
@@ -13,270 +13,445 @@ import (
 
 // traceElement represents a trace in the trace buffer
 type traceElement struct {
+	// The trace's ID
+	id pcommon.TraceID
+	
 	// Maps span IDs to spans
 	spans map[pcommon.SpanID]SpanWithResource
 	
-	// Last time a span was added to this trace
+	// First and last time a span was added to this trace
+	firstSeen   time.Time
 	lastUpdated time.Time
 	
 	// List element for LRU eviction
 	element *list.Element
 	
+	// When the trace completes if no more spans arrive, the strategy that
+	// completes it then, and its position in the shard's timeout index
+	deadline   time.Time
+	completion completionStrategy
+	heapIndex  int
+	
+	// Estimated size of the buffered spans in bytes
+	bytes int64
+	
 	// Trace completion information
 	rootSpanSeen bool
-	spanCount    int
+	spanCount    int // Distinct spans that have arrived
 	expectedSpans int // Might be available from trace context
+	
+	// Parents of arrived spans that have not arrived themselves, so are
+	// still open
+	openParents map[pcommon.SpanID]struct{}
+	
+	// IDs of the spans of a trace spilled to disk, whose spans are not held
+	spilledSpans map[pcommon.SpanID]struct{}
+}
+
+// newTraceElement creates the element of a trace first seen at firstSeen
+func newTraceElement(traceID pcommon.TraceID, firstSeen time.Time) *traceElement {
+	return &traceElement{
+		id:          traceID,
+		spans:       make(map[pcommon.SpanID]SpanWithResource),
+		firstSeen:   firstSeen,
+		lastUpdated: firstSeen,
+		heapIndex:   -1,
+	}
+}
+
+// hasSpan returns whether a span of the trace has arrived, buffered or spilled
+func (t *traceElement) hasSpan(spanID pcommon.SpanID) bool {
+	if _, ok := t.spans[spanID]; ok {
+		return true
+	}
+	_, ok := t.spilledSpans[spanID]
+	return ok
+}
+
+// buffered returns the trace held in memory as it is checkpointed. The spans
+// are shared with the buffer, which never modifies them.
+func (t *traceElement) buffered() BufferedTrace {
+	spans := make([]SpanWithResource, 0, len(t.spans))
+	for _, spanWithRes := range t.spans {
+		spans = append(spans, spanWithRes)
+	}
+	return BufferedTrace{
+		TraceID:     t.id,
+		FirstSeen:   t.firstSeen,
+		LastUpdated: t.lastUpdated,
+		Spans:       spans,
+	}
 }
 
 // TraceBuffer holds spans grouped by trace ID for trace-aware sampling.
 // It maintains an in-memory buffer of spans organized by trace ID, with efficient
-// LRU eviction when the buffer reaches its maximum size.
+// LRU eviction when the buffer reaches its maximum number of traces or bytes,
+// whichever comes first. Spans beyond a trace's own caps are dropped.
+// With a spill tier, evicted traces are parked on disk instead, where they
+// keep collecting spans until they complete like any other trace.
+//
+// Traces are spread over shards by the hash of their ID. Each shard has its
+// own lock, LRU list and timeout index, and an even share of the buffer's
+// limits, so spans of different traces are buffered in parallel.
 type TraceBuffer struct {
-	// Maps trace IDs to all spans in that trace
-	traces map[pcommon.TraceID]*traceElement
-	
-	// LRU list for eviction
-	lruList *list.List
+	// Shards holding the traces
+	shards []*traceBufferShard
 	
-	// Maximum number of traces to buffer
-	maxTraces int
+	// Memory limits of each trace in estimated bytes and in spans; 0 means
+	// no limit. The limits of the whole buffer are split over the shards.
+	maxBytesPerTrace int64
+	maxSpansPerTrace int
 	
 	// How long to wait for a trace to complete
 	timeout time.Duration
 	
+	// Strategies that decide when a trace is complete, ending with the
+	// idle timeout
+	strategies []completionStrategy
+	
+	// Span attribute carrying the expected span count of a trace, if any
+	expectedSpanCountAttribute string
+	
 	// Logger for debug and error output
 	logger *zap.Logger
 	
 	// Counter for trace evictions
 	evictionCounter *atomic.Int64
 	
+	// Counter for spans dropped by the per-trace caps, over the spill tier's
+	// limit or failing to spill
+	droppedSpansCounter *atomic.Int64
+	
 	// Total span count for metrics
 	spanCount atomic.Int64
 	
-	// Mutex for thread safety
-	mu sync.RWMutex
+	// Estimated size of all buffered spans in bytes, and the gauge it is
+	// published to
+	bytes      atomic.Int64
+	bytesGauge *atomic.Int64
+	
+	// Disk tier for evicted traces, if any, the number of traces parked in
+	// it, and the gauge that number is published to
+	spill        *traceSpill
+	spilled      atomic.Int64
+	spilledGauge *atomic.Int64
+	
+	// The settings above are only changed with every shard locked, so a
+	// shard can read them under its own lock
 }
 
 // NewTraceBuffer creates a new trace buffer with the specified size and timeout
 func NewTraceBuffer(maxTraces int, timeout time.Duration, logger *zap.Logger) *TraceBuffer {
-	return &TraceBuffer{
-		traces:         make(map[pcommon.TraceID]*traceElement, maxTraces),
-		lruList:        list.New(),
-		maxTraces:      maxTraces,
-		timeout:        timeout,
-		logger:         logger,
-		evictionCounter: nil, // Set externally if needed
+	return NewShardedTraceBuffer(1, maxTraces, timeout, logger)
+}
+
+// NewShardedTraceBuffer creates a trace buffer split over the given number
+// of shards, at most one per trace it can hold
+func NewShardedTraceBuffer(shards, maxTraces int, timeout time.Duration, logger *zap.Logger) *TraceBuffer {
+	if shards > maxTraces {
+		shards = maxTraces
+	}
+	if shards < 1 {
+		shards = 1
+	}
+	
+	tb := &TraceBuffer{
+		shards:     make([]*traceBufferShard, shards),
+		timeout:    timeout,
+		strategies: []completionStrategy{idleTimeoutCompletion{timeout: timeout}},
+		logger:     logger,
+	}
+	for i := range tb.shards {
+		tb.shards[i] = newTraceBufferShard(tb, splitLimit(int64(maxTraces), shards, i))
+	}
+	return tb
+}
+
+// splitLimit returns the share of limit of shard i of n, spreading the
+// remainder over the first shards
+func splitLimit(limit int64, n, i int) int64 {
+	share := limit / int64(n)
+	if int64(i) < limit%int64(n) {
+		share++
+	}
+	return share
+}
+
+// shardFor returns the shard holding a trace
+func (tb *TraceBuffer) shardFor(traceID pcommon.TraceID) *traceBufferShard {
+	if len(tb.shards) == 1 {
+		return tb.shards[0]
+	}
+	return tb.shards[hashTraceID(traceID)%uint64(len(tb.shards))]
+}
+
+// lockShards locks every shard, to change the settings they share
+func (tb *TraceBuffer) lockShards() {
+	for _, shard := range tb.shards {
+		shard.mu.Lock()
+	}
+}
+
+// unlockShards unlocks the shards locked by lockShards
+func (tb *TraceBuffer) unlockShards() {
+	for _, shard := range tb.shards {
+		shard.mu.Unlock()
 	}
 }
 
 // SetEvictionCounter sets the counter for trace evictions
 func (tb *TraceBuffer) SetEvictionCounter(counter *atomic.Int64) {
+	tb.lockShards()
+	defer tb.unlockShards()
+	
 	tb.evictionCounter = counter
 }
 
-// AddSpan adds a span to the trace buffer
-func (tb *TraceBuffer) AddSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
-	traceID := span.TraceID()
-	spanID := span.SpanID()
+// SetDroppedSpansCounter sets the counter for spans dropped by the per-trace caps
+func (tb *TraceBuffer) SetDroppedSpansCounter(counter *atomic.Int64) {
+	tb.lockShards()
+	defer tb.unlockShards()
 	
-	if traceID.IsEmpty() || spanID.IsEmpty() {
-		// Skip spans with invalid IDs
-		return
+	tb.droppedSpansCounter = counter
+}
+
+// SetBytesGauge sets the gauge the estimated buffer size is published to
+func (tb *TraceBuffer) SetBytesGauge(gauge *atomic.Int64) {
+	tb.lockShards()
+	defer tb.unlockShards()
+	
+	tb.bytesGauge = gauge
+	gauge.Store(tb.bytes.Load())
+}
+
+// SetMemoryLimits sets the byte limit of the buffer and the byte and span
+// caps of each trace; 0 disables a limit. The byte limit is split evenly
+// over the shards.
+func (tb *TraceBuffer) SetMemoryLimits(maxBytes, maxBytesPerTrace int64, maxSpansPerTrace int) {
+	tb.lockShards()
+	defer tb.unlockShards()
+	
+	tb.maxBytesPerTrace = maxBytesPerTrace
+	tb.maxSpansPerTrace = maxSpansPerTrace
+	for i, shard := range tb.shards {
+		shard.maxBytes = splitLimit(maxBytes, len(tb.shards), i)
 	}
+}
+
+// SetSpill makes the buffer park evicted traces in spill rather than drop
+// them, up to maxBytes estimated span bytes split evenly over the shards (0
+// means no limit), publishing their number to spilledGauge. Traces evicted
+// while the spill tier is full are dropped. Traces left in spill by a
+// previous run are picked up again; since what they had seen of their spans
+// is lost, they complete by timeout, maximum age or expected span count.
+func (tb *TraceBuffer) SetSpill(spill *traceSpill, maxBytes int64, spilledGauge *atomic.Int64) {
+	tb.lockShards()
+	defer tb.unlockShards()
 	
+	tb.spill = spill
+	tb.spilledGauge = spilledGauge
+	spilledGauge.Store(tb.spilled.Load())
+	for i, shard := range tb.shards {
+		shard.maxSpillBytes = splitLimit(maxBytes, len(tb.shards), i)
+	}
+	
+	leftovers, err := spill.Load()
+	if err != nil {
+		tb.logger.Error("Failed to load traces spilled by the previous run", zap.Error(err))
+	}
 	now := time.Now()
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
-	
-	// Get or create trace element
-	traceElem, exists := tb.traces[traceID]
-	if !exists {
-		// Create new trace element if this is a new trace
-		traceElem = &traceElement{
-			spans:       make(map[pcommon.SpanID]SpanWithResource),
-			lastUpdated: now,
-			rootSpanSeen: span.ParentSpanID().IsEmpty(),
-			spanCount:   0,
-			expectedSpans: 0, // Will be updated if available in attributes
-		}
-		
-		// Add to LRU list
-		traceElem.element = tb.lruList.PushFront(traceID)
-		
-		// If buffer is full, evict the least recently used trace
-		if len(tb.traces) >= tb.maxTraces {
-			tb.evictLRUTrace()
-		}
-		
-		// Add to traces map
-		tb.traces[traceID] = traceElem
-	} else {
-		// Move to front of LRU list (most recently used)
-		tb.lruList.MoveToFront(traceElem.element)
-		
-		// Update last updated time
-		traceElem.lastUpdated = now
-		
-		// Update root span seen flag
-		if !traceElem.rootSpanSeen && span.ParentSpanID().IsEmpty() {
-			traceElem.rootSpanSeen = true
+	for traceID, spans := range leftovers {
+		traceElem := newTraceElement(traceID, now)
+		traceElem.spans = nil
+		traceElem.spanCount = len(spans)
+		traceElem.spilledSpans = make(map[pcommon.SpanID]struct{}, len(spans))
+		for spanID, size := range spans {
+			traceElem.spilledSpans[spanID] = struct{}{}
+			traceElem.bytes += size
 		}
+		tb.shardFor(traceID).addSpilledTraceLocked(traceElem)
+	}
+	if len(leftovers) > 0 {
+		tb.logger.Info("Resuming traces spilled by the previous run", zap.Int("traces", len(leftovers)))
 	}
-	
-	// Get a SpanWithResource from the pool
-	spanWithRes := GetSpanWithResource()
-	
-	// Fill the SpanWithResource
-	FillSpanWithResource(spanWithRes, span, resource, scope)
-	
-	// Store the span
-	traceElem.spans[spanID] = *spanWithRes
-	
-	// Return to the pool
-	PutSpanWithResource(spanWithRes)
-	
-	// Update span counts
-	traceElem.spanCount++
-	tb.spanCount.Inc()
 }
 
-// GetCompletedTraces returns all traces that are considered complete and removes them from the buffer
-func (tb *TraceBuffer) GetCompletedTraces() []ptrace.Traces {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
+// CloseSpill stops using the spill tier, leaving the traces parked in it for
+// the next run. Traces evicted afterwards are dropped.
+func (tb *TraceBuffer) CloseSpill() {
+	tb.lockShards()
+	defer tb.unlockShards()
 	
-	var completedTraces []ptrace.Traces
-	now := time.Now()
-	tracesToRemove := make([]pcommon.TraceID, 0)
-	
-	// Find traces that have timed out
-	for traceID, traceElem := range tb.traces {
-		if now.Sub(traceElem.lastUpdated) >= tb.timeout {
-			// Create a new traces collection for this trace
-			traces := ptrace.NewTraces()
-			
-			// Get span count for logging
-			spanCount := len(traceElem.spans)
-			
-			// Add all spans from this trace
-			for _, spanWithRes := range traceElem.spans {
-				insertSpanIntoTraces(traces, spanWithRes)
-			}
-			
-			completedTraces = append(completedTraces, traces)
-			tracesToRemove = append(tracesToRemove, traceID)
-			
-			tb.logger.Debug("Trace completed by timeout",
-				zap.Stringer("trace_id", traceID),
-				zap.Int("span_count", spanCount),
-				zap.Duration("age", now.Sub(traceElem.lastUpdated)))
-			
-			// Update span count
-			tb.spanCount.Add(-int64(spanCount))
+	if tb.spill == nil {
+		return
+	}
+	tb.flushSpill(tb.spill, tb.droppedSpansCounter)
+	tb.spill = nil
+	for _, shard := range tb.shards {
+		for _, traceElem := range shard.spilled {
+			shard.forgetSpilledLocked(traceElem)
 		}
 	}
+}
+
+// SetCompletionStrategies sets the strategies that can complete a trace
+// before the idle timeout, which always applies
+func (tb *TraceBuffer) SetCompletionStrategies(strategies []completionStrategy) {
+	tb.lockShards()
+	defer tb.unlockShards()
 	
-	// Remove completed traces from the buffer
-	for _, traceID := range tracesToRemove {
-		tb.removeTraceLocked(traceID)
+	tb.strategies = append(append([]completionStrategy(nil), strategies...), idleTimeoutCompletion{timeout: tb.timeout})
+	for _, shard := range tb.shards {
+		shard.deadlines.reset(tb.strategies)
 	}
+}
+
+// SetExpectedSpanCountAttribute sets the span attribute carrying the
+// expected span count of a trace, read by the span count strategy
+func (tb *TraceBuffer) SetExpectedSpanCountAttribute(key string) {
+	tb.lockShards()
+	defer tb.unlockShards()
 	
-	return completedTraces
+	tb.expectedSpanCountAttribute = key
 }
 
-// removeTraceLocked removes a trace from the buffer (must be called with lock held)
-func (tb *TraceBuffer) removeTraceLocked(traceID pcommon.TraceID) {
-	if traceElem, exists := tb.traces[traceID]; exists {
-		// Remove from LRU list
-		if traceElem.element != nil {
-			tb.lruList.Remove(traceElem.element)
-		}
-		
-		// Remove from traces map
-		delete(tb.traces, traceID)
+// FlushSpill writes the spans queued for the spill tier to disk
+func (tb *TraceBuffer) FlushSpill() {
+	// The settings can be read under any shard's lock
+	shard := tb.shards[0]
+	shard.mu.RLock()
+	spill, droppedSpansCounter := tb.spill, tb.droppedSpansCounter
+	shard.mu.RUnlock()
+
+	if spill != nil {
+		tb.flushSpill(spill, droppedSpansCounter)
 	}
 }
 
-// evictLRUTrace evicts the least recently used trace from the buffer (must be called with lock held)
-func (tb *TraceBuffer) evictLRUTrace() {
-	// Get the last element from the LRU list
-	if tb.lruList.Len() == 0 {
-		return
-	}
-	
-	// Get the trace ID from the list element
-	elem := tb.lruList.Back()
-	traceID, ok := elem.Value.(pcommon.TraceID)
-	if !ok {
-		tb.logger.Error("Invalid element type in LRU list")
-		return
+// flushSpill writes the spans queued for spill to disk, counting the spans
+// that could not be written as dropped
+func (tb *TraceBuffer) flushSpill(spill *traceSpill, droppedSpansCounter *atomic.Int64) {
+	lost, err := spill.Flush()
+	if err != nil {
+		tb.logger.Error("Failed to write spilled spans, dropping them",
+			zap.Int("spans", lost),
+			zap.Error(err))
+		if droppedSpansCounter != nil {
+			droppedSpansCounter.Add(int64(lost))
+		}
 	}
+}
+
+// AddSpan adds a span to the buffer
+func (tb *TraceBuffer) AddSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+	traceID := span.TraceID()
+	spanID := span.SpanID()
 	
-	// Get the trace element
-	traceElem, exists := tb.traces[traceID]
-	if !exists {
-		tb.logger.Error("Trace not found in buffer",
-			zap.Stringer("trace_id", traceID))
+	if traceID.IsEmpty() || spanID.IsEmpty() {
+		// Skip spans with invalid IDs
 		return
 	}
 	
-	// Log the eviction
-	tb.logger.Debug("Evicting trace from buffer due to capacity limit",
-		zap.Stringer("trace_id", traceID),
-		zap.Time("last_updated", traceElem.lastUpdated),
-		zap.Int("spans", len(traceElem.spans)),
-		zap.Duration("age", time.Since(traceElem.lastUpdated)))
-	
-	// Increment the eviction counter if set
-	if tb.evictionCounter != nil {
-		tb.evictionCounter.Inc()
+	tb.shardFor(traceID).addSpan(span, resource, scope)
+}
+
+// GetCompletedTraces returns all traces that are considered complete and
+// removes them from the buffer. Spans queued for the spill tier are written
+// first, so none stay in memory only for long.
+func (tb *TraceBuffer) GetCompletedTraces() []ptrace.Traces {
+	tb.FlushSpill()
+
+	var completedTraces []ptrace.Traces
+	now := time.Now()
+	for _, shard := range tb.shards {
+		completedTraces = shard.takeCompleted(now, completedTraces)
 	}
-	
-	// Update span count
-	tb.spanCount.Add(-int64(len(traceElem.spans)))
-	
-	// Remove the trace from the buffer
-	tb.removeTraceLocked(traceID)
+	return completedTraces
 }
 
 // GetTrace returns a specific trace as a Traces object
 func (tb *TraceBuffer) GetTrace(traceID pcommon.TraceID) ptrace.Traces {
-	tb.mu.RLock()
-	defer tb.mu.RUnlock()
-	
-	if traceElem, exists := tb.traces[traceID]; exists {
-		traces := ptrace.NewTraces()
-		for _, spanWithRes := range traceElem.spans {
-			insertSpanIntoTraces(traces, spanWithRes)
-		}
-		return traces
-	}
-	
-	return ptrace.NewTraces()
+	return tb.shardFor(traceID).getTrace(traceID)
 }
 
 // RemoveTrace removes a trace from the buffer
 func (tb *TraceBuffer) RemoveTrace(traceID pcommon.TraceID) {
-	tb.mu.Lock()
-	defer tb.mu.Unlock()
-	
-	if traceElem, exists := tb.traces[traceID]; exists {
-		// Update span count
-		tb.spanCount.Add(-int64(len(traceElem.spans)))
-		
-		// Remove the trace
-		tb.removeTraceLocked(traceID)
+	tb.shardFor(traceID).removeTrace(traceID)
+}
+
+// Snapshot returns the traces held in memory. Spilled traces are left out,
+// as they are already on disk. The spans are shared with the buffer, which
+// never modifies them.
+func (tb *TraceBuffer) Snapshot() []BufferedTrace {
+	var traces []BufferedTrace
+	for _, shard := range tb.shards {
+		traces = shard.snapshot(traces)
+	}
+	return traces
+}
+
+// TakeSnapshot returns the traces held in memory, like Snapshot, for a full
+// checkpoint. From then on the buffer tracks which traces change and leave
+// memory, and TakeDelta returns them.
+func (tb *TraceBuffer) TakeSnapshot() []BufferedTrace {
+	var traces []BufferedTrace
+	for _, shard := range tb.shards {
+		traces = shard.takeSnapshot(traces)
+	}
+	return traces
+}
+
+// TakeDelta returns the traces held in memory that changed, and the IDs of
+// the traces that left memory, since the previous TakeDelta or TakeSnapshot,
+// and starts tracking changes afresh
+func (tb *TraceBuffer) TakeDelta() (changed []BufferedTrace, removed []pcommon.TraceID) {
+	for _, shard := range tb.shards {
+		changed, removed = shard.takeDelta(changed, removed)
 	}
+	return changed, removed
+}
+
+// Restore puts checkpointed traces back into the buffer, keeping the times
+// their spans arrived so they complete when they would have without the
+// restart. Traces already in the buffer are skipped, and the buffer's limits
+// apply as if the traces had just arrived in the order they were last updated.
+// It returns the number of traces restored.
+func (tb *TraceBuffer) Restore(traces []BufferedTrace) int {
+	// The most recently updated trace ends up at the front of the LRU lists
+	ordered := append([]BufferedTrace(nil), traces...)
+	sort.Slice(ordered, func(i, j int) bool {
+		return ordered[i].LastUpdated.Before(ordered[j].LastUpdated)
+	})
+	
+	restored := 0
+	for _, trace := range ordered {
+		if tb.shardFor(trace.TraceID).restore(trace) {
+			restored++
+		}
+	}
+	return restored
 }
 
 // Size returns the number of traces in the buffer
 func (tb *TraceBuffer) Size() int {
-	tb.mu.RLock()
-	defer tb.mu.RUnlock()
-	return len(tb.traces)
+	size := 0
+	for _, shard := range tb.shards {
+		size += shard.size()
+	}
+	return size
+}
+
+// SpilledSize returns the number of traces spilled to disk
+func (tb *TraceBuffer) SpilledSize() int {
+	return int(tb.spilled.Load())
+}
+
+// Bytes returns the estimated size of all buffered spans in bytes
+func (tb *TraceBuffer) Bytes() int64 {
+	return tb.bytes.Load()
 }
 
 // SpanCount returns the total number of spans across all traces
 func (tb *TraceBuffer) SpanCount() int {
 	return int(tb.spanCount.Load())
-}
\ No newline at end of file
+}
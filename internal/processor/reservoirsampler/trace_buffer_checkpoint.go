@@ -0,0 +1,293 @@
+package reservoirsampler
+
+import (
+	"bufio"
+	"compress/gzip"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.uber.org/zap"
+)
+
+// Trace buffer file format (gzip compressed), used by the backends that
+// store the trace buffer as one blob:
+//
+//	[Magic (4 bytes)] "RBUF"
+//	[Version (1 byte)]
+//	[Trace count (4 bytes)]
+//	Per trace:
+//	  [Length (4 bytes)]
+//	  [Trace record (Length bytes)] as encoded by encodeBufferedTrace
+const (
+	traceBufferFileMagic   = "RBUF"
+	traceBufferFileVersion = 1
+
+	// bufferedTraceVersion is the version of an encoded buffered trace
+	bufferedTraceVersion = 1
+
+	// bufferedTraceHeaderSize is the encoded size of a buffered trace without
+	// its spans: version, trace ID, first seen and last updated times and the
+	// span count, plus the trailing checksum
+	bufferedTraceHeaderSize = 1 + 16 + 8 + 8 + 4 + 4
+)
+
+// errCorruptBufferedTrace is returned when a checkpointed buffered trace cannot be decoded
+var errCorruptBufferedTrace = errors.New("corrupt buffered trace")
+
+// BufferedTrace is a trace waiting in the trace buffer, as it is checkpointed
+type BufferedTrace struct {
+	TraceID pcommon.TraceID
+
+	// When the first and the latest span of the trace arrived
+	FirstSeen   time.Time
+	LastUpdated time.Time
+
+	Spans []SpanWithResource
+}
+
+// encodeBufferedTrace encodes a buffered trace as its version, trace ID,
+// times, span count, each serialized span prefixed with its length, and a
+// CRC-32C of all of it
+func encodeBufferedTrace(trace BufferedTrace) ([]byte, error) {
+	buf := make([]byte, 0, bufferedTraceHeaderSize)
+	buf = append(buf, bufferedTraceVersion)
+	buf = append(buf, trace.TraceID[:]...)
+	buf = binary.BigEndian.AppendUint64(buf, uint64(trace.FirstSeen.UnixNano()))
+	buf = binary.BigEndian.AppendUint64(buf, uint64(trace.LastUpdated.UnixNano()))
+	buf = binary.BigEndian.AppendUint32(buf, uint32(len(trace.Spans)))
+
+	for _, span := range trace.Spans {
+		spanBytes, err := serializeSpanWithResource(span)
+		if err != nil {
+			return nil, fmt.Errorf("failed to serialize buffered span: %w", err)
+		}
+		buf = binary.BigEndian.AppendUint32(buf, uint32(len(spanBytes)))
+		buf = append(buf, spanBytes...)
+	}
+
+	return binary.BigEndian.AppendUint32(buf, crc32.Checksum(buf, castagnoliTable)), nil
+}
+
+// checkBufferedTrace verifies the size, checksum and version of a buffered
+// trace encoded by encodeBufferedTrace and returns its body
+func checkBufferedTrace(data []byte) ([]byte, error) {
+	if len(data) < bufferedTraceHeaderSize {
+		return nil, fmt.Errorf("%w: %d bytes", errCorruptBufferedTrace, len(data))
+	}
+
+	body, checksum := data[:len(data)-4], binary.BigEndian.Uint32(data[len(data)-4:])
+	if crc32.Checksum(body, castagnoliTable) != checksum {
+		return nil, fmt.Errorf("%w: checksum mismatch", errCorruptBufferedTrace)
+	}
+	if body[0] != bufferedTraceVersion {
+		return nil, fmt.Errorf("%w: unsupported version %d", errCorruptBufferedTrace, body[0])
+	}
+	return body, nil
+}
+
+// decodeBufferedTrace decodes a buffered trace encoded by encodeBufferedTrace
+func decodeBufferedTrace(data []byte) (BufferedTrace, error) {
+	body, err := checkBufferedTrace(data)
+	if err != nil {
+		return BufferedTrace{}, err
+	}
+
+	var trace BufferedTrace
+	copy(trace.TraceID[:], body[1:17])
+	trace.FirstSeen = time.Unix(0, int64(binary.BigEndian.Uint64(body[17:25])))
+	trace.LastUpdated = time.Unix(0, int64(binary.BigEndian.Uint64(body[25:33])))
+	spanCount := int(binary.BigEndian.Uint32(body[33:37]))
+
+	rest := body[37:]
+	trace.Spans = make([]SpanWithResource, 0, spanCount)
+	for i := 0; i < spanCount; i++ {
+		if len(rest) < 4 {
+			return BufferedTrace{}, fmt.Errorf("%w: truncated span", errCorruptBufferedTrace)
+		}
+		spanLen := int(binary.BigEndian.Uint32(rest))
+		if len(rest) < 4+spanLen {
+			return BufferedTrace{}, fmt.Errorf("%w: truncated span", errCorruptBufferedTrace)
+		}
+		span, err := deserializeSpanWithResource(rest[4 : 4+spanLen])
+		if err != nil {
+			return BufferedTrace{}, fmt.Errorf("%w: %v", errCorruptBufferedTrace, err)
+		}
+		trace.Spans = append(trace.Spans, span)
+		rest = rest[4+spanLen:]
+	}
+	if len(rest) != 0 {
+		return BufferedTrace{}, fmt.Errorf("%w: %d trailing bytes", errCorruptBufferedTrace, len(rest))
+	}
+
+	return trace, nil
+}
+
+// bufferedTraceRecords holds buffered traces encoded by encodeBufferedTrace,
+// by trace ID. The backends that store the trace buffer as one blob keep the
+// records of their last checkpoint, so a delta only encodes the traces that
+// changed.
+type bufferedTraceRecords map[pcommon.TraceID][]byte
+
+// newBufferedTraceRecords encodes buffered traces
+func newBufferedTraceRecords(traces []BufferedTrace) (bufferedTraceRecords, error) {
+	records := make(bufferedTraceRecords, len(traces))
+	if _, err := records.applyDelta(traces, nil); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+// bufferedTraceChange is the record a trace had before applyDelta replaced
+// or removed it
+type bufferedTraceChange struct {
+	traceID pcommon.TraceID
+	record  []byte
+	existed bool
+}
+
+// applyDelta encodes the changed traces into the records and removes the
+// removed ones, touching only those traces. It returns a function that puts
+// the records back as they were, for when saving them fails. If a trace
+// cannot be encoded the records are left unchanged.
+func (r *bufferedTraceRecords) applyDelta(changed []BufferedTrace, removed []pcommon.TraceID) (undo func(), err error) {
+	encoded := make([][]byte, len(changed))
+	for i, trace := range changed {
+		if encoded[i], err = encodeBufferedTrace(trace); err != nil {
+			return nil, err
+		}
+	}
+
+	if *r == nil {
+		*r = make(bufferedTraceRecords, len(changed))
+	}
+	records := *r
+
+	changes := make([]bufferedTraceChange, 0, len(removed)+len(changed))
+	save := func(traceID pcommon.TraceID) {
+		record, existed := records[traceID]
+		changes = append(changes, bufferedTraceChange{traceID: traceID, record: record, existed: existed})
+	}
+	for _, traceID := range removed {
+		save(traceID)
+		delete(records, traceID)
+	}
+	for i, trace := range changed {
+		save(trace.TraceID)
+		records[trace.TraceID] = encoded[i]
+	}
+
+	return func() {
+		for i := len(changes) - 1; i >= 0; i-- {
+			change := changes[i]
+			if change.existed {
+				records[change.traceID] = change.record
+			} else {
+				delete(records, change.traceID)
+			}
+		}
+	}, nil
+}
+
+// decode returns the buffered traces of the records. Traces that cannot be
+// decoded are left out.
+func (r bufferedTraceRecords) decode(logger *zap.Logger) []BufferedTrace {
+	traces := make([]BufferedTrace, 0, len(r))
+	for _, record := range r {
+		trace, err := decodeBufferedTrace(record)
+		if err != nil {
+			logger.Warn("Dropping unreadable buffered trace", zap.Error(err))
+			continue
+		}
+		traces = append(traces, trace)
+	}
+	return traces
+}
+
+// writeTraceBuffer writes buffered traces in the compressed trace buffer file format
+func writeTraceBuffer(w io.Writer, traces bufferedTraceRecords) error {
+	gz := gzip.NewWriter(w)
+	buf := bufio.NewWriter(gz)
+
+	header := make([]byte, 0, len(traceBufferFileMagic)+1+4)
+	header = append(header, traceBufferFileMagic...)
+	header = append(header, traceBufferFileVersion)
+	header = binary.BigEndian.AppendUint32(header, uint32(len(traces)))
+	if _, err := buf.Write(header); err != nil {
+		return fmt.Errorf("failed to write trace buffer header: %w", err)
+	}
+
+	length := make([]byte, 4)
+	for _, record := range traces {
+		binary.BigEndian.PutUint32(length, uint32(len(record)))
+		if _, err := buf.Write(length); err != nil {
+			return fmt.Errorf("failed to write buffered trace: %w", err)
+		}
+		if _, err := buf.Write(record); err != nil {
+			return fmt.Errorf("failed to write buffered trace: %w", err)
+		}
+	}
+
+	if err := buf.Flush(); err != nil {
+		return fmt.Errorf("failed to write trace buffer: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return fmt.Errorf("failed to compress trace buffer: %w", err)
+	}
+
+	return nil
+}
+
+// readTraceBuffer reads the records of buffered traces written by
+// writeTraceBuffer. Records that fail their checksum are left out.
+func readTraceBuffer(r io.Reader, logger *zap.Logger) (bufferedTraceRecords, error) {
+	gz, err := gzip.NewReader(bufio.NewReader(r))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress trace buffer: %w", err)
+	}
+	defer gz.Close()
+
+	// Reading to the end also verifies the gzip checksum
+	data, err := io.ReadAll(gz)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decompress trace buffer: %w", err)
+	}
+
+	headerSize := len(traceBufferFileMagic) + 1 + 4
+	if len(data) < headerSize {
+		return nil, fmt.Errorf("trace buffer too short: %d bytes", len(data))
+	}
+	if string(data[:len(traceBufferFileMagic)]) != traceBufferFileMagic {
+		return nil, errors.New("not a trace buffer file")
+	}
+	if version := data[len(traceBufferFileMagic)]; version != traceBufferFileVersion {
+		return nil, fmt.Errorf("unsupported trace buffer version %d", version)
+	}
+
+	count := int(binary.BigEndian.Uint32(data[len(traceBufferFileMagic)+1:]))
+	rest := data[headerSize:]
+	traces := make(bufferedTraceRecords, count)
+	for i := 0; i < count; i++ {
+		if len(rest) < 4 {
+			return nil, fmt.Errorf("trace buffer truncated after %d traces", i)
+		}
+		recordLen := int(binary.BigEndian.Uint32(rest))
+		if len(rest) < 4+recordLen {
+			return nil, fmt.Errorf("trace buffer truncated after %d traces", i)
+		}
+
+		record := rest[4 : 4+recordLen]
+		if body, err := checkBufferedTrace(record); err != nil {
+			logger.Warn("Dropping unreadable buffered trace", zap.Error(err))
+		} else {
+			traces[pcommon.TraceID(body[1:17])] = record
+		}
+		rest = rest[4+recordLen:]
+	}
+
+	return traces, nil
+}
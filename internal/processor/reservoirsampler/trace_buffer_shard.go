@@ -0,0 +1,671 @@
+package reservoirsampler
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+// traceBufferShard holds the traces of one shard of a trace buffer, with
+// its own lock, LRU list and timeout index. Settings shared by all shards
+// are read from the buffer.
+type traceBufferShard struct {
+	buffer *TraceBuffer
+
+	// Maps trace IDs to the traces held in memory
+	traces map[pcommon.TraceID]*traceElement
+
+	// LRU list for eviction
+	lruList *list.List
+
+	// Timeout index of every trace of the shard, buffered or spilled
+	deadlines traceDeadlines
+
+	// Traces parked in the spill tier, and the estimated size of their spans
+	// in bytes
+	spilled    map[pcommon.TraceID]*traceElement
+	spillBytes int64
+
+	// Spilled traces being read back or deleted outside the lock, which are
+	// not spilled again until that is done
+	unspilling map[pcommon.TraceID]struct{}
+
+	// The shard's share of the buffer's limits; 0 bytes means no limit
+	maxTraces     int
+	maxBytes      int64
+	maxSpillBytes int64
+
+	// Estimated size of the spans held by the shard in bytes
+	bytes int64
+
+	// Traces held in memory that changed, and traces that left memory, since
+	// the last checkpoint, tracked once a checkpoint has been taken
+	tracking      bool
+	changedTraces map[pcommon.TraceID]struct{}
+	removedTraces map[pcommon.TraceID]struct{}
+
+	mu sync.RWMutex
+}
+
+// newTraceBufferShard creates a shard of buffer holding up to maxTraces traces
+func newTraceBufferShard(buffer *TraceBuffer, maxTraces int64) *traceBufferShard {
+	return &traceBufferShard{
+		buffer:        buffer,
+		traces:        make(map[pcommon.TraceID]*traceElement, maxTraces),
+		lruList:       list.New(),
+		spilled:       make(map[pcommon.TraceID]*traceElement),
+		unspilling:    make(map[pcommon.TraceID]struct{}),
+		maxTraces:     int(maxTraces),
+		changedTraces: make(map[pcommon.TraceID]struct{}),
+		removedTraces: make(map[pcommon.TraceID]struct{}),
+	}
+}
+
+// addSpan adds a span with valid IDs to the shard
+func (s *traceBufferShard) addSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+	size := estimateSpanSize(span, resource, scope)
+
+	s.mu.Lock()
+	s.addSpanLocked(span, resource, scope, size)
+	spill, droppedSpansCounter := s.buffer.spill, s.buffer.droppedSpansCounter
+	s.mu.Unlock()
+
+	// Spans queued for the spill tier are written in batches, outside the lock
+	if spill != nil && spill.Due() {
+		s.buffer.flushSpill(spill, droppedSpansCounter)
+	}
+}
+
+// addSpanLocked adds a span of an estimated size to the shard (must be called with lock held)
+func (s *traceBufferShard) addSpanLocked(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope, size int64) {
+	traceID := span.TraceID()
+	spanID := span.SpanID()
+
+	// Taken under the lock, so the LRU list stays in update order
+	now := time.Now()
+
+	// A spilled trace keeps collecting its spans on disk
+	if traceElem, spilled := s.spilled[traceID]; spilled {
+		s.addSpilledSpanLocked(traceElem, span, resource, scope, size, now)
+		return
+	}
+
+	// Get or create trace element, unless the span would take the trace past
+	// its caps
+	traceElem, exists := s.traces[traceID]
+	var replaced int64
+	if exists {
+		if old, duplicate := traceElem.spans[spanID]; duplicate {
+			replaced = estimateSpanSize(old.Span, old.Resource, old.Scope)
+		} else if s.exceedsTraceLimitsLocked(traceElem.spanCount+1, traceElem.bytes+size) {
+			s.dropSpanLocked(traceID, size)
+			return
+		}
+	} else if s.exceedsTraceLimitsLocked(1, size) {
+		s.dropSpanLocked(traceID, size)
+		return
+	}
+
+	if !exists {
+		// Create new trace element if this is a new trace
+		traceElem = newTraceElement(traceID, now)
+		traceElem.rootSpanSeen = span.ParentSpanID().IsEmpty()
+
+		// Add to LRU list
+		traceElem.element = s.lruList.PushFront(traceID)
+
+		// If the shard is full, evict the least recently used trace
+		if len(s.traces) >= s.maxTraces {
+			s.evictLRUTraceLocked()
+		}
+
+		// Add to traces map
+		s.traces[traceID] = traceElem
+	} else {
+		// Move to front of LRU list (most recently used)
+		s.lruList.MoveToFront(traceElem.element)
+
+		// Update last updated time
+		traceElem.lastUpdated = now
+
+		// Update root span seen flag
+		if !traceElem.rootSpanSeen && span.ParentSpanID().IsEmpty() {
+			traceElem.rootSpanSeen = true
+		}
+	}
+
+	// Get a SpanWithResource from the pool
+	spanWithRes := GetSpanWithResource()
+
+	// Fill the SpanWithResource
+	FillSpanWithResource(spanWithRes, span, resource, scope)
+
+	// Store the span, replacing an earlier copy of it
+	_, duplicate := traceElem.spans[spanID]
+	traceElem.spans[spanID] = *spanWithRes
+
+	// Return to the pool
+	PutSpanWithResource(spanWithRes)
+
+	s.trackSpanLocked(traceElem, span)
+	s.markChangedLocked(traceID)
+
+	// Update span counts
+	if !duplicate {
+		traceElem.spanCount++
+		s.buffer.spanCount.Inc()
+	}
+	s.deadlines.update(traceElem, s.buffer.strategies)
+
+	// Update sizes, and evict the least recently used traces while the shard
+	// is over its byte limit
+	traceElem.bytes += size - replaced
+	s.addBytesLocked(size - replaced)
+	for s.maxBytes > 0 && s.bytes > s.maxBytes && s.lruList.Len() > 1 {
+		s.evictLRUTraceLocked()
+	}
+}
+
+// addSpilledSpanLocked adds a span to a trace spilled to disk (must be called with lock held)
+func (s *traceBufferShard) addSpilledSpanLocked(
+	traceElem *traceElement,
+	span ptrace.Span,
+	resource pcommon.Resource,
+	scope pcommon.InstrumentationScope,
+	size int64,
+	now time.Time,
+) {
+	spanID := span.SpanID()
+	_, duplicate := traceElem.spilledSpans[spanID]
+	if !duplicate && s.exceedsTraceLimitsLocked(traceElem.spanCount+1, traceElem.bytes+size) {
+		s.dropSpanLocked(traceElem.id, size)
+		return
+	}
+	if !duplicate && s.maxSpillBytes > 0 && s.spillBytes+size > s.maxSpillBytes {
+		s.buffer.logger.Debug("Dropping span of a spilled trace, the spill tier is full",
+			zap.Stringer("trace_id", traceElem.id),
+			zap.Int64("span_bytes", size))
+		if s.buffer.droppedSpansCounter != nil {
+			s.buffer.droppedSpansCounter.Inc()
+		}
+		return
+	}
+
+	spans := map[pcommon.SpanID]SpanWithResource{spanID: cloneSpanWithContext(span, resource, scope)}
+	s.buffer.spill.Write(traceElem.id, spans)
+
+	traceElem.lastUpdated = now
+	if span.ParentSpanID().IsEmpty() {
+		traceElem.rootSpanSeen = true
+	}
+	traceElem.spilledSpans[spanID] = struct{}{}
+	s.trackSpanLocked(traceElem, span)
+
+	if !duplicate {
+		traceElem.spanCount++
+		traceElem.bytes += size
+		s.spillBytes += size
+	}
+	s.deadlines.update(traceElem, s.buffer.strategies)
+}
+
+// trackSpanLocked updates what a trace's completion strategies know of it
+// once a span has arrived (must be called with lock held)
+func (s *traceBufferShard) trackSpanLocked(traceElem *traceElement, span ptrace.Span) {
+	// Track the spans still open: the span has arrived, and its parent is
+	// open until it arrives too
+	delete(traceElem.openParents, span.SpanID())
+	if parentID := span.ParentSpanID(); !parentID.IsEmpty() && !traceElem.hasSpan(parentID) {
+		if traceElem.openParents == nil {
+			traceElem.openParents = make(map[pcommon.SpanID]struct{})
+		}
+		traceElem.openParents[parentID] = struct{}{}
+	}
+
+	// Pick up the expected span count if the span carries it
+	if key := s.buffer.expectedSpanCountAttribute; key != "" {
+		if value, ok := span.Attributes().Get(key); ok && value.Type() == pcommon.ValueTypeInt {
+			traceElem.expectedSpans = int(value.Int())
+		}
+	}
+}
+
+// exceedsTraceLimitsLocked returns whether a trace of spans spans and bytes
+// bytes would be over the per-trace caps. A trace is never allowed more than
+// the whole shard. (must be called with lock held)
+func (s *traceBufferShard) exceedsTraceLimitsLocked(spans int, bytes int64) bool {
+	if s.buffer.maxSpansPerTrace > 0 && spans > s.buffer.maxSpansPerTrace {
+		return true
+	}
+	if s.buffer.maxBytesPerTrace > 0 && bytes > s.buffer.maxBytesPerTrace {
+		return true
+	}
+	return s.maxBytes > 0 && bytes > s.maxBytes
+}
+
+// dropSpanLocked records a span dropped by the per-trace caps (must be called with lock held)
+func (s *traceBufferShard) dropSpanLocked(traceID pcommon.TraceID, size int64) {
+	s.buffer.logger.Debug("Dropping span over the trace buffer's per-trace limits",
+		zap.Stringer("trace_id", traceID),
+		zap.Int64("span_bytes", size))
+
+	if s.buffer.droppedSpansCounter != nil {
+		s.buffer.droppedSpansCounter.Inc()
+	}
+}
+
+// addBytesLocked adds delta to the estimated shard and buffer sizes and
+// publishes the buffer's (must be called with lock held)
+func (s *traceBufferShard) addBytesLocked(delta int64) {
+	s.bytes += delta
+	s.buffer.bytes.Add(delta)
+	if s.buffer.bytesGauge != nil {
+		s.buffer.bytesGauge.Add(delta)
+	}
+}
+
+// takeCompleted removes the traces of the shard that are complete at now
+// and appends them to completed
+func (s *traceBufferShard) takeCompleted(now time.Time, completed []ptrace.Traces) []ptrace.Traces {
+	s.mu.Lock()
+
+	// The timeout index yields the complete traces first
+	var spilled []*traceElement
+	for len(s.deadlines) > 0 && !s.deadlines[0].deadline.After(now) {
+		traceElem := s.deadlines[0]
+
+		// Spilled traces are read back from disk once the lock is released
+		if traceElem.spilledSpans != nil {
+			s.forgetSpilledLocked(traceElem)
+			s.unspilling[traceElem.id] = struct{}{}
+			spilled = append(spilled, traceElem)
+			continue
+		}
+
+		// Create a new traces collection with all spans of the trace
+		traces := ptrace.NewTraces()
+		for _, spanWithRes := range traceElem.spans {
+			insertSpanIntoTraces(traces, spanWithRes)
+		}
+		completed = append(completed, traces)
+		s.removeTraceLocked(traceElem)
+
+		s.buffer.logger.Debug("Trace completed",
+			zap.Stringer("trace_id", traceElem.id),
+			zap.String("reason", traceElem.completion.Name()),
+			zap.Int("span_count", len(traceElem.spans)),
+			zap.Duration("age", now.Sub(traceElem.firstSeen)),
+			zap.Duration("idle", now.Sub(traceElem.lastUpdated)))
+	}
+	spill := s.buffer.spill
+	s.mu.Unlock()
+
+	if len(spilled) == 0 {
+		return completed
+	}
+
+	for _, traceElem := range spilled {
+		traces, err := takeSpilled(spill, traceElem.id, s.buffer.logger)
+		if err != nil {
+			s.buffer.logger.Error("Failed to read spilled trace, dropping it",
+				zap.Stringer("trace_id", traceElem.id),
+				zap.Error(err))
+			if s.buffer.evictionCounter != nil {
+				s.buffer.evictionCounter.Inc()
+			}
+			continue
+		}
+
+		completed = append(completed, traces)
+		s.buffer.logger.Debug("Spilled trace completed",
+			zap.Stringer("trace_id", traceElem.id),
+			zap.String("reason", traceElem.completion.Name()),
+			zap.Int("span_count", traces.SpanCount()),
+			zap.Duration("age", now.Sub(traceElem.firstSeen)))
+	}
+	s.finishUnspilling(spilled...)
+
+	return completed
+}
+
+// takeSpilled reads a spilled trace back from disk and deletes it there.
+// It runs without the shard lock, on a trace already removed from the shard.
+func takeSpilled(spill *traceSpill, traceID pcommon.TraceID, logger *zap.Logger) (ptrace.Traces, error) {
+	spans, err := spill.Read(traceID)
+	if deleteErr := spill.Delete(traceID); deleteErr != nil {
+		logger.Error("Failed to delete spilled trace", zap.Error(deleteErr))
+	}
+	if err != nil {
+		return ptrace.Traces{}, err
+	}
+
+	traces := ptrace.NewTraces()
+	for _, span := range spans {
+		insertSpanIntoTraces(traces, span)
+	}
+	return traces, nil
+}
+
+// finishUnspilling lets traces read back or deleted from disk be spilled again
+func (s *traceBufferShard) finishUnspilling(traceElems ...*traceElement) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, traceElem := range traceElems {
+		delete(s.unspilling, traceElem.id)
+	}
+}
+
+// spillTraceLocked parks a buffered trace on disk, queueing its spans to be
+// written with the next batch (must be called with lock held)
+func (s *traceBufferShard) spillTraceLocked(traceElem *traceElement) {
+	s.buffer.spill.Write(traceElem.id, traceElem.spans)
+
+	spanIDs := make(map[pcommon.SpanID]struct{}, len(traceElem.spans))
+	for spanID := range traceElem.spans {
+		spanIDs[spanID] = struct{}{}
+	}
+
+	// The trace keeps its place in the timeout index
+	s.detachTraceLocked(traceElem)
+	traceElem.spans = nil
+	traceElem.element = nil
+	traceElem.spilledSpans = spanIDs
+	s.addSpilledTraceLocked(traceElem)
+}
+
+// addSpilledTraceLocked registers a trace parked in the spill tier (must be called with lock held)
+func (s *traceBufferShard) addSpilledTraceLocked(traceElem *traceElement) {
+	s.spilled[traceElem.id] = traceElem
+	s.spillBytes += traceElem.bytes
+	s.deadlines.update(traceElem, s.buffer.strategies)
+	s.buffer.spilled.Inc()
+	if s.buffer.spilledGauge != nil {
+		s.buffer.spilledGauge.Inc()
+	}
+}
+
+// forgetSpilledLocked unregisters a trace parked in the spill tier, leaving
+// its spans on disk (must be called with lock held)
+func (s *traceBufferShard) forgetSpilledLocked(traceElem *traceElement) {
+	delete(s.spilled, traceElem.id)
+	s.spillBytes -= traceElem.bytes
+	s.deadlines.remove(traceElem)
+	s.buffer.spilled.Dec()
+	if s.buffer.spilledGauge != nil {
+		s.buffer.spilledGauge.Dec()
+	}
+}
+
+// removeTraceLocked removes a trace held in memory from the shard (must be called with lock held)
+func (s *traceBufferShard) removeTraceLocked(traceElem *traceElement) {
+	s.detachTraceLocked(traceElem)
+	s.deadlines.remove(traceElem)
+}
+
+// detachTraceLocked removes a trace held in memory from the shard's map,
+// LRU list and sizes (must be called with lock held)
+func (s *traceBufferShard) detachTraceLocked(traceElem *traceElement) {
+	// Update span count and size
+	s.buffer.spanCount.Add(-int64(len(traceElem.spans)))
+	s.addBytesLocked(-traceElem.bytes)
+
+	// Remove from LRU list
+	if traceElem.element != nil {
+		s.lruList.Remove(traceElem.element)
+	}
+
+	// Remove from traces map
+	delete(s.traces, traceElem.id)
+	s.markRemovedLocked(traceElem.id)
+}
+
+// markChangedLocked records that a trace held in memory changed since the
+// last checkpoint (must be called with lock held)
+func (s *traceBufferShard) markChangedLocked(traceID pcommon.TraceID) {
+	if s.tracking {
+		s.changedTraces[traceID] = struct{}{}
+		delete(s.removedTraces, traceID)
+	}
+}
+
+// markRemovedLocked records that a trace left memory since the last
+// checkpoint (must be called with lock held)
+func (s *traceBufferShard) markRemovedLocked(traceID pcommon.TraceID) {
+	if s.tracking {
+		delete(s.changedTraces, traceID)
+		s.removedTraces[traceID] = struct{}{}
+	}
+}
+
+// evictLRUTraceLocked evicts the least recently used trace from the shard (must be called with lock held)
+func (s *traceBufferShard) evictLRUTraceLocked() {
+	// Get the last element from the LRU list
+	if s.lruList.Len() == 0 {
+		return
+	}
+
+	// Get the trace ID from the list element
+	elem := s.lruList.Back()
+	traceID, ok := elem.Value.(pcommon.TraceID)
+	if !ok {
+		s.buffer.logger.Error("Invalid element type in LRU list")
+		return
+	}
+
+	// Get the trace element
+	traceElem, exists := s.traces[traceID]
+	if !exists {
+		s.buffer.logger.Error("Trace not found in buffer",
+			zap.Stringer("trace_id", traceID))
+		return
+	}
+
+	// Park the trace on disk rather than lose it, if there is a spill tier
+	// with room for it and no earlier part of the trace is still on its way
+	// off the disk
+	if s.buffer.spill != nil {
+		_, unspilling := s.unspilling[traceID]
+		switch {
+		case unspilling:
+			s.buffer.logger.Debug("Trace is being read back from the spill tier, evicting it",
+				zap.Stringer("trace_id", traceID))
+		case s.maxSpillBytes == 0 || s.spillBytes+traceElem.bytes <= s.maxSpillBytes:
+			s.spillTraceLocked(traceElem)
+			s.buffer.logger.Debug("Spilled trace from buffer due to capacity limit",
+				zap.Stringer("trace_id", traceID),
+				zap.Int("spans", traceElem.spanCount),
+				zap.Int64("bytes", traceElem.bytes))
+			return
+		default:
+			s.buffer.logger.Debug("Spill tier is full, evicting trace",
+				zap.Stringer("trace_id", traceID),
+				zap.Int64("spilled_bytes", s.spillBytes))
+		}
+	}
+
+	// Log the eviction
+	s.buffer.logger.Debug("Evicting trace from buffer due to capacity limit",
+		zap.Stringer("trace_id", traceID),
+		zap.Time("last_updated", traceElem.lastUpdated),
+		zap.Int("spans", len(traceElem.spans)),
+		zap.Int64("bytes", traceElem.bytes),
+		zap.Duration("age", time.Since(traceElem.lastUpdated)))
+
+	// Increment the eviction counter if set
+	if s.buffer.evictionCounter != nil {
+		s.buffer.evictionCounter.Inc()
+	}
+
+	// Remove the trace from the shard
+	s.removeTraceLocked(traceElem)
+}
+
+// getTrace returns a trace of the shard as a Traces object
+func (s *traceBufferShard) getTrace(traceID pcommon.TraceID) ptrace.Traces {
+	s.mu.RLock()
+
+	traces := ptrace.NewTraces()
+	if traceElem, exists := s.traces[traceID]; exists {
+		for _, spanWithRes := range traceElem.spans {
+			insertSpanIntoTraces(traces, spanWithRes)
+		}
+		s.mu.RUnlock()
+		return traces
+	}
+	_, spilled := s.spilled[traceID]
+	spill := s.buffer.spill
+	s.mu.RUnlock()
+
+	// Spilled traces are read back from disk outside the lock
+	if spilled {
+		spans, err := spill.Read(traceID)
+		if err != nil {
+			s.buffer.logger.Error("Failed to read spilled trace",
+				zap.Stringer("trace_id", traceID),
+				zap.Error(err))
+		}
+		for _, spanWithRes := range spans {
+			insertSpanIntoTraces(traces, spanWithRes)
+		}
+	}
+
+	return traces
+}
+
+// removeTrace removes a trace from the shard, deleting it from disk if it is spilled
+func (s *traceBufferShard) removeTrace(traceID pcommon.TraceID) {
+	s.mu.Lock()
+
+	if traceElem, exists := s.traces[traceID]; exists {
+		s.removeTraceLocked(traceElem)
+	}
+
+	traceElem, spilled := s.spilled[traceID]
+	if !spilled {
+		s.mu.Unlock()
+		return
+	}
+	s.forgetSpilledLocked(traceElem)
+	s.unspilling[traceID] = struct{}{}
+	spill := s.buffer.spill
+	s.mu.Unlock()
+
+	// The spilled spans are deleted from disk outside the lock
+	if err := spill.Delete(traceID); err != nil {
+		s.buffer.logger.Error("Failed to delete spilled trace", zap.Error(err))
+	}
+	s.finishUnspilling(traceElem)
+}
+
+// snapshot appends the traces held in memory by the shard to traces
+func (s *traceBufferShard) snapshot(traces []BufferedTrace) []BufferedTrace {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	for _, traceElem := range s.traces {
+		traces = append(traces, traceElem.buffered())
+	}
+
+	return traces
+}
+
+// takeSnapshot appends the traces held in memory by the shard to traces
+// and starts tracking changes afresh
+func (s *traceBufferShard) takeSnapshot(traces []BufferedTrace) []BufferedTrace {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, traceElem := range s.traces {
+		traces = append(traces, traceElem.buffered())
+	}
+	s.resetChangesLocked()
+
+	return traces
+}
+
+// takeDelta appends the traces of the shard changed and removed since the
+// previous takeDelta or takeSnapshot to changed and removed, and starts
+// tracking changes afresh
+func (s *traceBufferShard) takeDelta(changed []BufferedTrace, removed []pcommon.TraceID) ([]BufferedTrace, []pcommon.TraceID) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for traceID := range s.changedTraces {
+		if traceElem, ok := s.traces[traceID]; ok {
+			changed = append(changed, traceElem.buffered())
+		}
+	}
+	for traceID := range s.removedTraces {
+		removed = append(removed, traceID)
+	}
+	s.resetChangesLocked()
+
+	return changed, removed
+}
+
+// resetChangesLocked starts tracking changes afresh (must be called with lock held)
+func (s *traceBufferShard) resetChangesLocked() {
+	s.tracking = true
+	s.changedTraces = make(map[pcommon.TraceID]struct{})
+	s.removedTraces = make(map[pcommon.TraceID]struct{})
+}
+
+// restore puts a checkpointed trace back into the shard, unless it is
+// already there. It returns whether the trace was restored.
+func (s *traceBufferShard) restore(trace BufferedTrace) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, exists := s.traces[trace.TraceID]; exists {
+		return false
+	}
+	if _, spilled := s.spilled[trace.TraceID]; spilled {
+		return false
+	}
+
+	traceElem := newTraceElement(trace.TraceID, trace.FirstSeen)
+	traceElem.lastUpdated = trace.LastUpdated
+	for _, spanWithRes := range trace.Spans {
+		spanID := spanWithRes.Span.SpanID()
+		if _, duplicate := traceElem.spans[spanID]; duplicate || spanID.IsEmpty() {
+			continue
+		}
+		traceElem.spans[spanID] = spanWithRes
+		if spanWithRes.Span.ParentSpanID().IsEmpty() {
+			traceElem.rootSpanSeen = true
+		}
+		s.trackSpanLocked(traceElem, spanWithRes.Span)
+		traceElem.spanCount++
+		traceElem.bytes += estimateSpanSize(spanWithRes.Span, spanWithRes.Resource, spanWithRes.Scope)
+	}
+	if traceElem.spanCount == 0 {
+		return false
+	}
+
+	if len(s.traces) >= s.maxTraces {
+		s.evictLRUTraceLocked()
+	}
+	traceElem.element = s.lruList.PushFront(trace.TraceID)
+	s.traces[trace.TraceID] = traceElem
+	s.markChangedLocked(trace.TraceID)
+	s.deadlines.update(traceElem, s.buffer.strategies)
+	s.buffer.spanCount.Add(int64(traceElem.spanCount))
+	s.addBytesLocked(traceElem.bytes)
+	for s.maxBytes > 0 && s.bytes > s.maxBytes && s.lruList.Len() > 1 {
+		s.evictLRUTraceLocked()
+	}
+
+	return true
+}
+
+// size returns the number of traces held in memory by the shard
+func (s *traceBufferShard) size() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.traces)
+}
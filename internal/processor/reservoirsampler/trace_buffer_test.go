@@ -7,8 +7,10 @@ import (
 	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"go.opentelemetry.io/collector/pdata/pcommon"
 	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
 	"go.uber.org/zap"
 )
 
@@ -208,3 +210,369 @@ func TestTraceBufferConcurrentAccess(t *testing.T) {
 	// Verify buffer is empty
 	assert.Equal(t, 0, tb.Size(), "Buffer should be empty after getting completed traces")
 }
+
+// addBufferedSpan adds a span of trace traceID to the buffer, parented by
+// parentID unless it is negative
+func addBufferedSpan(tb *TraceBuffer, traceID, spanID, parentID int, expectedSpans int64) {
+	span := ptrace.NewSpan()
+	span.SetTraceID(generateTraceID(traceID))
+	span.SetSpanID(generateSpanID(spanID))
+	if parentID >= 0 {
+		span.SetParentSpanID(generateSpanID(parentID))
+	}
+	if expectedSpans > 0 {
+		span.Attributes().PutInt("trace.expected_span_count", expectedSpans)
+	}
+	tb.AddSpan(span, pcommon.NewResource(), pcommon.NewInstrumentationScope())
+}
+
+// TestTraceBufferRootSpanCompletion tests that a trace completes once its
+// root span has arrived and none of its spans is still open
+func TestTraceBufferRootSpanCompletion(t *testing.T) {
+	tb := NewTraceBuffer(10, time.Hour, zap.NewNop())
+	tb.SetCompletionStrategies([]completionStrategy{rootSpanCompletion{grace: 0}})
+
+	// A grandchild arrives first; its parent is still open
+	addBufferedSpan(tb, 1, 3, 2, 0)
+	addBufferedSpan(tb, 1, 1, -1, 0)
+	assert.Empty(t, tb.GetCompletedTraces())
+
+	// A trace without its root span waits too
+	addBufferedSpan(tb, 2, 2, 1, 0)
+	assert.Empty(t, tb.GetCompletedTraces())
+
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	completed := tb.GetCompletedTraces()
+	require.Len(t, completed, 1)
+	assert.Equal(t, 3, completed[0].SpanCount())
+	assert.Equal(t, 1, tb.Size())
+}
+
+// TestTraceBufferRootSpanGrace tests that a complete-looking trace waits for
+// late spans for the grace period
+func TestTraceBufferRootSpanGrace(t *testing.T) {
+	tb := NewTraceBuffer(10, time.Hour, zap.NewNop())
+	tb.SetCompletionStrategies([]completionStrategy{rootSpanCompletion{grace: 50 * time.Millisecond}})
+
+	addBufferedSpan(tb, 1, 1, -1, 0)
+	assert.Empty(t, tb.GetCompletedTraces())
+
+	time.Sleep(60 * time.Millisecond)
+	assert.Len(t, tb.GetCompletedTraces(), 1)
+}
+
+// TestTraceBufferSpanCountCompletion tests that a trace completes once it
+// has as many spans as it says it has
+func TestTraceBufferSpanCountCompletion(t *testing.T) {
+	tb := NewTraceBuffer(10, time.Hour, zap.NewNop())
+	tb.SetCompletionStrategies([]completionStrategy{spanCountCompletion{}})
+	tb.SetExpectedSpanCountAttribute("trace.expected_span_count")
+
+	addBufferedSpan(tb, 1, 1, -1, 3)
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	addBufferedSpan(tb, 2, 1, -1, 0)
+	assert.Empty(t, tb.GetCompletedTraces())
+
+	// A span sent twice counts once
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	assert.Empty(t, tb.GetCompletedTraces())
+
+	addBufferedSpan(tb, 1, 3, 1, 0)
+	completed := tb.GetCompletedTraces()
+	require.Len(t, completed, 1)
+	assert.Equal(t, 3, completed[0].SpanCount())
+}
+
+// TestTraceBufferMaxAgeCompletion tests that a busy trace completes once it
+// reaches its maximum age
+func TestTraceBufferMaxAgeCompletion(t *testing.T) {
+	tb := NewTraceBuffer(10, time.Hour, zap.NewNop())
+	tb.SetCompletionStrategies([]completionStrategy{maxAgeCompletion{maxAge: 50 * time.Millisecond}})
+
+	start := time.Now()
+	for i := 0; len(tb.GetCompletedTraces()) == 0; i++ {
+		require.Less(t, time.Since(start), time.Second)
+		addBufferedSpan(tb, 1, i, -1, 0)
+		time.Sleep(5 * time.Millisecond)
+	}
+	assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+}
+
+// TestTraceBufferCheckInterval tests that the buffer is checked often enough
+// for its completion strategies
+func TestTraceBufferCheckInterval(t *testing.T) {
+	cfg := createDefaultConfig().(*Config)
+	assert.Equal(t, time.Second, traceBufferCheckInterval(cfg))
+
+	cfg.TraceCompletion = []string{TraceCompletionMaxAge}
+	cfg.TraceMaxAge = 5 * time.Second
+	assert.Equal(t, 500*time.Millisecond, traceBufferCheckInterval(cfg))
+
+	cfg.TraceCompletion = []string{TraceCompletionRootSpan, TraceCompletionSpanCount}
+	assert.Equal(t, 100*time.Millisecond, traceBufferCheckInterval(cfg))
+}
+
+// TestEstimateSpanSize tests that the size estimate grows with the data a span carries
+func TestEstimateSpanSize(t *testing.T) {
+	resource := pcommon.NewResource()
+	scope := pcommon.NewInstrumentationScope()
+	span := ptrace.NewSpan()
+	base := estimateSpanSize(span, resource, scope)
+	assert.Greater(t, base, int64(0))
+
+	span.SetName("GET /checkout")
+	span.Attributes().PutStr("http.url", "https://example.com/checkout")
+	withAttrs := estimateSpanSize(span, resource, scope)
+	assert.Greater(t, withAttrs, base+int64(len("https://example.com/checkout")))
+
+	span.Events().AppendEmpty().Attributes().PutEmptyBytes("payload").FromRaw(make([]byte, 1000))
+	withEvent := estimateSpanSize(span, resource, scope)
+	assert.Greater(t, withEvent, withAttrs+1000)
+
+	// Each buffered span holds its own copy of the resource
+	resource.Attributes().PutStr("service.name", "checkout")
+	assert.Greater(t, estimateSpanSize(span, resource, scope), withEvent)
+}
+
+// TestTraceBufferByteAccounting tests that the buffer tracks the size of the spans it holds
+func TestTraceBufferByteAccounting(t *testing.T) {
+	tb := NewTraceBuffer(10, time.Hour, zap.NewNop())
+	gauge := atomic.NewInt64(0)
+	tb.SetBytesGauge(gauge)
+
+	spanSize := estimateSpanSize(ptrace.NewSpan(), pcommon.NewResource(), pcommon.NewInstrumentationScope())
+	addBufferedSpan(tb, 1, 1, -1, 0)
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	addBufferedSpan(tb, 2, 1, -1, 0)
+	assert.Equal(t, 3*spanSize, tb.Bytes())
+	assert.Equal(t, 3*spanSize, gauge.Load())
+
+	// A span sent twice is counted once
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	assert.Equal(t, 3*spanSize, tb.Bytes())
+	assert.Equal(t, 3, tb.SpanCount())
+
+	tb.RemoveTrace(generateTraceID(2))
+	assert.Equal(t, 2*spanSize, tb.Bytes())
+
+	tb.SetCompletionStrategies([]completionStrategy{rootSpanCompletion{}})
+	assert.Len(t, tb.GetCompletedTraces(), 1)
+	assert.Equal(t, int64(0), tb.Bytes())
+	assert.Equal(t, int64(0), gauge.Load())
+	assert.Equal(t, 0, tb.SpanCount())
+}
+
+// TestTraceBufferByteLimit tests that the least recently used traces are
+// evicted once the buffer is over its byte limit, before its trace limit
+func TestTraceBufferByteLimit(t *testing.T) {
+	tb := NewTraceBuffer(100, time.Hour, zap.NewNop())
+	evictions := atomic.NewInt64(0)
+	tb.SetEvictionCounter(evictions)
+
+	spanSize := estimateSpanSize(ptrace.NewSpan(), pcommon.NewResource(), pcommon.NewInstrumentationScope())
+	tb.SetMemoryLimits(3*spanSize+spanSize/2, 0, 0)
+
+	for i := 1; i <= 5; i++ {
+		addBufferedSpan(tb, i, 1, -1, 0)
+	}
+	assert.Equal(t, 3, tb.Size())
+	assert.Equal(t, int64(2), evictions.Load())
+	assert.LessOrEqual(t, tb.Bytes(), 3*spanSize+spanSize/2)
+	assert.Equal(t, 0, tb.GetTrace(generateTraceID(1)).SpanCount())
+	assert.Equal(t, 0, tb.GetTrace(generateTraceID(2)).SpanCount())
+	assert.Equal(t, 1, tb.GetTrace(generateTraceID(5)).SpanCount())
+}
+
+// TestTraceBufferPerTraceLimits tests that spans past a trace's caps are dropped
+func TestTraceBufferPerTraceLimits(t *testing.T) {
+	spanSize := estimateSpanSize(ptrace.NewSpan(), pcommon.NewResource(), pcommon.NewInstrumentationScope())
+
+	for name, limits := range map[string]struct {
+		maxBytesPerTrace int64
+		maxSpansPerTrace int
+	}{
+		"spans": {maxSpansPerTrace: 2},
+		"bytes": {maxBytesPerTrace: 2*spanSize + spanSize/2},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tb := NewTraceBuffer(10, time.Hour, zap.NewNop())
+			dropped := atomic.NewInt64(0)
+			tb.SetDroppedSpansCounter(dropped)
+			tb.SetMemoryLimits(0, limits.maxBytesPerTrace, limits.maxSpansPerTrace)
+
+			for i := 1; i <= 4; i++ {
+				addBufferedSpan(tb, 1, i, -1, 0)
+			}
+			assert.Equal(t, 2, tb.GetTrace(generateTraceID(1)).SpanCount())
+			assert.Equal(t, int64(2), dropped.Load())
+
+			// A span already buffered can still be replaced, and other traces
+			// have their own caps
+			addBufferedSpan(tb, 1, 1, -1, 0)
+			addBufferedSpan(tb, 2, 1, -1, 0)
+			assert.Equal(t, int64(2), dropped.Load())
+			assert.Equal(t, 3, tb.SpanCount())
+		})
+	}
+}
+
+// TestTraceBufferRestore tests that checkpointed traces come back with their
+// spans, sizes and arrival times
+func TestTraceBufferRestore(t *testing.T) {
+	tb := NewTraceBuffer(10, time.Minute, zap.NewNop())
+	tb.SetCompletionStrategies([]completionStrategy{rootSpanCompletion{grace: 0}})
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	addBufferedSpan(tb, 2, 1, -1, 0)
+	addBufferedSpan(tb, 2, 3, 2, 0)
+	addBufferedSpan(tb, 3, 1, -1, 0)
+
+	snapshot := tb.Snapshot()
+	require.Len(t, snapshot, 3)
+
+	// Trace 3 went idle before the restart
+	for i := range snapshot {
+		if snapshot[i].TraceID == generateTraceID(3) {
+			snapshot[i].LastUpdated = time.Now().Add(-2 * time.Minute)
+		}
+	}
+
+	restored := NewTraceBuffer(10, time.Minute, zap.NewNop())
+	restored.SetCompletionStrategies([]completionStrategy{rootSpanCompletion{grace: 0}})
+	assert.Equal(t, 3, restored.Restore(snapshot))
+	assert.Equal(t, 3, restored.Size())
+	assert.Equal(t, tb.SpanCount(), restored.SpanCount())
+	assert.Equal(t, tb.Bytes(), restored.Bytes())
+
+	// Restoring again adds nothing
+	assert.Zero(t, restored.Restore(snapshot))
+
+	// Trace 3 times out; trace 1 still waits for its root span and trace 2
+	// for span 2, which span 3 points at
+	completed := restored.GetCompletedTraces()
+	require.Len(t, completed, 1)
+	assert.Equal(t, generateTraceID(3), completed[0].ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).TraceID())
+
+	// Open parents are rebuilt, so the arrival of span 2 completes trace 2
+	addBufferedSpan(restored, 2, 2, 1, 0)
+	completed = restored.GetCompletedTraces()
+	require.Len(t, completed, 1)
+	assert.Equal(t, 3, completed[0].SpanCount())
+}
+
+// TestTraceBufferRestoreLimits tests that restored traces respect the buffer's capacity
+func TestTraceBufferRestoreLimits(t *testing.T) {
+	tb := NewTraceBuffer(10, time.Minute, zap.NewNop())
+	for i := 1; i <= 5; i++ {
+		addBufferedSpan(tb, i, 1, -1, 0)
+	}
+	snapshot := tb.Snapshot()
+	for i := range snapshot {
+		for id := 1; id <= 5; id++ {
+			if snapshot[i].TraceID == generateTraceID(id) {
+				// Trace 1 is the most recently updated
+				snapshot[i].LastUpdated = time.Now().Add(-time.Duration(id) * time.Second)
+			}
+		}
+	}
+
+	// The least recently updated traces are evicted first
+	restored := NewTraceBuffer(3, time.Minute, zap.NewNop())
+	restored.Restore(snapshot)
+	assert.Equal(t, 3, restored.Size())
+	for i := 1; i <= 5; i++ {
+		assert.Equal(t, i <= 3, restored.GetTrace(generateTraceID(i)).SpanCount() > 0, "trace %d", i)
+	}
+}
+
+// TestTraceBufferTakeDelta tests that a delta holds the traces that changed
+// and left memory since the previous snapshot or delta
+func TestTraceBufferTakeDelta(t *testing.T) {
+	tb := NewTraceBuffer(2, time.Hour, zap.NewNop())
+	tb.SetCompletionStrategies([]completionStrategy{rootSpanCompletion{}})
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	addBufferedSpan(tb, 2, 2, 1, 0)
+	assert.Len(t, tb.TakeSnapshot(), 2)
+	changed, removed := tb.TakeDelta()
+	assert.Empty(t, changed)
+	assert.Empty(t, removed)
+
+	// Trace 1 gets another span, and trace 3 evicts trace 2
+	addBufferedSpan(tb, 1, 3, 1, 0)
+	addBufferedSpan(tb, 3, 2, 1, 0)
+	changed, removed = tb.TakeDelta()
+	require.Len(t, changed, 2)
+	spanCounts := make(map[pcommon.TraceID]int)
+	for _, trace := range changed {
+		spanCounts[trace.TraceID] = len(trace.Spans)
+	}
+	assert.Equal(t, map[pcommon.TraceID]int{generateTraceID(1): 2, generateTraceID(3): 1}, spanCounts)
+	assert.Equal(t, []pcommon.TraceID{generateTraceID(2)}, removed)
+
+	// Trace 1 completes once its root span arrives
+	addBufferedSpan(tb, 1, 1, -1, 0)
+	require.Len(t, tb.GetCompletedTraces(), 1)
+	changed, removed = tb.TakeDelta()
+	assert.Empty(t, changed)
+	assert.Equal(t, []pcommon.TraceID{generateTraceID(1)}, removed)
+}
+
+// TestShardedTraceBuffer tests that a sharded buffer splits its capacity
+// over the shards and takes spans from many goroutines
+func TestShardedTraceBuffer(t *testing.T) {
+	// No more shards than traces
+	assert.Len(t, NewShardedTraceBuffer(8, 3, time.Minute, zap.NewNop()).shards, 3)
+
+	tb := NewShardedTraceBuffer(4, 10, 50*time.Millisecond, zap.NewNop())
+	tb.SetEvictionCounter(atomic.NewInt64(0))
+	require.Len(t, tb.shards, 4)
+	capacity := 0
+	for _, shard := range tb.shards {
+		capacity += shard.maxTraces
+	}
+	assert.Equal(t, 10, capacity)
+
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func(g int) {
+			defer wg.Done()
+			for i := 1; i <= 25; i++ {
+				addBufferedSpan(tb, g*25+i, 1, -1, 0)
+				addBufferedSpan(tb, g*25+i, 2, 1, 0)
+			}
+		}(g)
+	}
+	wg.Wait()
+
+	for _, shard := range tb.shards {
+		assert.LessOrEqual(t, shard.size(), shard.maxTraces)
+	}
+	assert.LessOrEqual(t, tb.Size(), 10)
+	assert.Equal(t, 2*tb.Size(), tb.SpanCount())
+	assert.Len(t, tb.Snapshot(), tb.Size())
+
+	time.Sleep(60 * time.Millisecond)
+	completed := tb.GetCompletedTraces()
+	assert.Len(t, completed, 100-int(tb.evictionCounter.Load()))
+	assert.Zero(t, tb.Size())
+	assert.Zero(t, tb.SpanCount())
+	assert.Zero(t, tb.Bytes())
+}
+
+// TestTraceBufferTimeoutIndex tests that a trace's timeout moves with its
+// latest span and only the traces past it complete
+func TestTraceBufferTimeoutIndex(t *testing.T) {
+	tb := NewTraceBuffer(10, 100*time.Millisecond, zap.NewNop())
+	addBufferedSpan(tb, 1, 1, -1, 0)
+	addBufferedSpan(tb, 2, 1, -1, 0)
+
+	time.Sleep(60 * time.Millisecond)
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	assert.Empty(t, tb.GetCompletedTraces())
+
+	time.Sleep(60 * time.Millisecond)
+	completed := tb.GetCompletedTraces()
+	require.Len(t, completed, 1)
+	assert.Equal(t, generateTraceID(2), completed[0].ResourceSpans().At(0).ScopeSpans().At(0).Spans().At(0).TraceID())
+	assert.Equal(t, 1, tb.Size())
+}
@@ -0,0 +1,197 @@
+package reservoirsampler
+
+import (
+	"container/heap"
+	"time"
+)
+
+// completionStrategy decides when a buffered trace is complete, so it can be
+// sampled without waiting any longer for its spans
+type completionStrategy interface {
+	// Name identifies the strategy in logs
+	Name() string
+
+	// Deadline returns when the trace is complete if no more of its spans
+	// arrive, or false if it is not complete until more do
+	Deadline(trace *traceElement) (time.Time, bool)
+}
+
+// idleTimeoutCompletion completes a trace once no span has arrived for a while
+type idleTimeoutCompletion struct {
+	timeout time.Duration
+}
+
+func (c idleTimeoutCompletion) Name() string {
+	return "timeout"
+}
+
+func (c idleTimeoutCompletion) Deadline(trace *traceElement) (time.Time, bool) {
+	return trace.lastUpdated.Add(c.timeout), true
+}
+
+// rootSpanCompletion completes a trace shortly after its root span has
+// arrived, as long as no span is still open. Spans are exported when they
+// end, so a span that is a parent of arrived spans but has not arrived
+// itself is still running.
+type rootSpanCompletion struct {
+	grace time.Duration
+}
+
+func (c rootSpanCompletion) Name() string {
+	return TraceCompletionRootSpan
+}
+
+func (c rootSpanCompletion) Deadline(trace *traceElement) (time.Time, bool) {
+	if !trace.rootSpanSeen || len(trace.openParents) > 0 {
+		return time.Time{}, false
+	}
+	return trace.lastUpdated.Add(c.grace), true
+}
+
+// spanCountCompletion completes a trace once it has as many spans as one of
+// them says it has
+type spanCountCompletion struct{}
+
+func (c spanCountCompletion) Name() string {
+	return TraceCompletionSpanCount
+}
+
+func (c spanCountCompletion) Deadline(trace *traceElement) (time.Time, bool) {
+	if trace.expectedSpans <= 0 || trace.spanCount < trace.expectedSpans {
+		return time.Time{}, false
+	}
+	return trace.lastUpdated, true
+}
+
+// maxAgeCompletion completes a trace once it has been buffered for a while,
+// however busy it still is
+type maxAgeCompletion struct {
+	maxAge time.Duration
+}
+
+func (c maxAgeCompletion) Name() string {
+	return TraceCompletionMaxAge
+}
+
+func (c maxAgeCompletion) Deadline(trace *traceElement) (time.Time, bool) {
+	return trace.firstSeen.Add(c.maxAge), true
+}
+
+// traceDeadlines is the timeout index of a trace buffer shard: a min-heap of
+// its traces ordered by the time they complete, so finding the complete
+// traces only looks at those. A trace's position is kept in its heapIndex.
+type traceDeadlines []*traceElement
+
+func (d traceDeadlines) Len() int {
+	return len(d)
+}
+
+func (d traceDeadlines) Less(i, j int) bool {
+	return d[i].deadline.Before(d[j].deadline)
+}
+
+func (d traceDeadlines) Swap(i, j int) {
+	d[i], d[j] = d[j], d[i]
+	d[i].heapIndex = i
+	d[j].heapIndex = j
+}
+
+func (d *traceDeadlines) Push(x interface{}) {
+	trace := x.(*traceElement)
+	trace.heapIndex = len(*d)
+	*d = append(*d, trace)
+}
+
+func (d *traceDeadlines) Pop() interface{} {
+	old := *d
+	trace := old[len(old)-1]
+	old[len(old)-1] = nil
+	trace.heapIndex = -1
+	*d = old[:len(old)-1]
+	return trace
+}
+
+// setDeadline sets the deadline of a trace to the earliest among the
+// strategies, and its completion to the strategy with that deadline
+func setDeadline(trace *traceElement, strategies []completionStrategy) {
+	trace.deadline, trace.completion = time.Time{}, nil
+	for _, strategy := range strategies {
+		deadline, ok := strategy.Deadline(trace)
+		if ok && (trace.completion == nil || deadline.Before(trace.deadline)) {
+			trace.deadline, trace.completion = deadline, strategy
+		}
+	}
+}
+
+// update recomputes the deadline of a trace, adding the trace to the index
+// if it is not in it yet
+func (d *traceDeadlines) update(trace *traceElement, strategies []completionStrategy) {
+	setDeadline(trace, strategies)
+	if trace.heapIndex < 0 {
+		heap.Push(d, trace)
+	} else {
+		heap.Fix(d, trace.heapIndex)
+	}
+}
+
+// reset recomputes the deadlines of every trace in the index
+func (d *traceDeadlines) reset(strategies []completionStrategy) {
+	for _, trace := range *d {
+		setDeadline(trace, strategies)
+	}
+	heap.Init(d)
+}
+
+// remove takes a trace out of the index, if it is in it
+func (d *traceDeadlines) remove(trace *traceElement) {
+	if trace.heapIndex >= 0 {
+		heap.Remove(d, trace.heapIndex)
+	}
+}
+
+// newCompletionStrategies creates the trace completion strategies listed in
+// the configuration, in order
+func newCompletionStrategies(cfg *Config) []completionStrategy {
+	strategies := make([]completionStrategy, 0, len(cfg.TraceCompletion))
+	for _, name := range cfg.TraceCompletion {
+		switch name {
+		case TraceCompletionRootSpan:
+			strategies = append(strategies, rootSpanCompletion{grace: cfg.TraceCompletionGrace})
+		case TraceCompletionSpanCount:
+			strategies = append(strategies, spanCountCompletion{})
+		case TraceCompletionMaxAge:
+			strategies = append(strategies, maxAgeCompletion{maxAge: cfg.TraceMaxAge})
+		}
+	}
+	return strategies
+}
+
+// traceBufferCheckInterval returns how often the trace buffer is checked for
+// complete traces: a tenth of the shortest wait among its strategies
+func traceBufferCheckInterval(cfg *Config) time.Duration {
+	shortest := cfg.TraceBufferTimeout
+	floor := time.Second
+	for _, name := range cfg.TraceCompletion {
+		// Early completion gains little if it is noticed late
+		floor = 100 * time.Millisecond
+
+		switch name {
+		case TraceCompletionRootSpan:
+			if cfg.TraceCompletionGrace < shortest {
+				shortest = cfg.TraceCompletionGrace
+			}
+		case TraceCompletionSpanCount:
+			shortest = 0
+		case TraceCompletionMaxAge:
+			if cfg.TraceMaxAge < shortest {
+				shortest = cfg.TraceMaxAge
+			}
+		}
+	}
+
+	interval := shortest / 10
+	if interval < floor {
+		interval = floor
+	}
+	return interval
+}
@@ -0,0 +1,564 @@
+package reservoirsampler
+
+import (
+	"container/heap"
+	"context"
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/cespare/xxhash/v2"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// sampledTrace is a trace kept in a TraceReservoir
+type sampledTrace struct {
+	// The hashes of the trace's spans in arrival order
+	spanHashes []uint64
+}
+
+// traceSpan is a span of an incoming trace, not yet copied into the reservoir
+type traceSpan struct {
+	hash     uint64
+	span     ptrace.Span
+	resource pcommon.Resource
+	scope    pcommon.InstrumentationScope
+}
+
+// TraceReservoir samples whole traces rather than spans, so an exported trace
+// always has every span that reached the reservoir. Its capacity is counted in
+// spans or in traces.
+//
+// Each trace gets a random key, u^(1/w) for a uniform random u and the
+// weight w of its heaviest span, and the reservoir keeps the traces with the
+// largest keys that fit in its capacity. With a capacity in traces this is a
+// uniform (or weighted) sample of traces. A trace is kept or evicted as a
+// whole: making room for a new trace evicts the traces with the smallest
+// keys, and a trace that would only fit by evicting a larger key is dropped.
+type TraceReservoir struct {
+	// The sampled traces keyed by trace ID hash, their keys in a min-heap, and all of their spans
+	traces  map[uint64]*sampledTrace
+	keyHeap spanKeyHeap
+	spanMap map[uint64]SpanWithResource
+
+	// Optional weight function; without it every trace has weight 1
+	weightFn WeightFunc
+
+	// Mutations since the last checkpoint, for delta checkpointing
+	dirtyAdded   map[uint64]struct{}
+	dirtyEvicted map[uint64]struct{}
+
+	// Configuration
+	size       int
+	countTrace bool
+	window     *WindowManager
+
+	// Capacity used, and the spans or traces seen, in the capacity unit
+	used int
+	seen int64
+
+	// The stratum recorded on sampled spans, if the reservoir is part of a
+	// StratifiedReservoir
+	stratum string
+
+	// Thread safety
+	mu     sync.RWMutex
+	random *rand.Rand
+
+	// Metrics
+	sizeGauge      *atomic.Int64
+	sampledCounter *atomic.Int64
+
+	// Logging
+	logger *zap.Logger
+}
+
+// NewTraceReservoir creates a new trace reservoir holding size spans, or
+// size traces if unit is TraceReservoirUnitTraces.
+// Without a window manager the reservoir does not count spans towards a window.
+func NewTraceReservoir(
+	size int,
+	unit string,
+	window *WindowManager,
+	sizeGauge, sampledCounter *atomic.Int64,
+	logger *zap.Logger,
+) *TraceReservoir {
+	return &TraceReservoir{
+		traces:         make(map[uint64]*sampledTrace),
+		spanMap:        make(map[uint64]SpanWithResource),
+		dirtyAdded:     make(map[uint64]struct{}),
+		dirtyEvicted:   make(map[uint64]struct{}),
+		size:           size,
+		countTrace:     unit == TraceReservoirUnitTraces,
+		window:         window,
+		random:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		sizeGauge:      sizeGauge,
+		sampledCounter: sampledCounter,
+		logger:         logger,
+	}
+}
+
+// hashTraceID creates a hash from a trace ID
+func hashTraceID(traceID pcommon.TraceID) uint64 {
+	return xxhash.Sum64(traceID[:])
+}
+
+// SetWeightFunc switches the reservoir to weighted sampling with the given weight function
+func (r *TraceReservoir) SetWeightFunc(weightFn WeightFunc) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.weightFn = weightFn
+}
+
+// Reset clears the reservoir for a new window
+func (r *TraceReservoir) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.resetLocked()
+}
+
+// CloseWindow exports the sampled traces and clears the reservoir for a new
+// window in one step, so no span added in between is lost
+func (r *TraceReservoir) CloseWindow(ctx context.Context) (ptrace.Traces, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	exportTraces := ptrace.NewTraces()
+	r.exportToLocked(exportTraces)
+	r.resetLocked()
+
+	return exportTraces, nil
+}
+
+// resetLocked clears the reservoir (must be called with lock held)
+func (r *TraceReservoir) resetLocked() {
+	r.traces = make(map[uint64]*sampledTrace)
+	r.keyHeap = nil
+	r.spanMap = make(map[uint64]SpanWithResource)
+	r.used = 0
+	r.seen = 0
+
+	// The new window starts with nothing persisted
+	r.dirtyAdded = make(map[uint64]struct{})
+	r.dirtyEvicted = make(map[uint64]struct{})
+
+	// Update metrics
+	r.sizeGauge.Store(0)
+}
+
+// AddSpan adds a span on its own. A span of a trace that is already sampled
+// joins it; any other span is sampled as a trace of one span.
+func (r *TraceReservoir) AddSpan(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.addTraceLocked(span.TraceID(), []traceSpan{{
+		hash:     hashSpanKey(createSpanKey(span)),
+		span:     span,
+		resource: resource,
+		scope:    scope,
+	}})
+}
+
+// AddTrace samples the spans of a completed trace together. Spans are grouped
+// by trace ID, so a batch holding several traces samples each of them.
+func (r *TraceReservoir) AddTrace(traces ptrace.Traces) {
+	order, groups := groupSpansByTrace(traces)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, traceID := range order {
+		r.addTraceLocked(traceID, groups[traceID])
+	}
+}
+
+// groupSpansByTrace groups the spans of a batch by trace ID, returning the
+// trace IDs in the order they first appear
+func groupSpansByTrace(traces ptrace.Traces) ([]pcommon.TraceID, map[pcommon.TraceID][]traceSpan) {
+	groups := make(map[pcommon.TraceID][]traceSpan)
+	var order []pcommon.TraceID
+	forEachSpan(traces, func(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+		traceID := span.TraceID()
+		if _, ok := groups[traceID]; !ok {
+			order = append(order, traceID)
+		}
+		groups[traceID] = append(groups[traceID], traceSpan{
+			hash:     hashSpanKey(createSpanKey(span)),
+			span:     span,
+			resource: resource,
+			scope:    scope,
+		})
+	})
+	return order, groups
+}
+
+// addTraceLocked samples the spans of one trace (must be called with lock held)
+func (r *TraceReservoir) addTraceLocked(traceID pcommon.TraceID, spans []traceSpan) {
+	// Increment the total count for this window
+	if r.window != nil {
+		r.window.AddCount(int64(len(spans)))
+	}
+
+	traceHash := hashTraceID(traceID)
+	if trace, ok := r.traces[traceHash]; ok {
+		// Late spans join their sampled trace, which may push it or
+		// others out if the capacity is counted in spans
+		if !r.countTrace {
+			r.seen += int64(len(spans))
+		}
+		r.appendSpansLocked(trace, spans)
+		r.evictOverflowLocked()
+		r.sizeGauge.Store(int64(len(r.spanMap)))
+		return
+	}
+
+	cost := r.costOf(len(spans))
+	r.seen += int64(cost)
+	if cost > r.size {
+		// The trace can never fit
+		return
+	}
+
+	weight := 1.0
+	if r.weightFn != nil {
+		weight = 0
+		for _, ts := range spans {
+			weight = math.Max(weight, r.weightFn(ts.span, ts.resource))
+		}
+		if !(weight > 0) || math.IsInf(weight, 1) {
+			return
+		}
+	}
+	logKey := math.Log(r.uniformLocked()) / weight
+
+	if !r.makeRoomLocked(cost, logKey) {
+		return
+	}
+
+	trace := &sampledTrace{spanHashes: make([]uint64, 0, len(spans))}
+	r.traces[traceHash] = trace
+	heap.Push(&r.keyHeap, keyedSpan{hash: traceHash, logKey: logKey})
+	r.appendSpansLocked(trace, spans)
+
+	// Update metrics
+	r.sizeGauge.Store(int64(len(r.spanMap)))
+}
+
+// costOf returns the capacity taken by a trace of n spans
+func (r *TraceReservoir) costOf(n int) int {
+	if r.countTrace && n > 0 {
+		return 1
+	}
+	return n
+}
+
+// makeRoomLocked evicts the traces with the smallest keys until cost fits,
+// as long as all of them have smaller keys than logKey. It returns false,
+// evicting nothing, if the room cannot be made (must be called with lock held).
+func (r *TraceReservoir) makeRoomLocked(cost int, logKey float64) bool {
+	var victims []keyedSpan
+	freed := 0
+	for r.used-freed+cost > r.size {
+		if len(r.keyHeap) == 0 || r.keyHeap[0].logKey >= logKey {
+			// Put the candidates back untouched
+			for _, victim := range victims {
+				heap.Push(&r.keyHeap, victim)
+			}
+			return false
+		}
+		victim := heap.Pop(&r.keyHeap).(keyedSpan)
+		victims = append(victims, victim)
+		freed += r.costOf(len(r.traces[victim.hash].spanHashes))
+	}
+
+	for _, victim := range victims {
+		r.evictTraceLocked(victim.hash)
+	}
+	return true
+}
+
+// evictOverflowLocked evicts the traces with the smallest keys until the
+// reservoir is within its capacity (must be called with lock held)
+func (r *TraceReservoir) evictOverflowLocked() {
+	for r.used > r.size && len(r.keyHeap) > 0 {
+		victim := heap.Pop(&r.keyHeap).(keyedSpan)
+		r.evictTraceLocked(victim.hash)
+	}
+}
+
+// evictTraceLocked removes a trace whose key has left the heap (must be called with lock held)
+func (r *TraceReservoir) evictTraceLocked(traceHash uint64) {
+	trace := r.traces[traceHash]
+	delete(r.traces, traceHash)
+	r.used -= r.costOf(len(trace.spanHashes))
+
+	for _, hash := range trace.spanHashes {
+		delete(r.spanMap, hash)
+		// Deleting a span that was added since the last checkpoint is harmless,
+		// and it may have overwritten a persisted span with the same hash
+		delete(r.dirtyAdded, hash)
+		r.dirtyEvicted[hash] = struct{}{}
+	}
+}
+
+// appendSpansLocked copies spans into a sampled trace (must be called with lock held)
+func (r *TraceReservoir) appendSpansLocked(trace *sampledTrace, spans []traceSpan) {
+	before := r.costOf(len(trace.spanHashes))
+
+	for _, ts := range spans {
+		if _, exists := r.spanMap[ts.hash]; exists {
+			continue
+		}
+
+		spanWithRes := cloneSpanWithContext(ts.span, ts.resource, ts.scope)
+		if r.stratum != "" {
+			spanWithRes.Span.Attributes().PutStr(stratumAttributeKey, r.stratum)
+		}
+
+		r.spanMap[ts.hash] = spanWithRes
+		trace.spanHashes = append(trace.spanHashes, ts.hash)
+		r.dirtyAdded[ts.hash] = struct{}{}
+		delete(r.dirtyEvicted, ts.hash)
+
+		r.sampledCounter.Inc()
+	}
+
+	r.used += r.costOf(len(trace.spanHashes)) - before
+}
+
+// uniformLocked returns a uniform random number in (0, 1) (must be called with lock held)
+func (r *TraceReservoir) uniformLocked() float64 {
+	u := r.random.Float64()
+	if u == 0 {
+		u = math.SmallestNonzeroFloat64
+	}
+	return u
+}
+
+// Resize changes the reservoir capacity, evicting the traces with the
+// smallest keys if it shrinks
+func (r *TraceReservoir) Resize(size int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if size < 0 {
+		size = 0
+	}
+	r.size = size
+	r.evictOverflowLocked()
+
+	// Update metrics
+	r.sizeGauge.Store(int64(len(r.spanMap)))
+}
+
+// RestoreSpans loads spans from a checkpoint into the reservoir, regrouped
+// into their traces. The traces get fresh keys, as keys are not checkpointed,
+// and traces that do not fit are dropped whole. It returns the number of spans restored.
+func (r *TraceReservoir) RestoreSpans(spans map[uint64]SpanWithResource) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	groups := make(map[uint64][]uint64)
+	for hash, spanWithRes := range spans {
+		traceHash := hashTraceID(spanWithRes.Span.TraceID())
+		groups[traceHash] = append(groups[traceHash], hash)
+	}
+
+	restored := 0
+	for traceHash, hashes := range groups {
+		if _, exists := r.traces[traceHash]; exists {
+			continue
+		}
+		cost := r.costOf(len(hashes))
+		if r.used+cost > r.size {
+			continue
+		}
+
+		weight := 1.0
+		if r.weightFn != nil {
+			weight = 0
+			for _, hash := range hashes {
+				weight = math.Max(weight, r.weightFn(spans[hash].Span, spans[hash].Resource))
+			}
+			if !(weight > 0) {
+				weight = 1
+			}
+		}
+
+		trace := &sampledTrace{spanHashes: hashes}
+		r.traces[traceHash] = trace
+		heap.Push(&r.keyHeap, keyedSpan{hash: traceHash, logKey: math.Log(r.uniformLocked()) / weight})
+		for _, hash := range hashes {
+			r.spanMap[hash] = spans[hash]
+		}
+		r.used += cost
+		restored += len(hashes)
+	}
+
+	// Estimate what the window had seen from its restored span count
+	if r.window != nil && restored > 0 {
+		count := r.window.Count()
+		if r.countTrace {
+			count = count * int64(len(r.traces)) / int64(restored)
+		}
+		r.seen = count
+	}
+	if r.seen < int64(r.used) {
+		r.seen = int64(r.used)
+	}
+
+	// Update metrics
+	r.sizeGauge.Store(int64(len(r.spanMap)))
+
+	return restored
+}
+
+// Export returns all sampled traces
+func (r *TraceReservoir) Export(ctx context.Context) (ptrace.Traces, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	exportTraces := ptrace.NewTraces()
+	r.exportToLocked(exportTraces)
+
+	return exportTraces, nil
+}
+
+// exportTo inserts the sampled traces into traces
+func (r *TraceReservoir) exportTo(traces ptrace.Traces) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	r.exportToLocked(traces)
+}
+
+// exportToLocked inserts the sampled traces into traces, each trace's spans
+// together, recording the probability each trace was sampled with (must be
+// called with lock held)
+func (r *TraceReservoir) exportToLocked(traces ptrace.Traces) {
+	for _, ks := range r.keyHeap {
+		trace := r.traces[ks.hash]
+		probability := r.inclusionProbabilityLocked(trace)
+		for _, hash := range trace.spanHashes {
+			span := insertSpanIntoTraces(traces, r.spanMap[hash])
+			applySamplingProbability(span, probability)
+		}
+	}
+}
+
+// inclusionProbabilityLocked returns the probability that a sampled trace was
+// kept (must be called with lock held). A trace of weight w is kept if its key
+// u^(1/w) exceeds the smallest key T in the reservoir, which happens with
+// probability 1 - T^w; if nothing was ever dropped it is 1.
+func (r *TraceReservoir) inclusionProbabilityLocked(trace *sampledTrace) float64 {
+	if r.seen <= int64(r.used) || len(r.keyHeap) == 0 {
+		return 1
+	}
+
+	weight := 1.0
+	if r.weightFn != nil {
+		weight = 0
+		for _, hash := range trace.spanHashes {
+			spanWithRes := r.spanMap[hash]
+			weight = math.Max(weight, r.weightFn(spanWithRes.Span, spanWithRes.Resource))
+		}
+		if !(weight > 0) {
+			weight = 1
+		}
+	}
+	return -math.Expm1(weight * r.keyHeap[0].logKey)
+}
+
+// GetAllSpans returns a copy of all spans in the reservoir
+func (r *TraceReservoir) GetAllSpans() map[uint64]SpanWithResource {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	spansCopy := make(map[uint64]SpanWithResource, len(r.spanMap))
+	for hash, spanWithRes := range r.spanMap {
+		spansCopy[hash] = spanWithRes
+	}
+	return spansCopy
+}
+
+// TakeDelta returns the spans added and the hashes evicted since the previous
+// TakeDelta or TakeSnapshot, and starts tracking mutations afresh
+func (r *TraceReservoir) TakeDelta() (added map[uint64]SpanWithResource, evicted []uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	added = make(map[uint64]SpanWithResource, len(r.dirtyAdded))
+	for hash := range r.dirtyAdded {
+		if spanWithRes, ok := r.spanMap[hash]; ok {
+			added[hash] = spanWithRes
+		}
+	}
+
+	evicted = make([]uint64, 0, len(r.dirtyEvicted))
+	for hash := range r.dirtyEvicted {
+		evicted = append(evicted, hash)
+	}
+
+	r.dirtyAdded = make(map[uint64]struct{})
+	r.dirtyEvicted = make(map[uint64]struct{})
+
+	return added, evicted
+}
+
+// TakeSnapshot returns a copy of all spans in the reservoir and starts
+// tracking mutations afresh, as the snapshot supersedes any pending delta
+func (r *TraceReservoir) TakeSnapshot() map[uint64]SpanWithResource {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	spansCopy := make(map[uint64]SpanWithResource, len(r.spanMap))
+	for hash, spanWithRes := range r.spanMap {
+		spansCopy[hash] = spanWithRes
+	}
+
+	r.dirtyAdded = make(map[uint64]struct{})
+	r.dirtyEvicted = make(map[uint64]struct{})
+
+	return spansCopy
+}
+
+// Size returns the number of spans in the reservoir
+func (r *TraceReservoir) Size() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.spanMap)
+}
+
+// TraceCount returns the number of traces in the reservoir
+func (r *TraceReservoir) TraceCount() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.traces)
+}
+
+// seenCount returns the spans or traces seen, in the capacity unit
+func (r *TraceReservoir) seenCount() int64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.seen
+}
+
+// setSeenCount sets the spans or traces seen, as restored from a checkpoint
+func (r *TraceReservoir) setSeenCount(seen int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.seen = seen
+}
+
+// setStratum sets the stratum recorded on sampled spans
+func (r *TraceReservoir) setStratum(stratum string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stratum = stratum
+}
@@ -0,0 +1,204 @@
+package reservoirsampler
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+// newTestTraceReservoir creates a trace reservoir of the given size and unit
+func newTestTraceReservoir(size int, unit string) *TraceReservoir {
+	window, sizeGauge, sampled := newTestWindow()
+	return NewTraceReservoir(size, unit, window, sizeGauge, sampled, zap.NewNop())
+}
+
+// newTestTrace creates a trace of numSpans spans, the first of them the root
+func newTestTrace(id, numSpans int) ptrace.Traces {
+	traces := ptrace.NewTraces()
+	rs := traces.ResourceSpans().AppendEmpty()
+	rs.Resource().Attributes().PutStr("service.name", "test-service")
+	ss := rs.ScopeSpans().AppendEmpty()
+
+	traceID := generateTraceID(id)
+	for i := 0; i < numSpans; i++ {
+		span := ss.Spans().AppendEmpty()
+		span.SetTraceID(traceID)
+		span.SetSpanID(generateSpanID(i))
+		if i > 0 {
+			span.SetParentSpanID(generateSpanID(0))
+		}
+	}
+	return traces
+}
+
+// countTraceSpans counts the exported spans of each trace
+func countTraceSpans(traces ptrace.Traces) map[pcommon.TraceID]int {
+	counts := make(map[pcommon.TraceID]int)
+	forEachSpan(traces, func(span ptrace.Span, _ pcommon.Resource, _ pcommon.InstrumentationScope) {
+		counts[span.TraceID()]++
+	})
+	return counts
+}
+
+// TestTraceReservoirKeepsWholeTraces tests that traces are sampled with all their spans
+func TestTraceReservoirKeepsWholeTraces(t *testing.T) {
+	r := newTestTraceReservoir(50, TraceReservoirUnitSpans)
+
+	for i := 0; i < 200; i++ {
+		r.AddTrace(newTestTrace(i, 5))
+	}
+
+	assert.Equal(t, 50, r.Size())
+	assert.Equal(t, 10, r.TraceCount())
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	counts := countTraceSpans(exported)
+	assert.Len(t, counts, 10)
+	for traceID, count := range counts {
+		assert.Equal(t, 5, count, "trace %s", traceID)
+	}
+
+	// A trace larger than the capacity never fits
+	r.AddTrace(newTestTrace(1000, 51))
+	assert.Equal(t, 50, r.Size())
+	assert.Equal(t, 10, r.TraceCount())
+}
+
+// TestTraceReservoirTraceUnit tests a capacity counted in traces
+func TestTraceReservoirTraceUnit(t *testing.T) {
+	r := newTestTraceReservoir(10, TraceReservoirUnitTraces)
+
+	spans := 0
+	for i := 0; i < 100; i++ {
+		r.AddTrace(newTestTrace(i, 1+i%5))
+		spans += 1 + i%5
+	}
+
+	assert.Equal(t, 10, r.TraceCount())
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, r.Size(), exported.SpanCount())
+
+	_, _, _, windowCount := r.window.GetCurrentState()
+	assert.Equal(t, int64(spans), windowCount)
+}
+
+// TestTraceReservoirUniform tests that every trace has the same inclusion probability
+func TestTraceReservoirUniform(t *testing.T) {
+	const (
+		size      = 5
+		numTraces = 20
+		trials    = 2000
+	)
+
+	included := make(map[pcommon.TraceID]int)
+	for trial := 0; trial < trials; trial++ {
+		r := newTestTraceReservoir(size, TraceReservoirUnitTraces)
+		for i := 0; i < numTraces; i++ {
+			r.AddTrace(newTestTrace(i, 3))
+		}
+		require.Equal(t, size, r.TraceCount())
+
+		exported, err := r.Export(context.Background())
+		require.NoError(t, err)
+		for traceID := range countTraceSpans(exported) {
+			included[traceID]++
+		}
+	}
+
+	require.Len(t, included, numTraces)
+	expected := float64(size) / float64(numTraces)
+	for traceID, count := range included {
+		assert.InDelta(t, expected, float64(count)/trials, 0.05, "trace %s", traceID)
+	}
+}
+
+// TestTraceReservoirLateSpans tests that late spans join their sampled trace
+// and that evicting a trace removes all of its spans
+func TestTraceReservoirLateSpans(t *testing.T) {
+	r := newTestTraceReservoir(4, TraceReservoirUnitSpans)
+
+	r.AddTrace(newTestTrace(1, 2))
+	r.AddTrace(newTestTrace(2, 2))
+	require.Equal(t, 2, r.TraceCount())
+	r.TakeSnapshot()
+
+	// A late span pushes one whole trace out
+	late := newTestTrace(1, 3)
+	spans := late.ResourceSpans().At(0).ScopeSpans().At(0)
+	r.AddSpan(spans.Spans().At(2), late.ResourceSpans().At(0).Resource(), spans.Scope())
+
+	assert.Equal(t, 1, r.TraceCount())
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	for _, count := range countTraceSpans(exported) {
+		assert.Contains(t, []int{2, 3}, count)
+	}
+
+	added, evicted := r.TakeDelta()
+	if r.Size() == 3 {
+		assert.Len(t, added, 1)
+		assert.Len(t, evicted, 2)
+	} else {
+		assert.Empty(t, added)
+		assert.Len(t, evicted, 3)
+	}
+}
+
+// TestTraceReservoirRestore tests that restored spans are regrouped into their traces
+func TestTraceReservoirRestore(t *testing.T) {
+	r := newTestTraceReservoir(30, TraceReservoirUnitSpans)
+	for i := 0; i < 50; i++ {
+		r.AddTrace(newTestTrace(i, 3))
+	}
+	snapshot := r.TakeSnapshot()
+	require.Len(t, snapshot, 30)
+
+	restored := newTestTraceReservoir(30, TraceReservoirUnitSpans)
+	assert.Equal(t, 30, restored.RestoreSpans(snapshot))
+	assert.Equal(t, 10, restored.TraceCount())
+
+	// Restored traces are evicted whole
+	restored.Resize(20)
+	assert.Equal(t, 18, restored.Size())
+	assert.Equal(t, 6, restored.TraceCount())
+}
+
+// TestStratifiedTraceReservoir tests that trace-aware strata keep whole traces
+func TestStratifiedTraceReservoir(t *testing.T) {
+	window, sizeGauge, sampled := newTestWindow()
+	r := NewStratifiedReservoir(&Config{
+		SizeK:              20,
+		StratifyBy:         "service.name",
+		StrataPolicy:       StrataPolicyEqual,
+		MaxStrata:          10,
+		TraceAware:         true,
+		TraceReservoirUnit: TraceReservoirUnitTraces,
+	}, window, sizeGauge, sampled, zap.NewNop())
+
+	for i := 0; i < 100; i++ {
+		trace := newTestTrace(i, 4)
+		if i%2 == 0 {
+			trace.ResourceSpans().At(0).Resource().Attributes().PutStr("service.name", "checkout")
+		}
+		r.AddTrace(trace)
+	}
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+
+	counts := countTraceSpans(exported)
+	assert.Len(t, counts, 20)
+	for traceID, count := range counts {
+		assert.Equal(t, 4, count, "trace %s", traceID)
+	}
+	assert.Equal(t, map[string]int{"checkout": 40, "test-service": 40}, countStrata(t, exported))
+	assert.Equal(t, 80, r.Size())
+}
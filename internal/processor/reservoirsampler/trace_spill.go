@@ -0,0 +1,282 @@
+package reservoirsampler
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/dgraph-io/badger/v3"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.uber.org/zap"
+)
+
+// keyPrefixSpill is the Badger key prefix of the spans of traces spilled from
+// the trace buffer
+const keyPrefixSpill = "spill:"
+
+// spillBatchSpans is how many spans are queued for the spill tier before
+// they are due to be written in one batch
+const spillBatchSpans = 256
+
+// traceSpill parks traces evicted from the trace buffer in the checkpoint
+// database, where they keep collecting spans until they complete. Each span
+// is stored under its trace and span IDs, so a trace is read back or deleted
+// with a prefix scan.
+//
+// Spans are queued in memory by Write, which is cheap enough to call under a
+// trace buffer shard's lock, and written to disk in batches by Flush. Reads
+// and deletes see the queued spans as well as the stored ones.
+type traceSpill struct {
+	db     *badger.DB
+	logger *zap.Logger
+
+	// Spans waiting to be written, by trace, and their number
+	mu           sync.Mutex
+	pending      map[pcommon.TraceID]map[pcommon.SpanID]SpanWithResource
+	pendingSpans int
+
+	// Held while a batch is written, so reads and deletes never miss spans
+	// that have left the queue but are not on disk yet
+	flushMu sync.Mutex
+}
+
+// newTraceSpill creates a spill tier in an open Badger database
+func newTraceSpill(db *badger.DB, logger *zap.Logger) *traceSpill {
+	return &traceSpill{
+		db:      db,
+		logger:  logger,
+		pending: make(map[pcommon.TraceID]map[pcommon.SpanID]SpanWithResource),
+	}
+}
+
+// spillTracePrefix returns the key prefix of the spans of a spilled trace
+func spillTracePrefix(traceID pcommon.TraceID) []byte {
+	prefix := make([]byte, 0, len(keyPrefixSpill)+len(traceID))
+	prefix = append(prefix, keyPrefixSpill...)
+	return append(prefix, traceID[:]...)
+}
+
+// spillSpanKey returns the key of a span of a spilled trace
+func spillSpanKey(traceID pcommon.TraceID, spanID pcommon.SpanID) []byte {
+	return append(spillTracePrefix(traceID), spanID[:]...)
+}
+
+// Write queues spans of a trace to be stored, replacing any stored or queued
+// copies of them
+func (s *traceSpill) Write(traceID pcommon.TraceID, spans map[pcommon.SpanID]SpanWithResource) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	queued, ok := s.pending[traceID]
+	if !ok {
+		queued = make(map[pcommon.SpanID]SpanWithResource, len(spans))
+		s.pending[traceID] = queued
+	}
+	for spanID, span := range spans {
+		if _, duplicate := queued[spanID]; !duplicate {
+			s.pendingSpans++
+		}
+		queued[spanID] = span
+	}
+}
+
+// Due returns whether enough spans are queued to be flushed in a batch
+func (s *traceSpill) Due() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pendingSpans >= spillBatchSpans
+}
+
+// Flush writes the queued spans to disk in one batch. On failure it returns
+// the number of spans that were lost.
+func (s *traceSpill) Flush() (int, error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	pending, count := s.pending, s.pendingSpans
+	if count > 0 {
+		s.pending = make(map[pcommon.TraceID]map[pcommon.SpanID]SpanWithResource)
+		s.pendingSpans = 0
+	}
+	s.mu.Unlock()
+	if count == 0 {
+		return 0, nil
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	lost := 0
+	for traceID, spans := range pending {
+		for spanID, span := range spans {
+			value, err := serializeSpanWithResource(span)
+			if err != nil {
+				s.logger.Warn("Dropping spilled span that cannot be serialized",
+					zap.Stringer("trace_id", traceID),
+					zap.Error(err))
+				lost++
+				continue
+			}
+			if err := wb.Set(spillSpanKey(traceID, spanID), value); err != nil {
+				return count, fmt.Errorf("failed to spill span: %w", err)
+			}
+		}
+	}
+
+	if err := wb.Flush(); err != nil {
+		return count, fmt.Errorf("failed to spill spans: %w", err)
+	}
+	if lost > 0 {
+		return lost, fmt.Errorf("failed to serialize %d spilled spans", lost)
+	}
+	return 0, nil
+}
+
+// Read returns the stored and queued spans of a trace. Spans that cannot be
+// decoded are left out.
+func (s *traceSpill) Read(traceID pcommon.TraceID) ([]SpanWithResource, error) {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	queued := make(map[pcommon.SpanID]struct{}, len(s.pending[traceID]))
+	spans := make([]SpanWithResource, 0, len(s.pending[traceID]))
+	for spanID, span := range s.pending[traceID] {
+		queued[spanID] = struct{}{}
+		spans = append(spans, span)
+	}
+	s.mu.Unlock()
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := spillTracePrefix(traceID)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			// A queued copy replaces the stored one
+			var spanID pcommon.SpanID
+			copy(spanID[:], it.Item().Key()[len(prefix):])
+			if _, ok := queued[spanID]; ok {
+				continue
+			}
+
+			value, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			span, err := deserializeSpanWithResource(value)
+			if err != nil {
+				s.logger.Warn("Dropping unreadable spilled span",
+					zap.Stringer("trace_id", traceID),
+					zap.Error(err))
+				continue
+			}
+			spans = append(spans, span)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to read spilled trace: %w", err)
+	}
+
+	return spans, nil
+}
+
+// Delete removes the stored and queued spans of a trace
+func (s *traceSpill) Delete(traceID pcommon.TraceID) error {
+	s.flushMu.Lock()
+	defer s.flushMu.Unlock()
+
+	s.mu.Lock()
+	s.pendingSpans -= len(s.pending[traceID])
+	delete(s.pending, traceID)
+	s.mu.Unlock()
+
+	var keys [][]byte
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := spillTracePrefix(traceID)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, it.Item().KeyCopy(nil))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to list spilled spans: %w", err)
+	}
+
+	return s.deleteKeys(keys)
+}
+
+// deleteKeys deletes keys in a write batch, which may span many transactions
+func (s *traceSpill) deleteKeys(keys [][]byte) error {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	wb := s.db.NewWriteBatch()
+	defer wb.Cancel()
+
+	for _, key := range keys {
+		if err := wb.Delete(key); err != nil {
+			return fmt.Errorf("failed to delete spilled span: %w", err)
+		}
+	}
+
+	if err := wb.Flush(); err != nil {
+		return fmt.Errorf("failed to delete spilled trace: %w", err)
+	}
+	return nil
+}
+
+// Load returns the traces left spilled by a previous run, with the IDs and
+// stored sizes of their spans. Queued spans are flushed first.
+func (s *traceSpill) Load() (map[pcommon.TraceID]map[pcommon.SpanID]int64, error) {
+	if _, err := s.Flush(); err != nil {
+		return nil, err
+	}
+
+	traces := make(map[pcommon.TraceID]map[pcommon.SpanID]int64)
+	var malformed [][]byte
+
+	err := s.db.View(func(txn *badger.Txn) error {
+		prefix := []byte(keyPrefixSpill)
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			key := it.Item().Key()
+			if len(key) != len(prefix)+16+8 {
+				malformed = append(malformed, it.Item().KeyCopy(nil))
+				continue
+			}
+
+			var traceID pcommon.TraceID
+			var spanID pcommon.SpanID
+			copy(traceID[:], key[len(prefix):])
+			copy(spanID[:], key[len(prefix)+16:])
+
+			spans, ok := traces[traceID]
+			if !ok {
+				spans = make(map[pcommon.SpanID]int64)
+				traces[traceID] = spans
+			}
+			spans[spanID] = it.Item().ValueSize()
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to load spilled traces: %w", err)
+	}
+
+	if err := s.deleteKeys(malformed); err != nil {
+		return nil, err
+	}
+	return traces, nil
+}
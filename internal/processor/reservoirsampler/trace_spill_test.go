@@ -0,0 +1,247 @@
+package reservoirsampler
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dgraph-io/badger/v3"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/consumer/consumertest"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// openTestSpillDB opens a Badger database for spilled traces that is closed
+// when the test ends
+func openTestSpillDB(t *testing.T) *badger.DB {
+	db, err := badger.Open(badger.DefaultOptions(filepath.Join(t.TempDir(), "spill")).WithLogger(nil))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// storedSpillSpans returns the number of spilled spans written to db
+func storedSpillSpans(t *testing.T, db *badger.DB) int {
+	stored := 0
+	require.NoError(t, db.View(func(txn *badger.Txn) error {
+		prefix := []byte(keyPrefixSpill)
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			stored++
+		}
+		return nil
+	}))
+	return stored
+}
+
+// TestTraceSpillRoundtrip tests that spilled spans are read back, listed and
+// deleted, whether they are still queued or written
+func TestTraceSpillRoundtrip(t *testing.T) {
+	db := openTestSpillDB(t)
+	spill := newTraceSpill(db, zap.NewNop())
+
+	var traceIDs []pcommon.TraceID
+	for trace := 1; trace <= 2; trace++ {
+		spans := make(map[pcommon.SpanID]SpanWithResource)
+		forEachSpan(newTestTrace(trace, 3), func(span ptrace.Span, resource pcommon.Resource, scope pcommon.InstrumentationScope) {
+			spans[span.SpanID()] = cloneSpanWithContext(span, resource, scope)
+			traceIDs = append(traceIDs, span.TraceID())
+		})
+		spill.Write(traceIDs[len(traceIDs)-1], spans)
+	}
+	first, second := traceIDs[0], traceIDs[len(traceIDs)-1]
+	assert.False(t, spill.Due())
+	assert.Zero(t, storedSpillSpans(t, db))
+
+	for _, flushed := range []bool{false, true} {
+		if flushed {
+			lost, err := spill.Flush()
+			require.NoError(t, err)
+			assert.Zero(t, lost)
+			assert.Equal(t, 6, storedSpillSpans(t, db))
+		}
+
+		read, err := spill.Read(first)
+		require.NoError(t, err)
+		require.Len(t, read, 3)
+		for _, span := range read {
+			assert.Equal(t, first, span.Span.TraceID())
+			assert.Equal(t, "test-service", span.Resource.Attributes().AsRaw()["service.name"])
+		}
+	}
+
+	leftovers, err := spill.Load()
+	require.NoError(t, err)
+	require.Len(t, leftovers, 2)
+	assert.Len(t, leftovers[second], 3)
+	for _, size := range leftovers[second] {
+		assert.Greater(t, size, int64(0))
+	}
+
+	require.NoError(t, spill.Delete(first))
+	read, err := spill.Read(first)
+	require.NoError(t, err)
+	assert.Empty(t, read)
+	leftovers, err = spill.Load()
+	require.NoError(t, err)
+	assert.Len(t, leftovers, 1)
+}
+
+// TestTraceBufferSpill tests that evicted traces are parked on disk, keep
+// collecting spans and complete like any other trace
+func TestTraceBufferSpill(t *testing.T) {
+	tb := NewTraceBuffer(2, time.Hour, zap.NewNop())
+	evictions, spilled := atomic.NewInt64(0), atomic.NewInt64(0)
+	tb.SetEvictionCounter(evictions)
+	spill := newTraceSpill(openTestSpillDB(t), zap.NewNop())
+	tb.SetSpill(spill, 0, spilled)
+	tb.SetCompletionStrategies([]completionStrategy{rootSpanCompletion{}})
+
+	// Trace 1 is waiting for a child span when it is evicted
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	addBufferedSpan(tb, 2, 2, 1, 0)
+	addBufferedSpan(tb, 3, 2, 1, 0)
+	assert.Equal(t, 2, tb.Size())
+	assert.Equal(t, 1, tb.SpilledSize())
+	assert.Equal(t, int64(1), spilled.Load())
+	assert.Equal(t, int64(0), evictions.Load())
+	assert.Equal(t, 2, tb.SpanCount())
+
+	// Its late spans go to disk too
+	addBufferedSpan(tb, 1, 1, -1, 0)
+	assert.Equal(t, 2, tb.Size())
+	assert.Equal(t, 2, tb.GetTrace(generateTraceID(1)).SpanCount())
+
+	completed := tb.GetCompletedTraces()
+	require.Len(t, completed, 1)
+	assert.Equal(t, 2, completed[0].SpanCount())
+	assert.Equal(t, 0, tb.SpilledSize())
+	assert.Equal(t, int64(0), spilled.Load())
+
+	leftovers, err := spill.Load()
+	require.NoError(t, err)
+	assert.Empty(t, leftovers)
+}
+
+// TestTraceBufferSpillResumes tests that traces left spilled by a previous
+// run complete in the next one
+func TestTraceBufferSpillResumes(t *testing.T) {
+	db := openTestSpillDB(t)
+
+	tb := NewTraceBuffer(1, time.Hour, zap.NewNop())
+	tb.SetSpill(newTraceSpill(db, zap.NewNop()), 0, atomic.NewInt64(0))
+	addBufferedSpan(tb, 1, 1, -1, 0)
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	addBufferedSpan(tb, 2, 1, -1, 0)
+	require.Equal(t, 1, tb.SpilledSize())
+	tb.CloseSpill()
+	assert.Equal(t, 0, tb.SpilledSize())
+
+	tb = NewTraceBuffer(1, 20*time.Millisecond, zap.NewNop())
+	tb.SetSpill(newTraceSpill(db, zap.NewNop()), 0, atomic.NewInt64(0))
+	assert.Equal(t, 1, tb.SpilledSize())
+	assert.Empty(t, tb.GetCompletedTraces())
+
+	time.Sleep(30 * time.Millisecond)
+	completed := tb.GetCompletedTraces()
+	require.Len(t, completed, 1)
+	assert.Equal(t, 2, completed[0].SpanCount())
+}
+
+// TestTraceBufferSpillBatches tests that spans of spilled traces are written
+// to disk in batches rather than one at a time
+func TestTraceBufferSpillBatches(t *testing.T) {
+	db := openTestSpillDB(t)
+	tb := NewTraceBuffer(1, time.Hour, zap.NewNop())
+	tb.SetSpill(newTraceSpill(db, zap.NewNop()), 0, atomic.NewInt64(0))
+
+	// Trace 1 is spilled, and its late spans are queued
+	addBufferedSpan(tb, 1, 1, -1, 0)
+	addBufferedSpan(tb, 2, 1, -1, 0)
+	for i := 2; i < spillBatchSpans; i++ {
+		addBufferedSpan(tb, 1, i, 1, 0)
+	}
+	assert.Zero(t, storedSpillSpans(t, db))
+	assert.Equal(t, spillBatchSpans-1, tb.GetTrace(generateTraceID(1)).SpanCount())
+
+	// The span that fills the batch writes it
+	addBufferedSpan(tb, 1, spillBatchSpans, 1, 0)
+	assert.Equal(t, spillBatchSpans, storedSpillSpans(t, db))
+
+	// Checking for completed traces writes what is queued, here trace 2
+	addBufferedSpan(tb, 3, 1, -1, 0)
+	assert.Equal(t, 2, tb.SpilledSize())
+	assert.Empty(t, tb.GetCompletedTraces())
+	assert.Equal(t, spillBatchSpans+1, storedSpillSpans(t, db))
+}
+
+// TestTraceBufferSpillLimit tests that traces evicted while the spill tier
+// is full are dropped, and so are spans that would take it past its limit
+func TestTraceBufferSpillLimit(t *testing.T) {
+	span := ptrace.NewSpan()
+	span.SetTraceID(generateTraceID(1))
+	span.SetSpanID(generateSpanID(2))
+	span.SetParentSpanID(generateSpanID(1))
+	size := estimateSpanSize(span, pcommon.NewResource(), pcommon.NewInstrumentationScope())
+
+	tb := NewTraceBuffer(1, time.Hour, zap.NewNop())
+	evictions, dropped := atomic.NewInt64(0), atomic.NewInt64(0)
+	tb.SetEvictionCounter(evictions)
+	tb.SetDroppedSpansCounter(dropped)
+	tb.SetSpill(newTraceSpill(openTestSpillDB(t), zap.NewNop()), size*3/2, atomic.NewInt64(0))
+
+	// Trace 1 is spilled, filling the spill tier, and trace 2 is evicted
+	addBufferedSpan(tb, 1, 2, 1, 0)
+	addBufferedSpan(tb, 2, 2, 1, 0)
+	addBufferedSpan(tb, 3, 2, 1, 0)
+	assert.Equal(t, 1, tb.SpilledSize())
+	assert.Equal(t, int64(1), evictions.Load())
+	assert.Empty(t, tb.GetTrace(generateTraceID(2)).SpanCount())
+
+	// A late span of trace 1 does not fit either
+	addBufferedSpan(tb, 1, 3, 1, 0)
+	assert.Equal(t, int64(1), dropped.Load())
+	assert.Equal(t, 1, tb.GetTrace(generateTraceID(1)).SpanCount())
+}
+
+// TestProcessorTraceBufferSpill tests that traces that overflow the trace
+// buffer still reach the reservoir
+func TestProcessorTraceBufferSpill(t *testing.T) {
+	cfg := &Config{
+		SizeK:                100,
+		WindowDuration:       time.Minute,
+		CheckpointBackend:    CheckpointBackendBadger,
+		CheckpointPath:       filepath.Join(t.TempDir(), "badger"),
+		CheckpointInterval:   time.Hour,
+		ExportQueueSize:      10,
+		TraceAware:           true,
+		TraceBufferMaxSize:   1,
+		TraceBufferTimeout:   time.Hour,
+		TraceBufferSpill:     true,
+		TraceCompletion:      []string{TraceCompletionRootSpan},
+		TraceCompletionGrace: 0,
+		TraceReservoirUnit:   TraceReservoirUnitSpans,
+	}
+
+	ctx := context.Background()
+	proc, err := newReservoirProcessor(ctx, newTestSettings(), cfg, new(consumertest.TracesSink), nil)
+	require.NoError(t, err)
+	require.NoError(t, proc.Start(ctx, nil))
+	defer func() {
+		require.NoError(t, proc.Shutdown(ctx))
+	}()
+
+	rp := proc.(*reservoirProcessor)
+	for i := 1; i <= 5; i++ {
+		require.NoError(t, proc.ConsumeTraces(ctx, newTestTrace(i, 2)))
+	}
+	require.Eventually(t, func() bool { return rp.reservoir.Size() == 10 }, 2*time.Second, 10*time.Millisecond)
+	assert.Equal(t, int64(0), rp.metricsManager.GetLruEvictionsCounter().Load())
+	assert.Equal(t, 0, rp.traceBuffer.SpilledSize())
+}
@@ -0,0 +1,92 @@
+package reservoirsampler
+
+import (
+	"container/heap"
+	"time"
+
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+)
+
+// AttributeWeight multiplies the weight of spans whose attribute matches a value
+type AttributeWeight struct {
+	// Key is the span or resource attribute to match
+	Key string `mapstructure:"key"`
+
+	// Value is the attribute value to match, compared as a string
+	Value string `mapstructure:"value"`
+
+	// Weight is the factor applied to matching spans
+	Weight float64 `mapstructure:"weight"`
+}
+
+// WeightFunc returns the sampling weight of a span; spans of weight 2 are
+// twice as likely to be kept as spans of weight 1
+type WeightFunc func(span ptrace.Span, resource pcommon.Resource) float64
+
+// newWeightFunc builds the weight function described by the configuration.
+// Every matching rule multiplies the weight, which starts at 1.
+func newWeightFunc(cfg *Config) WeightFunc {
+	errorWeight := cfg.ErrorSpanWeight
+	slowThreshold := cfg.SlowSpanThreshold
+	slowWeight := cfg.SlowSpanWeight
+	attributeWeights := cfg.AttributeWeights
+
+	return func(span ptrace.Span, resource pcommon.Resource) float64 {
+		weight := 1.0
+
+		if errorWeight > 0 && span.Status().Code() == ptrace.StatusCodeError {
+			weight *= errorWeight
+		}
+
+		if slowThreshold > 0 && slowWeight > 0 {
+			duration := time.Duration(span.EndTimestamp() - span.StartTimestamp())
+			if span.EndTimestamp() > span.StartTimestamp() && duration >= slowThreshold {
+				weight *= slowWeight
+			}
+		}
+
+		for _, aw := range attributeWeights {
+			value, ok := span.Attributes().Get(aw.Key)
+			if !ok {
+				value, ok = resource.Attributes().Get(aw.Key)
+			}
+			if ok && value.AsString() == aw.Value {
+				weight *= aw.Weight
+			}
+		}
+
+		return weight
+	}
+}
+
+// keyedSpan is a sampled span with its Efraimidis-Spirakis key.
+// The key is stored as log(u)/w rather than u^(1/w), which orders spans the
+// same way without underflowing for large weights.
+type keyedSpan struct {
+	hash   uint64
+	logKey float64
+}
+
+// spanKeyHeap is a min-heap of sampled spans ordered by key, so the span
+// most likely to be replaced is always at the root
+type spanKeyHeap []keyedSpan
+
+// Ensure spanKeyHeap implements heap.Interface
+var _ heap.Interface = (*spanKeyHeap)(nil)
+
+func (h spanKeyHeap) Len() int           { return len(h) }
+func (h spanKeyHeap) Less(i, j int) bool { return h[i].logKey < h[j].logKey }
+func (h spanKeyHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+
+func (h *spanKeyHeap) Push(x interface{}) {
+	*h = append(*h, x.(keyedSpan))
+}
+
+func (h *spanKeyHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	item := old[n-1]
+	*h = old[:n-1]
+	return item
+}
@@ -0,0 +1,136 @@
+package reservoirsampler
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/collector/pdata/pcommon"
+	"go.opentelemetry.io/collector/pdata/ptrace"
+	"go.uber.org/zap"
+)
+
+// newTestWeightedReservoir creates a weighted reservoir of the given size
+func newTestWeightedReservoir(size int, weightFn WeightFunc) *Reservoir {
+	window, sizeGauge, sampled := newTestWindow()
+	r := NewReservoir(size, window, sizeGauge, sampled, zap.NewNop())
+	r.SetWeightFunc(weightFn)
+	return r
+}
+
+// TestWeightFunc tests that matching weight rules multiply the weight
+func TestWeightFunc(t *testing.T) {
+	weightFn := newWeightFunc(&Config{
+		ErrorSpanWeight:   10,
+		SlowSpanThreshold: time.Second,
+		SlowSpanWeight:    5,
+		AttributeWeights: []AttributeWeight{
+			{Key: "http.route", Value: "/checkout", Weight: 3},
+			{Key: "service.name", Value: "payments", Weight: 2},
+		},
+	})
+
+	now := time.Now()
+	newSpan := func(duration time.Duration) ptrace.Span {
+		span := ptrace.NewSpan()
+		span.SetStartTimestamp(pcommon.NewTimestampFromTime(now))
+		span.SetEndTimestamp(pcommon.NewTimestampFromTime(now.Add(duration)))
+		return span
+	}
+	resource := pcommon.NewResource()
+
+	span := newSpan(time.Millisecond)
+	assert.Equal(t, 1.0, weightFn(span, resource))
+
+	span.Status().SetCode(ptrace.StatusCodeError)
+	assert.Equal(t, 10.0, weightFn(span, resource))
+
+	span = newSpan(2 * time.Second)
+	assert.Equal(t, 5.0, weightFn(span, resource))
+
+	// Span attributes and resource attributes both match
+	span = newSpan(time.Millisecond)
+	span.Attributes().PutStr("http.route", "/checkout")
+	assert.Equal(t, 3.0, weightFn(span, resource))
+	resource.Attributes().PutStr("service.name", "payments")
+	assert.Equal(t, 6.0, weightFn(span, resource))
+
+	span.Attributes().PutStr("http.route", "/cart")
+	assert.Equal(t, 2.0, weightFn(span, resource))
+}
+
+// TestWeightedReservoirUniform tests that equal weights give every span the same inclusion probability
+func TestWeightedReservoirUniform(t *testing.T) {
+	const (
+		size     = 5
+		numSpans = 20
+		trials   = 2000
+	)
+
+	traces := generateTraces(numSpans)
+	rss := traces.ResourceSpans()
+	included := make(map[uint64]int)
+
+	for trial := 0; trial < trials; trial++ {
+		r := newTestWeightedReservoir(size, func(ptrace.Span, pcommon.Resource) float64 { return 1 })
+		for i := 0; i < rss.Len(); i++ {
+			rs := rss.At(i)
+			ss := rs.ScopeSpans().At(0)
+			r.AddSpan(ss.Spans().At(0), rs.Resource(), ss.Scope())
+		}
+		require.Equal(t, size, r.Size())
+		for hash := range r.GetAllSpans() {
+			included[hash]++
+		}
+	}
+
+	require.Len(t, included, numSpans)
+	expected := float64(size) / float64(numSpans)
+	for hash, count := range included {
+		assert.InDelta(t, expected, float64(count)/trials, 0.05, "span %d", hash)
+	}
+}
+
+// TestWeightedReservoirFavorsHeavySpans tests that rare heavy spans survive sampling
+func TestWeightedReservoirFavorsHeavySpans(t *testing.T) {
+	const (
+		size     = 50
+		numSpans = 10000
+	)
+
+	r := newTestWeightedReservoir(size, newWeightFunc(&Config{
+		ErrorSpanWeight: 100,
+		SlowSpanWeight:  1,
+	}))
+
+	traces := generateTraces(numSpans)
+	rss := traces.ResourceSpans()
+	for i := 0; i < rss.Len(); i++ {
+		rs := rss.At(i)
+		ss := rs.ScopeSpans().At(0)
+		span := ss.Spans().At(0)
+		// One span in a hundred is an error
+		if i%100 == 0 {
+			span.Status().SetCode(ptrace.StatusCodeError)
+		}
+		r.AddSpan(span, rs.Resource(), ss.Scope())
+	}
+
+	errorSpans := 0
+	for _, spanWithRes := range r.GetAllSpans() {
+		if spanWithRes.Span.Status().Code() == ptrace.StatusCodeError {
+			errorSpans++
+		}
+	}
+
+	// Uniform sampling would keep about one error span; errors carry half
+	// of the total weight, so weighted sampling keeps about half
+	assert.Equal(t, size, r.Size())
+	assert.Greater(t, errorSpans, 10)
+
+	exported, err := r.Export(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, size, exported.SpanCount())
+}
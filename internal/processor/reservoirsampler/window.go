@@ -8,10 +8,16 @@ import (
 	"go.uber.org/zap"
 )
 
+// maxRolloverWait bounds how long the rollover scheduler sleeps. Timers stall
+// while the host is suspended, so waking up regularly lets a window that
+// ended during a pause close soon after the pause.
+const maxRolloverWait = time.Second
+
 // WindowManager handles time-based sampling windows
 type WindowManager struct {
 	// Configuration
 	windowDuration time.Duration
+	aligned        bool
 	
 	// State
 	currentWindow   int64
@@ -54,6 +60,16 @@ func (w *WindowManager) GetCurrentState() (windowID int64, startTime time.Time,
 	return w.currentWindow, w.windowStartTime, w.windowEndTime, w.windowCount.Load()
 }
 
+// ViewState calls fn with the current window state while holding the window lock.
+// No rollover can happen while fn runs, so anything it reads from the
+// reservoir belongs to the window it is given.
+func (w *WindowManager) ViewState(fn func(windowID int64, startTime time.Time, endTime time.Time, count int64)) {
+	w.lock.RLock()
+	defer w.lock.RUnlock()
+	
+	fn(w.currentWindow, w.windowStartTime, w.windowEndTime, w.windowCount.Load())
+}
+
 // SetState sets the window state (used when loading from checkpoint)
 func (w *WindowManager) SetState(windowID int64, startTime time.Time, endTime time.Time, count int64) {
 	w.lock.Lock()
@@ -70,21 +86,64 @@ func (w *WindowManager) IncrementCount() int64 {
 	return w.windowCount.Inc()
 }
 
+// Count returns the window span count. Unlike GetCurrentState it takes no
+// lock, so it can be called while the window rolls over.
+func (w *WindowManager) Count() int64 {
+	return w.windowCount.Load()
+}
+
+// AddCount adds n spans to the window span count and returns the new count
+func (w *WindowManager) AddCount(n int64) int64 {
+	return w.windowCount.Add(n)
+}
+
+// SetAligned makes windows start on multiples of the window duration since
+// the Unix epoch rather than when the previous window rolled over, so
+// replicas agree on window boundaries and IDs. The current window is realigned.
+func (w *WindowManager) SetAligned(aligned bool) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	
+	w.aligned = aligned
+	if aligned {
+		w.initializeWindowLocked()
+	}
+}
+
+// StartNewWindow starts a new window after the window with the given ID
+// (used when the checkpointed window has expired)
+func (w *WindowManager) StartNewWindow(previousWindowID int64) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	
+	w.currentWindow = previousWindowID
+	w.initializeWindowLocked()
+}
+
 // CheckRollover checks if it's time to roll over to a new window
 // Returns true if a rollover occurred
 func (w *WindowManager) CheckRollover() bool {
-	now := time.Now()
+	// Compare wall clock times, which keep running while the host is suspended
+	now := time.Now().Round(0)
 	
-	// Quick check without locking
-	if now.Before(w.windowEndTime) {
+	// Quick check under the read lock
+	w.lock.RLock()
+	ended := !now.Before(w.windowEndTime)
+	w.lock.RUnlock()
+	if !ended {
 		return false
 	}
 	
 	w.lock.Lock()
 	defer w.lock.Unlock()
 	
-	// Double check after acquiring the lock
-	if now.After(w.windowEndTime) {
+	// Double check after acquiring the lock, as another caller may have
+	// rolled the window over in between
+	if !now.Before(w.windowEndTime) {
+		// Windows that would have followed a window closed late, because the
+		// process was paused or idle, are skipped rather than closed empty
+		missed := int64(now.Sub(w.windowEndTime) / w.windowDuration)
+		
 		// Notify callback before rolling over
 		if w.onWindowRollover != nil {
 			w.onWindowRollover()
@@ -93,6 +152,10 @@ func (w *WindowManager) CheckRollover() bool {
 		// Start a new window
 		w.initializeWindowLocked()
 		
+		if missed > 0 {
+			w.logger.Warn("Closed a stale sampling window, skipping the windows missed since",
+				zap.Int64("missed_windows", missed))
+		}
 		w.logger.Info("Started new sampling window",
 			zap.Int64("window", w.currentWindow),
 			zap.Time("start", w.windowStartTime),
@@ -104,6 +167,40 @@ func (w *WindowManager) CheckRollover() bool {
 	return false
 }
 
+// RunRolloverScheduler closes each window when it ends, whether or not spans
+// arrive, until stop is closed
+func (w *WindowManager) RunRolloverScheduler(stop <-chan struct{}) {
+	timer := time.NewTimer(w.untilRollover())
+	defer timer.Stop()
+	
+	for {
+		select {
+		case <-timer.C:
+			w.CheckRollover()
+			timer.Reset(w.untilRollover())
+			
+		case <-stop:
+			return
+		}
+	}
+}
+
+// untilRollover returns how long the rollover scheduler should sleep
+func (w *WindowManager) untilRollover() time.Duration {
+	w.lock.RLock()
+	wait := w.windowEndTime.Sub(time.Now().Round(0))
+	w.lock.RUnlock()
+	
+	if wait > maxRolloverWait {
+		return maxRolloverWait
+	}
+	if wait < time.Millisecond {
+		// Wait past the end, as the window closes once it is over
+		return time.Millisecond
+	}
+	return wait
+}
+
 // initializeWindow initializes a new sampling window
 func (w *WindowManager) initializeWindow() {
 	w.lock.Lock()
@@ -115,6 +212,17 @@ func (w *WindowManager) initializeWindow() {
 func (w *WindowManager) initializeWindowLocked() {
 	now := time.Now()
 	
+	if w.aligned {
+		// The window containing now, numbered by its boundary, so the same
+		// instant has the same window ID everywhere
+		index := now.UnixNano() / int64(w.windowDuration)
+		w.windowStartTime = time.Unix(0, index*int64(w.windowDuration))
+		w.windowEndTime = w.windowStartTime.Add(w.windowDuration)
+		w.currentWindow = index
+		w.windowCount.Store(0)
+		return
+	}
+	
 	w.windowStartTime = now
 	w.windowEndTime = now.Add(w.windowDuration)
 	w.currentWindow++
@@ -0,0 +1,95 @@
+package reservoirsampler
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/atomic"
+	"go.uber.org/zap"
+)
+
+// TestAlignedWindows tests that aligned windows start on epoch boundaries
+// and that their IDs only depend on the time
+func TestAlignedWindows(t *testing.T) {
+	w := NewWindowManager(time.Minute, nil, zap.NewNop())
+	w.SetAligned(true)
+	id, start, end, count := w.GetCurrentState()
+
+	assert.Zero(t, start.UnixNano()%int64(time.Minute))
+	assert.Equal(t, time.Minute, end.Sub(start))
+	assert.Equal(t, start.Unix()/60, id)
+	assert.Zero(t, count)
+	assert.False(t, time.Now().Before(start))
+
+	// Another replica lands in the same window
+	other := NewWindowManager(time.Minute, nil, zap.NewNop())
+	other.SetAligned(true)
+	otherID, otherStart, _, _ := other.GetCurrentState()
+	if otherID == id+1 {
+		// The minute turned between the two
+		assert.Equal(t, end, otherStart)
+	} else {
+		assert.Equal(t, id, otherID)
+		assert.Equal(t, start, otherStart)
+	}
+}
+
+// TestStartNewWindow tests that a new window follows the given window
+func TestStartNewWindow(t *testing.T) {
+	w := NewWindowManager(time.Minute, nil, zap.NewNop())
+	w.IncrementCount()
+	w.StartNewWindow(41)
+
+	id, start, end, count := w.GetCurrentState()
+	assert.Equal(t, int64(42), id)
+	assert.Equal(t, time.Minute, end.Sub(start))
+	assert.Zero(t, count)
+
+	// Aligned IDs come from the clock instead
+	w.SetAligned(true)
+	w.StartNewWindow(41)
+	id, start, _, _ = w.GetCurrentState()
+	assert.Equal(t, start.Unix()/60, id)
+}
+
+// TestRolloverScheduler tests that windows close on time without traffic
+func TestRolloverScheduler(t *testing.T) {
+	rollovers := atomic.NewInt64(0)
+	w := NewWindowManager(50*time.Millisecond, func() { rollovers.Inc() }, zap.NewNop())
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		w.RunRolloverScheduler(stop)
+		close(done)
+	}()
+
+	time.Sleep(180 * time.Millisecond)
+	close(stop)
+	<-done
+
+	assert.GreaterOrEqual(t, rollovers.Load(), int64(2))
+	assert.LessOrEqual(t, rollovers.Load(), int64(4))
+}
+
+// TestStaleWindowClosedOnce tests that a window that ended long ago is closed
+// once, without closing the windows missed since
+func TestStaleWindowClosedOnce(t *testing.T) {
+	rollovers := atomic.NewInt64(0)
+	w := NewWindowManager(time.Minute, func() { rollovers.Inc() }, zap.NewNop())
+
+	// The process was paused for an hour
+	start := time.Now().Add(-61 * time.Minute)
+	w.SetState(7, start, start.Add(time.Minute), 100)
+
+	assert.True(t, w.CheckRollover())
+	assert.False(t, w.CheckRollover())
+	assert.Equal(t, int64(1), rollovers.Load())
+
+	id, start, end, count := w.GetCurrentState()
+	assert.Equal(t, int64(8), id)
+	assert.True(t, time.Now().Before(end))
+	assert.Equal(t, time.Minute, end.Sub(start))
+	assert.Zero(t, count)
+}